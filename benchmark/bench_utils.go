@@ -20,7 +20,7 @@ type Config struct {
 	RecSize     int
 	VcType      int
 	NumUpdates  int
-	UpdateTypes int // 0 = ADD, 1 = EDIT, 2 = BOTH
+	UpdateTypes int // 0 = ADD, 1 = EDIT, 2 = BOTH, 3 = DELETE
 }
 
 // Experiment Suite
@@ -33,6 +33,9 @@ func GetUpdateTypesFromConfig(updateTypes int) []database.OpType {
 	if updateTypes == 2 {
 		return []database.OpType{database.ADD, database.EDIT}
 	}
+	if updateTypes == 3 {
+		return []database.OpType{database.DELETE}
+	}
 	return []database.OpType{database.OpType(updateTypes)}
 }
 
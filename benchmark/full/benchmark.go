@@ -38,6 +38,8 @@ func main() {
 	// PROCESS ARGS ///////////////////////////////////////////////////
 	flag.Parse()
 	configs := benchmark.ReadBenchConfigs(*pathRead)
+	// client and servers run in this process
+	vc.AllowLocalSetup(true)
 
 	var wg sync.WaitGroup
 	var start time.Time
@@ -82,11 +84,17 @@ func main() {
 		// Create a new APIR server
 		servers := make([]pir.APIRServer, NUM_SERVERS)
 		for i := range NUM_SERVERS {
-			servers[i] = pir.NewServer(pir.PirType(exp.PirType), db, i, exp.NumParts, vc.VcType(exp.VcType))
+			servers[i], err = pir.NewServer(pir.PirType(exp.PirType), db, i, exp.NumParts, vc.VcType(exp.VcType))
+			if err != nil {
+				log.Fatalln("Error in NewServer: ", err)
+			}
 		}
 
 		// Create a new APIR client (pass in PirType and N)
-		client := pir.NewClient(pir.PirType(exp.PirType), exp.DbSize, exp.NumParts, exp.RecSize, vc.VcType(exp.VcType))
+		client, err := pir.NewClient(pir.PirType(exp.PirType), exp.DbSize, exp.NumParts, exp.RecSize, vc.VcType(exp.VcType))
+		if err != nil {
+			log.Fatalln("Error in NewClient: ", err)
+		}
 
 		///////////////////////////////////////////////////////////////////
 		// OFFLINE PHASE //////////////////////////////////////////////////
@@ -169,8 +177,11 @@ func main() {
 
 			// Generate queries for record idx
 			start = time.Now()
-			query0, query1, _ := client.Query(idx)
-			queries := []pir.Query{query0, query1}
+			handle, err := client.Query(idx)
+			if err != nil {
+				log.Fatalln("Error in Query: ", err)
+			}
+			queries := handle.Queries[:]
 			exp.RT["Query"] += time.Since(start)
 			fmt.Println("Finished Query in ", exp.RT["Query"], ". Start Answer.")
 
@@ -195,7 +206,7 @@ func main() {
 
 			// Reconstruct the record
 			start = time.Now()
-			record, _ := client.Reconstruct(digest, hint, answers[0], answers[1])
+			record, _ := client.Reconstruct(handle, digest, hint, answers[0], answers[1])
 			exp.RT["Reconstruct"] += time.Since(start)
 
 			fmt.Println("Finished Reconstruct in ", exp.RT["Reconstruct"])
@@ -2,6 +2,7 @@ package benchmark
 
 import (
 	"bytes"
+	"encoding"
 	"log"
 	"math/big"
 	"os"
@@ -71,12 +72,14 @@ var registeredObjs = []interface{}{
 	vc.MerkleParams{},
 	vc.MerkleCommitment{},
 	vc.MerkleProof{},
+	vc.MerkleMultiProof{},
 	vc.PPParams{},
 	vc.PPCommitment{},
 	vc.PointProof{},
 	vc.PPAggProof{},
 	big.Int{},
 	merkle.Proof{},
+	merkle.MultiProof{},
 	math.G1{},
 	pp.PP{},
 
@@ -147,12 +150,40 @@ func codecHandle(types []reflect.Type) codec.Handle {
 	return &h
 }
 
+// SerializedSize returns the number of bytes needed to send e. Types with a
+// canonical binary encoding (see pir/encoding.go) are measured by their
+// encoding, slices by the sum of their elements. All other values are
+// measured using the codec.
 func SerializedSize(e interface{}) (int, error) {
+	switch v := e.(type) {
+	case nil:
+		return 0, nil
+	case encoding.BinaryMarshaler:
+		b, err := v.MarshalBinary()
+		if err != nil {
+			return -1, err
+		}
+		return len(b), nil
+	}
+
+	rv := reflect.ValueOf(e)
+	if (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) && rv.Type().Elem().Kind() != reflect.Uint8 {
+		var total int
+		for i := 0; i < rv.Len(); i++ {
+			size, err := SerializedSize(rv.Index(i).Interface())
+			if err != nil {
+				return -1, err
+			}
+			total += size
+		}
+		return total, nil
+	}
+
 	var buf bytes.Buffer
 	enc := codec.NewEncoder(&buf, codecHandle((registeredTypes())))
 	err := enc.Encode(e)
 	if err != nil {
-		panic(err)
+		return -1, err
 	}
 	return buf.Len(), nil
 }
@@ -14,6 +14,13 @@ import (
 	"testing"
 )
 
+// Parties of the tests run in the same process and share the parameters of
+// a process-local trusted setup
+func TestMain(m *testing.M) {
+	vc.AllowLocalSetup(true)
+	os.Exit(m.Run())
+}
+
 func TestServerSerialize(t *testing.T) {
 
 	// use random seed each time
@@ -29,6 +36,8 @@ func TestServerSerialize(t *testing.T) {
 	NUM_SERVERS := 2
 	recSize := 32
 	db := database.MakeRandomDB(seed, N, recSize)
+	// APIR_DPF128 only supports 16-byte records
+	db16 := database.MakeRandomDB(seed, N, 16)
 
 	Q := int(math.Sqrt(float64(N)))
 	if N%Q != 0 {
@@ -40,7 +49,7 @@ func TestServerSerialize(t *testing.T) {
 		pir.PIR_DPF,
 		pir.PIR_SinglePass,
 		pir.APIR_MATRIX,
-		// pir.APIR_DPF128,
+		pir.APIR_DPF128,
 		pir.APIR_TAPIR,
 	}
 	vctypes := [][]vc.VcType{
@@ -49,8 +58,8 @@ func TestServerSerialize(t *testing.T) {
 		[]vc.VcType{vc.None},
 		// []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof},
 		[]vc.VcType{vc.VC_MerkleTree},
-		// []vc.VcType{vc.None},
-		[]vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof},
+		[]vc.VcType{vc.None},
+		[]vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof, vc.VC_KZG},
 	}
 	qs := []int{
 		-1,
@@ -72,9 +81,16 @@ func TestServerSerialize(t *testing.T) {
 			// queries := make([]pir.Query, NUM_SERVERS)
 			// answers := make([]pir.Answer, NUM_SERVERS)
 
-			servers := []pir.APIRServer{
-				pir.NewServer(pirType, db, 0, qs[i], vcType),
-				pir.NewServer(pirType, db, 1, qs[i], vcType),
+			serverDB := db
+			if pirType == pir.APIR_DPF128 {
+				serverDB = db16
+			}
+			servers := make([]pir.APIRServer, NUM_SERVERS)
+			for k := range servers {
+				servers[k], err = pir.NewServer(pirType, serverDB, k, qs[i], vcType)
+				if err != nil {
+					t.Fatalf("error creating server %d: %v", k, err)
+				}
 			}
 
 			for i, server := range servers {
@@ -111,7 +127,9 @@ func TestServerSerialize(t *testing.T) {
 				decodedServer := decoded.(pir.APIRServer)
 
 				vcType := decodedServer.GetVCType()
-				decodedServer.SetVC(vcType)
+				if err := decodedServer.SetVC(vcType); err != nil {
+					t.Fatalf("error setting VC: %v", err)
+				}
 
 				if b, err := server.Equals(decodedServer); !b {
 					// if !reflect.DeepEqual(server, decodedServer) {
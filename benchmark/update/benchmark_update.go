@@ -38,6 +38,8 @@ func main() {
 	// PROCESS ARGS ///////////////////////////////////////////////////
 	flag.Parse()
 	configs := benchmark.ReadBenchConfigs(*pathRead)
+	// client and servers run in this process
+	vc.AllowLocalSetup(true)
 
 	var wg sync.WaitGroup
 	var start time.Time
@@ -70,11 +72,17 @@ func main() {
 		// Create a new APIR server
 		servers := make([]pir.APIRServer, NUM_SERVERS)
 		for i := range NUM_SERVERS {
-			servers[i] = pir.NewServer(pir.PirType(exp.PirType), dbs[i], i, exp.NumParts, vc.VcType(exp.VcType))
+			servers[i], err = pir.NewServer(pir.PirType(exp.PirType), dbs[i], i, exp.NumParts, vc.VcType(exp.VcType))
+			if err != nil {
+				log.Fatalln("Error in NewServer: ", err)
+			}
 		}
 
 		// Create a new APIR client (pass in PirType and N)
-		client := pir.NewClient(pir.PirType(exp.PirType), exp.DbSize, exp.NumParts, exp.RecSize, vc.VcType(exp.VcType))
+		client, err := pir.NewClient(pir.PirType(exp.PirType), exp.DbSize, exp.NumParts, exp.RecSize, vc.VcType(exp.VcType))
+		if err != nil {
+			log.Fatalln("Error in NewClient: ", err)
+		}
 
 		///////////////////////////////////////////////////////////////////
 		// OFFLINE PHASE //////////////////////////////////////////////////
@@ -125,7 +133,7 @@ func main() {
 
 		// Verify the setup
 		start = time.Now()
-		_, _, err := client.VerSetup(digests[0], digests[1], hintResps[0], hintResps[1])
+		_, _, err = client.VerSetup(digests[0], digests[1], hintResps[0], hintResps[1])
 		if err != nil {
 			log.Fatalln("Error in VerSetup: ", err)
 		}
@@ -183,7 +191,11 @@ func main() {
 			start = time.Now()
 			for i := range NUM_SERVERS {
 				go func(i int) {
-					nsUpdate[i], qsUpdate[i], digestsUpdate[i], opsUpdate[i] = servers[i].Update(ops[i])
+					var err error
+					nsUpdate[i], qsUpdate[i], digestsUpdate[i], opsUpdate[i], err = servers[i].Update(ops[i])
+					if err != nil {
+						log.Fatalln("Error in Update: ", err)
+					}
 					wg.Done()
 					// log.Println("Answer: thread", i, "did work")
 				}(i)
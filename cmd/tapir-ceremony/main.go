@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"tapir/modules/pp"
+)
+
+const usage = `Usage: tapir-ceremony <command> [flags]
+
+Multi-party setup of PointProof public parameters. The trapdoor is the
+product of the secrets of all participants, so the parameters are secure
+as long as one participant discards its secret.
+
+Commands:
+  init             start a new transcript
+  contribute       verify the transcript and append a contribution
+  verify-ceremony  verify the transcript and write the final parameters
+`
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "init":
+		err = initCeremony(os.Args[2:])
+	case "contribute":
+		err = contribute(os.Args[2:])
+	case "verify-ceremony":
+		err = verifyCeremony(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalln("error:", err)
+	}
+}
+
+func initCeremony(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	size := fs.Int("n", 32, "vector length, i.e., the partition size N/Q for APIR_TAPIR or N for APIR_Matrix.")
+	out := fs.String("out", "ceremony.bin", "path of the transcript to write.")
+	fs.Parse(args)
+
+	if *size < 1 {
+		return fmt.Errorf("n must be positive")
+	}
+	if err := pp.NewCeremony(*size).Save(*out); err != nil {
+		return err
+	}
+	log.Printf("Started ceremony for n=%d in %s\n", *size, *out)
+	return nil
+}
+
+func contribute(args []string) error {
+	fs := flag.NewFlagSet("contribute", flag.ExitOnError)
+	in := fs.String("in", "ceremony.bin", "path of the current transcript.")
+	out := fs.String("out", "ceremony.bin", "path of the transcript to write.")
+	fs.Parse(args)
+
+	cer, err := pp.LoadCeremony(*in)
+	if err != nil {
+		return err
+	}
+	// never build on a transcript that does not verify
+	if len(cer.Contributions) > 0 {
+		if _, err := pp.VerifyCeremony(cer); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	cer.Contribute()
+	log.Println("Finished contribution in", time.Since(start))
+
+	if err := cer.Save(*out); err != nil {
+		return err
+	}
+	last := cer.Current()
+	log.Printf("Wrote contribution %d to %s, digest: %x\n", len(cer.Contributions), *out, last.Digest)
+	return nil
+}
+
+func verifyCeremony(args []string) error {
+	fs := flag.NewFlagSet("verify-ceremony", flag.ExitOnError)
+	in := fs.String("in", "ceremony.bin", "path of the transcript.")
+	out := fs.String("pp", "", "path to write the final public parameters to (see tapir-server -pp).")
+	fs.Parse(args)
+
+	cer, err := pp.LoadCeremony(*in)
+	if err != nil {
+		return err
+	}
+	params, err := pp.VerifyCeremony(cer)
+	if err != nil {
+		return err
+	}
+	log.Printf("Verified %d contributions for n=%d, digest: %x\n", len(cer.Contributions), cer.N, params.Digest)
+
+	if *out != "" {
+		if err := params.Save(*out); err != nil {
+			return err
+		}
+		log.Println("Wrote parameters to", *out)
+	}
+	return nil
+}
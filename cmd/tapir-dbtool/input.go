@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// entry is a key-value pair of the input
+type entry struct {
+	Key   []byte
+	Value []byte
+}
+
+// readEntries reads the entries of r in the given format
+func readEntries(r io.Reader, format string, header bool) ([]entry, error) {
+	switch format {
+	case "csv":
+		return readCSV(r, header)
+	case "jsonl":
+		return readJSONL(r)
+	case "kv":
+		return readKV(r)
+	default:
+		return nil, fmt.Errorf("unknown input format %q", format)
+	}
+}
+
+// readCSV reads rows of two fields, key and value. The first row is skipped
+// if header is set.
+func readCSV(r io.Reader, header bool) ([]entry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	var entries []entry
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header {
+			header = false
+			continue
+		}
+		entries = append(entries, entry{Key: []byte(row[0]), Value: []byte(row[1])})
+	}
+}
+
+// readJSONL reads one object {"key": ..., "value": ...} of strings per line
+func readJSONL(r io.Reader) ([]entry, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<26)
+	var entries []entry
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var e struct {
+			Key   *string `json:"key"`
+			Value *string `json:"value"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if e.Key == nil || e.Value == nil {
+			return nil, fmt.Errorf("line %d: missing key or value", line)
+		}
+		entries = append(entries, entry{Key: []byte(*e.Key), Value: []byte(*e.Value)})
+	}
+	return entries, sc.Err()
+}
+
+// readKV reads binary entries of the form
+//
+//	| key length (4 bytes, big endian) | key | value length (4 bytes, big endian) | value |
+func readKV(r io.Reader) ([]entry, error) {
+	br := bufio.NewReader(r)
+	var entries []entry
+	for {
+		key, err := readField(br)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", len(entries), err)
+		}
+		value, err := readField(br)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", len(entries), noEOF(err))
+		}
+		entries = append(entries, entry{Key: key, Value: value})
+	}
+}
+
+// readField reads a length-prefixed field, io.EOF only if r is at its end
+func readField(r io.Reader) ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(l[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, noEOF(err)
+	}
+	return b, nil
+}
+
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"tapir/modules/database"
+	"tapir/modules/vc"
+	"tapir/pir"
+)
+
+var (
+	in       = flag.String("in", "", "path of the input file.")
+	format   = flag.String("format", "csv", "input format: csv (rows of key and value), jsonl (objects with string fields key and value) or kv (length-prefixed binary keys and values, see README).")
+	header   = flag.Bool("header", false, "skip the first row of a csv input.")
+	out      = flag.String("out", "tapir.db", "path of the database file to write.")
+	manifest = flag.String("manifest", "", "path of the key-to-index manifest to write, -out with suffix .manifest.json if empty.")
+	pirType  = flag.Int("pir", int(pir.APIR_TAPIR), "PIR type (see README).")
+	vcType   = flag.Int("vc", int(vc.VC_MerkleTree), "VC type (see README).")
+	numPart  = flag.Int("q", 32, "number of partitions Q, -1 if not used by the PIR type.")
+	recSize  = flag.Int("recsize", 32, "record size in bytes.")
+	ppPath   = flag.String("pp", "", "path to a PointProof or KZG parameter file (see tapir-ppgen), required for these VCs.")
+	workers  = flag.Int("workers", 0, "number of goroutines generating the digest, 0 for one per CPU.")
+)
+
+// Manifest maps the keys of the input to the head records of their values,
+// which clients retrieve with pirnet.Client.RetrieveValue. Keys are encoded
+// in base64.
+type Manifest struct {
+	PirType  pir.PirType
+	VcType   vc.VcType
+	Q        int
+	N        int
+	RecSize  int
+	MaxLen   int    // length of the longest value
+	Checksum string // SHA-256 of the records, hex encoded
+	Digest   string // pir.Fingerprint of the digest, hex encoded
+	Entries  []ManifestEntry
+}
+
+type ManifestEntry struct {
+	Key   []byte
+	Index int
+}
+
+// Builds a database file for tapir-server from key-value pairs. The entries
+// are sorted by key and their values are encoded with
+// database.EncodeValues, so both servers build identical databases from
+// the same entries in any order. The number of records is padded to a
+// multiple of Q for the partitioned PIR types.
+func main() {
+	flag.Parse()
+
+	if *in == "" {
+		log.Fatalln("the input file is required (-in)")
+	}
+	if *manifest == "" {
+		*manifest = *out + ".manifest.json"
+	}
+	t := pir.PirType(*pirType)
+
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Fatalln("error opening input:", err)
+	}
+	entries, err := readEntries(f, *format, *header)
+	f.Close()
+	if err != nil {
+		log.Fatalln("error reading input:", err)
+	}
+	if len(entries) == 0 {
+		log.Fatalln("the input holds no entries")
+	}
+	slices.SortFunc(entries, func(a, b entry) int { return bytes.Compare(a.Key, b.Key) })
+	values := make([][]byte, len(entries))
+	m := Manifest{PirType: t, VcType: vc.VcType(*vcType), Q: *numPart, RecSize: *recSize}
+	for i, e := range entries {
+		if i > 0 && bytes.Equal(e.Key, entries[i-1].Key) {
+			log.Fatalf("duplicate key %q\n", e.Key)
+		}
+		values[i] = e.Value
+		m.MaxLen = max(m.MaxLen, len(e.Value))
+		m.Entries = append(m.Entries, ManifestEntry{Key: e.Key, Index: i})
+	}
+
+	recs, err := database.EncodeValues(values, *recSize)
+	if err != nil {
+		log.Fatalln("error encoding values:", err)
+	}
+	n := len(recs)
+	if (t == pir.APIR_TAPIR || t == pir.PIR_SinglePass) && *numPart > 0 {
+		n += (*numPart - n%*numPart) % *numPart
+	}
+	m.N = n
+	log.Printf("Encoded %d entries in %d records of size %d, padded to %d records\n", len(entries), len(recs), *recSize, n)
+
+	params, err := vc.LoadParams(vc.VcType(*vcType), *ppPath)
+	if err != nil {
+		log.Fatalln("error loading the VC parameters shared with the servers and the clients (-pp):", err)
+	}
+	if params != nil {
+		log.Printf("Loaded %v parameters with digest %x\n", vc.VcType(*vcType), params.ParamsDigest())
+	}
+
+	db, err := database.CreateFile(*out, n, *recSize)
+	if err != nil {
+		log.Fatalln("error creating database:", err)
+	}
+	// fail removes the incomplete database
+	fail := func(msg string, err error) {
+		db.Close()
+		os.Remove(*out)
+		log.Fatalln(msg, err)
+	}
+	for i, rec := range recs {
+		db.SetRecord(i, rec)
+	}
+
+	start := time.Now()
+	ps, err := pir.NewServer(t, db, 0, *numPart, vc.VcType(*vcType))
+	if err != nil {
+		fail("error setting up server:", err)
+	}
+	pir.SetWorkers(ps, *workers)
+	d, err := ps.GenDigest()
+	if err != nil {
+		fail("error generating digest:", err)
+	}
+	fingerprint, err := pir.Fingerprint(d)
+	if err != nil {
+		fail("error encoding digest:", err)
+	}
+	log.Println("Finished GenDigest in", time.Since(start))
+
+	sum := db.Checksum()
+	m.Checksum = hex.EncodeToString(sum[:])
+	m.Digest = hex.EncodeToString(fingerprint)
+	if err := db.Close(); err != nil {
+		log.Fatalln("error writing database:", err)
+	}
+	b, err := json.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		log.Fatalln("error encoding manifest:", err)
+	}
+	if err := os.WriteFile(*manifest, b, 0o644); err != nil {
+		log.Fatalln("error writing manifest:", err)
+	}
+
+	log.Printf("Wrote %s and %s\n", *out, *manifest)
+	log.Println("Checksum:", m.Checksum)
+	log.Println("Digest:", m.Digest)
+	if t != pir.APIR_TAPIR && t != pir.APIR_MATRIX {
+		log.Printf("The digest of %v does not depend on the database, compare the checksum\n", t)
+	}
+	log.Printf("Serve with: tapir-server -db=%s -pir=%d -vc=%d -q=%d -recsize=%d\n", *out, *pirType, *vcType, *numPart, *recSize)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"log"
+	"time"
+
+	"tapir/modules/kzg"
+	"tapir/modules/pp"
+	"tapir/modules/vc"
+)
+
+var (
+	size = flag.Int("n", 32, "vector length, i.e., the partition size N/Q for APIR_TAPIR or N for APIR_Matrix.")
+	out  = flag.String("out", "pp.bin", "path of the parameter file to write.")
+	vcT  = flag.Int("vc", int(vc.VC_PointProof), "VC type, PointProof or KZG (see README).")
+)
+
+// Runs a PointProof or KZG setup with a fresh random trapdoor and writes the public
+// parameters to a file, which is then distributed to both servers and clients.
+// The trapdoor is discarded once the parameters are computed.
+func main() {
+	flag.Parse()
+
+	if *size < 1 {
+		log.Fatalln("n must be positive")
+	}
+
+	var save func(string) error
+	var digest []byte
+	start := time.Now()
+	switch vc.VcType(*vcT) {
+	case vc.VC_PointProof:
+		params := pp.NewPublicParams(*size)
+		save, digest = params.Save, params.Digest
+	case vc.VC_KZG:
+		srs := kzg.NewSRS(*size)
+		save, digest = srs.Save, srs.Digest
+	default:
+		log.Fatalf("VC type %v has no setup\n", vc.VcType(*vcT))
+	}
+	log.Println("Finished setup in", time.Since(start))
+
+	if err := save(*out); err != nil {
+		log.Fatalln("error writing parameters:", err)
+	}
+	log.Printf("Wrote %v parameters for n=%d to %s\n", vc.VcType(*vcT), *size, *out)
+	log.Println("Digest:", hex.EncodeToString(digest))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"tapir/modules/database"
+	"tapir/modules/vc"
+	"tapir/pir"
+	"tapir/pirnet"
+)
+
+var (
+	addr    = flag.String("addr", ":7000", "TCP address to listen on.")
+	admin   = flag.String("admin", "", "TCP address to accept updates on in addition to all other requests, e.g., 127.0.0.1:7100. Updates are disabled if empty.")
+	role    = flag.Int("role", 0, "role of this server (0 or 1).")
+	pirType = flag.Int("pir", int(pir.APIR_TAPIR), "PIR type (see README).")
+	vcType  = flag.Int("vc", int(vc.VC_MerkleTree), "VC type (see README).")
+	numRecs = flag.Int("n", 1024, "number of records of the random database, ignored if -db is set.")
+	numPart = flag.Int("q", 32, "number of partitions Q, -1 if not used by the PIR type.")
+	recSize = flag.Int("recsize", 32, "record size in bytes.")
+	seed    = flag.Int("seed", 42, "seed of the random database, both servers need to use the same seed.")
+	dbPath  = flag.String("db", "", "path to a database file created by database.CreateFile, or a file of concatenated records of size -recsize.")
+	ppPath  = flag.String("pp", "", "path to a PointProof or KZG parameter file (see tapir-ppgen), required for these VCs.")
+	workers = flag.Int("workers", 0, "number of goroutines generating the digest or answering a query, 0 for one per CPU.")
+)
+
+// loadDB maps a file-backed database or reads a file of concatenated
+// records of size recSize, which does not start with the magic of a
+// database file
+func loadDB(path string, recSize int) (*database.DB, error) {
+	db, err := database.OpenFile(path)
+	if !errors.Is(err, database.ErrNoMagic) {
+		return db, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if recSize <= 0 || len(data)%recSize != 0 {
+		return nil, fmt.Errorf("file size %d is not a multiple of the record size %d", len(data), recSize)
+	}
+	n := len(data) / recSize
+	return &database.DB{N: n, RecSize: recSize, Capacity: n, Data: data}, nil
+}
+
+func main() {
+	flag.Parse()
+
+	if *role != 0 && *role != 1 {
+		log.Fatalln("role must be 0 or 1")
+	}
+
+	var db *database.DB
+	if *dbPath != "" {
+		var err error
+		db, err = loadDB(*dbPath, *recSize)
+		if err != nil {
+			log.Fatalln("error loading database:", err)
+		}
+	} else {
+		// every value of -seed gives a different database
+		var prgSeed [32]byte
+		binary.LittleEndian.PutUint64(prgSeed[:], uint64(*seed))
+		db = database.MakeRandomDB(prgSeed, *numRecs, *recSize)
+	}
+
+	params, err := vc.LoadParams(vc.VcType(*vcType), *ppPath)
+	if err != nil {
+		log.Fatalln("error loading the VC parameters shared with the other server and the clients (-pp):", err)
+	}
+	if params != nil {
+		log.Printf("Loaded %v parameters with digest %x\n", vc.VcType(*vcType), params.ParamsDigest())
+	}
+
+	t := pir.PirType(*pirType)
+	log.Printf("Setting up %v server %d with VC type %v for N=%d, Q=%d, record size %d\n",
+		t, *role, vc.VcType(*vcType), db.N, *numPart, db.RecSize)
+
+	start := time.Now()
+	ps, err := pir.NewServer(t, db, *role, *numPart, vc.VcType(*vcType))
+	if err != nil {
+		log.Fatalln("error setting up server:", err)
+	}
+	pir.SetWorkers(ps, *workers)
+	s, err := pirnet.NewServer(ps)
+	if err != nil {
+		log.Fatalln("error setting up server:", err)
+	}
+	log.Println("Finished GenDigest in", time.Since(start))
+
+	// stop serving on a signal and write the header of a file-backed
+	// database, so that the server can be restarted with the updated records
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		s.Close()
+	}()
+
+	if *admin != "" {
+		go func() {
+			log.Println("Accepting updates on", *admin)
+			if err := s.ListenAndServeAdmin(*admin); !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+	log.Println("Listening on", *addr)
+	if err := s.ListenAndServe(*addr); !errors.Is(err, net.ErrClosed) {
+		log.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		log.Fatalln("error closing database:", err)
+	}
+}
@@ -0,0 +1,153 @@
+package kwpir
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"tapir/modules/database"
+	"tapir/pir"
+)
+
+// ErrNotFound is returned by Lookup if no candidate record holds the key.
+// With an authenticated scheme all candidate records were verified against
+// the digest, so the error proves that the key is not in the table.
+var ErrNotFound = errors.New("key not found")
+
+// Server is the part of pir.APIRServer used by the client, it is also
+// implemented by pirnet.Remote
+type Server interface {
+	GenDigest(ctx context.Context) (pir.Digest, error)
+	GenHint(ctx context.Context, hq pir.HintQuery) (pir.HintResp, error)
+	Answer(ctx context.Context, q pir.Query) (pir.Answer, error)
+}
+
+// Client looks up keys in a table served by two servers, using the index
+// queries of C. Lookup may be called from several goroutines, Setup waits
+// for running lookups.
+type Client struct {
+	C       pir.APIRClient
+	Servers [2]Server
+	Params  *Params
+
+	// mu guards Digest and Hint
+	mu     sync.RWMutex
+	Digest pir.Digest
+	Hint   pir.Hint
+}
+
+// NewClient returns a client for the table with parameters p, C must be a
+// client for a database of p.N() records of size p.RecSize
+func NewClient(c pir.APIRClient, servers [2]Server, p *Params) *Client {
+	return &Client{C: c, Servers: servers, Params: p}
+}
+
+// Setup runs the offline phase of C
+func (c *Client) Setup(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d0, err := c.Servers[0].GenDigest(ctx)
+	if err != nil {
+		return fmt.Errorf("server 0: %w", err)
+	}
+	d1, err := c.Servers[1].GenDigest(ctx)
+	if err != nil {
+		return fmt.Errorf("server 1: %w", err)
+	}
+	hq0, hq1, err := c.C.RequestHint()
+	if err != nil {
+		return err
+	}
+	h0, err := c.Servers[0].GenHint(ctx, hq0)
+	if err != nil {
+		return fmt.Errorf("server 0: %w", err)
+	}
+	h1, err := c.Servers[1].GenHint(ctx, hq1)
+	if err != nil {
+		return fmt.Errorf("server 1: %w", err)
+	}
+	c.Digest, c.Hint, err = c.C.VerSetup(d0, d1, h0, h1)
+	return err
+}
+
+// retrieve privately retrieves record i, the query is released if a server
+// does not answer. Burned hint sets, see pir.HintRefresher, are refreshed
+// when the query needs them.
+func (c *Client) retrieve(ctx context.Context, i int) (database.Record, error) {
+	h, err := c.C.Query(i)
+	if errors.Is(err, pir.ErrHintSetBurned) {
+		if err := c.refreshBurned(ctx); err != nil {
+			return nil, err
+		}
+		h, err = c.C.Query(i)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.send(ctx, h)
+}
+
+// refreshBurned sends the queries of the burned hint sets again
+func (c *Client) refreshBurned(ctx context.Context) error {
+	hr, ok := c.C.(pir.HintRefresher)
+	if !ok {
+		return nil
+	}
+	for h := hr.RefreshQuery(); h != nil; h = hr.RefreshQuery() {
+		if _, err := c.send(ctx, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends the queries of h to the servers and reconstructs the record
+func (c *Client) send(ctx context.Context, h *pir.QueryHandle) (database.Record, error) {
+	a0, err := c.Servers[0].Answer(ctx, h.Queries[0])
+	if err != nil {
+		h.Release()
+		return nil, fmt.Errorf("server 0: %w", err)
+	}
+	a1, err := c.Servers[1].Answer(ctx, h.Queries[1])
+	if err != nil {
+		h.Release()
+		return nil, fmt.Errorf("server 1: %w", err)
+	}
+	return c.C.Reconstruct(h, c.Digest, c.Hint, a0, a1)
+}
+
+// Lookup returns the value stored under key, or ErrNotFound. It retrieves
+// every candidate record of the key, even after finding it, so that all
+// lookups issue the same number of queries. A retrieved record that does not
+// decode is an error, as the table holds no such records.
+func (c *Client) Lookup(ctx context.Context, key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errors.New("empty key")
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var value []byte
+	found := false
+	for _, i := range c.Params.Candidates(key) {
+		rec, err := c.retrieve(ctx, i)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving record %d: %w", i, err)
+		}
+		k, v, err := decodeRecord(rec)
+		if err != nil {
+			return nil, fmt.Errorf("malformed record %d: %w", i, err)
+		}
+		if !found && bytes.Equal(k, key) {
+			value = append([]byte{}, v...)
+			found = true
+		}
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
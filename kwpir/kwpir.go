@@ -0,0 +1,234 @@
+// Package kwpir looks up records by key with any index-based scheme of the
+// pir package.
+//
+// The key-value entries are placed in a table of cuckoo-hashed buckets
+// followed by a small stash: each key is stored in one of the NumHashes
+// buckets given by public hash functions, or in the stash if cuckoo hashing
+// fails. The table is an ordinary database of N() records, which the servers
+// serve with any pir.APIRServer. A lookup retrieves all candidate records of
+// a key, its buckets and the whole stash, so the servers learn nothing about
+// the key nor whether it is present.
+package kwpir
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+
+	"tapir/modules/database"
+)
+
+// Record layout of the table:
+//
+//	| key length (2 bytes) | value length (4 bytes) | key | value | zero padding |
+//
+// Empty buckets and stash slots are all-zero records, i.e., have an empty key.
+const headerSize = 6
+
+const (
+	// maximum key length encodable in the record header
+	MaxKeySize = 1<<16 - 1
+	// maximum number of evictions before an entry is moved to the stash
+	maxEvictions = 500
+)
+
+// Params are the public parameters of a table, clients and servers need the
+// same parameters
+type Params struct {
+	NumHashes  int // 2 or 3
+	NumBuckets int
+	StashSize  int
+	RecSize    int
+	// Seed keys the hash functions, a table that cannot be built with one
+	// seed can be rebuilt with another
+	Seed [32]byte
+}
+
+type Entry struct {
+	Key   []byte
+	Value []byte
+}
+
+// NewParams returns parameters for a table of numEntries entries. The number
+// of buckets keeps the load below the threshold of cuckoo hashing with
+// numHashes hash functions. NumBuckets may be increased afterwards, e.g., for
+// N() to be a multiple of the number of partitions of TAPIR.
+func NewParams(numEntries, numHashes, stashSize, recSize int, seed [32]byte) (*Params, error) {
+	p := &Params{
+		NumHashes: numHashes,
+		StashSize: stashSize,
+		RecSize:   recSize,
+		Seed:      seed,
+	}
+	switch numHashes {
+	case 2:
+		// load 0.4, the threshold is 0.5
+		p.NumBuckets = (5*numEntries + 1) / 2
+	case 3:
+		// load 0.77, the threshold is 0.91
+		p.NumBuckets = (13*numEntries + 9) / 10
+	}
+	p.NumBuckets = max(p.NumBuckets, numHashes)
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Params) check() error {
+	if p.NumHashes != 2 && p.NumHashes != 3 {
+		return fmt.Errorf("%d hash functions, kwpir uses 2 or 3", p.NumHashes)
+	}
+	if p.NumBuckets < p.NumHashes {
+		return fmt.Errorf("%d buckets for %d hash functions", p.NumBuckets, p.NumHashes)
+	}
+	if p.StashSize < 0 {
+		return errors.New("negative stash size")
+	}
+	if p.RecSize <= headerSize {
+		return fmt.Errorf("record size %d does not exceed the header of %d bytes", p.RecSize, headerSize)
+	}
+	return nil
+}
+
+// N returns the number of records of the table
+func (p *Params) N() int {
+	return p.NumBuckets + p.StashSize
+}
+
+// RecordSize returns the record size needed for keys and values of the
+// given lengths
+func RecordSize(keySize, valueSize int) int {
+	return headerSize + keySize + valueSize
+}
+
+// Buckets returns the distinct buckets of key
+func (p *Params) Buckets(key []byte) []int {
+	bs := make([]int, 0, p.NumHashes)
+	h := sha256.New()
+	for t := byte(0); len(bs) < p.NumHashes; t++ {
+		h.Reset()
+		h.Write(p.Seed[:])
+		h.Write([]byte{t})
+		h.Write(key)
+		b := int(binary.LittleEndian.Uint64(h.Sum(nil)) % uint64(p.NumBuckets))
+		if !slices.Contains(bs, b) {
+			bs = append(bs, b)
+		}
+	}
+	return bs
+}
+
+// Candidates returns the indices of all records that may hold key, its
+// buckets followed by the stash
+func (p *Params) Candidates(key []byte) []int {
+	cs := p.Buckets(key)
+	for s := range p.StashSize {
+		cs = append(cs, p.NumBuckets+s)
+	}
+	return cs
+}
+
+func encodeRecord(e Entry, recSize int) database.Record {
+	rec := make(database.Record, recSize)
+	binary.LittleEndian.PutUint16(rec[0:2], uint16(len(e.Key)))
+	binary.LittleEndian.PutUint32(rec[2:6], uint32(len(e.Value)))
+	copy(rec[headerSize:], e.Key)
+	copy(rec[headerSize+len(e.Key):], e.Value)
+	return rec
+}
+
+// decodeRecord returns the key and value held by rec, an empty key for empty
+// records
+func decodeRecord(rec database.Record) ([]byte, []byte, error) {
+	if len(rec) < headerSize {
+		return nil, nil, fmt.Errorf("record of %d bytes is shorter than the header", len(rec))
+	}
+	keySize := int(binary.LittleEndian.Uint16(rec[0:2]))
+	valueSize := int(binary.LittleEndian.Uint32(rec[2:6]))
+	if valueSize > len(rec)-headerSize-keySize {
+		return nil, nil, fmt.Errorf("entry of %d bytes exceeds the record size %d", RecordSize(keySize, valueSize), len(rec))
+	}
+	rest := rec[headerSize+keySize+valueSize:]
+	if !bytes.Equal(rest, make([]byte, len(rest))) {
+		return nil, nil, errors.New("record padding is not zero")
+	}
+	key := rec[headerSize : headerSize+keySize]
+	return key, rec[headerSize+keySize : headerSize+keySize+valueSize], nil
+}
+
+// Build places the entries in a table with parameters p. Building is
+// deterministic given the parameters and the order of the entries, so both
+// servers can build the same table independently. It fails if an entry does
+// not fit a record, keys are empty or repeat, or an entry fits neither its
+// buckets nor the stash.
+func Build(p *Params, entries []Entry) (*database.DB, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		if len(e.Key) == 0 {
+			return nil, errors.New("empty key")
+		}
+		if len(e.Key) > MaxKeySize {
+			return nil, fmt.Errorf("key of %d bytes exceeds the maximum of %d", len(e.Key), MaxKeySize)
+		}
+		if RecordSize(len(e.Key), len(e.Value)) > p.RecSize {
+			return nil, fmt.Errorf("entry of %d bytes exceeds the record size %d", RecordSize(len(e.Key), len(e.Value)), p.RecSize)
+		}
+		if _, ok := keys[string(e.Key)]; ok {
+			return nil, fmt.Errorf("key %q repeats", e.Key)
+		}
+		keys[string(e.Key)] = struct{}{}
+	}
+
+	prg := rand.New(rand.NewChaCha8(p.Seed))
+	table := make([]int, p.NumBuckets)
+	for b := range table {
+		table[b] = -1
+	}
+	var stash []int
+	for k := range entries {
+		cur := k
+		for evictions := 0; ; evictions++ {
+			if evictions > maxEvictions {
+				if len(stash) == p.StashSize {
+					return nil, errors.New("cuckoo hashing failed with a full stash, retry with another seed or more buckets")
+				}
+				stash = append(stash, cur)
+				break
+			}
+			bs := p.Buckets(entries[cur].Key)
+			placed := false
+			for _, b := range bs {
+				if table[b] == -1 {
+					table[b] = cur
+					placed = true
+					break
+				}
+			}
+			if placed {
+				break
+			}
+			// evict the entry of a random bucket and place it elsewhere
+			b := bs[prg.IntN(len(bs))]
+			table[b], cur = cur, table[b]
+		}
+	}
+
+	db := &database.DB{N: p.N(), RecSize: p.RecSize, Capacity: p.N(), Data: make([]byte, p.N()*p.RecSize)}
+	for b, k := range table {
+		if k != -1 {
+			copy(db.Data[b*p.RecSize:], encodeRecord(entries[k], p.RecSize))
+		}
+	}
+	for s, k := range stash {
+		copy(db.Data[(p.NumBuckets+s)*p.RecSize:], encodeRecord(entries[k], p.RecSize))
+	}
+	return db, nil
+}
@@ -0,0 +1,221 @@
+package kwpir
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"testing"
+
+	"tapir/modules/database"
+	"tapir/modules/vc"
+	"tapir/pir"
+	"tapir/pirnet"
+)
+
+// lookups also work against remote servers
+var _ Server = (*pirnet.Remote)(nil)
+
+// localServer answers the requests of the client in process
+type localServer struct {
+	s pir.APIRServer
+}
+
+func (l localServer) GenDigest(ctx context.Context) (pir.Digest, error) {
+	return l.s.GenDigest()
+}
+
+func (l localServer) GenHint(ctx context.Context, hq pir.HintQuery) (pir.HintResp, error) {
+	return l.s.GenHint(hq)
+}
+
+func (l localServer) Answer(ctx context.Context, q pir.Query) (pir.Answer, error) {
+	return l.s.Answer(q)
+}
+
+func makeEntries(n int) []Entry {
+	entries := make([]Entry, n)
+	for i := range entries {
+		entries[i] = Entry{
+			Key:   []byte(fmt.Sprintf("key-%d", i)),
+			Value: bytes.Repeat([]byte{byte(i)}, i%10),
+		}
+	}
+	return entries
+}
+
+// newClient builds the table and returns a client with both servers
+func newClient(t *testing.T, pirType pir.PirType, p *Params, db *database.DB, Q int, vctype vc.VcType) *Client {
+	var servers [2]Server
+	for i := range servers {
+		s, err := pir.NewServer(pirType, db, i, Q, vctype)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = localServer{s}
+	}
+	pc, err := pir.NewClient(pirType, p.N(), Q, p.RecSize, vctype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(pc, servers, p)
+	if err := c.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestLookup(t *testing.T) {
+	n := 50
+	Q := 4
+	entries := makeEntries(n)
+	for _, numHashes := range []int{2, 3} {
+		p, err := NewParams(n, numHashes, 2, 32, [32]byte{17})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// TAPIR partitions the table into Q parts
+		p.NumBuckets += (Q - p.N()%Q) % Q
+		db, err := Build(p, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, s := range []struct {
+			pirType pir.PirType
+			Q       int
+			vctype  vc.VcType
+		}{
+			{pir.PIR_DPF, -1, vc.None},
+			{pir.APIR_TAPIR, Q, vc.VC_MerkleTree},
+		} {
+			log.Println("TestLookup with", s.pirType, "and", numHashes, "hash functions")
+			c := newClient(t, s.pirType, p, db, s.Q, s.vctype)
+			for _, e := range entries[:10] {
+				v, err := c.Lookup(context.Background(), e.Key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(v, e.Value) {
+					t.Fatalf("wrong value for key %s", e.Key)
+				}
+			}
+			if _, err := c.Lookup(context.Background(), []byte("missing")); !errors.Is(err, ErrNotFound) {
+				t.Fatal("expected ErrNotFound, got", err)
+			}
+		}
+	}
+}
+
+func TestBuildStash(t *testing.T) {
+	n := 40
+	entries := makeEntries(n)
+
+	// as many buckets as entries are too few for 2 hash functions
+	p := &Params{NumHashes: 2, NumBuckets: n, StashSize: 0, RecSize: 32}
+	if _, err := Build(p, entries); err == nil {
+		t.Fatal("built overfull table without stash")
+	}
+
+	// the entries that do not fit go to the stash
+	p.StashSize = n
+	db, err := Build(p, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stashed := 0
+	for s := range p.StashSize {
+		if k, _, _ := decodeRecord(db.GetRecord(p.NumBuckets + s)); len(k) > 0 {
+			stashed++
+		}
+	}
+	if stashed == 0 {
+		t.Fatal("no entry in the stash")
+	}
+
+	c := newClient(t, pir.PIR_DPF, p, db, -1, vc.None)
+	for _, e := range entries {
+		v, err := c.Lookup(context.Background(), e.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, e.Value) {
+			t.Fatalf("wrong value for key %s", e.Key)
+		}
+	}
+}
+
+func TestBuildRejects(t *testing.T) {
+	p, err := NewParams(2, 3, 0, 16, [32]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entries := range [][]Entry{
+		{{Key: nil, Value: []byte{1}}},
+		{{Key: []byte("a")}, {Key: []byte("a")}},
+		{{Key: []byte("a"), Value: make([]byte, 10)}},
+	} {
+		if _, err := Build(p, entries); err == nil {
+			t.Fatal("accepted invalid entries", entries)
+		}
+	}
+	if _, err := NewParams(10, 4, 0, 16, [32]byte{}); err == nil {
+		t.Fatal("accepted 4 hash functions")
+	}
+}
+
+// tamperedServer modifies the first key byte of the records in its answers
+type tamperedServer struct {
+	Server
+}
+
+func (s tamperedServer) Answer(ctx context.Context, q pir.Query) (pir.Answer, error) {
+	a, err := s.Server.Answer(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	switch a := a.(type) {
+	case *pir.DPFAnswer:
+		a.QueryRecord[headerSize] ^= 1
+	case *pir.TAPIRAnswer:
+		a.FlatRecords[headerSize] ^= 1
+	}
+	return a, nil
+}
+
+// A modified answer is detected by authenticated schemes. Without
+// authentication, the key is not found in the modified records.
+func TestLookupModifiedAnswer(t *testing.T) {
+	n := 20
+	Q := 4
+	entries := makeEntries(n)
+	p, err := NewParams(n, 3, 0, 32, [32]byte{18})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.NumBuckets += (Q - p.N()%Q) % Q
+	db, err := Build(p, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []struct {
+		pirType pir.PirType
+		Q       int
+		vctype  vc.VcType
+	}{
+		{pir.PIR_DPF, -1, vc.None},
+		{pir.APIR_TAPIR, Q, vc.VC_MerkleTree},
+	} {
+		c := newClient(t, s.pirType, p, db, s.Q, s.vctype)
+		c.Servers[1] = tamperedServer{c.Servers[1]}
+		_, err := c.Lookup(context.Background(), entries[0].Key)
+		if err == nil {
+			t.Fatal("found key in modified answer with", s.pirType)
+		}
+		if s.pirType == pir.APIR_TAPIR && errors.Is(err, ErrNotFound) {
+			t.Fatal("modified answer passed verification")
+		}
+	}
+}
@@ -1,12 +1,13 @@
 package database
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"log"
 	"math/rand/v2"
 	"os"
+	"slices"
 
 	"tapir/modules/psetggm"
 
@@ -19,6 +20,14 @@ type DB struct {
 	Capacity int
 
 	Data []byte
+
+	// Free holds the sorted indices of deleted slots, which are reused by
+	// later ADDs before the database is extended
+	Free []int
+
+	// file is the mapped file of a database opened with OpenFile or
+	// CreateFile, nil for a database in memory
+	file *mapping
 }
 
 // One database record
@@ -41,9 +50,14 @@ func (db *DB) Equals(db2 *DB) (bool, error) {
 	if db.Capacity != db2.Capacity {
 		return false, errors.New("capacity not equal")
 	}
+	if !slices.Equal(db.Free, db2.Free) {
+		return false, errors.New("free slots not equal")
+	}
 	return true, nil
 }
 
+// PadRecord left-pads r with zeros to size bytes, the length of r is lost.
+// EncodeValues keeps the length of values of any size.
 func PadRecord(r Record, size int) Record {
 	if len(r) > size {
 		panic("Record is too big to pad to desired size")
@@ -78,7 +92,13 @@ func (db *DB) SetRecord(i int, val []byte) error {
 	return nil
 }
 
-func (db *DB) ExtendCapacity(ext int) {
+// ExtendCapacity makes room for ext records after the first N. A
+// file-backed database uses the slots reserved by its file, or grows the
+// file and maps it again.
+func (db *DB) ExtendCapacity(ext int) error {
+	if db.file != nil {
+		return db.grow(db.N + ext)
+	}
 	// Copy existing data
 	newData := make([]byte, (db.N+ext)*db.RecSize)
 	copy(newData, db.Data)
@@ -86,27 +106,155 @@ func (db *DB) ExtendCapacity(ext int) {
 	// Update database
 	db.Capacity = db.N + ext
 	db.Data = newData
+	return nil
+}
+
+// Delete zeroes the record at index i and marks its slot free
+func (db *DB) Delete(i int) error {
+	if i < 0 || i >= db.N {
+		return errors.New("index out of range")
+	}
+	clear(db.Data[i*db.RecSize : (i+1)*db.RecSize])
+	if pos, found := slices.BinarySearch(db.Free, i); !found {
+		db.Free = slices.Insert(db.Free, pos, i)
+	}
+	return nil
+}
+
+// IsFree reports whether the slot at index i was deleted and not reused
+func (db *DB) IsFree(i int) bool {
+	_, found := slices.BinarySearch(db.Free, i)
+	return found
+}
+
+// PopFree returns the lowest free slot and marks it used. The choice is
+// deterministic, so that servers holding the same database reuse the same
+// slots.
+func (db *DB) PopFree() (int, bool) {
+	if len(db.Free) == 0 {
+		return -1, false
+	}
+	i := db.Free[0]
+	db.Free = db.Free[1:]
+	return i, true
+}
+
+// MarkUsed removes the slot at index i from the free slots, e.g., after it
+// was overwritten by an EDIT
+func (db *DB) MarkUsed(i int) {
+	if pos, found := slices.BinarySearch(db.Free, i); found {
+		db.Free = slices.Delete(db.Free, pos, pos+1)
+	}
+}
+
+// ErrInvalidUpdate is returned for an update that cannot be applied to the
+// database, e.g., an EDIT of an index out of range.
+var ErrInvalidUpdate = errors.New("invalid update")
+
+// CheckUpdates checks that ops can be applied to the database without
+// changing it: EDITs and DELETEs must refer to existing records, and the
+// values of ADDs and EDITs must be of the record size. It returns the
+// number of ADDs AssignIndices will append after the last record.
+func (db *DB) CheckUpdates(ops []Update) (int, error) {
+	adds := 0
+	for i, op := range ops {
+		switch op.Op {
+		case ADD:
+			adds++
+		case EDIT, DELETE:
+			if op.Idx < 0 || op.Idx >= db.N {
+				return 0, fmt.Errorf("%w: %v %d of index %d of database with %d records", ErrInvalidUpdate, op.Op, i, op.Idx, db.N)
+			}
+		default:
+			return 0, fmt.Errorf("%w: unknown op %d", ErrInvalidUpdate, op.Op)
+		}
+		if op.Op != DELETE && len(op.Val) != db.RecSize {
+			return 0, fmt.Errorf("%w: %v %d of %d bytes for records of %d bytes", ErrInvalidUpdate, op.Op, i, len(op.Val), db.RecSize)
+		}
+	}
+	return max(0, adds-len(db.Free)), nil
+}
+
+// AssignIndices sets the index of each ADD to the lowest free slot or, if
+// there is none, to the next index after the end of the database, and the
+// value of each DELETE to the all-zero record. The ops can then be applied
+// one by one with Apply, after extending the capacity if needed.
+// It returns the number of ADDs that grow the database.
+func (db *DB) AssignIndices(ops []Update) int {
+	appended := 0
+	for i := range ops {
+		switch ops[i].Op {
+		case ADD:
+			if idx, ok := db.PopFree(); ok {
+				ops[i].Idx = idx
+			} else {
+				ops[i].Idx = db.N + appended
+				appended++
+			}
+		case DELETE:
+			// a deleted slot holds the all-zero record
+			ops[i].Val = make([]byte, db.RecSize)
+		}
+	}
+	return appended
+}
+
+// Apply applies an update whose index was assigned by AssignIndices and
+// returns the record previously stored at its index
+func (db *DB) Apply(op Update) (Record, error) {
+	if op.Idx < 0 || (op.Op != ADD && op.Idx >= db.N) {
+		return nil, fmt.Errorf("cannot apply %v to index %d of database with %d records", op.Op, op.Idx, db.N)
+	}
+	old := db.GetRecord(op.Idx)
+	if old == nil {
+		return nil, errors.New("index out of range")
+	}
+	if op.Op == DELETE {
+		db.Delete(op.Idx)
+	} else {
+		db.SetRecord(op.Idx, op.Val)
+		db.MarkUsed(op.Idx)
+	}
+	// ADDs into free slots do not grow the database
+	if op.Op == ADD && op.Idx >= db.N {
+		db.N = op.Idx + 1
+	}
+	return old, nil
 }
 
 // do not use this for partitioned databases!
-func (db *DB) Update(ops []Update) {
+func (db *DB) Update(ops []Update) error {
+	if _, err := db.CheckUpdates(ops); err != nil {
+		return err
+	}
 
 	var additions []Update
 
 	for _, op := range ops {
 		if op.Op == ADD {
-			additions = append(additions, op)
+			// reuse deleted slots first
+			if i, ok := db.PopFree(); ok {
+				db.SetRecord(i, op.Val)
+			} else {
+				additions = append(additions, op)
+			}
 		} else if op.Op == EDIT {
 			db.SetRecord(op.Idx, op.Val)
+			db.MarkUsed(op.Idx)
+		} else if op.Op == DELETE {
+			db.Delete(op.Idx)
 		}
 	}
 	if len(additions) > 0 {
-		db.ExtendCapacity(len(additions))
+		if err := db.ExtendCapacity(len(additions)); err != nil {
+			return err
+		}
 		for _, op := range additions {
 			db.SetRecord(db.N, op.Val)
 			db.N++
 		}
 	}
+	return db.Sync()
 }
 
 // func (db *DB) UpdateWithPartitions(ops []Update, partSize int) { //(updatedPartitions map[int]struct{}) {
@@ -141,22 +289,25 @@ func (db *DB) Update(ops []Update) {
 // 	}
 // }
 
-// Return consecutive records in (start, start+end)
+// Return consecutive records in (start, start+end). The records are not
+// copied: they share the memory of the database, change with later updates
+// and must not be modified.
 func (db *DB) GetRecords(start, num int) []Record {
 
-	if start >= db.Capacity {
+	if start >= db.Capacity || start+num > db.Capacity {
 		return nil
 	}
 	recs := make([]Record, num)
-	for i := 0; i < num; i++ {
-		recs[i] = db.GetRecord(start + i)
+	for i := range recs {
+		off := (start + i) * db.RecSize
+		recs[i] = db.Data[off : off+db.RecSize : off+db.RecSize]
 	}
 	return recs
 }
 
 func DBFromRecords(records []Record) *DB {
 	if len(records) < 1 {
-		return &DB{0, 0, 0, nil}
+		return &DB{N: 0, RecSize: 0, Capacity: 0, Data: nil}
 	}
 
 	// if len(records[0]) != 16 {
@@ -214,10 +365,12 @@ func MakeRandomUpdates(prg *rand.ChaCha8, dbsize, numUpdates, recSize int, types
 	for i := range ops {
 		// Get random operation type from types slice
 		ops[i].Op = types[int(prg.Uint64()%uint64(len(types)))]
-		ops[i].Val = make([]byte, recSize)
-		_, err := prg.Read(ops[i].Val)
-		if err != nil {
-			panic(err)
+		if ops[i].Op != DELETE {
+			ops[i].Val = make([]byte, recSize)
+			_, err := prg.Read(ops[i].Val)
+			if err != nil {
+				panic(err)
+			}
 		}
 		if ops[i].Op == ADD {
 			ops[i].Idx = -1
@@ -244,9 +397,11 @@ func MakeUpdatesFixedValues(prg *rand.ChaCha8, dbsize, numUpdates, recSize int,
 		// Get random operation type from types slice
 		ops[i].Op = types[int(prg.Uint64()%uint64(len(types)))]
 
-		ops[i].Val = make([]byte, recSize)
-		// for j := range recSize {
-		ops[i].Val[0] = byte(1)
+		if ops[i].Op != DELETE {
+			ops[i].Val = make([]byte, recSize)
+			// for j := range recSize {
+			ops[i].Val[0] = byte(1)
+		}
 
 		if ops[i].Op == ADD {
 			ops[i].Idx = -1
@@ -279,60 +434,67 @@ func XorInto(a []byte, b []byte) {
 }
 
 func (db *DB) VectorProd(bitVector []byte) []byte {
+	return db.VectorProdRange(bitVector, 0, db.N)
+}
+
+// VectorProdRange returns the XOR of the records in [start, end) selected by
+// bitVector, whose bit i selects record start+i. start must be a multiple
+// of 8.
+func (db *DB) VectorProdRange(bitVector []byte, start, end int) []byte {
 	out := make(Record, db.RecSize)
+	if start >= end {
+		return out
+	}
 	if db.RecSize == 32 {
-		psetggm.XorHashesByBitVector(db.Data, bitVector, out)
+		psetggm.XorHashesByBitVector(db.Data[start*db.RecSize:end*db.RecSize], bitVector, out)
 	} else {
 		var j uint
-		for j = 0; j < uint(db.N); j++ {
+		data := db.Data[start*db.RecSize:]
+		for j = 0; j < uint(end-start); j++ {
 			if ((1 << (j % 8)) & bitVector[j/8]) != 0 {
-				XorInto(out, db.Data[j*uint(db.RecSize):(j+1)*uint(db.RecSize)])
+				XorInto(out, data[j*uint(db.RecSize):(j+1)*uint(db.RecSize)])
 			}
 		}
 	}
 	return out
 }
 
+// VectorProdIndices returns the XOR of the records at indices selected by
+// bitVector, whose bit j selects record indices[j].
+func (db *DB) VectorProdIndices(bitVector []byte, indices []uint32) []byte {
+	out := make(Record, db.RecSize)
+	for j, i := range indices {
+		if ((1 << (j % 8)) & bitVector[j/8]) != 0 {
+			XorInto(out, db.Data[int(i)*db.RecSize:(int(i)+1)*db.RecSize])
+		}
+	}
+	return out
+}
+
+// WriteToFile writes the N records of db to a file of concatenated records,
+// which ReadFromFile reads back. Use CreateFile for a file that keeps the
+// record size and is mapped instead of read.
 func (db *DB) WriteToFile(filename string) error {
 	f, err := os.Create(filename)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
-	defer f.Close()
-
-	w := bufio.NewWriter(f)
-	defer w.Flush()
-
-	for i := 0; i < db.N; i++ {
-		w.Write(db.Slice(i, i+1)) // this is stupid why don't we do it in larger chunks??
+	if _, err := f.Write(db.Slice(0, db.N)); err != nil {
+		f.Close()
+		return err
 	}
-	return nil
+	return f.Close()
 }
 
-// TODO extend to variable record size
+// ReadFromFile reads a file of N concatenated records, the record size is
+// the file size divided by N
 func ReadFromFile(filename string, N int) (*DB, error) {
-	log.Println("ReadFromFile does not support record sizes other than 16B")
-	f, err := os.Open(filename)
+	data, err := os.ReadFile(filename)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
-	defer f.Close()
-	r := bufio.NewReader(f)
-	db := &DB{N: N, RecSize: 16, Data: nil}
-	var rec Record
-	for {
-		rec = make([]byte, 16)
-		_, err := r.Read(rec)
-		if err != nil {
-			break
-		}
-		db.Data = append(db.Data, rec...)
-	}
-	if err != nil && err.Error() != "EOF" {
-		log.Fatal(err)
-		return nil, err
+	if N <= 0 || len(data)%N != 0 {
+		return nil, fmt.Errorf("file of %d bytes does not hold %d records of equal size", len(data), N)
 	}
-	return db, nil
+	return &DB{N: N, RecSize: len(data) / N, Capacity: N, Data: data}, nil
 }
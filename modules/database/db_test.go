@@ -106,3 +106,20 @@ func ExampleDatabaseWrite() {
 	// [1 1 1 1 1 1 1 1 1 1 1 1 1 1 1 1]
 
 }
+
+func ExampleDB_Delete() {
+	// Create a new database with 3 records of 4 bytes each
+	db := MakeNumberDB(3, 4)
+
+	// Delete the second record, its slot is zeroed and marked free
+	db.Delete(1)
+	fmt.Println(db.GetRecord(1), db.Free)
+
+	// A later ADD reuses the free slot instead of extending the database
+	db.Update([]Update{{Op: ADD, Idx: -1, Val: []byte{7, 7, 7, 7}}})
+	fmt.Println(db.N, db.GetRecord(1), db.Free)
+
+	// Output:
+	// [0 0 0 0] [1]
+	// 3 [7 7 7 7] []
+}
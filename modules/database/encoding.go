@@ -0,0 +1,126 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Values of any length are stored in records of a fixed size. Value i of
+// EncodeValues starts in its head record i:
+//
+//	| length of the value (4 bytes) | index of the first continuation record (4) | first bytes of the value |
+//
+// Bytes that do not fit into the head record are split across consecutive
+// continuation records after the head records, the last record is padded
+// with zeros. The head record tells the client how many continuation
+// records to retrieve; the number of records retrieved reveals the number
+// of slots of the value to the servers.
+
+// ValueHeaderSize is the size of the header of a head record
+const ValueHeaderSize = 8
+
+// ErrMalformedValue is returned for a head or continuation record that does
+// not decode to a value.
+var ErrMalformedValue = errors.New("malformed encoded value")
+
+// ValueSlots returns the number of records, the head record included, that
+// hold a value of length n in records of size recSize
+func ValueSlots(n, recSize int) int {
+	if n <= recSize-ValueHeaderSize {
+		return 1
+	}
+	return 1 + (n-(recSize-ValueHeaderSize)+recSize-1)/recSize
+}
+
+// EncodeValues lays out the values in records of size recSize: the head
+// record of value i is record i and continuation records follow the
+// len(values) head records. recSize must exceed ValueHeaderSize.
+func EncodeValues(values [][]byte, recSize int) ([]Record, error) {
+	if recSize <= ValueHeaderSize {
+		return nil, fmt.Errorf("record size %d does not exceed the value header of %d bytes", recSize, ValueHeaderSize)
+	}
+	recs := make([]Record, len(values))
+	next := len(values)
+	for i, v := range values {
+		if uint64(len(v)) > 1<<32-1 {
+			return nil, fmt.Errorf("value %d of %d bytes is too large", i, len(v))
+		}
+		head := make(Record, recSize)
+		binary.BigEndian.PutUint32(head, uint32(len(v)))
+		rest := v[copy(head[ValueHeaderSize:], v):]
+		if len(rest) > 0 {
+			if uint64(next) > 1<<32-1 {
+				return nil, fmt.Errorf("value %d starts at record %d", i, next)
+			}
+			binary.BigEndian.PutUint32(head[4:], uint32(next))
+		}
+		recs[i] = head
+		for len(rest) > 0 {
+			rec := make(Record, recSize)
+			rest = rest[copy(rec, rest):]
+			recs = append(recs, rec)
+			next++
+		}
+	}
+	return recs, nil
+}
+
+// parseHead returns the length of the value in head, the index of its
+// first continuation record and the number of continuation records
+func parseHead(head Record) (n, start, k int, err error) {
+	if len(head) <= ValueHeaderSize {
+		return 0, 0, 0, fmt.Errorf("%w: head record of %d bytes", ErrMalformedValue, len(head))
+	}
+	n = int(binary.BigEndian.Uint32(head))
+	start = int(binary.BigEndian.Uint32(head[4:]))
+	k = ValueSlots(n, len(head)) - 1
+	if k > 0 && start == 0 {
+		return 0, 0, 0, fmt.Errorf("%w: value of %d bytes without continuation records", ErrMalformedValue, n)
+	}
+	return n, start, k, nil
+}
+
+// ContinuationIndices returns the indices of the continuation records of the
+// value whose head record is head, in the order DecodeValue takes them.
+// Values longer than maxLen, e.g., the longest value of the database, are
+// rejected.
+func ContinuationIndices(head Record, maxLen int) ([]int, error) {
+	n, start, k, err := parseHead(head)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxLen {
+		return nil, fmt.Errorf("%w: value of %d bytes exceeds %d bytes", ErrMalformedValue, n, maxLen)
+	}
+	if k == 0 {
+		return nil, nil
+	}
+	idx := make([]int, k)
+	for j := range idx {
+		idx[j] = start + j
+	}
+	return idx, nil
+}
+
+// DecodeValue returns the value stored in the head record head and its
+// continuation records rest, which are retrieved at ContinuationIndices
+func DecodeValue(head Record, rest []Record) ([]byte, error) {
+	n, _, k, err := parseHead(head)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != k {
+		return nil, fmt.Errorf("%w: %d continuation records, expected %d", ErrMalformedValue, len(rest), k)
+	}
+	// the value fits into the given records
+	v := make([]byte, 0, n)
+	v = append(v, head[ValueHeaderSize:min(len(head), ValueHeaderSize+n)]...)
+	for _, rec := range rest {
+		if len(rec) != len(head) {
+			return nil, fmt.Errorf("%w: continuation record of %d bytes", ErrMalformedValue, len(rec))
+		}
+		v = append(v, rec[:min(len(rec), n-len(v))]...)
+	}
+	return v, nil
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestEncodeValues(t *testing.T) {
+	prg := rand.New(rand.NewPCG(32, 0))
+	for _, recSize := range []int{16, 32, 100} {
+		values := [][]byte{nil, make([]byte, recSize-ValueHeaderSize), make([]byte, recSize-ValueHeaderSize+1)}
+		for range 50 {
+			v := make([]byte, 20+prg.IntN(4096-20))
+			for j := range v {
+				v[j] = byte(prg.Uint32())
+			}
+			values = append(values, v)
+		}
+		recs, err := EncodeValues(values, recSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := DBFromRecords(recs)
+		total := 0
+		for i, v := range values {
+			head := db.GetRecord(i)
+			indices, err := ContinuationIndices(head, 4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(indices)+1 != ValueSlots(len(v), recSize) {
+				t.Fatalf("value %d of %d bytes in %d records", i, len(v), len(indices)+1)
+			}
+			total += len(indices) + 1
+			rest := make([]Record, len(indices))
+			for j, idx := range indices {
+				rest[j] = db.GetRecord(idx)
+			}
+			dec, err := DecodeValue(head, rest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(dec, v) {
+				t.Fatalf("value %d of %d bytes does not match", i, len(v))
+			}
+		}
+		if total != db.N {
+			t.Fatalf("%d records for %d slots", db.N, total)
+		}
+	}
+}
+
+func TestDecodeMalformedValue(t *testing.T) {
+	recs, err := EncodeValues([][]byte{make([]byte, 100)}, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := recs[0]
+	if _, err := ContinuationIndices(head, 99); !errors.Is(err, ErrMalformedValue) {
+		t.Fatal("expected value exceeding the maximum length, got", err)
+	}
+	if _, err := DecodeValue(head, recs[1:3]); !errors.Is(err, ErrMalformedValue) {
+		t.Fatal("expected missing continuation record, got", err)
+	}
+	if _, err := DecodeValue(head, []Record{recs[1], recs[2], recs[3][:8]}); !errors.Is(err, ErrMalformedValue) {
+		t.Fatal("expected short continuation record, got", err)
+	}
+	if _, err := DecodeValue(head[:ValueHeaderSize], nil); !errors.Is(err, ErrMalformedValue) {
+		t.Fatal("expected short head record, got", err)
+	}
+	if _, err := EncodeValues(nil, ValueHeaderSize); err == nil {
+		t.Fatal("accepted records without room for values")
+	}
+}
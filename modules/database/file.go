@@ -0,0 +1,264 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// File-backed databases store the records after a fixed-size header and map
+// the file into memory, so a database can be larger than RAM and a server
+// can be restarted without generating the data again.
+//
+// Header layout (big endian):
+//
+//	| magic (8 bytes) | version (4) | RecSize (4) | N (8) | Capacity (8) | checksum (32) | Reserved (8) | free slots (8) |
+//
+// The header is padded to fileHeaderSize, so the records start page
+// aligned. Reserved >= Capacity record slots follow, a full file reserves
+// twice as many slots when it grows, so a growing database is mapped again
+// only a logarithmic number of times. The indices of the free slots, 8
+// bytes each, follow the reserved slots. The checksum is the SHA-256 hash
+// of the N records and the free slots.
+
+const (
+	fileMagic      = "TAPIRDB\x00"
+	fileVersion    = 1
+	fileHeaderSize = 4096
+)
+
+var (
+	// ErrFormat is returned by OpenFile for a file that is not a database
+	// file or whose header does not match its contents.
+	ErrFormat = errors.New("malformed database file")
+	// ErrNoMagic is the ErrFormat returned by OpenFile for a file that does
+	// not start with the magic of a database file, e.g., a file of
+	// concatenated records.
+	ErrNoMagic = fmt.Errorf("%w: missing magic", ErrFormat)
+)
+
+// mapping is the memory-mapped file of a file-backed database. The file
+// only grows, and earlier mappings stay valid until Close, so records
+// returned by GetRecords remain readable after ExtendCapacity.
+type mapping struct {
+	f    *os.File
+	maps [][]byte
+	// number of record slots of the file and the last mapping
+	reserved int
+}
+
+// CreateFile creates a file-backed database of n zero records of size
+// recSize at path, replacing an existing file. The records are set with
+// SetRecord, and Close writes the header.
+func CreateFile(path string, n, recSize int) (*DB, error) {
+	if n < 0 || recSize <= 0 {
+		return nil, fmt.Errorf("invalid database of %d records of size %d", n, recSize)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{N: n, RecSize: recSize, file: &mapping{f: f}}
+	if err := db.grow(n); err != nil {
+		db.closeFile()
+		return nil, err
+	}
+	if err := db.Sync(); err != nil {
+		db.closeFile()
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenFile maps the database file at path, created by CreateFile, and
+// verifies the checksum of its records. Changes to the records are written
+// to the file, Sync or Close update the header.
+func OpenFile(path string) (*DB, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openFile(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+func openFile(f *os.File) (*DB, error) {
+	var h [fileHeaderSize]byte
+	k, err := f.ReadAt(h[:], 0)
+	if k < len(fileMagic) || string(h[:len(fileMagic)]) != fileMagic {
+		return nil, ErrNoMagic
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: error reading header: %w", ErrFormat, err)
+	}
+	if v := binary.BigEndian.Uint32(h[8:]); v != fileVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrFormat, v)
+	}
+	recSize := binary.BigEndian.Uint32(h[12:])
+	n := binary.BigEndian.Uint64(h[16:])
+	capacity := binary.BigEndian.Uint64(h[24:])
+	reserved := binary.BigEndian.Uint64(h[64:])
+	numFree := binary.BigEndian.Uint64(h[72:])
+	if recSize == 0 || n > capacity || capacity > reserved || reserved > (1<<62)/uint64(recSize) || numFree > n {
+		return nil, fmt.Errorf("%w: %d records of size %d with capacity %d", ErrFormat, n, recSize, capacity)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := uint64(fileHeaderSize) + reserved*uint64(recSize)
+	if size := end + 8*numFree; uint64(st.Size()) != size {
+		return nil, fmt.Errorf("%w: file of %d bytes, expected %d", ErrFormat, st.Size(), size)
+	}
+	free := make([]byte, 8*numFree)
+	if _, err := f.ReadAt(free, int64(end)); err != nil {
+		return nil, fmt.Errorf("%w: error reading free slots: %w", ErrFormat, err)
+	}
+
+	db := &DB{N: int(n), RecSize: int(recSize), file: &mapping{f: f}}
+	for i := range int(numFree) {
+		idx := binary.BigEndian.Uint64(free[8*i:])
+		if idx >= n || (i > 0 && idx <= uint64(db.Free[i-1])) {
+			return nil, fmt.Errorf("%w: free slot %d out of order or range", ErrFormat, idx)
+		}
+		db.Free = append(db.Free, int(idx))
+	}
+	if err := db.file.remap(int(reserved), db.RecSize); err != nil {
+		db.closeFile()
+		return nil, err
+	}
+	db.setCapacity(int(capacity))
+	sum := db.Checksum()
+	if !bytes.Equal(sum[:], h[32:64]) {
+		db.closeFile()
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrFormat)
+	}
+	return db, nil
+}
+
+// IsFile reports whether db is backed by a file
+func (db *DB) IsFile() bool {
+	return db.file != nil
+}
+
+// grow extends the database to capacity records. If the reserved slots do
+// not suffice, the file reserves twice as many and is mapped again.
+func (db *DB) grow(capacity int) error {
+	m := db.file
+	if capacity > m.reserved {
+		// drop the free slots after the reserved slots, so that the new
+		// slots are zero, Sync writes them again
+		if err := m.f.Truncate(int64(fileHeaderSize + m.reserved*db.RecSize)); err != nil {
+			return err
+		}
+		reserved := capacity
+		if m.reserved > 0 {
+			reserved = max(capacity, 2*m.reserved)
+		}
+		if err := m.f.Truncate(int64(fileHeaderSize + reserved*db.RecSize)); err != nil {
+			return err
+		}
+		if err := m.remap(reserved, db.RecSize); err != nil {
+			return err
+		}
+	}
+	db.setCapacity(capacity)
+	return nil
+}
+
+// remap maps the header and the reserved record slots of size recSize
+func (m *mapping) remap(reserved, recSize int) error {
+	data, err := mmap(m.f, fileHeaderSize+reserved*recSize)
+	if err != nil {
+		return fmt.Errorf("error mapping database file: %w", err)
+	}
+	m.maps = append(m.maps, data)
+	m.reserved = reserved
+	return nil
+}
+
+// setCapacity points Data at the first capacity record slots of the last
+// mapping
+func (db *DB) setCapacity(capacity int) {
+	data := db.file.maps[len(db.file.maps)-1]
+	end := fileHeaderSize + capacity*db.RecSize
+	db.Data = data[fileHeaderSize:end:end]
+	db.Capacity = capacity
+}
+
+// Checksum returns the SHA-256 hash of the N records and the free slots,
+// which the header of a file-backed database holds
+func (db *DB) Checksum() [32]byte {
+	h := sha256.New()
+	h.Write(db.Data[:db.N*db.RecSize])
+	h.Write(db.encodeFree())
+	return [32]byte(h.Sum(nil))
+}
+
+// encodeFree returns the indices of the free slots, 8 bytes each
+func (db *DB) encodeFree() []byte {
+	b := make([]byte, 0, 8*len(db.Free))
+	for _, i := range db.Free {
+		b = binary.BigEndian.AppendUint64(b, uint64(i))
+	}
+	return b
+}
+
+// Sync writes the free slots and the header with the checksum and flushes
+// the file, the servers sync after every batch of updates. It does nothing
+// for a database in memory.
+func (db *DB) Sync() error {
+	if db.file == nil {
+		return nil
+	}
+	m := db.file
+	end := int64(fileHeaderSize + m.reserved*db.RecSize)
+	free := db.encodeFree()
+	if err := m.f.Truncate(end + int64(len(free))); err != nil {
+		return err
+	}
+	if _, err := m.f.WriteAt(free, end); err != nil {
+		return err
+	}
+	h := m.maps[len(m.maps)-1][:fileHeaderSize]
+	copy(h, fileMagic)
+	binary.BigEndian.PutUint32(h[8:], fileVersion)
+	binary.BigEndian.PutUint32(h[12:], uint32(db.RecSize))
+	binary.BigEndian.PutUint64(h[16:], uint64(db.N))
+	binary.BigEndian.PutUint64(h[24:], uint64(db.Capacity))
+	sum := db.Checksum()
+	copy(h[32:], sum[:])
+	binary.BigEndian.PutUint64(h[64:], uint64(m.reserved))
+	binary.BigEndian.PutUint64(h[72:], uint64(len(db.Free)))
+	return m.f.Sync()
+}
+
+// Close syncs a file-backed database and unmaps it, the database and the
+// records returned by GetRecords must not be used afterwards. It does
+// nothing for a database in memory.
+func (db *DB) Close() error {
+	if db.file == nil {
+		return nil
+	}
+	err := db.Sync()
+	return errors.Join(err, db.closeFile())
+}
+
+func (db *DB) closeFile() error {
+	m := db.file
+	var errs []error
+	for _, data := range m.maps {
+		errs = append(errs, munmap(data))
+	}
+	errs = append(errs, m.f.Close())
+	db.file = nil
+	db.Data = nil
+	return errors.Join(errs...)
+}
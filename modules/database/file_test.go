@@ -0,0 +1,142 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"tapir/modules/psetggm"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	mem := MakeRandomDB([32]byte{30}, 100, 16)
+
+	db, err := CreateFile(path, mem.N, mem.RecSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range mem.N {
+		db.SetRecord(i, mem.GetRecord(i))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.Equals(mem); !ok {
+		t.Fatal("reopened database differs:", err)
+	}
+
+	// records are read from the mapping without copying, and records
+	// returned before the file grows stay readable
+	recs := db.GetRecords(0, db.N)
+	out := make([]byte, 16)
+	if err := psetggm.CopyIn(out, db.Data, 7, db.RecSize); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, recs[7]) {
+		t.Fatal("CopyIn on the mapped file differs")
+	}
+	prg := rand.NewChaCha8([32]byte{31})
+	ops := MakeRandomUpdates(prg, mem.N, 20, mem.RecSize, []OpType{ADD, EDIT, DELETE})
+	mem.Update(ops)
+	if err := db.Update(ops); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.Equals(mem); !ok {
+		t.Fatal("updated database differs:", err)
+	}
+	// the update is synced, so the file opens without Close, e.g., after
+	// a crash
+	synced, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := synced.Equals(mem); !ok {
+		t.Fatal("synced database differs:", err)
+	}
+	synced.Close()
+	for i, rec := range recs {
+		if !bytes.Equal(rec, mem.GetRecord(i)) {
+			t.Fatal("record", i, "returned before the update differs")
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.N != mem.N || db.Capacity != mem.Capacity || !bytes.Equal(db.Data, mem.Data) || !slices.Equal(db.Free, mem.Free) {
+		t.Fatal("reopened database differs after the update")
+	}
+
+	// the file is mapped again only when the reserved slots are used up
+	maps := len(db.file.maps)
+	for range 2 * db.Capacity {
+		if err := db.ExtendCapacity(db.Capacity - db.N + 1); err != nil {
+			t.Fatal(err)
+		}
+		db.N++
+	}
+	if len(db.file.maps) > maps+2 {
+		t.Fatal("file mapped", len(db.file.maps)-maps, "more times while doubling the capacity twice")
+	}
+}
+
+func TestFileMalformed(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db")
+	db, err := CreateFile(path, 10, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a modified record fails the checksum
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[fileHeaderSize+40] ^= 1
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFile(path); !errors.Is(err, ErrFormat) || errors.Is(err, ErrNoMagic) {
+		t.Fatal("expected malformed file, got", err)
+	}
+
+	// so does a truncated file and a file of concatenated records
+	if err := os.WriteFile(path, data[:fileHeaderSize+100], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFile(path); !errors.Is(err, ErrFormat) {
+		t.Fatal("expected truncated file, got", err)
+	}
+	raw := filepath.Join(dir, "raw")
+	if err := MakeNumberDB(512, 16).WriteToFile(raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFile(raw); !errors.Is(err, ErrNoMagic) {
+		t.Fatal("expected raw file to be rejected, got", err)
+	}
+	if err := os.WriteFile(raw, []byte("TAPIR"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFile(raw); !errors.Is(err, ErrNoMagic) {
+		t.Fatal("expected short file to be rejected, got", err)
+	}
+}
@@ -2,7 +2,10 @@ package database
 
 import (
 	"bytes"
+	"fmt"
 	"log"
+
+	"tapir/modules/utils"
 )
 
 type Update struct {
@@ -17,12 +20,15 @@ type OpType int
 const (
 	ADD OpType = iota
 	EDIT
+	// DELETE zeroes the record at Idx and marks its slot free, Val is unused
+	DELETE
 )
 
 func (t OpType) String() string {
 	return [...]string{
-		"ADD",  // 0
-		"EDIT", // 1
+		"ADD",    // 0
+		"EDIT",   // 1
+		"DELETE", // 2
 	}[t]
 }
 
@@ -41,3 +47,27 @@ func (op1 *Update) Equals(op2 Update) bool {
 	}
 	return true
 }
+
+// Binary encoding: op (1 byte), index (8 bytes), value (length-prefixed)
+func (op Update) MarshalBinary() ([]byte, error) {
+	w := &utils.BinWriter{}
+	w.Byte(byte(op.Op))
+	w.Uint64(uint64(op.Idx))
+	w.Bytes(op.Val)
+	return w.Buf, nil
+}
+
+func (op *Update) UnmarshalBinary(data []byte) error {
+	r := utils.NewBinReader(data)
+	t := OpType(r.Byte())
+	idx := r.Uint64()
+	val := r.Bytes()
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	if t != ADD && t != EDIT && t != DELETE {
+		return fmt.Errorf("%w: unknown update op %d", utils.ErrMalformed, t)
+	}
+	op.Op, op.Idx, op.Val = t, int(idx), val
+	return nil
+}
@@ -68,6 +68,17 @@ func prg(seed, s0, s1 *byte) (byte, byte) {
 	return t0, t1
 }
 
+// KeySize returns the size of the keys generated by Gen for a domain of
+// 2^logN points: the root seed and control bit, one correction word of 18
+// bytes per level expanded by the tree and the final correction word.
+func KeySize(logN uint64) int {
+	stop := uint64(0)
+	if logN >= 7 {
+		stop = logN - 7
+	}
+	return 17 + 18*int(stop) + 16
+}
+
 func Gen(alpha uint64, logN uint64) (DPFkey, DPFkey) {
 	if alpha >= (1<<logN) || logN > 63 {
 		panic("dpf: invalid parameters")
@@ -260,3 +271,49 @@ func EvalFull(key DPFkey, logN uint64) []byte {
 	evalFullRecursive(blockStack,key, s, t, 0, stop, &b)
 	return b.data
 }
+
+// EvalSubtree evaluates the key on the 2^(logN-depth) points whose depth most
+// significant bits equal prefix, i.e., the subtree below the node prefix at
+// the given depth. The result equals the corresponding bytes of EvalFull,
+// so that disjoint subtrees can be evaluated in parallel. depth must be at
+// most logN-7, the depth at which EvalFull stops expanding the tree.
+func EvalSubtree(key DPFkey, logN uint64, depth uint64, prefix uint64) []byte {
+	if logN < 7 || depth > logN-7 {
+		panic("dpf: subtree depth too large")
+	}
+	s := new(block)
+	sL := new(block)
+	sR := new(block)
+	copy(s[:], key[:16])
+	t := key[16]
+
+	// walk down to the root of the subtree as in Eval
+	for i := uint64(0); i < depth; i++ {
+		tL, tR := prg(&s[0], &sL[0], &sR[0])
+		if t != 0 {
+			sCW := key[17+i*18 : 17+i*18+16]
+			tLCW := key[17+i*18+16]
+			tRCW := key[17+i*18+17]
+			xor16(&sL[0], &sL[0], &sCW[0])
+			xor16(&sR[0], &sR[0], &sCW[0])
+			tL ^= tLCW
+			tR ^= tRCW
+		}
+		if (prefix & (uint64(1) << (depth - 1 - i))) != 0 {
+			*s = *sR
+			t = tR
+		} else {
+			*s = *sL
+			t = tL
+		}
+	}
+
+	var b = bytearr{make([]byte, 1<<(logN-3-depth)), 0}
+	var blockStack = make([][2]*block, 63)
+	for i := 0; i < 63; i++ {
+		blockStack[i][0] = new(block)
+		blockStack[i][1] = new(block)
+	}
+	evalFullRecursive(blockStack, key, s, t, depth, logN-7, &b)
+	return b.data
+}
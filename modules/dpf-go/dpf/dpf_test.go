@@ -1,6 +1,7 @@
 package dpf
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 )
@@ -58,6 +59,21 @@ func TestEvalFull(test *testing.T) {
 	}
 }
 
+func TestEvalSubtree(test *testing.T) {
+	logN := uint64(10)
+	a, _ := Gen(uint64(700), logN)
+	full := EvalFull(a, logN)
+	for depth := uint64(0); depth <= logN-7; depth++ {
+		size := uint64(1) << (logN - 3 - depth)
+		for prefix := uint64(0); prefix < uint64(1)<<depth; prefix++ {
+			sub := EvalSubtree(a, logN, depth, prefix)
+			if !bytes.Equal(sub, full[prefix*size:(prefix+1)*size]) {
+				test.Fatalf("subtree %d at depth %d differs", prefix, depth)
+			}
+		}
+	}
+}
+
 func TestEvalFullShort(test *testing.T) {
 	logN := uint64(3)
 	alpha := uint64(1)
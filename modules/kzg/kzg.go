@@ -0,0 +1,359 @@
+package kzg
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	bls "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr/fft"
+
+	"tapir/modules/database"
+)
+
+// KZG vector commitments over BLS12-381.
+//
+// A vector m of length N is committed to as the polynomial f of degree < D
+// (D the smallest power of two >= N) with f(ω^i) = m_i for i < N and
+// f(ω^i) = 0 otherwise, where ω generates the multiplicative subgroup of
+// order D. The SRS is kept in Lagrange form, so committing is a single
+// multi-exponentiation, updating an element is a single scalar
+// multiplication, and openings are computed without FFTs.
+//
+// Besides the usual KZG check e(C - m_i·g1, [τ - ω^i]_2) = e(π, g2), the SRS
+// contains hints H_i = [1/(τ - ω^i)]_2, which allow to verify an opening as
+// e(C - m_i·g1, H_i) = e(π, g2). Since the proof is always paired with g2,
+// openings of different commitments at different points can be aggregated
+// into a single G1 element Σ r_j π_j, where the r_j are derived from the
+// commitments, indices and values (see Aggregate).
+
+type G1 = bls.G1Affine
+type G2 = bls.G2Affine
+
+type SRS struct {
+	Digest []byte
+	N      int
+	// Lagrange[i] = [L_i(τ)]_1
+	Lagrange []G1
+	// Quotients[i] = [A(τ)/(τ - ω^i)]_1, with A(X) = X^D - 1
+	Quotients []G1
+	// Diag[i] = [(L_i(τ) - 1)/(τ - ω^i)]_1
+	Diag []G1
+	// Hints[i] = [1/(τ - ω^i)]_2
+	Hints []G2
+}
+
+// NewSRS runs a trusted setup for vectors of length N. The trapdoor τ is
+// sampled using crypto/rand and wiped once the SRS is computed, all parties
+// must use the same SRS (see Save and Load).
+func NewSRS(N int) *SRS {
+	if N < 1 {
+		panic(fmt.Sprintf("cannot set up KZG for vectors of length %d", N))
+	}
+	var τ fr.Element
+	if _, err := τ.SetRandom(); err != nil {
+		panic(fmt.Sprintf("sampling KZG trapdoor: %v", err))
+	}
+	defer τ.SetZero()
+
+	ω := omegas(N)
+	d := domainSize(N)
+
+	// den[i] = 1/(τ - ω^i)
+	den := make([]fr.Element, N)
+	for i := range den {
+		den[i].Sub(&τ, &ω[i])
+	}
+	den = fr.BatchInvert(den)
+	defer clear(den)
+
+	// A(τ) = τ^D - 1
+	var a, one, dInv fr.Element
+	a.Exp(τ, new(big.Int).SetUint64(d))
+	one.SetOne()
+	a.Sub(&a, &one)
+	dInv.SetUint64(d)
+	dInv.Inverse(&dInv)
+
+	quot := make([]fr.Element, N)
+	lag := make([]fr.Element, N)
+	diag := make([]fr.Element, N)
+	defer func() {
+		clear(quot)
+		clear(lag)
+		clear(diag)
+	}()
+	for i := range quot {
+		quot[i].Mul(&a, &den[i])
+		// L_i(τ) = ω^i A(τ) / (D (τ - ω^i))
+		lag[i].Mul(&quot[i], &ω[i]).Mul(&lag[i], &dInv)
+		diag[i].Sub(&lag[i], &one).Mul(&diag[i], &den[i])
+	}
+	a.SetZero()
+
+	_, _, g1, g2 := bls.Generators()
+	srs := &SRS{
+		N:         N,
+		Lagrange:  bls.BatchScalarMultiplicationG1(&g1, lag),
+		Quotients: bls.BatchScalarMultiplicationG1(&g1, quot),
+		Diag:      bls.BatchScalarMultiplicationG1(&g1, diag),
+		Hints:     bls.BatchScalarMultiplicationG2(&g2, den),
+	}
+	srs.SetupDigest()
+	return srs
+}
+
+func domainSize(N int) uint64 {
+	return ecc.NextPowerOfTwo(uint64(N))
+}
+
+// omegas returns the first N powers of the generator of the evaluation domain
+func omegas(N int) []fr.Element {
+	gen, err := fft.Generator(domainSize(N))
+	if err != nil {
+		panic(err)
+	}
+	ω := make([]fr.Element, N)
+	ω[0].SetOne()
+	for i := 1; i < N; i++ {
+		ω[i].Mul(&ω[i-1], &gen)
+	}
+	return ω
+}
+
+func (srs *SRS) SetupDigest() {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, uint32(srs.N))
+	for _, gs := range [][]G1{srs.Lagrange, srs.Quotients, srs.Diag} {
+		for i := range gs {
+			b := gs[i].Bytes()
+			h.Write(b[:])
+		}
+	}
+	for i := range srs.Hints {
+		b := srs.Hints[i].Bytes()
+		h.Write(b[:])
+	}
+	srs.Digest = h.Sum(nil)
+}
+
+// FieldElementFromBytes maps a record to the field. Records are hashed, so
+// the commitment binds records of any length.
+func FieldElementFromBytes(b []byte) fr.Element {
+	d := sha256.Sum256(b)
+	var e fr.Element
+	e.SetBytes(d[:])
+	return e
+}
+
+func Commit(srs *SRS, m []fr.Element) *G1 {
+	if len(m) != srs.N {
+		panic(fmt.Sprintf("message should be of size %d but is of size %d", srs.N, len(m)))
+	}
+	var C G1
+	if _, err := C.MultiExp(srs.Lagrange, m, ecc.MultiExpConfig{}); err != nil {
+		panic(err)
+	}
+	return &C
+}
+
+// Open computes the quotient (f(X) - m_i)/(X - ω^i) at τ, which is
+//
+//	Σ_{j≠i} m_j ω^j/(D (ω^j - ω^i)) (Quotients[j] - Quotients[i]) + m_i Diag[i]
+func Open(srs *SRS, i int, m []fr.Element) (mi fr.Element, π *G1) {
+	if i < 0 || i >= srs.N {
+		panic(fmt.Sprintf("can only open an index in [0,%d]", srs.N-1))
+	}
+	if len(m) != srs.N {
+		panic(fmt.Sprintf("message should be of size %d but is of size %d", srs.N, len(m)))
+	}
+	ω := omegas(srs.N)
+	var dInv fr.Element
+	dInv.SetUint64(domainSize(srs.N))
+	dInv.Inverse(&dInv)
+
+	scalars := make([]fr.Element, srs.N)
+	for j := range scalars {
+		if j == i {
+			scalars[j].SetOne()
+			continue
+		}
+		scalars[j].Sub(&ω[j], &ω[i])
+	}
+	scalars = fr.BatchInvert(scalars)
+
+	var sum fr.Element
+	for j := range scalars {
+		if j == i {
+			continue
+		}
+		scalars[j].Mul(&scalars[j], &ω[j]).Mul(&scalars[j], &dInv).Mul(&scalars[j], &m[j])
+		sum.Add(&sum, &scalars[j])
+	}
+	scalars[i].Neg(&sum)
+
+	π = new(G1)
+	if _, err := π.MultiExp(srs.Quotients, scalars, ecc.MultiExpConfig{}); err != nil {
+		panic(err)
+	}
+	var d G1
+	d.ScalarMultiplication(&srs.Diag[i], m[i].BigInt(new(big.Int)))
+	π.Add(π, &d)
+
+	return m[i], π
+}
+
+// shifted returns r·(C - m·g1)
+func shifted(C *G1, m, r *fr.Element) G1 {
+	_, _, g1, _ := bls.Generators()
+	var mg, res G1
+	mg.ScalarMultiplication(&g1, m.BigInt(new(big.Int)))
+	res.Sub(C, &mg)
+	if r != nil {
+		res.ScalarMultiplication(&res, r.BigInt(new(big.Int)))
+	}
+	return res
+}
+
+func Verify(srs *SRS, mi fr.Element, π *G1, C *G1, i int) error {
+	if i < 0 || i >= srs.N {
+		return fmt.Errorf("index %d out of range [0,%d]", i, srs.N-1)
+	}
+	_, _, _, g2 := bls.Generators()
+	var negπ G1
+	negπ.Neg(π)
+	ok, err := bls.PairingCheck([]G1{shifted(C, &mi, nil), negπ}, []G2{srs.Hints[i], g2})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%v is not an element in index %d in %v", mi.String(), i, C)
+	}
+	return nil
+}
+
+func Update(srs *SRS, C *G1, m []fr.Element, mi fr.Element, i int) {
+	var δ fr.Element
+	δ.Sub(&mi, &m[i])
+	var d G1
+	d.ScalarMultiplication(&srs.Lagrange[i], δ.BigInt(new(big.Int)))
+	C.Add(C, &d)
+}
+
+// UpdateProof updates the opening π of index j after the element at index i
+// changed from prev to mi. With δ = mi - prev, the quotient of index j
+// changes by δ L_i(X)/(X - ω^j), so π changes by
+//
+//	δ ω^i/(D (ω^i - ω^j)) (Quotients[i] - Quotients[j])  for j ≠ i
+//	δ Diag[i]                                            for j = i
+func UpdateProof(srs *SRS, π *G1, j int, prev, mi fr.Element, i int) {
+	var δ fr.Element
+	δ.Sub(&mi, &prev)
+	var d G1
+	if j == i {
+		d.ScalarMultiplication(&srs.Diag[i], δ.BigInt(new(big.Int)))
+		π.Add(π, &d)
+		return
+	}
+	gen, err := fft.Generator(domainSize(srs.N))
+	if err != nil {
+		panic(err)
+	}
+	var ωi, ωj, c fr.Element
+	ωi.Exp(gen, big.NewInt(int64(i)))
+	ωj.Exp(gen, big.NewInt(int64(j)))
+	c.Sub(&ωi, &ωj)
+	c.Mul(&c, new(fr.Element).SetUint64(domainSize(srs.N)))
+	c.Inverse(&c)
+	c.Mul(&c, &ωi).Mul(&c, &δ)
+
+	d.Sub(&srs.Quotients[i], &srs.Quotients[j])
+	d.ScalarMultiplication(&d, c.BigInt(new(big.Int)))
+	π.Add(π, &d)
+}
+
+// RO derives the aggregation coefficients. They depend on the commitments
+// as well as on the opened indices and values, otherwise openings of
+// different commitments at the same index could be combined to cancel out.
+func RO(srs *SRS, cs []*G1, indices []int, values []fr.Element) []fr.Element {
+	h := sha256.New()
+	h.Write(srs.Digest)
+	for j := range cs {
+		b := cs[j].Bytes()
+		h.Write(b[:])
+		binary.Write(h, binary.BigEndian, uint64(indices[j]))
+		v := values[j].Bytes()
+		h.Write(v[:])
+	}
+	transcript := h.Sum(nil)
+
+	rs := make([]fr.Element, len(cs))
+	for j := range rs {
+		h.Reset()
+		h.Write(transcript)
+		binary.Write(h, binary.BigEndian, uint32(j))
+		rs[j].SetBytes(h.Sum(nil))
+	}
+	return rs
+}
+
+// Aggregate combines the openings proofs[j] of commitments[j] at indices[j]
+// with values values[j] into a single G1 element
+func Aggregate(srs *SRS, commitments []*G1, proofs []*G1, indices []int, values []fr.Element) *G1 {
+	if len(proofs) != len(commitments) || len(indices) != len(commitments) || len(values) != len(commitments) {
+		panic(fmt.Sprintf("cannot aggregate %d proofs corresponding to %d commitments", len(proofs), len(commitments)))
+	}
+	rs := RO(srs, commitments, indices, values)
+	ps := make([]G1, len(proofs))
+	for j := range proofs {
+		ps[j] = *proofs[j]
+	}
+	var π G1
+	if _, err := π.MultiExp(ps, rs, ecc.MultiExpConfig{}); err != nil {
+		panic(err)
+	}
+	return &π
+}
+
+// VerifyAggregation checks Π_j e(r_j (C_j - m_j·g1), H_{i_j}) = e(π, g2)
+func VerifyAggregation(srs *SRS, indices []int, commitments []*G1, π *G1, values []fr.Element) error {
+	if len(indices) != len(commitments) || len(values) != len(commitments) {
+		return fmt.Errorf("got %d indices and %d values for %d commitments", len(indices), len(values), len(commitments))
+	}
+	rs := RO(srs, commitments, indices, values)
+	_, _, _, g2 := bls.Generators()
+
+	ps := make([]G1, 0, len(commitments)+1)
+	qs := make([]G2, 0, len(commitments)+1)
+	for j, i := range indices {
+		if i < 0 || i >= srs.N {
+			return fmt.Errorf("index %d out of range [0,%d]", i, srs.N-1)
+		}
+		ps = append(ps, shifted(commitments[j], &values[j], &rs[j]))
+		qs = append(qs, srs.Hints[i])
+	}
+	var negπ G1
+	negπ.Neg(π)
+	ps = append(ps, negπ)
+	qs = append(qs, g2)
+
+	ok, err := bls.PairingCheck(ps, qs)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("invalid aggregation")
+	}
+	return nil
+}
+
+func VerifyAggregationRecords(srs *SRS, indices []int, commitments []*G1, π *G1, elems []database.Record) error {
+	values := make([]fr.Element, len(elems))
+	for j := range elems {
+		values[j] = FieldElementFromBytes(elems[j])
+	}
+	return VerifyAggregation(srs, indices, commitments, π, values)
+}
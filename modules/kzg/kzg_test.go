@@ -0,0 +1,182 @@
+package kzg
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+	"github.com/stretchr/testify/assert"
+)
+
+func randomVec(t *testing.T, N int) []fr.Element {
+	m := make([]fr.Element, N)
+	for i := range m {
+		if _, err := m[i].SetRandom(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func TestKZGCommitment(t *testing.T) {
+	// not a power of two, so the domain is padded
+	N := 100
+	srs := NewSRS(N)
+	m := randomVec(t, N)
+
+	C := Commit(srs, m)
+
+	for i := 0; i < srs.N; i++ {
+		mi, π := Open(srs, i, m)
+
+		err := Verify(srs, mi, π, C, i)
+		assert.NoError(t, err)
+
+		err = Verify(srs, mi, π, C, (i+1)%srs.N)
+		assert.Error(t, err)
+
+		err = Verify(srs, m[(i+1)%srs.N], π, C, i)
+		assert.Error(t, err)
+	}
+}
+
+func TestKZGSingleElement(t *testing.T) {
+	srs := NewSRS(1)
+	m := randomVec(t, 1)
+	C := Commit(srs, m)
+	mi, π := Open(srs, 0, m)
+	assert.NoError(t, Verify(srs, mi, π, C, 0))
+}
+
+func TestKZGUpdate(t *testing.T) {
+	N := 64
+	srs := NewSRS(N)
+	m := randomVec(t, N)
+	m2 := randomVec(t, N)
+
+	C := Commit(srs, m)
+
+	for i := 0; i < srs.N; i++ {
+		Update(srs, C, m, m2[i], i)
+		m[i] = m2[i]
+		_, π := Open(srs, i, m)
+
+		err := Verify(srs, m2[i], π, C, i)
+		assert.NoError(t, err)
+	}
+	assert.True(t, C.Equal(Commit(srs, m)))
+}
+
+func TestKZGUpdateProof(t *testing.T) {
+	N := 12
+	srs := NewSRS(N)
+	m := randomVec(t, N)
+	C := Commit(srs, m)
+	proofs := make([]*G1, N)
+	for j := range proofs {
+		_, proofs[j] = Open(srs, j, m)
+	}
+
+	for _, i := range []int{0, 5, N - 1, 5} {
+		mi := randomVec(t, 1)[0]
+		for j := range proofs {
+			UpdateProof(srs, proofs[j], j, m[i], mi, i)
+		}
+		Update(srs, C, m, mi, i)
+		m[i] = mi
+
+		for j := range proofs {
+			assert.NoError(t, Verify(srs, m[j], proofs[j], C, j))
+			_, π := Open(srs, j, m)
+			assert.True(t, π.Equal(proofs[j]))
+		}
+	}
+}
+
+func TestKZGAggregation(t *testing.T) {
+	N := 16
+	Q := 6
+	srs := NewSRS(N)
+
+	ms := make([][]fr.Element, Q)
+	cs := make([]*G1, Q)
+	πs := make([]*G1, Q)
+	values := make([]fr.Element, Q)
+	// some commitments are opened at the same index
+	indices := []int{0, 3, 3, 15, 7, 0}
+	for j := range ms {
+		ms[j] = randomVec(t, N)
+		cs[j] = Commit(srs, ms[j])
+		values[j], πs[j] = Open(srs, indices[j], ms[j])
+	}
+
+	π := Aggregate(srs, cs, πs, indices, values)
+	assert.NoError(t, VerifyAggregation(srs, indices, cs, π, values))
+
+	// a wrong value is rejected
+	wrong := append([]fr.Element(nil), values...)
+	wrong[2].SetOne()
+	assert.Error(t, VerifyAggregation(srs, indices, cs, π, wrong))
+
+	// so is a wrong index
+	wrongIdx := append([]int(nil), indices...)
+	wrongIdx[4] = 8
+	assert.Error(t, VerifyAggregation(srs, wrongIdx, cs, π, values))
+
+	// shifting two values opened at the same index such that the
+	// combination r_1 δ_1 + r_2 δ_2 of the original coefficients vanishes
+	// changes the coefficients and is rejected
+	rs := RO(srs, cs, indices, values)
+	var δ1, δ2 fr.Element
+	δ1.Set(&rs[2])
+	δ2.Neg(&rs[1])
+	shifted := append([]fr.Element(nil), values...)
+	shifted[1].Add(&shifted[1], &δ1)
+	shifted[2].Add(&shifted[2], &δ2)
+	assert.Error(t, VerifyAggregation(srs, indices, cs, π, shifted))
+}
+
+func TestKZGSetupIsRandom(t *testing.T) {
+	N := 8
+	srs1 := NewSRS(N)
+	srs2 := NewSRS(N)
+	assert.NotEqual(t, srs1.Digest, srs2.Digest)
+	assert.False(t, srs1.Lagrange[0].Equal(&srs2.Lagrange[0]))
+}
+
+func TestKZGSaveLoad(t *testing.T) {
+	N := 8
+	srs := NewSRS(N)
+	path := filepath.Join(t.TempDir(), "kzg.bin")
+	assert.NoError(t, srs.Save(path))
+
+	loaded, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, srs.N, loaded.N)
+	assert.Equal(t, srs.Digest, loaded.Digest)
+
+	// the loaded SRS verifies openings made with the original one
+	m := randomVec(t, N)
+	C := Commit(srs, m)
+	mi, π := Open(srs, 3, m)
+	assert.NoError(t, Verify(loaded, mi, π, C, 3))
+
+	// a modified digest or SRS element is rejected
+	b, err := EncodeSRS(srs)
+	assert.NoError(t, err)
+	b[len(b)-1] ^= 1
+	_, err = DecodeSRS(b)
+	assert.ErrorIs(t, err, ErrSRSDigest)
+
+	b, err = EncodeSRS(srs)
+	assert.NoError(t, err)
+	other := srs.Lagrange[1].Bytes()
+	copy(b[len(srsMagic)+5:], other[:])
+	_, err = DecodeSRS(b)
+	assert.Error(t, err)
+
+	for _, l := range []int{0, len(srsMagic), len(b) - 1} {
+		_, err = DecodeSRS(b[:l])
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,117 @@
+package kzg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	bls "github.com/consensys/gnark-crypto/ecc/bls12-381"
+
+	"tapir/modules/utils"
+)
+
+////////////////////////////////////////////////////////////
+// SRS FILES
+////////////////////////////////////////////////////////////
+
+// Encoding of the SRS:
+// magic (8 bytes) | version (1 byte) | N (uint32) |
+// 3N compressed G1 elements (Lagrange, Quotients, Diag) |
+// N compressed G2 elements (Hints) | digest (length-prefixed)
+//
+// The digest is recomputed when decoding and must match the stored one.
+
+var srsMagic = []byte("TAPIRKZG")
+
+const srsVersion = 1
+
+var ErrSRSDigest = errors.New("KZG SRS digest mismatch")
+
+func EncodeSRS(srs *SRS) ([]byte, error) {
+	n := srs.N
+	if len(srs.Lagrange) != n || len(srs.Quotients) != n || len(srs.Diag) != n || len(srs.Hints) != n {
+		return nil, fmt.Errorf("incomplete KZG SRS for N=%d", n)
+	}
+	w := &utils.BinWriter{}
+	w.Raw(srsMagic)
+	w.Byte(srsVersion)
+	w.Uint32(uint32(n))
+	for _, gs := range [][]G1{srs.Lagrange, srs.Quotients, srs.Diag} {
+		for i := range gs {
+			b := gs[i].Bytes()
+			w.Raw(b[:])
+		}
+	}
+	for i := range srs.Hints {
+		b := srs.Hints[i].Bytes()
+		w.Raw(b[:])
+	}
+	w.Bytes(srs.Digest)
+	return w.Buf, nil
+}
+
+func DecodeSRS(data []byte) (*SRS, error) {
+	r := utils.NewBinReader(data)
+	if !bytes.Equal(r.Raw(len(srsMagic)), srsMagic) {
+		r.Fail(fmt.Errorf("%w: not a KZG SRS file", utils.ErrMalformed))
+	}
+	if v := r.Byte(); r.Err() == nil && v != srsVersion {
+		r.Fail(fmt.Errorf("%w: unsupported KZG SRS version %d", utils.ErrMalformed, v))
+	}
+	n := int(r.Uint32())
+	if r.Err() == nil && (n < 1 || uint64(n)*uint64(3*bls.SizeOfG1AffineCompressed+bls.SizeOfG2AffineCompressed) > uint64(r.Remaining())) {
+		r.Fail(fmt.Errorf("%w: KZG SRS for N=%d truncated", utils.ErrMalformed, n))
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	srs := &SRS{N: n}
+	for _, gs := range []*[]G1{&srs.Lagrange, &srs.Quotients, &srs.Diag} {
+		*gs = make([]G1, n)
+		for i := range *gs {
+			if _, err := (*gs)[i].SetBytes(r.Raw(bls.SizeOfG1AffineCompressed)); err != nil {
+				return nil, fmt.Errorf("%w: G1 element %d: %v", utils.ErrMalformed, i, err)
+			}
+		}
+	}
+	srs.Hints = make([]G2, n)
+	for i := range srs.Hints {
+		if _, err := srs.Hints[i].SetBytes(r.Raw(bls.SizeOfG2AffineCompressed)); err != nil {
+			return nil, fmt.Errorf("%w: G2 element %d: %v", utils.ErrMalformed, i, err)
+		}
+	}
+	digest := r.Bytes()
+	if err := r.Finish(); err != nil {
+		return nil, err
+	}
+
+	srs.SetupDigest()
+	if !bytes.Equal(srs.Digest, digest) {
+		return nil, ErrSRSDigest
+	}
+	return srs, nil
+}
+
+// Save writes the SRS to the file at path
+func (srs *SRS) Save(path string) error {
+	b, err := EncodeSRS(srs)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+// Load reads an SRS written by Save and checks its digest
+func Load(path string) (*SRS, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	srs, err := DecodeSRS(b)
+	if err != nil {
+		return nil, fmt.Errorf("loading KZG SRS from %s: %w", path, err)
+	}
+	return srs, nil
+}
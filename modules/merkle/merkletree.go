@@ -17,9 +17,11 @@ package merkle
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/fnv"
-	"log"
 	"math"
+	"math/bits"
+	"slices"
 	"tapir/modules/database"
 )
 
@@ -31,7 +33,10 @@ type MerkleTree struct {
 	// data are stored as a map from the actual data encoded to string to
 	// the index of the data in the tree
 	data map[uint64]uint32
-	// nodes are the leaf and branch nodes of the Merkle tree
+	// keys are the keys of data for each leaf
+	keys []uint64
+	// nodes are the leaf and branch nodes of the Merkle tree, the number of
+	// leaves (including padding) is a power of 2
 	nodes [][]byte
 }
 
@@ -43,6 +48,16 @@ func hashFNV1a64(data []byte) uint64 {
 	return h.Sum64()
 }
 
+// dataKey returns the key of data at index i in the data map
+func dataKey(data []byte, i int) uint64 {
+	return hashFNV1a64(append(append([]byte{}, data...), indexToBytes(i)...))
+}
+
+// Len returns the number of leaves of the tree, excluding padding
+func (t *MerkleTree) Len() int {
+	return len(t.keys)
+}
+
 func (t *MerkleTree) indexOf(input []byte) (uint32, error) {
 	if i, ok := t.data[hashFNV1a64(input)]; ok {
 		return i, nil
@@ -68,7 +83,10 @@ func (t *MerkleTree) GenerateProof(data []byte) (*Proof, error) {
 // If the data is present in the tree this will return the hashes for each level in the tree and the index of the value in the tree
 func (t *MerkleTree) GenerateProofIndex(index uint32) (*Proof, error) {
 
-	proofLen := int(math.Ceil(math.Log2(float64(len(t.data)))))
+	if int(index) >= t.Len() {
+		return nil, fmt.Errorf("index %d out of range", index)
+	}
+	proofLen := int(math.Ceil(math.Log2(float64(len(t.nodes) / 2))))
 	hashes := make([][]byte, proofLen)
 
 	cur := 0
@@ -84,7 +102,7 @@ func (t *MerkleTree) GenerateProofIndex(index uint32) (*Proof, error) {
 // 4 bytes are for how many hashes are in the path, 8 bytes for embedding the index
 // in the tree (see proof.go for details).
 func (t *MerkleTree) EncodedProofLength() int {
-	return int(math.Ceil(math.Log2(float64(len(t.data)))))*t.hash.HashLength() + numHashesByteSize + indexByteSize
+	return int(math.Ceil(math.Log2(float64(len(t.nodes)/2))))*t.hash.HashLength() + numHashesByteSize + indexByteSize
 }
 
 // New creates a new Merkle tree using the provided raw data and default hash type.
@@ -104,6 +122,7 @@ func NewUsing(data [][]byte, hash HashType) (*MerkleTree, error) {
 
 	// map with the original data to easily loop up the index
 	md := make(map[uint64]uint32, len(data))
+	keys := make([]uint64, len(data))
 	hashForNodes := fnv.New64a()
 	// We pad our data length up to the power of 2
 	nodes := make([][]byte, 2*branchesLen)
@@ -114,7 +133,8 @@ func NewUsing(data [][]byte, hash HashType) (*MerkleTree, error) {
 		if _, err := hashForNodes.Write(append([]byte(data[i]), ib...)); err != nil {
 			return nil, err
 		}
-		md[hashForNodes.Sum64()] = uint32(i)
+		keys[i] = hashForNodes.Sum64()
+		md[keys[i]] = uint32(i)
 		hashForNodes.Reset()
 	}
 	for i := len(data) + branchesLen; i < len(nodes); i++ {
@@ -130,6 +150,7 @@ func NewUsing(data [][]byte, hash HashType) (*MerkleTree, error) {
 		hash:  hash,
 		nodes: nodes,
 		data:  md,
+		keys:  keys,
 	}
 
 	return tree, nil
@@ -152,6 +173,7 @@ func NewUsingRecords(records *[]database.Record, hash HashType) (*MerkleTree, er
 
 	// map with the original data to easily loop up the index
 	md := make(map[uint64]uint32, len(*records))
+	keys := make([]uint64, len(*records))
 	hashForNodes := fnv.New64a()
 	// We pad our data length up to the power of 2
 	nodes := make([][]byte, branchesLen+len(*records)+(branchesLen-len(*records)))
@@ -163,7 +185,8 @@ func NewUsingRecords(records *[]database.Record, hash HashType) (*MerkleTree, er
 		if _, err := hashForNodes.Write(append([]byte(record), ib...)); err != nil {
 			return nil, err
 		}
-		md[hashForNodes.Sum64()] = uint32(i)
+		keys[i] = hashForNodes.Sum64()
+		md[keys[i]] = uint32(i)
 		hashForNodes.Reset()
 	}
 	for i := len(*records) + branchesLen; i < len(nodes); i++ {
@@ -179,6 +202,7 @@ func NewUsingRecords(records *[]database.Record, hash HashType) (*MerkleTree, er
 		hash:  hash,
 		nodes: nodes,
 		data:  md,
+		keys:  keys,
 	}
 
 	return tree, nil
@@ -199,63 +223,105 @@ func indexToBytes(i int) []byte {
 	return b
 }
 
-func (t *MerkleTree) UpdateMulti(ops []database.Update) ([]byte, error) {
-	branchesLen := int(math.Exp2(math.Ceil(math.Log2(float64(len(t.data))))))
-	hashForNodes := fnv.New64a()
+// grow doubles the capacity of the tree. The old tree becomes the left
+// subtree of the new root, the right subtree consists of padding only.
+func (t *MerkleTree) grow() {
+	branchesLen := len(t.nodes) / 2
+	nodes := make([][]byte, 4*branchesLen)
 
-	for _, op := range ops {
-		if op.Op == database.ADD && op.Idx >= len(t.data) {
-			log.Fatalln("currently only EDIT supported")
-		}
-		ib := indexToBytes(op.Idx)
-		t.nodes[op.Idx+branchesLen] = t.hash.Hash(op.Val, ib)
-		if _, err := hashForNodes.Write(append([]byte(op.Val), ib...)); err != nil {
-			return nil, err
+	// node i in level l of the old tree moves to i + 2^l
+	pad := make([]byte, t.hash.HashLength())
+	for l := 1; l <= branchesLen; l *= 2 {
+		copy(nodes[2*l:3*l], t.nodes[l:2*l])
+	}
+	// the padding subtree has identical nodes in each level
+	for l := 2 * branchesLen; l >= 2; l /= 2 {
+		for i := 3 * l / 2; i < 2*l; i++ {
+			nodes[i] = pad
 		}
-		t.data[hashForNodes.Sum64()] = uint32(op.Idx)
-		hashForNodes.Reset()
+		pad = t.hash.Hash(pad, pad)
+	}
+	nodes[1] = t.hash.Hash(nodes[2], nodes[3])
+	t.nodes = nodes
+}
 
-		// // delete old value from map
-		oldVal := t.nodes[op.Idx+branchesLen]
-		if _, err := hashForNodes.Write(append([]byte(oldVal), ib...)); err != nil {
-			return nil, err
+// setLeaf sets the leaf at index idx, which is either an existing leaf or
+// the first leaf after the existing ones, and recomputes its path
+func (t *MerkleTree) setLeaf(idx int, val []byte) error {
+	switch {
+	case idx < 0 || idx > t.Len():
+		return fmt.Errorf("index %d out of range for tree with %d leaves", idx, t.Len())
+	case idx == t.Len():
+		if idx == len(t.nodes)/2 {
+			t.grow()
+		}
+		t.keys = append(t.keys, 0)
+	default:
+		// delete old value from map
+		if i, ok := t.data[t.keys[idx]]; ok && int(i) == idx {
+			delete(t.data, t.keys[idx])
 		}
-		delete(t.data, hashForNodes.Sum64())
-		hashForNodes.Reset()
 	}
-	for i := branchesLen - 1; i > 0; i-- {
+
+	branchesLen := len(t.nodes) / 2
+	t.nodes[idx+branchesLen] = t.hash.Hash(val, indexToBytes(idx))
+	t.keys[idx] = dataKey(val, idx)
+	t.data[t.keys[idx]] = uint32(idx)
+
+	for i := (idx + branchesLen) / 2; i > 0; i = i / 2 {
 		t.nodes[i] = t.hash.Hash(t.nodes[i*2], t.nodes[i*2+1])
 	}
-	return t.nodes[1], nil
+	return nil
 }
 
-func (t *MerkleTree) Update(op database.Update) ([]byte, error) {
-	branchesLen := int(math.Exp2(math.Ceil(math.Log2(float64(len(t.data))))))
-	hashForNodes := fnv.New64a()
-	// oldVal := t.nodes[op.Idx+branchesLen]
+// Append adds a leaf after the existing ones and returns the new root.
+// If the tree is full, its capacity is doubled.
+func (t *MerkleTree) Append(val []byte) ([]byte, error) {
+	if err := t.setLeaf(t.Len(), val); err != nil {
+		return nil, err
+	}
+	return t.nodes[1], nil
+}
 
-	// delete old value from map
-	for k, v := range t.data {
-		if v == uint32(op.Idx) {
-			delete(t.data, k)
-			break
+// UpdateMulti applies the updates in order and returns the new root. EDITs
+// and DELETEs replace existing leaves, ADDs replace existing leaves or, at
+// index Len(), append a leaf.
+func (t *MerkleTree) UpdateMulti(ops []database.Update) ([]byte, error) {
+	for _, op := range ops {
+		if op.Op != database.ADD && op.Idx >= t.Len() {
+			return nil, fmt.Errorf("cannot edit index %d of tree with %d leaves", op.Idx, t.Len())
+		}
+		if err := t.setLeaf(op.Idx, op.Val); err != nil {
+			return nil, err
 		}
 	}
+	return t.nodes[1], nil
+}
 
-	if op.Op == database.ADD && op.Idx > len(t.data) {
-		log.Fatalln("currently only EDIT supported")
-	}
-	ib := indexToBytes(op.Idx)
-	t.nodes[op.Idx+branchesLen] = t.hash.Hash(op.Val, ib)
-	if _, err := hashForNodes.Write(append([]byte(op.Val), ib...)); err != nil {
-		return nil, err
-	}
-	t.data[hashForNodes.Sum64()] = uint32(op.Idx)
-	hashForNodes.Reset()
+func (t *MerkleTree) Update(op database.Update) ([]byte, error) {
+	return t.UpdateMulti([]database.Update{op})
+}
 
-	for i := (op.Idx + branchesLen) / 2; i > 0; i = i / 2 {
-		t.nodes[i] = t.hash.Hash(t.nodes[i*2], t.nodes[i*2+1])
+// UpdateProof brings the proof p up to date after the leaf at idx was set.
+// Only the sibling hash where the paths of p.Index and idx meet changes, all
+// other hashes of p are off the path of idx. If the tree has grown since p
+// was generated, p is generated again.
+func (t *MerkleTree) UpdateProof(p *Proof, idx uint32) error {
+	branchesLen := len(t.nodes) / 2
+	if 1<<len(p.Hashes) != branchesLen {
+		fresh, err := t.GenerateProofIndex(p.Index)
+		if err != nil {
+			return err
+		}
+		*p = *fresh
+		return nil
 	}
-
-	return t.nodes[1], nil
+	if p.Index == idx {
+		return nil
+	}
+	d := bits.Len32(p.Index^idx) - 1
+	// p may share its hashes with copies made before the update
+	p.Hashes = slices.Clone(p.Hashes)
+	p.Hashes[d] = t.nodes[(int(idx)+branchesLen)>>d]
+	return nil
 }
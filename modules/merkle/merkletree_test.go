@@ -4,8 +4,11 @@ import (
 	"hash/fnv"
 	"log"
 	"math"
+	"tapir/modules/database"
 	"tapir/modules/utils"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func BenchmarkNew(b *testing.B) {
@@ -72,3 +75,109 @@ func TestTreeGen(t *testing.T) {
 		md[checksum] = uint32(i)
 	}
 }
+
+func randomData(n int) [][]byte {
+	rng := utils.RandomPRG()
+	data := make([][]byte, n)
+	for i := range data {
+		data[i] = make([]byte, 32)
+		rng.Read(data[i])
+	}
+	return data
+}
+
+func TestAppend(t *testing.T) {
+	data := randomData(70)
+
+	tree, err := New(data[:1])
+	require.NoError(t, err)
+	for k := 2; k <= len(data); k++ {
+		root, err := tree.Append(data[k-1])
+		require.NoError(t, err)
+		require.Equal(t, k, tree.Len())
+
+		// the grown tree equals a tree built from scratch
+		fresh, err := New(data[:k])
+		require.NoError(t, err)
+		require.Equal(t, fresh.Root(), root)
+		require.Equal(t, fresh.nodes, tree.nodes)
+	}
+
+	for i := range data {
+		proof, err := tree.GenerateProofIndex(uint32(i))
+		require.NoError(t, err)
+		ok, err := VerifyProof(data[i], proof, uint32(i), tree.Root())
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	_, err = tree.GenerateProofIndex(uint32(len(data)))
+	require.Error(t, err)
+}
+
+func TestUpdateMulti(t *testing.T) {
+	data := randomData(20)
+	tree, err := New(data[:16])
+	require.NoError(t, err)
+
+	newVal := randomData(1)[0]
+	ops := []database.Update{
+		{Op: database.EDIT, Idx: 3, Val: newVal},
+		{Op: database.ADD, Idx: 16, Val: data[16]},
+		{Op: database.ADD, Idx: 17, Val: data[17]},
+	}
+	root, err := tree.UpdateMulti(ops)
+	require.NoError(t, err)
+
+	expected := append([][]byte{}, data[:18]...)
+	expected[3] = newVal
+	fresh, err := New(expected)
+	require.NoError(t, err)
+	require.Equal(t, fresh.Root(), root)
+
+	// the old value is removed from the data map, the new one is added
+	_, ok := tree.data[dataKey(data[3], 3)]
+	require.False(t, ok)
+	require.Equal(t, uint32(3), tree.data[dataKey(newVal, 3)])
+	require.Len(t, tree.data, 18)
+
+	// leaves cannot be skipped or edited before they exist
+	_, err = tree.Update(database.Update{Op: database.ADD, Idx: 19, Val: data[19]})
+	require.Error(t, err)
+	_, err = tree.Update(database.Update{Op: database.EDIT, Idx: 18, Val: data[18]})
+	require.Error(t, err)
+}
+
+func TestUpdateProof(t *testing.T) {
+	data := randomData(20)
+	tree, err := New(data[:16])
+	require.NoError(t, err)
+	proofs := make([]*Proof, 16)
+	for i := range proofs {
+		proofs[i], err = tree.GenerateProofIndex(uint32(i))
+		require.NoError(t, err)
+	}
+
+	check := func() {
+		for i, p := range proofs {
+			fresh, err := tree.GenerateProofIndex(uint32(i))
+			require.NoError(t, err)
+			require.Equal(t, fresh, p)
+		}
+	}
+	for _, idx := range []int{0, 7, 8, 15, 7} {
+		_, err = tree.Update(database.Update{Op: database.EDIT, Idx: idx, Val: randomData(1)[0]})
+		require.NoError(t, err)
+		for _, p := range proofs {
+			require.NoError(t, tree.UpdateProof(p, uint32(idx)))
+		}
+		check()
+	}
+
+	// appending beyond the capacity doubles the depth of the tree
+	_, err = tree.Append(data[16])
+	require.NoError(t, err)
+	for _, p := range proofs {
+		require.NoError(t, tree.UpdateProof(p, 16))
+	}
+	check()
+}
@@ -0,0 +1,284 @@
+package merkle
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"slices"
+)
+
+// MultiProof opens several leaves of one tree at once. Sibling hashes that
+// are shared by the paths of several leaves, or that can be computed from
+// the opened leaves themselves, are included only once respectively not
+// at all.
+type MultiProof struct {
+	// Depth of the tree, i.e., the length of a single proof
+	Depth uint32
+	// Indices of the opened leaves, sorted and without duplicates
+	Indices []uint32
+	// Hashes of the nodes not computable from the opened leaves, level by
+	// level from the leaves to the root and from left to right in each level
+	Hashes [][]byte
+}
+
+// normalizeIndices sorts indices and removes duplicates
+func normalizeIndices(indices []uint32) []uint32 {
+	idx := slices.Clone(indices)
+	slices.Sort(idx)
+	return slices.Compact(idx)
+}
+
+// multiProofHashes walks up the tree from the leaves at positions level by
+// level and calls sibling for every node that is needed but not computable
+func multiProofHashes(depth uint32, indices []uint32, sibling func(pos uint64) ([]byte, error)) ([][]byte, error) {
+	var hashes [][]byte
+	level := make([]uint64, len(indices))
+	for i, idx := range indices {
+		level[i] = uint64(idx) + 1<<depth
+	}
+	for d := uint32(0); d < depth; d++ {
+		next := level[:0]
+		for i := 0; i < len(level); i++ {
+			pos := level[i]
+			if pos%2 == 0 && i+1 < len(level) && level[i+1] == pos+1 {
+				// both children are known
+				i++
+			} else {
+				h, err := sibling(pos ^ 1)
+				if err != nil {
+					return nil, err
+				}
+				hashes = append(hashes, h)
+			}
+			next = append(next, pos/2)
+		}
+		level = next
+	}
+	return hashes, nil
+}
+
+// GenerateMultiProof generates a proof for the leaves at indices
+func (t *MerkleTree) GenerateMultiProof(indices []uint32) (*MultiProof, error) {
+	if len(indices) == 0 {
+		return nil, errors.New("no indices to open")
+	}
+	branchesLen := len(t.nodes) / 2
+	depth := uint32(bits.TrailingZeros(uint(branchesLen)))
+	idx := normalizeIndices(indices)
+	if int(idx[len(idx)-1]) >= branchesLen {
+		return nil, fmt.Errorf("index %d out of range", idx[len(idx)-1])
+	}
+	hashes, err := multiProofHashes(depth, idx, func(pos uint64) ([]byte, error) {
+		return t.nodes[pos], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MultiProof{Depth: depth, Indices: idx, Hashes: hashes}, nil
+}
+
+// UpdateMultiProof brings the multiproof p up to date after the leaves at
+// idxs were set and reports whether any hash of p changed. For each leaf not
+// opened by p, only the hash where its path meets the paths of the opened
+// leaves changes. If the tree has grown since p was generated, p is
+// generated again.
+func (t *MerkleTree) UpdateMultiProof(p *MultiProof, idxs []uint32) (bool, error) {
+	branchesLen := len(t.nodes) / 2
+	if 1<<p.Depth != branchesLen {
+		fresh, err := t.GenerateMultiProof(p.Indices)
+		if err != nil {
+			return false, err
+		}
+		*p = *fresh
+		return true, nil
+	}
+	// nodes on the paths of the updated leaves, the root is never part of
+	// a proof
+	updated := make(map[uint64]struct{}, len(idxs)*int(p.Depth))
+	for _, idx := range idxs {
+		if int(idx) >= branchesLen {
+			return false, fmt.Errorf("index %d out of range", idx)
+		}
+		for pos := uint64(idx) + uint64(branchesLen); pos > 1; pos /= 2 {
+			updated[pos] = struct{}{}
+		}
+	}
+	// p may share its hashes with copies made before the update
+	hashes := slices.Clone(p.Hashes)
+	changed := false
+	j := 0
+	_, err := multiProofHashes(p.Depth, p.Indices, func(pos uint64) ([]byte, error) {
+		if j >= len(hashes) {
+			return nil, errors.New("multiproof has fewer hashes than its indices require")
+		}
+		if _, ok := updated[pos]; ok {
+			hashes[j] = t.nodes[pos]
+			changed = true
+		}
+		j++
+		return nil, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if j != len(hashes) {
+		return false, errors.New("multiproof has more hashes than its indices require")
+	}
+	if changed {
+		p.Hashes = hashes
+	}
+	return changed, nil
+}
+
+// MergeProofs combines proofs of several leaves of the same tree into a
+// multiproof, without access to the tree.
+func MergeProofs(proofs []*Proof) (*MultiProof, error) {
+	if len(proofs) == 0 {
+		return nil, errors.New("no proofs to merge")
+	}
+	depth := uint32(len(proofs[0].Hashes))
+	known := make(map[uint64][]byte)
+	indices := make([]uint32, len(proofs))
+	for i, p := range proofs {
+		if uint32(len(p.Hashes)) != depth {
+			return nil, errors.New("proofs of trees of different depths")
+		}
+		if depth < 32 && p.Index >= 1<<depth {
+			return nil, fmt.Errorf("index %d out of range", p.Index)
+		}
+		indices[i] = p.Index
+		pos := uint64(p.Index) + 1<<depth
+		for _, h := range p.Hashes {
+			known[pos^1] = h
+			pos /= 2
+		}
+	}
+	idx := normalizeIndices(indices)
+	hashes, err := multiProofHashes(depth, idx, func(pos uint64) ([]byte, error) {
+		h, ok := known[pos]
+		if !ok {
+			return nil, fmt.Errorf("missing hash of node %d", pos)
+		}
+		return h, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MultiProof{Depth: depth, Indices: idx, Hashes: hashes}, nil
+}
+
+type node struct {
+	pos  uint64
+	hash []byte
+}
+
+// VerifyMultiProof verifies a multiproof for data[i] at indices[i] using
+// the default hash type. indices may be in any order, but must be the
+// indices the proof was generated for.
+func VerifyMultiProof(data [][]byte, proof *MultiProof, indices []uint32, root []byte) (bool, error) {
+	if len(data) != len(indices) {
+		return false, fmt.Errorf("%d data items for %d indices", len(data), len(indices))
+	}
+	if proof.Depth >= 32 {
+		return false, nil
+	}
+	hashType := NewBLAKE3()
+
+	level := make([]node, len(indices))
+	for i, idx := range indices {
+		if uint64(idx) >= 1<<proof.Depth {
+			return false, nil
+		}
+		level[i] = node{pos: uint64(idx) + 1<<proof.Depth, hash: hashType.Hash(data[i], indexToBytes(int(idx)))}
+	}
+	slices.SortFunc(level, func(a, b node) int { return cmp.Compare(a.pos, b.pos) })
+	// the same index opened twice must have the same data
+	level = slices.CompactFunc(level, func(a, b node) bool {
+		return a.pos == b.pos && bytes.Equal(a.hash, b.hash)
+	})
+	if len(level) != len(proof.Indices) {
+		return false, nil
+	}
+	for i, n := range level {
+		if n.pos != uint64(proof.Indices[i])+1<<proof.Depth {
+			return false, nil
+		}
+	}
+
+	hashes := proof.Hashes
+	for d := uint32(0); d < proof.Depth; d++ {
+		next := level[:0]
+		for i := 0; i < len(level); i++ {
+			n := level[i]
+			var left, right []byte
+			if n.pos%2 == 0 && i+1 < len(level) && level[i+1].pos == n.pos+1 {
+				left, right = n.hash, level[i+1].hash
+				i++
+			} else {
+				if len(hashes) == 0 {
+					return false, nil
+				}
+				if n.pos%2 == 0 {
+					left, right = n.hash, hashes[0]
+				} else {
+					left, right = hashes[0], n.hash
+				}
+				hashes = hashes[1:]
+			}
+			next = append(next, node{pos: n.pos / 2, hash: hashType.Hash(left, right)})
+		}
+		level = next
+	}
+	if len(hashes) != 0 || len(level) != 1 {
+		return false, nil
+	}
+	return bytes.Equal(level[0].hash, root), nil
+}
+
+// Encoding of a multiproof:
+// depth (4 bytes) | number of indices (4 bytes) | indices (4 bytes each) |
+// number of hashes (4 bytes) | hashes (32 bytes each)
+func EncodeMultiProof(p *MultiProof) []byte {
+	out := make([]byte, 0, 3*numHashesByteSize+len(p.Indices)*indexByteSize+len(p.Hashes)*32)
+	out = binary.LittleEndian.AppendUint32(out, p.Depth)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(p.Indices)))
+	for _, idx := range p.Indices {
+		out = binary.LittleEndian.AppendUint32(out, idx)
+	}
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(p.Hashes)))
+	for _, h := range p.Hashes {
+		out = append(out, h...)
+	}
+	return out
+}
+
+func DecodeMultiProof(p []byte) (*MultiProof, error) {
+	hashLength := uint64(32) // blake3
+	if len(p) < 3*numHashesByteSize {
+		return nil, fmt.Errorf("multiproof too short: %d bytes", len(p))
+	}
+	depth := binary.LittleEndian.Uint32(p)
+	numIndices := uint64(binary.LittleEndian.Uint32(p[4:]))
+	rest := p[8:]
+	if uint64(len(rest)) < numIndices*indexByteSize+numHashesByteSize {
+		return nil, fmt.Errorf("multiproof length %d does not match %d indices", len(p), numIndices)
+	}
+	indices := make([]uint32, numIndices)
+	for i := range indices {
+		indices[i] = binary.LittleEndian.Uint32(rest[i*indexByteSize:])
+	}
+	rest = rest[numIndices*indexByteSize:]
+	numHashes := uint64(binary.LittleEndian.Uint32(rest))
+	rest = rest[numHashesByteSize:]
+	if uint64(len(rest)) != numHashes*hashLength {
+		return nil, fmt.Errorf("multiproof length %d does not match %d hashes", len(p), numHashes)
+	}
+	hashes := make([][]byte, numHashes)
+	for i := range hashes {
+		hashes[i] = rest[uint64(i)*hashLength : uint64(i+1)*hashLength]
+	}
+	return &MultiProof{Depth: depth, Indices: indices, Hashes: hashes}, nil
+}
@@ -0,0 +1,146 @@
+package merkle
+
+import (
+	"testing"
+
+	"tapir/modules/database"
+	"tapir/modules/utils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiProof(t *testing.T) {
+	rng := utils.RandomPRG()
+	data := make([][]byte, 1000)
+	for i := range data {
+		d := make([]byte, 32)
+		rng.Read(d)
+		data[i] = d
+	}
+	tree, err := New(data)
+	require.NoError(t, err)
+
+	for _, indices := range [][]uint32{
+		{7},
+		{0, 1, 2, 3},
+		{999, 3, 500, 3},
+		{100, 101, 102, 103, 104, 105, 106, 107, 108, 109},
+	} {
+		proof, err := tree.GenerateMultiProof(indices)
+		require.NoError(t, err)
+
+		elems := make([][]byte, len(indices))
+		single := make([]*Proof, len(indices))
+		numHashes := 0
+		for i, idx := range indices {
+			elems[i] = data[idx]
+			single[i], err = tree.GenerateProofIndex(idx)
+			require.NoError(t, err)
+			numHashes += len(single[i].Hashes)
+		}
+		if len(indices) > 1 {
+			require.Less(t, len(proof.Hashes), numHashes)
+		}
+
+		ok, err := VerifyMultiProof(elems, proof, indices, tree.Root())
+		require.NoError(t, err)
+		require.True(t, ok, "multiproof for %v did not verify", indices)
+
+		// merging the single proofs gives the same multiproof
+		merged, err := MergeProofs(single)
+		require.NoError(t, err)
+		require.Equal(t, proof, merged)
+
+		b := EncodeMultiProof(proof)
+		dec, err := DecodeMultiProof(b)
+		require.NoError(t, err)
+		require.Equal(t, proof, dec)
+		for _, l := range []int{0, 8, len(b) - 1} {
+			_, err = DecodeMultiProof(b[:l])
+			require.Error(t, err)
+		}
+
+		// wrong data or indices do not verify
+		wrong := append([][]byte(nil), elems...)
+		wrong[0] = data[(indices[0]+1)%uint32(len(data))]
+		ok, err = VerifyMultiProof(wrong, proof, indices, tree.Root())
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		wrongIdx := append([]uint32(nil), indices...)
+		wrongIdx[0] = (wrongIdx[0] + 1) % uint32(len(data))
+		ok, err = VerifyMultiProof(elems, proof, wrongIdx, tree.Root())
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		if len(proof.Hashes) > 0 {
+			short := *proof
+			short.Hashes = proof.Hashes[1:]
+			ok, err = VerifyMultiProof(elems, &short, indices, tree.Root())
+			require.NoError(t, err)
+			require.False(t, ok)
+		}
+	}
+
+	// a whole subtree needs a single hash per level above it
+	indices := make([]uint32, 16)
+	for i := range indices {
+		indices[i] = uint32(32 + i)
+	}
+	proof, err := tree.GenerateMultiProof(indices)
+	require.NoError(t, err)
+	require.Len(t, proof.Hashes, 10-4)
+}
+
+func TestUpdateMultiProof(t *testing.T) {
+	data := randomData(20)
+	tree, err := New(data[:16])
+	require.NoError(t, err)
+	indices := [][]uint32{{0, 1, 2, 3}, {4, 5, 6, 7}, {1, 9, 14}, {5}}
+	proofs := make([]*MultiProof, len(indices))
+	for i, idx := range indices {
+		proofs[i], err = tree.GenerateMultiProof(idx)
+		require.NoError(t, err)
+	}
+
+	for _, idxs := range [][]uint32{{2}, {0, 15}, {8, 9, 10}, {5, 5}} {
+		for _, idx := range idxs {
+			_, err = tree.Update(database.Update{Op: database.EDIT, Idx: int(idx), Val: randomData(1)[0]})
+			require.NoError(t, err)
+		}
+		for i, p := range proofs {
+			changed, err := tree.UpdateMultiProof(p, idxs)
+			require.NoError(t, err)
+			fresh, err := tree.GenerateMultiProof(indices[i])
+			require.NoError(t, err)
+			require.Equal(t, fresh, p)
+			// an update of an opened leaf leaves the proof unchanged
+			if len(idxs) == 1 && idxs[0] == 2 {
+				require.Equal(t, i != 0, changed, "proof %d", i)
+			}
+		}
+	}
+
+	// appending beyond the capacity doubles the depth of the tree
+	_, err = tree.Append(data[16])
+	require.NoError(t, err)
+	for i, p := range proofs {
+		_, err := tree.UpdateMultiProof(p, []uint32{16})
+		require.NoError(t, err)
+		fresh, err := tree.GenerateMultiProof(indices[i])
+		require.NoError(t, err)
+		require.Equal(t, fresh, p)
+	}
+	_, err = tree.UpdateMultiProof(proofs[0], []uint32{64})
+	require.Error(t, err)
+}
+
+func TestMultiProofSingleLeaf(t *testing.T) {
+	tree, err := New([][]byte{[]byte("only")})
+	require.NoError(t, err)
+	proof, err := tree.GenerateMultiProof([]uint32{0})
+	require.NoError(t, err)
+	ok, err := VerifyMultiProof([][]byte{[]byte("only")}, proof, []uint32{0}, tree.Root())
+	require.NoError(t, err)
+	require.True(t, ok)
+}
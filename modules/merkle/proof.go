@@ -15,6 +15,7 @@ package merkle
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 )
 
 const (
@@ -71,12 +72,18 @@ func generateProofHash(data []byte, proof *Proof, hashType HashType) []byte {
 	return proofHash
 }
 
-func DecodeProof(p []byte) *Proof {
+func DecodeProof(p []byte) (*Proof, error) {
+	if len(p) < numHashesByteSize+indexByteSize {
+		return nil, fmt.Errorf("proof too short: %d bytes", len(p))
+	}
 	// number of hashes
 	numHashes := binary.LittleEndian.Uint32(p[:numHashesByteSize])
 
 	// hashes
 	hashLength := uint32(32) // blake3
+	if uint64(len(p)) != uint64(numHashesByteSize)+uint64(numHashes)*uint64(hashLength)+indexByteSize {
+		return nil, fmt.Errorf("proof length %d does not match %d hashes", len(p), numHashes)
+	}
 	hashes := make([][]byte, numHashes)
 	for i := uint32(0); i < numHashes; i++ {
 		hashes[i] = p[4+hashLength*i : 4+hashLength*(i+1)]
@@ -88,7 +95,7 @@ func DecodeProof(p []byte) *Proof {
 	return &Proof{
 		Hashes: hashes,
 		Index:  index,
-	}
+	}, nil
 }
 
 func EncodeProof(p *Proof) []byte {
@@ -30,9 +30,14 @@ func TestEncodeDecodeProof(t *testing.T) {
 	b := EncodeProof(proof)
 
 	// decode proof
-	p := DecodeProof(b)
+	p, err := DecodeProof(b)
+	require.NoError(t, err)
 
 	require.Equal(t, *proof, *p)
+
+	// truncated proofs must be rejected
+	_, err = DecodeProof(b[:len(b)-1])
+	require.Error(t, err)
 }
 
 // Test Proof encoding, decoding and verification of each data item
@@ -63,7 +68,8 @@ func TestProofVerification(t *testing.T) {
 		// encode the proof
 		b := EncodeProof(proof)
 		// decode proof
-		p := DecodeProof(b)
+		p, err := DecodeProof(b)
+		require.NoError(t, err)
 		require.Equal(t, *proof, *p)
 
 		// check if proof verifies
@@ -0,0 +1,222 @@
+//go:build !libote
+
+package osu_crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"log"
+)
+
+// Pure-Go two-party DPF with outputs in GF(2^128), used when the libOTe
+// backend (build tag libote) is not available. Tree-based construction of
+// Boyle, Gilboa, Ishai (CCS'16) with a length-doubling PRG from fixed-key
+// AES in Matyas-Meyer-Oseas mode. The two output shares XOR to the value at
+// the point and to zero everywhere else.
+//
+// Key layout (same size as the libOTe keys):
+//
+//	| seed (16) | seed correction words (16*depth) | t-bit correction words (depth) | output correction word (16) |
+
+// Fixed AES keys of the PRG, for the left child, right child and the leaf
+// conversion, respectively
+var prgLeft, prgRight, prgConvert cipher.Block
+
+func init() {
+	for i, b := range []*cipher.Block{&prgLeft, &prgRight, &prgConvert} {
+		key := make([]byte, 16)
+		key[0] = byte(i + 1)
+		var err error
+		if *b, err = aes.NewCipher(key); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// mmo computes AES_k(s) XOR s into dst
+func mmo(k cipher.Block, dst, s []byte) {
+	k.Encrypt(dst, s)
+	for i := 0; i < BLOCKSIZE; i++ {
+		dst[i] ^= s[i]
+	}
+}
+
+// expandSeed computes the child seed and control bit of s in direction dir.
+// The control bit is the least significant bit of the seed, it is cleared
+// in the returned seed.
+func expandSeed(dst, s []byte, dir int) byte {
+	if dir == left {
+		mmo(prgLeft, dst, s)
+	} else {
+		mmo(prgRight, dst, s)
+	}
+	t := dst[0] & 1
+	dst[0] &^= 1
+	return t
+}
+
+func xorBlock(dst, a []byte) {
+	for i := 0; i < BLOCKSIZE; i++ {
+		dst[i] ^= a[i]
+	}
+}
+
+// KeyGen generates the keys of a DPF that evaluates to values at points[0].
+// The root seeds of the keys are derived from seed, which must be sampled
+// uniformly at random for every pair of keys. Only single point DPFs are
+// supported.
+func KeyGen(domain uint64, points []uint64, values *FieldElem, seed [16]byte) ([]byte, []byte, uint64) {
+	numPoints := uint64(len(points))
+	if numPoints != num_points {
+		log.Println("Only single point DPFs are supported")
+		return nil, nil, 0
+	}
+	if len(values.Data) != 16*int(numPoints) {
+		log.Println("Values length mismatch")
+		return nil, nil, 0
+	}
+	// check that all points are in domain
+	for _, point := range points {
+		if point >= domain {
+			log.Println("Point out of domain")
+			return nil, nil, 0
+		}
+	}
+
+	depth := treeDepth(domain)
+	size := expectedKeySize(depth)
+	key0 := make([]byte, size)
+	key1 := make([]byte, size)
+
+	// root seeds AES_seed(0) and AES_seed(1)
+	prg, err := aes.NewCipher(seed[:])
+	if err != nil {
+		panic(err)
+	}
+	s0 := make([]byte, BLOCKSIZE)
+	s1 := make([]byte, BLOCKSIZE)
+	s1[BLOCKSIZE-1] = 1
+	prg.Encrypt(s0, s0)
+	prg.Encrypt(s1, s1)
+	s0[0] &^= 1
+	s1[0] &^= 1
+	copy(key0, s0)
+	copy(key1, s1)
+	t0, t1 := byte(0), byte(1)
+
+	sCWs := key0[16 : 16+16*depth]
+	tCWs := key0[16+16*depth : 16+17*depth]
+
+	children := [2][2][]byte{
+		{make([]byte, BLOCKSIZE), make([]byte, BLOCKSIZE)},
+		{make([]byte, BLOCKSIZE), make([]byte, BLOCKSIZE)},
+	}
+	var ts [2][2]byte
+
+	for level := uint64(0); level < depth; level++ {
+		// path bit of the point, most significant first
+		keep := int(points[0]>>(depth-1-level)) & 1
+		lose := 1 - keep
+
+		for dir := range 2 {
+			ts[0][dir] = expandSeed(children[0][dir], s0, dir)
+			ts[1][dir] = expandSeed(children[1][dir], s1, dir)
+		}
+
+		// seed correction word: equalizes the seeds off the path
+		sCW := sCWs[16*level : 16*(level+1)]
+		copy(sCW, children[0][lose])
+		xorBlock(sCW, children[1][lose])
+
+		// control bit correction words, bit 0 for left and bit 1 for right
+		tCW := [2]byte{
+			ts[0][left] ^ ts[1][left] ^ byte(keep) ^ 1,
+			ts[0][right] ^ ts[1][right] ^ byte(keep),
+		}
+		tCWs[level] = tCW[left] | tCW[right]<<1
+
+		copy(s0, children[0][keep])
+		copy(s1, children[1][keep])
+		if t0 == 1 {
+			xorBlock(s0, sCW)
+		}
+		if t1 == 1 {
+			xorBlock(s1, sCW)
+		}
+		t0 = ts[0][keep] ^ (t0 & tCW[keep])
+		t1 = ts[1][keep] ^ (t1 & tCW[keep])
+	}
+
+	// output correction word: values XOR convert(s0) XOR convert(s1)
+	outCW := key0[size-16:]
+	conv := make([]byte, BLOCKSIZE)
+	copy(outCW, values.Data)
+	mmo(prgConvert, conv, s0)
+	xorBlock(outCW, conv)
+	mmo(prgConvert, conv, s1)
+	xorBlock(outCW, conv)
+
+	// the correction words are the same in both keys
+	copy(key1[16:], key0[16:])
+
+	return key0, key1, size
+}
+
+// Expand evaluates the key of party partyIdx on the full domain and returns
+// the 16-byte outputs of all points in [0, domain).
+func Expand(partyIdx uint64, domain uint64, numPoints uint64, key []byte, keySize uint64) []byte {
+	if numPoints != num_points {
+		panic("numPoints can only be 1 for now...single point DPFs only")
+	}
+	depth := treeDepth(domain)
+	if keySize != expectedKeySize(depth) || uint64(len(key)) < keySize {
+		panic("DPF key size does not match domain")
+	}
+	sCWs := key[16 : 16+16*depth]
+	tCWs := key[16+16*depth : 16+17*depth]
+	outCW := key[keySize-16 : keySize]
+
+	// seeds and control bits of the current level, only nodes with leaves
+	// inside the domain are expanded
+	seeds := make([]byte, BLOCKSIZE*domain)
+	next := make([]byte, BLOCKSIZE*domain)
+	ts := make([]byte, domain)
+	nextTs := make([]byte, domain)
+	copy(seeds, key[:16])
+	ts[0] = byte(partyIdx & 1)
+
+	for level := uint64(0); level < depth; level++ {
+		width := (domain-1)>>(depth-level) + 1
+		nextWidth := (domain-1)>>(depth-level-1) + 1
+		sCW := sCWs[16*level : 16*(level+1)]
+		tCW := [2]byte{tCWs[level] & 1, tCWs[level] >> 1}
+
+		for j := uint64(0); j < width; j++ {
+			s := seeds[BLOCKSIZE*j : BLOCKSIZE*(j+1)]
+			for dir := range 2 {
+				c := 2*j + uint64(dir)
+				if c >= nextWidth {
+					break
+				}
+				child := next[BLOCKSIZE*c : BLOCKSIZE*(c+1)]
+				nextTs[c] = expandSeed(child, s, dir)
+				if ts[j] == 1 {
+					xorBlock(child, sCW)
+					nextTs[c] ^= tCW[dir]
+				}
+			}
+		}
+		seeds, next = next, seeds
+		ts, nextTs = nextTs, ts
+	}
+
+	keyExp := make([]byte, BLOCKSIZE*domain*numPoints)
+	for j := uint64(0); j < domain; j++ {
+		out := keyExp[BLOCKSIZE*j : BLOCKSIZE*(j+1)]
+		mmo(prgConvert, out, seeds[BLOCKSIZE*j:BLOCKSIZE*(j+1)])
+		if ts[j] == 1 {
+			xorBlock(out, outCW)
+		}
+	}
+	return keyExp
+}
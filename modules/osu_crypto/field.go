@@ -0,0 +1,73 @@
+package osu_crypto
+
+import (
+	"crypto/rand"
+	"math/bits"
+)
+
+// Constants and field element helpers shared by the libOTe backend
+// (osu_dpf.go, build tag libote) and the pure-Go backend (dpf128.go).
+
+const test_domain = uint64(150)
+const num_points = uint64(1)
+const BLOCKSIZE = 16
+const left = 0
+const right = 1
+
+func treeDepth(domain uint64) uint64 {
+	if domain <= 1 {
+		return 0
+	}
+	return uint64(bits.Len64(domain - 1))
+}
+
+func expectedKeySize(depth uint64) uint64 {
+	return 16 + 16*(num_points*depth+num_points) + num_points*depth
+}
+
+// KeySize returns the size of the keys generated by KeyGen for a single
+// point DPF on domain, which Expand expects
+func KeySize(domain uint64) uint64 {
+	return expectedKeySize(treeDepth(domain))
+}
+
+// define field element type
+type FieldElem struct {
+	// 16 bytes (128 bits)
+	Data []byte
+}
+
+// define constructor
+func NewFieldElem() *FieldElem {
+	return &FieldElem{
+		Data: make([]byte, 16),
+	}
+}
+
+// Samples a uniformly random field element using crypto/rand
+func NewRandomElem() *FieldElem {
+	elem := NewFieldElem()
+	if _, err := rand.Read(elem.Data); err != nil {
+		panic(err)
+	}
+	return elem
+}
+
+func FieldElemOne() *FieldElem {
+	elem := NewFieldElem()
+	elem.Data[0] = 1
+	return elem
+}
+
+func XorDPF(a []byte, b []byte, out []byte, numBytes int) {
+
+	// XOR the two byte slices
+	for i := 0; i < numBytes; i++ {
+		out[i] = a[i] ^ b[i]
+	}
+
+}
+
+func FieldAdd(x *FieldElem, y *FieldElem, out *FieldElem) {
+	XorDPF(x.Data, y.Data, out.Data, BLOCKSIZE)
+}
@@ -0,0 +1,101 @@
+//go:build !libote
+
+package osu_crypto
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Pure-Go arithmetic in GF(2^128) = GF(2)[x]/(x^128 + x^7 + x^2 + x + 1),
+// the field used by osuCrypto::block::gf128Mul. A 16-byte block is read as
+// a little-endian 128-bit integer whose bit i is the coefficient of x^i,
+// hence FieldElemOne (Data[0] = 1) is the multiplicative identity.
+
+// unreduced product of two field elements
+type gf256 [4]uint64
+
+// bmul64 returns the lower 64 bits of the carry-less product of x and y.
+// Constant-time integer multiplication with holes, see BearSSL's ghash_ctmul64.
+func bmul64(x, y uint64) uint64 {
+	const m0, m1, m2, m3 = 0x1111111111111111, 0x2222222222222222, 0x4444444444444444, 0x8888888888888888
+	x0, x1, x2, x3 := x&m0, x&m1, x&m2, x&m3
+	y0, y1, y2, y3 := y&m0, y&m1, y&m2, y&m3
+	z0 := (x0 * y0) ^ (x1 * y3) ^ (x2 * y2) ^ (x3 * y1)
+	z1 := (x0 * y1) ^ (x1 * y0) ^ (x2 * y3) ^ (x3 * y2)
+	z2 := (x0 * y2) ^ (x1 * y1) ^ (x2 * y0) ^ (x3 * y3)
+	z3 := (x0 * y3) ^ (x1 * y2) ^ (x2 * y1) ^ (x3 * y0)
+	return (z0 & m0) | (z1 & m1) | (z2 & m2) | (z3 & m3)
+}
+
+// clmul returns the 128-bit carry-less product of x and y as (hi, lo)
+func clmul(x, y uint64) (uint64, uint64) {
+	lo := bmul64(x, y)
+	hi := bits.Reverse64(bmul64(bits.Reverse64(x), bits.Reverse64(y))) >> 1
+	return hi, lo
+}
+
+// mulAcc XORs the unreduced product of a and b into acc (Karatsuba)
+func (acc *gf256) mulAcc(a, b []byte) {
+	a0, a1 := binary.LittleEndian.Uint64(a[:8]), binary.LittleEndian.Uint64(a[8:16])
+	b0, b1 := binary.LittleEndian.Uint64(b[:8]), binary.LittleEndian.Uint64(b[8:16])
+
+	lh, ll := clmul(a0, b0)
+	hh, hl := clmul(a1, b1)
+	mh, ml := clmul(a0^a1, b0^b1)
+	mh ^= lh ^ hh
+	ml ^= ll ^ hl
+
+	acc[0] ^= ll
+	acc[1] ^= lh ^ ml
+	acc[2] ^= hl ^ mh
+	acc[3] ^= hh
+}
+
+// reduce writes acc modulo x^128 + x^7 + x^2 + x + 1 to out
+func (acc *gf256) reduce(out []byte) {
+	r0, r1, r2, r3 := acc[0], acc[1], acc[2], acc[3]
+
+	// x^128 = x^7 + x^2 + x + 1, fold the upper 128 bits in two steps
+	r2 ^= (r3 >> 63) ^ (r3 >> 62) ^ (r3 >> 57)
+	r1 ^= r3 ^ (r3 << 1) ^ (r3 << 2) ^ (r3 << 7)
+	r1 ^= (r2 >> 63) ^ (r2 >> 62) ^ (r2 >> 57)
+	r0 ^= r2 ^ (r2 << 1) ^ (r2 << 2) ^ (r2 << 7)
+
+	binary.LittleEndian.PutUint64(out[:8], r0)
+	binary.LittleEndian.PutUint64(out[8:16], r1)
+}
+
+func FieldMul(x *FieldElem, y *FieldElem) *FieldElem {
+	out := NewFieldElem()
+	var acc gf256
+	acc.mulAcc(x.Data, y.Data)
+	acc.reduce(out.Data)
+	return out
+}
+
+// Multiplies expanded key against the database, each chunk of 128 bits
+// at a time, and sums up the products. Since reduction is linear the
+// products are accumulated unreduced and reduced once at the end.
+// length input is how many elements in the database, not how many bytes.
+func MultiplyDB(keyExp []byte, DB []byte, length int) *FieldElem {
+	out := NewFieldElem()
+	var acc gf256
+	for i := 0; i < length; i++ {
+		acc.mulAcc(keyExp[BLOCKSIZE*i:BLOCKSIZE*(i+1)], DB[BLOCKSIZE*i:BLOCKSIZE*(i+1)])
+	}
+	acc.reduce(out.Data)
+	return out
+}
+
+// MultiplyDBIndices is MultiplyDB over the records of DB at indices, the
+// p-th element of keyExp multiplies record indices[p].
+func MultiplyDBIndices(keyExp []byte, DB []byte, indices []uint32) *FieldElem {
+	out := NewFieldElem()
+	var acc gf256
+	for p, i := range indices {
+		acc.mulAcc(keyExp[BLOCKSIZE*p:BLOCKSIZE*(p+1)], DB[BLOCKSIZE*int(i):BLOCKSIZE*(int(i)+1)])
+	}
+	acc.reduce(out.Data)
+	return out
+}
@@ -0,0 +1,90 @@
+//go:build !libote
+
+package osu_crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// reference multiplication in GF(2^128), bit by bit
+func slowMul(x, y *FieldElem) *FieldElem {
+	a0, a1 := binary.LittleEndian.Uint64(x.Data[:8]), binary.LittleEndian.Uint64(x.Data[8:])
+	b0, b1 := binary.LittleEndian.Uint64(y.Data[:8]), binary.LittleEndian.Uint64(y.Data[8:])
+	var r0, r1 uint64
+	for i := 0; i < 128; i++ {
+		// add a if bit i of b is set
+		var bit uint64
+		if i < 64 {
+			bit = b0 >> i & 1
+		} else {
+			bit = b1 >> (i - 64) & 1
+		}
+		if bit == 1 {
+			r0 ^= a0
+			r1 ^= a1
+		}
+		// a = a * x mod x^128 + x^7 + x^2 + x + 1
+		carry := a1 >> 63
+		a1 = a1<<1 | a0>>63
+		a0 <<= 1
+		if carry == 1 {
+			a0 ^= 0x87
+		}
+	}
+	out := NewFieldElem()
+	binary.LittleEndian.PutUint64(out.Data[:8], r0)
+	binary.LittleEndian.PutUint64(out.Data[8:], r1)
+	return out
+}
+
+func TestFieldMul(t *testing.T) {
+	one := FieldElemOne()
+	for i := 0; i < 1000; i++ {
+		x, y := NewRandomElem(), NewRandomElem()
+		if !bytes.Equal(FieldMul(x, one).Data, x.Data) {
+			t.Fatal("x * 1 != x")
+		}
+		if !bytes.Equal(FieldMul(x, y).Data, slowMul(x, y).Data) {
+			t.Fatalf("FieldMul(%x, %x) does not match reference", x.Data, y.Data)
+		}
+	}
+}
+
+func TestMultiplyDB(t *testing.T) {
+	n := 100
+	keyExp := make([]byte, BLOCKSIZE*n)
+	db := make([]byte, BLOCKSIZE*n)
+	expected := NewFieldElem()
+	for i := 0; i < n; i++ {
+		x, y := NewRandomElem(), NewRandomElem()
+		copy(keyExp[BLOCKSIZE*i:], x.Data)
+		copy(db[BLOCKSIZE*i:], y.Data)
+		FieldAdd(expected, slowMul(x, y), expected)
+	}
+	if !bytes.Equal(MultiplyDB(keyExp, db, n).Data, expected.Data) {
+		t.Fatal("MultiplyDB does not match sum of products")
+	}
+}
+
+func TestMultiplyDBIndices(t *testing.T) {
+	n := 100
+	indices := []uint32{3, 17, 18, 42, 99}
+	keyExp := make([]byte, BLOCKSIZE*len(indices))
+	db := make([]byte, BLOCKSIZE*n)
+	for i := 0; i < n; i++ {
+		copy(db[BLOCKSIZE*i:], NewRandomElem().Data)
+	}
+	expected := NewFieldElem()
+	for p, i := range indices {
+		x := NewRandomElem()
+		copy(keyExp[BLOCKSIZE*p:], x.Data)
+		y := NewFieldElem()
+		copy(y.Data, db[BLOCKSIZE*int(i):])
+		FieldAdd(expected, slowMul(x, y), expected)
+	}
+	if !bytes.Equal(MultiplyDBIndices(keyExp, db, indices).Data, expected.Data) {
+		t.Fatal("MultiplyDBIndices does not match sum of products")
+	}
+}
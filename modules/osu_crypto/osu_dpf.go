@@ -1,3 +1,5 @@
+//go:build libote
+
 package osu_crypto
 
 /*
@@ -12,21 +14,8 @@ import "C"
 import (
 	"log"
 	"math"
-	"math/rand"
 )
 
-const test_domain = uint64(150)
-const num_points = uint64(1)
-const BLOCKSIZE = 16
-const left = 0
-const right = 1
-
-// define field element type
-type FieldElem struct {
-	// 16 bytes (128 bits)
-	Data []byte
-}
-
 func simple() {
 	a := int(C.simple_function())
 	log.Println("a:", a)
@@ -37,30 +26,10 @@ func exampleSpan() {
 	log.Println("span last number is:", span)
 }
 
-// define constructor
-func NewFieldElem() *FieldElem {
-	return &FieldElem{
-		Data: make([]byte, 16),
-	}
-}
-
-// TODO make faster and better
-func NewRandomElem() *FieldElem {
-	elem := NewFieldElem()
-	for i := 0; i < len(elem.Data); i++ {
-		elem.Data[i] = byte(rand.Intn(256))
-	}
-	return elem
-}
-
-func FieldElemOne() *FieldElem {
-	elem := NewFieldElem()
-	elem.Data[0] = 1
-	return elem
-}
-
-// TODO make the seed full 16 bytes
-func KeyGen(domain uint64, points []uint64, values *FieldElem, seed uint64) ([]byte, []byte, uint64) {
+// KeyGen generates the keys of a DPF that evaluates to values at points.
+// seed seeds the PRNG of libOTe and must be sampled uniformly at random for
+// every pair of keys.
+func KeyGen(domain uint64, points []uint64, values *FieldElem, seed [16]byte) ([]byte, []byte, uint64) {
 
 	// log.Println("Generating keys...")
 
@@ -98,7 +67,7 @@ func KeyGen(domain uint64, points []uint64, values *FieldElem, seed uint64) ([]b
 		(*C.uint64_t)(&points[0]),
 		(*C.uint8_t)(&values.Data[0]),
 		(C.uint64_t)(numPoints),
-		(C.uint64_t)(seed), // TODO BUG HERE, unused now
+		(*C.uint8_t)(&seed[0]),
 		(*C.uint64_t)(&reportedKeySize[0]),
 		(*C.uint8_t)(&key0[0]),
 		(*C.uint8_t)(&key1[0]),
@@ -169,6 +138,20 @@ func MultiplyDB(keyExp []byte, DB []byte, length int) *FieldElem {
 	return out
 }
 
+// MultiplyDBIndices is MultiplyDB over the records of DB at indices, the
+// p-th element of keyExp multiplies record indices[p]. The records are
+// gathered into a buffer of their own for libOTe.
+func MultiplyDBIndices(keyExp []byte, DB []byte, indices []uint32) *FieldElem {
+	if len(indices) == 0 {
+		return NewFieldElem()
+	}
+	recs := make([]byte, BLOCKSIZE*len(indices))
+	for p, i := range indices {
+		copy(recs[BLOCKSIZE*p:], DB[BLOCKSIZE*int(i):BLOCKSIZE*(int(i)+1)])
+	}
+	return MultiplyDB(keyExp, recs, len(indices))
+}
+
 func FieldMul(x *FieldElem, y *FieldElem) *FieldElem {
 
 	// log.Println("Multiplying keyExp with DB...")
@@ -184,16 +167,3 @@ func FieldMul(x *FieldElem, y *FieldElem) *FieldElem {
 
 	return out
 }
-
-func XorDPF(a []byte, b []byte, out []byte, numBytes int) {
-
-	// XOR the two byte slices
-	for i := 0; i < numBytes; i++ {
-		out[i] = a[i] ^ b[i]
-	}
-
-}
-
-func FieldAdd(x *FieldElem, y *FieldElem, out *FieldElem) {
-	XorDPF(x.Data, y.Data, out.Data, BLOCKSIZE)
-}
@@ -1,3 +1,5 @@
+//go:build libote
+
 #include <stdlib.h>
 #include <stdint.h>
 #include <stdio.h>
@@ -39,7 +41,7 @@ extern "C"
         u64* points, 
         u8* values,
         u64 numPoints,
-        u64 prngSeed, // type PRNG& in C++ verison
+        u8* prngSeed, // 16 bytes
         u64* keySize,
         u8* keyOut0,
         u8* keyOut1)
@@ -50,11 +52,10 @@ extern "C"
         // VALUES CAST -- Cast the u8* values to std::span<osuCrypto::block>
         std::span<osuCrypto::block> valuesSpan = make_span_from_data(reinterpret_cast<osuCrypto::block*>(values), numPoints);
 
-        // TODO do more like this, use the seed given
-        // osuCrypto::PRNG prng;
-        // prng.SetSeed(prngSeed);
-        // Make a PRNG and set its seed
-        osuCrypto::PRNG prng(osuCrypto::block(prngSeed, 0)); 
+        // Make a PRNG seeded with the 16 bytes of prngSeed
+        osuCrypto::block seed;
+        std::memcpy(&seed, prngSeed, sizeof(seed));
+        osuCrypto::PRNG prng(seed);
         
         // OUTPUT KEYS -- Create temporary C++ keys
         std::array<osuCrypto::RegularDpfKey, 2> cppKeys;
@@ -28,7 +28,7 @@ int example_span();
  * points: The plaintext list of locations to encode.
  * values: The plaintext list of values to encode at the specified locations.
  * numPoints: The number of non-zero points / number of DPF keys (should be 1)
- * prngSeed: Seed for the source of randomness
+ * prngSeed: 16-byte seed of the source of randomness
  * keySize: Output parameter: Memory to store the size of one DPF key
  * keysOut: Output parameter: The two generated DPF keys. (length = keySize * 2)
  */
@@ -37,7 +37,7 @@ void keyGen(
     u64* points, 
     u8* values,
     u64 numPoints,
-    u64 prngSeed, // type PRNG& in C++ verison
+    u8* prngSeed, // 16 bytes
     u64* keySize,
     u8* keyOut0,
     u8* keyOut1);
@@ -1,3 +1,5 @@
+//go:build libote
+
 #include "regular_dpf.h"
 #include <stdio.h>
 #include <stdlib.h>
@@ -0,0 +1,320 @@
+package pp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"tapir/modules/utils"
+)
+
+////////////////////////////////////////////////////////////
+// POWERS-OF-TAU CEREMONY
+////////////////////////////////////////////////////////////
+
+// The trapdoor α of the public parameters is the product of the secrets
+// s_1, ..., s_k of all participants of the ceremony. Starting from the
+// parameters for α = 1, each participant raises the i-th power of the
+// current α in G1s, G2s and Gt to s^i, wipes s, and publishes a proof that
+// the update is correct. Forging openings requires α, i.e., the secrets of
+// all participants, so a single honest participant suffices.
+
+var ErrCeremony = errors.New("invalid ceremony")
+
+// ContributionProof shows that a contribution multiplied α by the secret s
+// of the participant, and that the participant knows s
+type ContributionProof struct {
+	S1 *G1 // g1^s
+	S2 *G2 // g2^s
+	R  *G1 // H^s, with H hashed from the previous parameters and S1
+}
+
+type Contribution struct {
+	Params *PP // parameters after the contribution
+	Proof  *ContributionProof
+}
+
+// Ceremony is the public transcript of all contributions
+type Ceremony struct {
+	N             int
+	Contributions []*Contribution
+}
+
+func NewCeremony(N int) *Ceremony {
+	return &Ceremony{N: N}
+}
+
+// InitialParams returns the parameters for α = 1, the start of the ceremony
+func InitialParams(N int) *PP {
+	pp := &PP{N: N, G1s: make(G1v, 2*N), G2s: make(G2v, N), Gt: c.GenGt.Exp(c.NewZrFromInt(1))}
+	for i := range pp.G1s {
+		pp.G1s[i] = c.GenG1.Copy()
+	}
+	for i := range pp.G2s {
+		pp.G2s[i] = c.GenG2.Copy()
+	}
+	pp.SetupDigest()
+	return pp
+}
+
+// Current returns the parameters after the last contribution
+func (cer *Ceremony) Current() *PP {
+	if len(cer.Contributions) == 0 {
+		return InitialParams(cer.N)
+	}
+	return cer.Contributions[len(cer.Contributions)-1].Params
+}
+
+// Contribute adds a contribution with a fresh secret to the ceremony
+func (cer *Ceremony) Contribute() {
+	params, proof := Contribute(cer.Current())
+	cer.Contributions = append(cer.Contributions, &Contribution{Params: params, Proof: proof})
+}
+
+// Contribute rerandomizes prev by a fresh secret s sampled using crypto/rand,
+// s is wiped before returning
+func Contribute(prev *PP) (*PP, *ContributionProof) {
+	r, err := c.Rand()
+	if err != nil {
+		panic("failed obtaining randomness source")
+	}
+	s := c.NewRandomZr(r)
+	defer wipe(s)
+
+	proof := &ContributionProof{S1: c.GenG1.Mul(s), S2: c.GenG2.Mul(s)}
+	proof.R = updateHash(prev, proof.S1).Mul(s)
+	return rerandomize(prev, s), proof
+}
+
+// rerandomize multiplies the trapdoor of prev by s
+func rerandomize(prev *PP, s *Zr) *PP {
+	N := prev.N
+	next := &PP{N: N, G1s: make(G1v, 2*N), G2s: make(G2v, N)}
+
+	// powers of s are computed incrementally, each intermediate power is
+	// wiped as soon as the next one is known
+	pow := s.Copy()
+	for i := 1; i <= 2*N; i++ {
+		switch {
+		case i <= N:
+			next.G1s[i-1] = prev.G1s[i-1].Mul(pow)
+			next.G2s[i-1] = prev.G2s[i-1].Mul(pow)
+		case i == N+1:
+			next.Gt = prev.Gt.Exp(pow)
+			// Artificially put the generator instead of g^{a^{N+1}}
+			next.G1s[i-1] = c.GenG1.Copy()
+		default:
+			next.G1s[i-1] = prev.G1s[i-1].Mul(pow)
+		}
+		p := pow.Mul(s)
+		wipe(pow)
+		pow = p
+	}
+	wipe(pow)
+
+	next.SetupDigest()
+	return next
+}
+
+// updateHash binds the proof of knowledge to the previous parameters
+func updateHash(prev *PP, S1 *G1) *G1 {
+	return HashToG1(append(append([]byte("TAPIR ceremony"), prev.Digest...), S1.Bytes()...))
+}
+
+// pairingsEqual checks e(a, b) = e(x, y)
+func pairingsEqual(a *G1, b *G2, x *G1, y *G2) bool {
+	return e(a, b).Equals(e(x, y))
+}
+
+// VerifyUpdate checks that next is well-formed and results from multiplying
+// the trapdoor of prev by the secret s of proof
+func VerifyUpdate(prev, next *PP, proof *ContributionProof) error {
+	if prev.N != next.N {
+		return fmt.Errorf("%w: parameters for N=%d follow N=%d", ErrCeremony, next.N, prev.N)
+	}
+	if proof == nil || proof.S1 == nil || proof.S2 == nil || proof.R == nil {
+		return fmt.Errorf("%w: incomplete update proof", ErrCeremony)
+	}
+	if proof.S1.IsInfinity() {
+		return fmt.Errorf("%w: secret is zero", ErrCeremony)
+	}
+	g1, g2 := c.GenG1, c.GenG2
+	// S1 and S2 have the same exponent s
+	if !pairingsEqual(proof.S1, g2, g1, proof.S2) {
+		return fmt.Errorf("%w: inconsistent update proof", ErrCeremony)
+	}
+	// the participant knows s
+	if !pairingsEqual(proof.R, g2, updateHash(prev, proof.S1), proof.S2) {
+		return fmt.Errorf("%w: invalid proof of knowledge", ErrCeremony)
+	}
+	if err := VerifyParams(next); err != nil {
+		return err
+	}
+	// the trapdoor was multiplied by s
+	if !pairingsEqual(next.G1s[0], g2, prev.G1s[0], proof.S2) {
+		return fmt.Errorf("%w: parameters not updated by the proven secret", ErrCeremony)
+	}
+	return nil
+}
+
+// VerifyParams checks that pp consists of consecutive powers of a single
+// trapdoor α and that its digest is correct. The pairing equations are
+// batched using random linear combinations.
+func VerifyParams(pp *PP) error {
+	N := pp.N
+	if N < 1 || len(pp.G1s) != 2*N || len(pp.G2s) != N || pp.Gt == nil {
+		return fmt.Errorf("%w: incomplete parameters for N=%d", ErrCeremony, N)
+	}
+	recomputed := &PP{N: N, G1s: pp.G1s, G2s: pp.G2s, Gt: pp.Gt}
+	recomputed.SetupDigest()
+	if !bytes.Equal(recomputed.Digest, pp.Digest) {
+		return fmt.Errorf("%w: %w", ErrCeremony, ErrParamsDigest)
+	}
+	if pp.G1s[0].IsInfinity() {
+		return fmt.Errorf("%w: trapdoor is zero", ErrCeremony)
+	}
+	if !pp.G1s[N].Equals(c.GenG1) {
+		return fmt.Errorf("%w: missing generator in place of g^{α^{N+1}}", ErrCeremony)
+	}
+	g1, g2 := c.GenG1, c.GenG2
+
+	// G1s[i] and G2s[i] have the same exponent α^{i+1}, this also defines
+	// α through G2s[0]
+	r := RandVec(N)
+	if !pairingsEqual(pp.G1s[:N].MulV(r).Sum(), g2, g1, pp.G2s.Mulv(r).Sum()) {
+		return fmt.Errorf("%w: G1 and G2 powers differ", ErrCeremony)
+	}
+
+	// each G1 power is the previous one to the α, except around the
+	// generator at index N where α^{N+2} follows α^N (checked below)
+	var hi, lo G1v
+	for i := 1; i < 2*N; i++ {
+		if i == N || i == N+1 {
+			continue
+		}
+		hi = append(hi, pp.G1s[i])
+		lo = append(lo, pp.G1s[i-1])
+	}
+	if len(hi) > 0 {
+		r = RandVec(len(hi))
+		if !pairingsEqual(hi.MulV(r).Sum(), g2, lo.MulV(r).Sum(), pp.G2s[0]) {
+			return fmt.Errorf("%w: G1 elements are not consecutive powers", ErrCeremony)
+		}
+	}
+	if N > 1 && !pairingsEqual(pp.G1s[N+1], g2, pp.G1s[N-1], pp.G2s[1]) {
+		return fmt.Errorf("%w: G1 elements are not consecutive powers", ErrCeremony)
+	}
+
+	// Gt is the target group element to the α^{N+1}
+	if !pp.Gt.Equals(e(pp.G1s[N-1], pp.G2s[0])) {
+		return fmt.Errorf("%w: Gt is not the (N+1)-th power", ErrCeremony)
+	}
+	return nil
+}
+
+// VerifyCeremony checks the whole transcript, starting from the parameters
+// for α = 1, and returns the final parameters
+func VerifyCeremony(cer *Ceremony) (*PP, error) {
+	if len(cer.Contributions) == 0 {
+		return nil, fmt.Errorf("%w: no contributions", ErrCeremony)
+	}
+	prev := InitialParams(cer.N)
+	for i, contrib := range cer.Contributions {
+		if contrib == nil || contrib.Params == nil {
+			return nil, fmt.Errorf("%w: contribution %d is empty", ErrCeremony, i)
+		}
+		if err := VerifyUpdate(prev, contrib.Params, contrib.Proof); err != nil {
+			return nil, fmt.Errorf("contribution %d: %w", i, err)
+		}
+		prev = contrib.Params
+	}
+	return prev, nil
+}
+
+////////////////////////////////////////////////////////////
+// TRANSCRIPT FILES
+////////////////////////////////////////////////////////////
+
+// Encoding of a ceremony transcript:
+// magic (8 bytes) | version (1 byte) | N (uint32) | #contributions (uint32) |
+// per contribution: parameters (length-prefixed, see EncodeParams) | S1 | S2 | R
+
+var ceremonyMagic = []byte("TAPIRCER")
+
+const ceremonyVersion = 1
+
+func EncodeCeremony(cer *Ceremony) ([]byte, error) {
+	w := &utils.BinWriter{}
+	w.Raw(ceremonyMagic)
+	w.Byte(ceremonyVersion)
+	w.Uint32(uint32(cer.N))
+	w.Uint32(uint32(len(cer.Contributions)))
+	for _, contrib := range cer.Contributions {
+		b, err := EncodeParams(contrib.Params)
+		if err != nil {
+			return nil, err
+		}
+		w.Bytes(b)
+		w.Raw(contrib.Proof.S1.Bytes())
+		w.Raw(contrib.Proof.S2.Bytes())
+		w.Raw(contrib.Proof.R.Bytes())
+	}
+	return w.Buf, nil
+}
+
+// DecodeCeremony only checks the encoding, use VerifyCeremony to check the
+// contributions
+func DecodeCeremony(data []byte) (*Ceremony, error) {
+	r := utils.NewBinReader(data)
+	if !bytes.Equal(r.Raw(len(ceremonyMagic)), ceremonyMagic) {
+		r.Fail(fmt.Errorf("%w: not a ceremony transcript", utils.ErrMalformed))
+	}
+	if v := r.Byte(); r.Err() == nil && v != ceremonyVersion {
+		r.Fail(fmt.Errorf("%w: unsupported ceremony version %d", utils.ErrMalformed, v))
+	}
+	cer := &Ceremony{N: int(r.Uint32())}
+	num := r.Len(2*G1Size() + G2Size())
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	for i := 0; i < num; i++ {
+		params, err := DecodeParams(r.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("contribution %d: %w", i, err)
+		}
+		S1, err1 := G1FromBytes(r.Raw(G1Size()))
+		S2, err2 := c.NewG2FromBytes(r.Raw(G2Size()))
+		R, err3 := G1FromBytes(r.Raw(G1Size()))
+		if err := errors.Join(r.Err(), err1, err2, err3); err != nil {
+			return nil, fmt.Errorf("%w: contribution %d: %v", utils.ErrMalformed, i, err)
+		}
+		cer.Contributions = append(cer.Contributions, &Contribution{Params: params, Proof: &ContributionProof{S1: S1, S2: S2, R: R}})
+	}
+	if err := r.Finish(); err != nil {
+		return nil, err
+	}
+	return cer, nil
+}
+
+// Save writes the transcript to the file at path
+func (cer *Ceremony) Save(path string) error {
+	b, err := EncodeCeremony(cer)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+// LoadCeremony reads a transcript written by Save
+func LoadCeremony(path string) (*Ceremony, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cer, err := DecodeCeremony(b)
+	if err != nil {
+		return nil, fmt.Errorf("loading ceremony from %s: %w", path, err)
+	}
+	return cer, nil
+}
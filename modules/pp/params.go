@@ -0,0 +1,121 @@
+package pp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"tapir/modules/utils"
+)
+
+////////////////////////////////////////////////////////////
+// PUBLIC PARAMETER FILES
+////////////////////////////////////////////////////////////
+
+// Encoding of the public parameters:
+// magic (8 bytes) | version (1 byte) | N (uint32) |
+// 2N G1 elements | N G2 elements | Gt (length-prefixed) | digest (length-prefixed)
+//
+// The digest is recomputed when decoding and must match the stored one.
+
+var paramsMagic = []byte("TAPIRPP\x00")
+
+const paramsVersion = 1
+
+var ErrParamsDigest = errors.New("public parameter digest mismatch")
+
+func G2Size() int {
+	return len(c.GenG2.Bytes())
+}
+
+func EncodeParams(pp *PP) ([]byte, error) {
+	if len(pp.G1s) != 2*pp.N || len(pp.G2s) != pp.N || pp.Gt == nil {
+		return nil, fmt.Errorf("incomplete public parameters for N=%d", pp.N)
+	}
+	w := &utils.BinWriter{}
+	w.Raw(paramsMagic)
+	w.Byte(paramsVersion)
+	w.Uint32(uint32(pp.N))
+	for _, g := range pp.G1s {
+		w.Raw(g.Bytes())
+	}
+	for _, g := range pp.G2s {
+		w.Raw(g.Bytes())
+	}
+	w.Bytes(pp.Gt.Bytes())
+	w.Bytes(pp.Digest)
+	return w.Buf, nil
+}
+
+func DecodeParams(data []byte) (*PP, error) {
+	r := utils.NewBinReader(data)
+	if !bytes.Equal(r.Raw(len(paramsMagic)), paramsMagic) {
+		r.Fail(fmt.Errorf("%w: not a public parameter file", utils.ErrMalformed))
+	}
+	if v := r.Byte(); r.Err() == nil && v != paramsVersion {
+		r.Fail(fmt.Errorf("%w: unsupported public parameter version %d", utils.ErrMalformed, v))
+	}
+	n := int(r.Uint32())
+	if r.Err() == nil && uint64(n)*uint64(2*G1Size()+G2Size()) > uint64(r.Remaining()) {
+		r.Fail(fmt.Errorf("%w: public parameters for N=%d truncated", utils.ErrMalformed, n))
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	g1s := make(G1v, 2*n)
+	for i := range g1s {
+		g, err := G1FromBytes(r.Raw(G1Size()))
+		if err != nil {
+			return nil, fmt.Errorf("%w: G1 element %d: %v", utils.ErrMalformed, i, err)
+		}
+		g1s[i] = g
+	}
+	g2s := make(G2v, n)
+	for i := range g2s {
+		g, err := c.NewG2FromBytes(r.Raw(G2Size()))
+		if err != nil {
+			return nil, fmt.Errorf("%w: G2 element %d: %v", utils.ErrMalformed, i, err)
+		}
+		g2s[i] = g
+	}
+	gtBytes := r.Bytes()
+	digest := r.Bytes()
+	if err := r.Finish(); err != nil {
+		return nil, err
+	}
+	gt, err := c.NewGtFromBytes(gtBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: Gt element: %v", utils.ErrMalformed, err)
+	}
+
+	pp := &PP{N: n, G1s: g1s, G2s: g2s, Gt: gt}
+	pp.SetupDigest()
+	if !bytes.Equal(pp.Digest, digest) {
+		return nil, ErrParamsDigest
+	}
+	return pp, nil
+}
+
+// Save writes the public parameters to the file at path
+func (pp *PP) Save(path string) error {
+	b, err := EncodeParams(pp)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+// Load reads public parameters written by Save and checks their digest
+func Load(path string) (*PP, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pp, err := DecodeParams(b)
+	if err != nil {
+		return nil, fmt.Errorf("loading public parameters from %s: %w", path, err)
+	}
+	return pp, nil
+}
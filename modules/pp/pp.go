@@ -1,9 +1,11 @@
 package pp
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"fmt"
+	"math/big"
 	"tapir/modules/database"
 )
 
@@ -17,52 +19,36 @@ type PP struct {
 	Gt     *Gt
 }
 
+// NewPublicParams runs a trusted setup for vectors of length N. The trapdoor
+// α is sampled using crypto/rand and wiped once the parameters are computed,
+// all parties must use the same parameters (see Save and Load). To not trust
+// a single party with α, run a ceremony instead (see ceremony.go).
 func NewPublicParams(N int) *PP {
 
-	// Servers need to use the same randomness
-	// TODO use a seed to generate the randomness
-	// α := c.NewRandomZr(rand.Reader)
-	α := c.NewZrFromBytes([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	α := c.NewRandomZr(rand.Reader)
+	defer wipe(α)
 
-	pp := &PP{N: N}
+	gob.Register(c.GenG1.Copy())
 
-	g1 := c.GenG1.Copy()
-	g2 := c.GenG2.Copy()
-	gob.Register(G1(*g1))
+	pp := rerandomize(InitialParams(N), α)
 
-	g1α := func(i int) *G1 {
-		return g1.Mul(α.PowMod(c.NewZrFromInt(int64(i))))
-	}
-
-	g2α := func(i int) *G2 {
-		return g2.Mul(α.PowMod(c.NewZrFromInt(int64(i))))
-	}
-
-	for i := 1; i <= N; i++ {
-		pp.G1s = append(pp.G1s, g1α(i))
-	}
-
-	// Artificially put the generator instead of g^{a^{N+1}}
-	pp.G1s = append(pp.G1s, c.GenG1.Copy())
-
-	for i := N + 2; i <= 2*N; i++ {
-		pp.G1s = append(pp.G1s, g1α(i))
-	}
 	gob.Register(G1v(pp.G1s))
-
-	for i := 1; i <= N; i++ {
-		pp.G2s = append(pp.G2s, g2α(i))
-	}
 	gob.Register(G2v(pp.G2s))
-
-	pp.Gt = c.GenGt.Exp(α.PowMod(c.NewZrFromInt(int64(N + 1))))
 	gob.Register(Gt(*pp.Gt))
 
-	pp.SetupDigest()
-
 	return pp
 }
 
+// wipe overwrites the value of z. This is best effort, the big integer
+// arithmetic of the curve library may leave copies in temporaries.
+func wipe(z *Zr) {
+	if b, ok := z.Zr.(interface{ Bits() []big.Word }); ok {
+		w := b.Bits()
+		clear(w[:cap(w)])
+	}
+	z.Clone(ZeroZr())
+}
+
 func (pp *PP) Size() int {
 	return len(pp.G1s.Bytes()) + len(pp.G2s.Bytes()) + len(pp.Gt.Bytes())
 }
@@ -135,6 +121,18 @@ func Update(pp *PP, C *G1, m Vec, mi *Zr, i int) {
 
 }
 
+// UpdateProof updates the proof π of index j after the element at index i
+// changed from prev to mi. Proofs are sums over the elements at all other
+// indices, so π changes by (mi-prev)·g1^{α^{N+1-j+i}}, and the proof of
+// index i itself stays the same.
+func UpdateProof(pp *PP, π *G1, j int, prev, mi *Zr, i int) {
+	if j == i {
+		return
+	}
+	δ := c.ModSub(mi, prev, GroupOrder)
+	π.Add(pp.G1s[pp.N-j+i].Mul(δ))
+}
+
 func Aggregate(pp *PP, commitments G1v, proofs []*G1, RO func(*PP, []*G1, int) *Zr) *G1 {
 	if len(proofs) != len(commitments) {
 		panic(fmt.Sprintf("cannot aggregate %d proofs corresponding to %d commitments", len(proofs), len(commitments)))
@@ -208,6 +206,14 @@ func RO(pp *PP, cs []*G1, i int) *Zr {
 	return result
 }
 
+// Size of the encoding of a G1 element returned by G1.Bytes()
+func G1Size() int {
+	return len(c.GenG1.Bytes())
+}
+
 func G1FromBytes(b []byte) (*G1, error) {
+	if len(b) != G1Size() {
+		return nil, fmt.Errorf("invalid G1 encoding length %d", len(b))
+	}
 	return c.NewG1FromBytes(b)
 }
@@ -2,6 +2,7 @@ package pp
 
 import (
 	"crypto/rand"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -57,6 +58,36 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
+func TestUpdateProof(t *testing.T) {
+	N := 32
+	pp := NewPublicParams(N)
+
+	var m Vec
+	for i := 0; i < N; i++ {
+		m = append(m, c.NewRandomZr(rand.Reader))
+	}
+	C := Commit(pp, m)
+	proofs := make([]*G1, N)
+	for j := range proofs {
+		_, proofs[j] = Open(pp, j, m)
+	}
+
+	for _, i := range []int{0, 5, N - 1, 5} {
+		mi := c.NewRandomZr(rand.Reader)
+		for j := range proofs {
+			UpdateProof(pp, proofs[j], j, m[i], mi, i)
+		}
+		Update(pp, C, m, mi, i)
+		m[i] = mi
+
+		for j := range proofs {
+			assert.NoError(t, Verify(pp, m[j], proofs[j], C, j))
+			_, π := Open(pp, j, m)
+			assert.True(t, π.Equals(proofs[j]))
+		}
+	}
+}
+
 func TestAggregation(t *testing.T) {
 	N := 8
 	pp := NewPublicParams(N)
@@ -89,3 +120,130 @@ func TestAggregation(t *testing.T) {
 		assert.NoError(t, err)
 	}
 }
+
+func TestSetupIsRandom(t *testing.T) {
+	N := 8
+	pp1 := NewPublicParams(N)
+	pp2 := NewPublicParams(N)
+	assert.NotEqual(t, pp1.Digest, pp2.Digest)
+	assert.False(t, pp1.G1s[0].Equals(pp2.G1s[0]))
+}
+
+func TestSaveLoad(t *testing.T) {
+	N := 8
+	pp := NewPublicParams(N)
+	path := filepath.Join(t.TempDir(), "pp.bin")
+	assert.NoError(t, pp.Save(path))
+
+	loaded, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, pp.N, loaded.N)
+	assert.Equal(t, pp.Digest, loaded.Digest)
+
+	// the loaded parameters verify openings made with the original ones
+	var m Vec
+	for i := 0; i < N; i++ {
+		m = append(m, c.NewRandomZr(rand.Reader))
+	}
+	C := Commit(pp, m)
+	mi, π := Open(pp, 3, m)
+	assert.NoError(t, Verify(loaded, mi, π, C, 3))
+
+	// a modified digest or parameter is rejected
+	b, err := EncodeParams(pp)
+	assert.NoError(t, err)
+	b[len(b)-1] ^= 1
+	_, err = DecodeParams(b)
+	assert.ErrorIs(t, err, ErrParamsDigest)
+
+	b, err = EncodeParams(pp)
+	assert.NoError(t, err)
+	copy(b[len(paramsMagic)+5:], c.GenG1.Bytes())
+	_, err = DecodeParams(b)
+	assert.Error(t, err)
+
+	for _, l := range []int{0, len(paramsMagic), len(b) - 1} {
+		_, err = DecodeParams(b[:l])
+		assert.Error(t, err)
+	}
+}
+
+func TestWipe(t *testing.T) {
+	z := c.NewRandomZr(rand.Reader)
+	wipe(z)
+	assert.True(t, z.Equals(ZeroZr()))
+}
+
+func TestCeremony(t *testing.T) {
+	N := 8
+
+	// e.g., both server operators and an auditor
+	cer := NewCeremony(N)
+	for i := 0; i < 3; i++ {
+		cer.Contribute()
+	}
+	pp, err := VerifyCeremony(cer)
+	assert.NoError(t, err)
+
+	// the resulting parameters are usable
+	var m Vec
+	for i := 0; i < N; i++ {
+		m = append(m, c.NewRandomZr(rand.Reader))
+	}
+	C := Commit(pp, m)
+	for i := 0; i < N; i++ {
+		mi, π := Open(pp, i, m)
+		assert.NoError(t, Verify(pp, mi, π, C, i))
+	}
+
+	// the transcript can be stored
+	path := filepath.Join(t.TempDir(), "ceremony.bin")
+	assert.NoError(t, cer.Save(path))
+	loaded, err := LoadCeremony(path)
+	assert.NoError(t, err)
+	pp2, err := VerifyCeremony(loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, pp.Digest, pp2.Digest)
+
+	// parameters of a single-party setup are well-formed as well
+	assert.NoError(t, VerifyParams(NewPublicParams(N)))
+}
+
+func TestCeremonyRejectsInvalid(t *testing.T) {
+	N := 4
+	cer := NewCeremony(N)
+	cer.Contribute()
+	cer.Contribute()
+
+	// parameters not derived from the previous contribution
+	bad := &Ceremony{N: N, Contributions: []*Contribution{cer.Contributions[0], {Params: NewPublicParams(N), Proof: cer.Contributions[1].Proof}}}
+	_, err := VerifyCeremony(bad)
+	assert.ErrorIs(t, err, ErrCeremony)
+
+	// proof of knowledge copied from another contribution
+	other := NewCeremony(N)
+	other.Contribute()
+	proof := *cer.Contributions[1].Proof
+	proof.R = other.Contributions[0].Proof.R
+	bad = &Ceremony{N: N, Contributions: []*Contribution{cer.Contributions[0], {Params: cer.Contributions[1].Params, Proof: &proof}}}
+	_, err = VerifyCeremony(bad)
+	assert.ErrorIs(t, err, ErrCeremony)
+
+	// an element is replaced and the digest recomputed
+	params := *cer.Contributions[1].Params
+	params.G1s = append(G1v{}, params.G1s...)
+	params.G1s[N+2] = params.G1s[N+2].Mul(IntToZr(2))
+	params.SetupDigest()
+	assert.ErrorIs(t, VerifyParams(&params), ErrCeremony)
+
+	// Gt is replaced
+	params = *cer.Contributions[1].Params
+	params.Gt = c.GenGt.Exp(IntToZr(5))
+	params.SetupDigest()
+	assert.ErrorIs(t, VerifyParams(&params), ErrCeremony)
+
+	// skipping a contribution
+	bad = &Ceremony{N: N, Contributions: cer.Contributions[1:]}
+	_, err = VerifyCeremony(bad)
+	assert.ErrorIs(t, err, ErrCeremony)
+}
@@ -5,7 +5,6 @@
 #include "permute.h"
 #include <iostream>
 #include <vector>
-//#include <openssl/rand.h>
 
 extern "C" {
 
@@ -36,18 +35,8 @@ void answer(const uint8_t* pset, unsigned int pos, unsigned int univ_size, unsig
 const __m128i one = _mm_setr_epi32(0, 0, 0, 1);
 
 void answer_single_pass(uint8_t* db, unsigned int db_num_elems, unsigned int set_num_elems, unsigned int db_elem_size,
-    uint8_t* parities, unsigned int seed_permutations, unsigned int* permutations, unsigned int* inverse_permutations) {
+    uint8_t* parities, const uint8_t* perm_key, unsigned int* permutations, unsigned int* inverse_permutations) {
 
-    srand(seed_permutations);
-
-    // NEWER C++11 LIBRARY VERSION
-    // std::mt19937 rng(seed_permutations);
-
-    // OPENSSL VERSION
-    // RAND_seed((const unsigned char*)&seed_permutations, sizeof(seed_permutations));
-    // // For deterministic behavior, we need to clear the entropy pool
-    // RAND_cleanup();
-    
     unsigned int perm_size = db_num_elems/ set_num_elems;
 
     //note that size of permutation is also number of parities
@@ -55,17 +44,10 @@ void answer_single_pass(uint8_t* db, unsigned int db_num_elems, unsigned int set
     unsigned int* curr_inverse = inverse_permutations;
     uint8_t* moving_db = db;
     for (int i = 0; i < set_num_elems; i++) { //iterate over each permutation (which pertains to a chunk of db)
-        //use randomness from permutations, need to change this so that it is deterministic and recoverable
-        
-        
-        permute(0, perm_size, curr_permutation);
-        //short unsigned int* curr_inverse = new short unsigned int[perm_size];
+        // permutation i is derived from the client's key, so the client can recompute it
+        permute(perm_key, i, perm_size, curr_permutation);
         invert_permutation(curr_permutation, perm_size, curr_inverse); // possibly do this as part of permute function
 
-        // uint32_t curr_place = i*perm_size;
-        // for (int j = 0; j < perm_size; j++) {
-        //     permutations[curr_place+j] = curr_permutation[j]; 
-        // }
         xor_single_pass(moving_db, curr_inverse, perm_size, parities, db_elem_size);
 
         moving_db =  moving_db + (db_elem_size*perm_size); // adjust scope (partition of db that we are reading)
@@ -75,24 +57,14 @@ void answer_single_pass(uint8_t* db, unsigned int db_num_elems, unsigned int set
 
 }
 
-void generate_permutations(unsigned int db_num_elems, unsigned int set_num_elems, unsigned int seed_permutations, unsigned int* permutations, unsigned int* inverse_permutations) {
-
-    srand(seed_permutations);
+void generate_permutations(unsigned int db_num_elems, unsigned int set_num_elems, const uint8_t* perm_key, unsigned int* permutations, unsigned int* inverse_permutations) {
 
-    // NEWER C++11 LIBRARY VERSION
-    // std::mt19937 rng(seed_permutations);
-
-    // OPENSSL VERSION
-    // RAND_seed((const unsigned char*)&seed_permutations, sizeof(seed_permutations));
-    // // For deterministic behavior, we need to clear the entropy pool
-    // RAND_cleanup();
-    
     unsigned int perm_size = db_num_elems/ set_num_elems;
     unsigned int* curr_permutation = permutations;
     unsigned int* curr_inverse = inverse_permutations;
     for (int i = 0; i < set_num_elems; i++) { //iterate over each permutation 
         
-        permute(0, perm_size, curr_permutation);
+        permute(perm_key, i, perm_size, curr_permutation);
         invert_permutation(curr_permutation, perm_size, curr_inverse);
         curr_permutation = (curr_permutation+perm_size);
         curr_inverse = (curr_inverse+perm_size);;
@@ -100,23 +72,12 @@ void generate_permutations(unsigned int db_num_elems, unsigned int set_num_elems
 
 }
 
-void generate_single_permutation(unsigned int perm_size, unsigned int seed_permutations, unsigned int* permutations, unsigned int* inverse_permutations) {
-
-    srand(seed_permutations);
-
-    // NEWER C++11 LIBRARY VERSION
-    // std::mt19937 rng(seed_permutations);
-
-    // OPENSSL VERSION
-    // RAND_seed((const unsigned char*)&seed_permutations, sizeof(seed_permutations));
-    // // For deterministic behavior, we need to clear the entropy pool
-    // RAND_cleanup();
-    
-    unsigned int* curr_permutation = permutations;
-    unsigned int* curr_inverse = inverse_permutations;        
-    permute(0, perm_size, curr_permutation);
-    invert_permutation(curr_permutation, perm_size, curr_inverse);
+// Generates only the permutation of partition perm_idx, equal to the one
+// generate_permutations derives for that partition under the same key
+void generate_single_permutation(unsigned int perm_size, const uint8_t* perm_key, unsigned int perm_idx, unsigned int* permutations, unsigned int* inverse_permutations) {
 
+    permute(perm_key, perm_idx, perm_size, permutations);
+    invert_permutation(permutations, perm_size, inverse_permutations);
 
 }
 
@@ -12,11 +12,11 @@ void answer(const uint8_t* pset, unsigned int pos, unsigned int univ_size, unsig
 //new fast answer for single pass pir
 
 void answer_single_pass(uint8_t* db, unsigned int db_num_elems, unsigned int set_num_elems, unsigned int db_elem_size,
-    uint8_t* parities, unsigned int seed_permutations, uint32_t* permutations, uint32_t* inverse_permutations);
+    uint8_t* parities, const uint8_t* perm_key, uint32_t* permutations, uint32_t* inverse_permutations);
 
-void generate_permutations(unsigned int db_num_elems, unsigned int set_num_elems, unsigned int seed_permutations, unsigned int* permutations, unsigned int* inverse_permutations);
+void generate_permutations(unsigned int db_num_elems, unsigned int set_num_elems, const uint8_t* perm_key, unsigned int* permutations, unsigned int* inverse_permutations);
 
-void generate_single_permutation(unsigned int perm_size, unsigned int seed_permutations, unsigned int* permutations, unsigned int* inverse_permutations);
+void generate_single_permutation(unsigned int perm_size, const uint8_t* perm_key, unsigned int perm_idx, unsigned int* permutations, unsigned int* inverse_permutations);
 
 #ifdef __cplusplus
 } // extern "C" 
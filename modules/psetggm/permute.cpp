@@ -4,41 +4,78 @@
 #include <algorithm>
 #include "intrinsics.h"
 #include <iostream>
+#include "AES.h"
 #include "permute.h"
-//#include "openssl/rand.h"
-//-L"/opt/homebrew/Cellar/libsodium/1.0.18_1/lib" -lsodium
+
+// Keyed randomness for the permutations: AES-CTR under the client's
+// permutation key. The high 64 bits of each counter block hold the stream
+// (partition) index, so every partition gets an independent keystream and
+// a single partition can be regenerated without the ones before it.
+class PermPRG {
+public:
+    PermPRG(const uint8_t* key, uint64_t stream) : aes(key), stream(stream), ctr(0), pos(bufWords) {}
+
+    uint32_t next() {
+        if (pos == bufWords) {
+            refill();
+        }
+        return words[pos++];
+    }
+
+    // Uniform integer in [0, n), using Lemire's multiply-and-reject method
+    // https://lemire.me/blog/2016/06/30/fast-random-shuffling/
+    uint32_t uniform(uint32_t n) {
+        uint64_t m = (uint64_t)next() * (uint64_t)n;
+        uint32_t l = (uint32_t)m;
+        if (l < n) {
+            uint32_t t = (uint32_t)(-n) % n;
+            while (l < t) {
+                m = (uint64_t)next() * (uint64_t)n;
+                l = (uint32_t)m;
+            }
+        }
+        return m >> 32;
+    }
+
+private:
+    static const int bufBlocks = 64;
+    static const int bufWords = bufBlocks * sizeof(block) / sizeof(uint32_t);
+
+    void refill() {
+        block pt[bufBlocks];
+        for (int i = 0; i < bufBlocks; i++) {
+            pt[i] = _mm_set_epi64x(stream, ctr++);
+        }
+        aes.encryptECBBlocks(pt, bufBlocks, (block*)words);
+        pos = 0;
+    }
+
+    AES aes;
+    uint64_t stream;
+    uint64_t ctr;
+    int pos;
+    alignas(16) uint32_t words[bufWords];
+};
 
 extern "C"
 {
-    unsigned char buf[4];
     //use fisher yates algorithm to sample a permutation
-   
-    void permute(unsigned int seed, unsigned int range, unsigned int* range_arr)
+    void permute(const uint8_t* key, uint64_t stream, uint32_t range, uint32_t* range_arr)
     {
-        for (unsigned int i = 0; i < range; i++) {
+        for (uint32_t i = 0; i < range; i++) {
             range_arr[i] = i;
         }
+        if (range < 2) {
+            return;
+        }
 
-        //permute array using fisher-yates
-        for (unsigned int i = range-1; i > 0; i--){
-
-            // OPENSSL VERSION
-            // NOTE that the original code removed rand() in order to use a cryptographically secure PRNG, see below
-            // change rand() to cryptographically safe randomness from AES (can use one AES call > once)
-            // unsigned int j = getRandIntModN(i+1);
-
-            // SRAND VERSION
-            unsigned int j = rand() % (i+1);
-
-            // NEWER C++11 LIBRARY VERSION
-            // std::uniform_int_distribution<unsigned int> uni_int(0, i);
-            // unsigned int j = uni_int(rng);
+        PermPRG prg(key, stream);
 
-            //std::cout << "random int: " << j << std::endl;
+        //permute array using fisher-yates
+        for (uint32_t i = range-1; i > 0; i--){
+            uint32_t j = prg.uniform(i+1);
             std::swap(range_arr[i],range_arr[j]);
-
         }
-
     }
 
 
@@ -48,14 +85,6 @@ extern "C"
         }
     }
 
-    // uint32_t getRandIntModN(uint32_t N) {
-    //     RAND_bytes(buf,4);
-    //     return fastMod(uint32_t((unsigned char)(buf[0]) << 24 |
-    //         (unsigned char)(buf[1]) << 16 |
-    //         (unsigned char)(buf[2]) << 8 |
-    //         (unsigned char)(buf[3])),N);
-    // }
-
     //https://lemire.me/blog/2016/06/27/a-fast-alternative-to-the-modulo-reduction/
     uint32_t fastMod(uint32_t x, uint32_t N) {
         return ((uint64_t) x * (uint64_t) N) >> 32;
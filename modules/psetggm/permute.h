@@ -1,13 +1,17 @@
+#include <stdint.h>
+
 #ifdef __cplusplus
 extern "C" {
 #endif
 
+// Size in bytes of the AES-128 key seeding the permutations
+#define PERM_KEY_SIZE 16
 
-
-void permute(unsigned int seed, uint32_t range, uint32_t* range_arr);
+// Samples a uniformly random permutation of {0, ..., range-1} into range_arr.
+// The randomness is AES-CTR under key, domain-separated by stream.
+void permute(const uint8_t* key, uint64_t stream, uint32_t range, uint32_t* range_arr);
 void invert_permutation(uint32_t* perm_array, uint32_t range, uint32_t* inv_array);
 uint32_t fastMod(uint32_t x, uint32_t N);
-//uint32_t getRandIntModN(uint32_t N);
 
 
 #ifdef __cplusplus
@@ -11,7 +11,7 @@ package psetggm
 */
 import "C"
 import (
-	"log"
+	"fmt"
 	"unsafe"
 )
 
@@ -68,40 +68,112 @@ func FastAnswer(pset []byte, hole, univSize, setSize, shift int, db []byte, rowL
 		(*C.uchar)(&db[0]), C.uint(len(db)), C.uint(rowLen), C.uint(len(out)), (*C.uchar)(&out[0]))
 }
 
-func SinglePassAnswer(db []byte, dbNumElems int, setNumElems int, dbElemSize int,
-	parities []byte, permSeed int, permutations []uint32, inverse_permutations []uint32) {
-	C.answer_single_pass((*C.uchar)(&db[0]), C.uint(dbNumElems), C.uint(setNumElems), C.uint(dbElemSize),
-		(*C.uchar)(&parities[0]), C.uint(permSeed), (*C.uint)(&permutations[0]), (*C.uint)(&inverse_permutations[0]))
+// PermKeySize is the size in bytes of the AES-128 key from which the
+// partition permutations are derived.
+const PermKeySize = C.PERM_KEY_SIZE
 
+func checkPermKey(permKey []byte) error {
+	if len(permKey) != PermKeySize {
+		return fmt.Errorf("permutation key must be %d bytes, got %d", PermKeySize, len(permKey))
+	}
+	return nil
 }
 
-func GeneratePerms(dbNumElems int, setNumElems int, permSeed int, permutations []uint32, inverse_permutations []uint32) {
-	C.generate_permutations(C.uint(dbNumElems), C.uint(setNumElems), C.uint(permSeed), (*C.uint)(&permutations[0]), (*C.uint)(&inverse_permutations[0]))
+// checkPermSize checks that the permutation arrays hold n elements
+func checkPermSize(n int, permutations, inverse_permutations []uint32) error {
+	if n < 1 || len(permutations) < n || len(inverse_permutations) < n {
+		return fmt.Errorf("permutation arrays of %d and %d elements for %d elements", len(permutations), len(inverse_permutations), n)
+	}
+	return nil
+}
 
+// checkElemSize checks that elemSize is supported by the SIMD code and that
+// the buffers hold an element
+func checkElemSize(elemSize int, bufs ...[]byte) error {
+	if elemSize <= 0 || elemSize%16 != 0 {
+		return fmt.Errorf("elements of %d bytes are not supported, their size must be a multiple of 16", elemSize)
+	}
+	for _, b := range bufs {
+		if len(b) < elemSize {
+			return fmt.Errorf("buffer of %d bytes for an element of %d bytes", len(b), elemSize)
+		}
+	}
+	return nil
 }
 
-func FastXorInto(out []byte, in []byte, elemSize int) {
-	if elemSize%16 != 0 {
-		log.Fatal("FastXorInto is not implemented for elements that are not multiples of 16 in size")
+func SinglePassAnswer(db []byte, dbNumElems int, setNumElems int, dbElemSize int,
+	parities []byte, permKey []byte, permutations []uint32, inverse_permutations []uint32) error {
+	if err := checkPermKey(permKey); err != nil {
+		return err
+	}
+	if err := checkPermSize(dbNumElems, permutations, inverse_permutations); err != nil {
+		return err
+	}
+	if err := checkElemSize(dbElemSize, db, parities); err != nil {
+		return err
+	}
+	C.answer_single_pass((*C.uchar)(&db[0]), C.uint(dbNumElems), C.uint(setNumElems), C.uint(dbElemSize),
+		(*C.uchar)(&parities[0]), (*C.uchar)(&permKey[0]), (*C.uint)(&permutations[0]), (*C.uint)(&inverse_permutations[0]))
+	return nil
+}
+
+// GeneratePerms derives one permutation per partition from permKey, the i-th
+// permutation is written to permutations[i*(dbNumElems/setNumElems):].
+func GeneratePerms(dbNumElems int, setNumElems int, permKey []byte, permutations []uint32, inverse_permutations []uint32) error {
+	if err := checkPermKey(permKey); err != nil {
+		return err
+	}
+	if err := checkPermSize(dbNumElems, permutations, inverse_permutations); err != nil {
+		return err
+	}
+	C.generate_permutations(C.uint(dbNumElems), C.uint(setNumElems), (*C.uchar)(&permKey[0]), (*C.uint)(&permutations[0]), (*C.uint)(&inverse_permutations[0]))
+	return nil
+}
+
+// FastXorInto XORs the first elemSize bytes of in into out, elemSize must be
+// a multiple of 16
+func FastXorInto(out []byte, in []byte, elemSize int) error {
+	if err := checkElemSize(elemSize, out, in); err != nil {
+		return err
 	}
 	C.xor_into((*C.uchar)(&out[0]), (*C.uchar)(&in[0]), C.uint(elemSize))
+	return nil
 }
 
-func CopyIn(out []byte, db []byte, index int, elemSize int) {
-	if elemSize%16 != 0 {
-		log.Fatal("CopyIn is not implemented for elements that are not multiples of 16 in size")
+// CopyIn XORs element index of db into out, which copies it if out is zero.
+// elemSize must be a multiple of 16.
+func CopyIn(out []byte, db []byte, index int, elemSize int) error {
+	if err := checkElemSize(elemSize, out); err != nil {
+		return err
+	}
+	if index < 0 || (index+1)*elemSize > len(db) {
+		return fmt.Errorf("element %d out of bounds of %d elements", index, len(db)/elemSize)
 	}
 	C.xor_into((*C.uchar)(&out[0]), (*C.uchar)(&db[index*elemSize]), C.uint(elemSize))
-	//C.xor_into((*C.uchar)(&out[0]), (*C.uchar)(&db[0]), C.uint(elemSize))
+	return nil
 }
 
-func SinglePermutation(randomness int, permArr []uint32, invPermArr []uint32, permSize int) {
-
-	C.permute(C.uint(randomness), C.uint(permSize), (*C.uint)(&permArr[0]))
+func SinglePermutation(permKey []byte, stream int, permArr []uint32, invPermArr []uint32, permSize int) error {
+	if err := checkPermKey(permKey); err != nil {
+		return err
+	}
+	if err := checkPermSize(permSize, permArr, invPermArr); err != nil {
+		return err
+	}
+	C.permute((*C.uchar)(&permKey[0]), C.uint64_t(stream), C.uint(permSize), (*C.uint)(&permArr[0]))
 	C.invert_permutation((*C.uint)(&permArr[0]), C.uint(permSize), (*C.uint)(&invPermArr[0]))
+	return nil
 }
 
-func GenerateSinglePerm(partNumElems int, permSeed int, permutations []uint32, inverse_permutations []uint32) {
-	C.generate_single_permutation(C.uint(partNumElems), C.uint(permSeed), (*C.uint)(&permutations[0]), (*C.uint)(&inverse_permutations[0]))
-
+// GenerateSinglePerm derives the permutation of partition permIdx, it equals
+// the one GeneratePerms outputs for that partition under the same key.
+func GenerateSinglePerm(partNumElems int, permKey []byte, permIdx int, permutations []uint32, inverse_permutations []uint32) error {
+	if err := checkPermKey(permKey); err != nil {
+		return err
+	}
+	if err := checkPermSize(partNumElems, permutations, inverse_permutations); err != nil {
+		return err
+	}
+	C.generate_single_permutation(C.uint(partNumElems), (*C.uchar)(&permKey[0]), C.uint(permIdx), (*C.uint)(&permutations[0]), (*C.uint)(&inverse_permutations[0]))
+	return nil
 }
@@ -6,11 +6,16 @@ int main()
 {
     int range = 32;
     std::cout << "range: " << range << std::endl;
-    srand(time(NULL)); // randomize seed
+    srand(time(NULL)); // randomize key
+    uint8_t key[PERM_KEY_SIZE];
+    for (int i = 0; i < PERM_KEY_SIZE; i++)
+    {
+        key[i] = rand();
+    }
     int start_s = clock();
 
     unsigned int* perm_arr = new unsigned int[range];
-    permute(rand(),range, perm_arr);
+    permute(key, 0, range, perm_arr);
     int stop_s = clock();
     std::cout << "time elapsed on permute: " <<((stop_s - start_s)/double(CLOCKS_PER_SEC)) << " seconds" << std::endl;
 
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+////////////////////////////////////////////////////////////
+// BINARY ENCODING
+////////////////////////////////////////////////////////////
+
+// All integers are encoded in little-endian byte order, byte slices are
+// prefixed with their length as uint32.
+
+var ErrMalformed = errors.New("malformed encoding")
+
+type BinWriter struct {
+	Buf []byte
+}
+
+func (w *BinWriter) Byte(b byte) {
+	w.Buf = append(w.Buf, b)
+}
+
+func (w *BinWriter) Uint32(v uint32) {
+	w.Buf = binary.LittleEndian.AppendUint32(w.Buf, v)
+}
+
+func (w *BinWriter) Uint64(v uint64) {
+	w.Buf = binary.LittleEndian.AppendUint64(w.Buf, v)
+}
+
+// Raw appends b without a length prefix
+func (w *BinWriter) Raw(b []byte) {
+	w.Buf = append(w.Buf, b...)
+}
+
+// Bytes appends b with a length prefix
+func (w *BinWriter) Bytes(b []byte) {
+	w.Uint32(uint32(len(b)))
+	w.Raw(b)
+}
+
+// BinReader reads values written by a BinWriter. The first error is sticky,
+// all subsequent reads return zero values.
+type BinReader struct {
+	buf []byte
+	err error
+}
+
+func NewBinReader(b []byte) *BinReader {
+	return &BinReader{buf: b}
+}
+
+// Fail sets the error of r if it does not already have one
+func (r *BinReader) Fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *BinReader) Err() error {
+	return r.err
+}
+
+func (r *BinReader) Remaining() int {
+	return len(r.buf)
+}
+
+func (r *BinReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.Fail(fmt.Errorf("%w: need %d bytes, have %d", ErrMalformed, n, len(r.buf)))
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *BinReader) Byte() byte {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *BinReader) Uint32() uint32 {
+	b := r.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *BinReader) Uint64() uint64 {
+	b := r.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// Raw returns a copy of the next n bytes
+func (r *BinReader) Raw(n int) []byte {
+	b := r.take(n)
+	if b == nil {
+		return nil
+	}
+	return append(make([]byte, 0, n), b...)
+}
+
+// Bytes reads a length-prefixed byte slice
+func (r *BinReader) Bytes() []byte {
+	return r.Raw(r.Len(1))
+}
+
+// Len reads a uint32 count of elements of elemSize bytes each and checks
+// that the remaining input can hold them.
+func (r *BinReader) Len(elemSize int) int {
+	n := int(r.Uint32())
+	if r.err != nil {
+		return 0
+	}
+	if elemSize > 0 && n > len(r.buf)/elemSize {
+		r.Fail(fmt.Errorf("%w: %d elements of %d bytes exceed input", ErrMalformed, n, elemSize))
+		return 0
+	}
+	return n
+}
+
+// Finish returns the error of r or an error if there are unread bytes left
+func (r *BinReader) Finish() error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.buf) != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrMalformed, len(r.buf))
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package vc
+
+import (
+	"fmt"
+
+	bls "github.com/consensys/gnark-crypto/ecc/bls12-381"
+
+	"tapir/modules/merkle"
+	"tapir/modules/pp"
+	"tapir/modules/utils"
+)
+
+// Binary encodings of commitments and aggregated proofs. Each encoding
+// starts with the VcType of the scheme, hence values can be decoded without
+// knowing the scheme. Nil values (VC type None) are encoded as the tag only.
+
+func MarshalCommitment(c Commitment) ([]byte, error) {
+	w := &utils.BinWriter{}
+	switch c := c.(type) {
+	case nil:
+		w.Byte(byte(None))
+	case *MerkleCommitment:
+		w.Byte(byte(VC_MerkleTree))
+		w.Bytes(c.Root)
+	case *PPCommitment:
+		w.Byte(byte(VC_PointProof))
+		w.Raw(c.Commitment.Bytes())
+	case *KZGCommitment:
+		w.Byte(byte(VC_KZG))
+		b := c.Commitment.Bytes()
+		w.Raw(b[:])
+	default:
+		return nil, fmt.Errorf("cannot marshal commitment of type %T", c)
+	}
+	return w.Buf, nil
+}
+
+func UnmarshalCommitment(b []byte) (Commitment, error) {
+	r := utils.NewBinReader(b)
+	var c Commitment
+	switch t := VcType(r.Byte()); t {
+	case None:
+	case VC_MerkleTree:
+		c = &MerkleCommitment{Root: r.Bytes()}
+	case VC_PointProof:
+		g, err := pp.G1FromBytes(r.Raw(r.Remaining()))
+		if err != nil {
+			r.Fail(err)
+		} else {
+			c = &PPCommitment{Commitment: *g}
+		}
+	case VC_KZG:
+		kc := &KZGCommitment{}
+		if _, err := kc.Commitment.SetBytes(r.Raw(bls.SizeOfG1AffineCompressed)); err != nil {
+			r.Fail(fmt.Errorf("%w: %w", utils.ErrMalformed, err))
+		} else {
+			c = kc
+		}
+	default:
+		r.Fail(fmt.Errorf("%w: unknown VC type %d", utils.ErrMalformed, t))
+	}
+	if err := r.Finish(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func MarshalAggProof(p AggProof) ([]byte, error) {
+	w := &utils.BinWriter{}
+	switch p := p.(type) {
+	case nil:
+		w.Byte(byte(None))
+	case *MerkleAggProof:
+		w.Byte(byte(VC_MerkleTree))
+		w.Uint32(uint32(len(p.Proofs)))
+		for i := range p.Proofs {
+			mp, ok := p.Proofs[i].(*MerkleMultiProof)
+			if !ok {
+				return nil, fmt.Errorf("cannot marshal proof of type %T", p.Proofs[i])
+			}
+			w.Bytes(merkle.EncodeMultiProof(&mp.Proof))
+		}
+	case *pp.G1:
+		w.Byte(byte(VC_PointProof))
+		w.Raw(p.Bytes())
+	case *KZGAggProof:
+		w.Byte(byte(VC_KZG))
+		b := p.Point.Bytes()
+		w.Raw(b[:])
+	default:
+		return nil, fmt.Errorf("cannot marshal aggregated proof of type %T", p)
+	}
+	return w.Buf, nil
+}
+
+func UnmarshalAggProof(b []byte) (AggProof, error) {
+	r := utils.NewBinReader(b)
+	var p AggProof
+	switch t := VcType(r.Byte()); t {
+	case None:
+	case VC_MerkleTree:
+		// every encoded multiproof has a length prefix and at least 12 bytes
+		n := r.Len(16)
+		proofs := make([]Proof, n)
+		for i := range proofs {
+			mp, err := merkle.DecodeMultiProof(r.Bytes())
+			if err != nil {
+				r.Fail(fmt.Errorf("%w: %w", utils.ErrMalformed, err))
+				break
+			}
+			proofs[i] = &MerkleMultiProof{Proof: *mp}
+		}
+		p = &MerkleAggProof{Proofs: proofs}
+	case VC_PointProof:
+		g, err := pp.G1FromBytes(r.Raw(r.Remaining()))
+		if err != nil {
+			r.Fail(err)
+		} else {
+			p = g
+		}
+	case VC_KZG:
+		kp := &KZGAggProof{}
+		if _, err := kp.Point.SetBytes(r.Raw(bls.SizeOfG1AffineCompressed)); err != nil {
+			r.Fail(fmt.Errorf("%w: %w", utils.ErrMalformed, err))
+		} else {
+			p = kp
+		}
+	default:
+		r.Fail(fmt.Errorf("%w: unknown VC type %d", utils.ErrMalformed, t))
+	}
+	if err := r.Finish(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
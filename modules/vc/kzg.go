@@ -0,0 +1,255 @@
+package vc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	bls "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+
+	"tapir/modules/database"
+	"tapir/modules/kzg"
+)
+
+func init() {
+	gob.Register(Proof(&KZGProof{}))
+	gob.Register(Commitment(&KZGCommitment{}))
+	gob.Register(AggProof(&KZGAggProof{}))
+}
+
+type KZGParams struct {
+	*kzg.SRS
+}
+
+type KZGCommitment struct {
+	Commitment kzg.G1
+}
+
+type KZGVector struct {
+	Vec []fr.Element
+}
+
+// KZGProof is an opening of a single index. Only Point is part of the
+// proof, Idx and Val are the opened index and value, which Aggregate needs
+// to derive the aggregation coefficients.
+type KZGProof struct {
+	Point kzg.G1
+	Idx   int
+	Val   fr.Element
+}
+
+type KZGAggProof struct {
+	Point kzg.G1
+}
+
+func (params *KZGParams) Equals(other VCParams) (bool, error) {
+	if o, ok := other.(*KZGParams); !ok || params.N != o.N || !bytes.Equal(params.Digest, o.Digest) {
+		return false, errors.New("VC Params not equal")
+	}
+	return true, nil
+}
+
+func (params *KZGParams) Type() VcType {
+	return VC_KZG
+}
+
+func (params *KZGParams) VectorFromRecords(recs []database.Record) (Vector, error) {
+	if err := checkLength(len(recs), params.N); err != nil {
+		return nil, err
+	}
+
+	v := make([]fr.Element, params.N)
+	for i, elem := range recs {
+		v[i] = kzg.FieldElementFromBytes(elem)
+	}
+
+	return &KZGVector{Vec: v}, nil
+}
+
+func (params *KZGParams) ProofToBytes(p Proof) []byte {
+	b := p.(*KZGProof).Point.Bytes()
+	return b[:]
+}
+
+func (params *KZGParams) BytesToProof(in []byte) (Proof, error) {
+	p := &KZGProof{Idx: -1}
+	if len(in) != bls.SizeOfG1AffineCompressed {
+		return nil, fmt.Errorf("error converting bytes to proof: got %d bytes", len(in))
+	}
+	if _, err := p.Point.SetBytes(in); err != nil {
+		return nil, fmt.Errorf("error converting bytes to proof: %w", err)
+	}
+	return p, nil
+}
+
+// KZG parameters come from a trusted setup and are handled like the
+// PointProof parameters: loaded from a file (LoadKZGParams) or, if
+// AllowLocalSetup was called, set up once per process.
+var kzgParams = struct {
+	sync.Mutex
+	byN map[int]*kzg.SRS
+}{byN: make(map[int]*kzg.SRS)}
+
+// LoadKZGParams loads an SRS from path, subsequent calls to
+// NewVc(VC_KZG, n) with n equal to its vector length use it.
+func LoadKZGParams(path string) (*KZGParams, error) {
+	srs, err := kzg.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	SetKZGParams(srs)
+	return &KZGParams{srs}, nil
+}
+
+// SetKZGParams makes NewVc(VC_KZG, srs.N) use srs
+func SetKZGParams(srs *kzg.SRS) {
+	kzgParams.Lock()
+	defer kzgParams.Unlock()
+	kzgParams.byN[srs.N] = srs
+}
+
+// SetupKZG returns the loaded SRS for vectors of length n
+func SetupKZG(n int) (*KZGParams, error) {
+	kzgParams.Lock()
+	defer kzgParams.Unlock()
+	srs, ok := kzgParams.byN[n]
+	if !ok {
+		if !localSetup.Load() {
+			return nil, fmt.Errorf("%w: KZG for n=%d", ErrNoParams, n)
+		}
+		log.Printf("no KZG parameters loaded for n=%d, running a process-local setup", n)
+		srs = kzg.NewSRS(n)
+		kzgParams.byN[n] = srs
+	}
+	return &KZGParams{srs}, nil
+}
+
+// ParamsDigest identifies the SRS, all parties must agree on it
+func (params *KZGParams) ParamsDigest() []byte {
+	return params.Digest
+}
+
+func (params *KZGParams) Commit(v Vector) Commitment {
+	return &KZGCommitment{Commitment: *kzg.Commit(params.SRS, v.(*KZGVector).Vec)}
+}
+
+func (params *KZGParams) Open(v Vector, idx int, _ Commitment) (Proof, error) {
+	vec := v.(*KZGVector).Vec
+	if !(0 <= idx && idx < len(vec)) {
+		return nil, fmt.Errorf("%w: index %d out of range", ErrParamMismatch, idx)
+	}
+	val, proof := kzg.Open(params.SRS, idx, vec)
+	return &KZGProof{Point: *proof, Idx: idx, Val: val}, nil
+}
+
+func (params *KZGParams) Verify(c Commitment, p Proof, idx int, elem database.Record) bool {
+	kp, ok := p.(*KZGProof)
+	kc, okc := c.(*KZGCommitment)
+	// Making sure in index lies in the boundaries
+	if !ok || !okc || !(0 <= idx && idx < params.N) {
+		return false
+	}
+	err := kzg.Verify(params.SRS, kzg.FieldElementFromBytes(elem), &kp.Point, &kc.Commitment, idx)
+	return err == nil
+}
+
+func (params *KZGParams) EqualCommitments(c1, c2 Commitment) bool {
+	kc1, ok1 := c1.(*KZGCommitment)
+	kc2, ok2 := c2.(*KZGCommitment)
+	return ok1 && ok2 && kc1.Commitment.Equal(&kc2.Commitment)
+}
+
+func (params *KZGParams) EqualProofs(p1, p2 Proof) bool {
+	kp1, ok1 := p1.(*KZGProof)
+	kp2, ok2 := p2.(*KZGProof)
+	return ok1 && ok2 && kp1.Point.Equal(&kp2.Point)
+}
+
+// Aggregate combines openings of different commitments, possibly at
+// different indices, into a single G1 element. The proofs must come from
+// Open, as the aggregation coefficients depend on the opened values.
+func (params *KZGParams) Aggregate(proofs *[]Proof, coms *[]Commitment) (AggProof, error) {
+	if len(*proofs) != len(*coms) {
+		return nil, fmt.Errorf("%w: cannot aggregate %d proofs corresponding to %d commitments", ErrParamMismatch, len(*proofs), len(*coms))
+	}
+	ps := make([]*kzg.G1, len(*proofs))
+	cs := make([]*kzg.G1, len(*proofs))
+	indices := make([]int, len(*proofs))
+	values := make([]fr.Element, len(*proofs))
+
+	for i := range *proofs {
+		p := (*proofs)[i].(*KZGProof)
+		if p.Idx < 0 {
+			return nil, errors.New("cannot aggregate a KZG proof without its opening")
+		}
+		ps[i] = &p.Point
+		indices[i] = p.Idx
+		values[i] = p.Val
+		cs[i] = &(*coms)[i].(*KZGCommitment).Commitment
+	}
+
+	return &KZGAggProof{Point: *kzg.Aggregate(params.SRS, cs, ps, indices, values)}, nil
+}
+
+func (params *KZGParams) VerifyAggregation(aggProof AggProof, coms *[]Commitment, indices []int, elems []database.Record) bool {
+	agg, ok := aggProof.(*KZGAggProof)
+	if !ok || len(indices) != len(*coms) || len(elems) != len(*coms) {
+		return false
+	}
+	cs := make([]*kzg.G1, len(*coms))
+	for i := range *coms {
+		c, ok := (*coms)[i].(*KZGCommitment)
+		if !ok || !(0 <= indices[i] && indices[i] < params.N) {
+			return false
+		}
+		cs[i] = &c.Commitment
+	}
+	res := kzg.VerifyAggregationRecords(params.SRS, indices, cs, &agg.Point, elems)
+	return res == nil
+}
+
+func (params *KZGParams) UpdateMulti(c Commitment, v Vector, ops []database.Update) (Commitment, Vector, error) {
+	for _, op := range ops {
+		var err error
+		if c, v, err = params.Update(c, v, database.Update{Op: op.Op, Idx: op.Idx % params.N, Val: op.Val}); err != nil {
+			return nil, nil, err
+		}
+	}
+	return c, v, nil
+}
+
+// UpdateProofs updates each proof by one or two multiples of the SRS
+// quotients, see kzg.UpdateProof. The opened value of the proof of op.Idx
+// becomes the new one.
+func (params *KZGParams) UpdateProofs(_ Vector, proofs []Proof, op database.Update, old database.Record) error {
+	if !(0 <= op.Idx && op.Idx < len(proofs)) {
+		return fmt.Errorf("%w: index %d out of range", ErrParamMismatch, op.Idx)
+	}
+	prev := kzg.FieldElementFromBytes(old)
+	mi := kzg.FieldElementFromBytes(op.Val)
+	for j, p := range proofs {
+		kp := p.(*KZGProof)
+		kzg.UpdateProof(params.SRS, &kp.Point, j, prev, mi, op.Idx)
+		if j == op.Idx {
+			kp.Val = mi
+		}
+	}
+	return nil
+}
+
+func (params *KZGParams) Update(c Commitment, v Vector, op database.Update) (Commitment, Vector, error) {
+	vec := v.(*KZGVector)
+	if !(0 <= op.Idx && op.Idx < len(vec.Vec)) {
+		return nil, nil, fmt.Errorf("%w: index %d out of range", ErrParamMismatch, op.Idx)
+	}
+	fieldElem := kzg.FieldElementFromBytes(op.Val)
+	com := c.(*KZGCommitment)
+	kzg.Update(params.SRS, &com.Commitment, vec.Vec, fieldElem, op.Idx)
+	vec.Vec[op.Idx] = fieldElem
+
+	return com, vec, nil
+}
@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"errors"
-	"log"
+	"fmt"
 	"tapir/modules/database"
 	"tapir/modules/merkle"
 )
@@ -18,6 +18,10 @@ func init() {
 	gob.Register(Proof(&mp))
 	mc := MerkleCommitment{}
 	gob.Register(Commitment(&mc))
+	ma := MerkleAggProof{}
+	gob.Register(AggProof(&ma))
+	mm := MerkleMultiProof{}
+	gob.Register(Proof(&mm))
 }
 
 type MerkleParams struct {
@@ -37,6 +41,12 @@ type MerkleProof struct {
 	Proof merkle.Proof
 }
 
+type MerkleMultiProof struct {
+	Proof merkle.MultiProof
+}
+
+// MerkleAggProof contains one multiproof per distinct commitment, in the
+// order of the first occurrence of the commitment
 type MerkleAggProof struct {
 	Proofs []Proof
 }
@@ -46,22 +56,22 @@ func SetupMerkle(n int) *MerkleParams {
 	return params
 }
 func (params *MerkleParams) Equals(other VCParams) (bool, error) {
-	if params.N != other.(*MerkleParams).N {
+	if o, ok := other.(*MerkleParams); !ok || params.N != o.N {
 		return false, errors.New("VC Params not equal")
 	}
 	return true, nil
 }
 
 // Generate Merkle Tree and store in MerkleVector
-func (params *MerkleParams) VectorFromRecords(v []database.Record) Vector {
-	if len(v) != params.N {
-		panic("Vector length does not match setup")
+func (params *MerkleParams) VectorFromRecords(v []database.Record) (Vector, error) {
+	if err := checkLength(len(v), params.N); err != nil {
+		return nil, err
 	}
 	tree, err := merkle.NewFromRecords(&v)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return &MerkleVector{tree}
+	return &MerkleVector{tree}, nil
 }
 
 func (params *MerkleParams) Commit(v Vector) Commitment {
@@ -69,40 +79,136 @@ func (params *MerkleParams) Commit(v Vector) Commitment {
 	return &mc
 }
 
-func (params *MerkleParams) Open(v Vector, idx int, c Commitment) Proof {
+func (params *MerkleParams) Open(v Vector, idx int, c Commitment) (Proof, error) {
 	tree := v.(*MerkleVector)
 	proof, err := tree.GenerateProofIndex(uint32(idx))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return &MerkleProof{Proof: *proof}
+	return &MerkleProof{Proof: *proof}, nil
 }
 
 func (params *MerkleParams) Verify(c Commitment, p Proof, idx int, elem database.Record) bool {
-	b, err := merkle.VerifyProof(elem, &p.(*MerkleProof).Proof, uint32(idx), c.(*MerkleCommitment).Root)
+	mp, ok := p.(*MerkleProof)
+	mc, okc := c.(*MerkleCommitment)
+	if !ok || !okc || idx < 0 {
+		return false
+	}
+	b, err := merkle.VerifyProof(elem, &mp.Proof, uint32(idx), mc.Root)
+	return err == nil && b
+}
+
+func (params *MerkleParams) OpenMulti(v Vector, idxs []int, c Commitment) (Proof, error) {
+	tree := v.(*MerkleVector)
+	indices := make([]uint32, len(idxs))
+	for i, idx := range idxs {
+		indices[i] = uint32(idx)
+	}
+	proof, err := tree.GenerateMultiProof(indices)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return b
+	return &MerkleMultiProof{Proof: *proof}, nil
 }
 
-// No aggregation for Merkle trees, just naive saving all proofs
-func (params *MerkleParams) Aggregate(proofs *[]Proof, _ *[]Commitment) AggProof {
-	return &MerkleAggProof{Proofs: *proofs}
+func (params *MerkleParams) VerifyMulti(c Commitment, p Proof, idxs []int, elems []database.Record) bool {
+	mp, ok := p.(*MerkleMultiProof)
+	mc, okc := c.(*MerkleCommitment)
+	if !ok || !okc || len(idxs) != len(elems) {
+		return false
+	}
+	indices := make([]uint32, len(idxs))
+	data := make([][]byte, len(idxs))
+	for i, idx := range idxs {
+		// trees may have grown beyond N leaves by ADD updates
+		if idx < 0 {
+			return false
+		}
+		indices[i] = uint32(idx)
+		data[i] = elems[i]
+	}
+	b, err := merkle.VerifyMultiProof(data, &mp.Proof, indices, mc.Root)
+	return err == nil && b
 }
 
-// No aggregation for Merkle trees, just naive verification of all proofs
-func (params *MerkleParams) VerifyAggregation(aggProof AggProof, c *[]Commitment, idxs []int, elems []database.Record) bool {
-	mp := aggProof.(*MerkleAggProof)
-	if len(idxs) != len(elems) || len(idxs) != len(mp.Proofs) {
-		panic("Index and element length mismatch")
+func (params *MerkleParams) MultiProofToBytes(p Proof) []byte {
+	return merkle.EncodeMultiProof(&p.(*MerkleMultiProof).Proof)
+}
+
+func (params *MerkleParams) BytesToMultiProof(in []byte) (Proof, error) {
+	p, err := merkle.DecodeMultiProof(in)
+	if err != nil {
+		return nil, err
+	}
+	return &MerkleMultiProof{Proof: *p}, nil
+}
+
+// groupByCommitment returns the positions of equal commitments, in the order
+// of their first occurrence, false if a commitment is not a Merkle
+// commitment
+func groupByCommitment(coms []Commitment) ([][]int, bool) {
+	var groups [][]int
+	pos := make(map[string]int)
+	for i, c := range coms {
+		mc, ok := c.(*MerkleCommitment)
+		if !ok {
+			return nil, false
+		}
+		root := string(mc.Root)
+		g, ok := pos[root]
+		if !ok {
+			g = len(groups)
+			pos[root] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups, true
+}
+
+// Merkle trees have no actual aggregation, proofs of the same commitment
+// are merged into a multiproof, which removes the redundant hashes
+func (params *MerkleParams) Aggregate(proofs *[]Proof, coms *[]Commitment) (AggProof, error) {
+	if len(*proofs) != len(*coms) {
+		return nil, fmt.Errorf("%w: %d proofs for %d commitments", ErrParamMismatch, len(*proofs), len(*coms))
+	}
+	groups, ok := groupByCommitment(*coms)
+	if !ok {
+		return nil, fmt.Errorf("%w: commitment of another scheme", ErrParamMismatch)
 	}
-	for i, index := range idxs {
-		b, err := merkle.VerifyProof(elems[i], &mp.Proofs[i].(*MerkleProof).Proof, uint32(index), (*c)[i].(*MerkleCommitment).Root)
+	agg := &MerkleAggProof{Proofs: make([]Proof, len(groups))}
+	for g, group := range groups {
+		ps := make([]*merkle.Proof, len(group))
+		for i, j := range group {
+			ps[i] = &(*proofs)[j].(*MerkleProof).Proof
+		}
+		mp, err := merkle.MergeProofs(ps)
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		agg.Proofs[g] = &MerkleMultiProof{Proof: *mp}
+	}
+	return agg, nil
+}
+
+// Verifies the multiproof of each distinct commitment
+func (params *MerkleParams) VerifyAggregation(aggProof AggProof, c *[]Commitment, idxs []int, elems []database.Record) bool {
+	mp, ok := aggProof.(*MerkleAggProof)
+	if !ok || len(idxs) != len(elems) || len(idxs) != len(*c) {
+		return false
+	}
+	groups, ok := groupByCommitment(*c)
+	if !ok || len(groups) != len(mp.Proofs) {
+		return false
+	}
+	for g, group := range groups {
+		gIdxs := make([]int, len(group))
+		gElems := make([]database.Record, len(group))
+		for i, j := range group {
+			gIdxs[i], gElems[i] = idxs[j], elems[j]
 		}
-		if !b {
+		p, ok := mp.Proofs[g].(*MerkleMultiProof)
+		if !ok || !params.VerifyMulti((*c)[group[0]], p, gIdxs, gElems) {
 			return false
 		}
 	}
@@ -114,20 +220,34 @@ func (params *MerkleParams) ProofToBytes(p Proof) []byte {
 }
 
 func (params *MerkleParams) BytesToProof(in []byte) (Proof, error) {
-	return &MerkleProof{Proof: *merkle.DecodeProof(in)}, nil
+	p, err := merkle.DecodeProof(in)
+	if err != nil {
+		return nil, err
+	}
+	return &MerkleProof{Proof: *p}, nil
 }
 
 func (params *MerkleParams) Type() VcType {
 	return VC_MerkleTree
 }
 
+// Merkle trees have no public parameters
+func (params *MerkleParams) ParamsDigest() []byte {
+	return nil
+}
+
 func (params *MerkleParams) EqualCommitments(c1, c2 Commitment) bool {
-	return bytes.Equal(c1.(*MerkleCommitment).Root, c2.(*MerkleCommitment).Root)
+	mc1, ok1 := c1.(*MerkleCommitment)
+	mc2, ok2 := c2.(*MerkleCommitment)
+	return ok1 && ok2 && bytes.Equal(mc1.Root, mc2.Root)
 }
 
 func (params *MerkleParams) EqualProofs(c1, c2 Proof) bool {
-	mc1 := c1.(*MerkleProof)
-	mc2 := c2.(*MerkleProof)
+	mc1, ok1 := c1.(*MerkleProof)
+	mc2, ok2 := c2.(*MerkleProof)
+	if !ok1 || !ok2 {
+		return false
+	}
 	if mc1.Proof.Index == mc2.Proof.Index || len(mc1.Proof.Hashes) == len(mc2.Proof.Hashes) {
 		for i := 0; i < len(mc1.Proof.Hashes); i++ {
 			if !bytes.Equal(mc1.Proof.Hashes[i], mc2.Proof.Hashes[i]) {
@@ -139,18 +259,50 @@ func (params *MerkleParams) EqualProofs(c1, c2 Proof) bool {
 	return false
 }
 
-// Works only for additions
-func (params *MerkleParams) UpdateMulti(c Commitment, vec Vector, ops []database.Update) (Commitment, Vector) {
+// Applies EDITs and ADDs to the tree and returns the commitment to the new
+// root. An ADD at the index after the last leaf appends a leaf, growing the
+// tree beyond N leaves.
+func (params *MerkleParams) UpdateMulti(c Commitment, vec Vector, ops []database.Update) (Commitment, Vector, error) {
 	root, err := vec.(*MerkleVector).MerkleTree.UpdateMulti(ops)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
+	}
+	return &MerkleCommitment{Root: root}, vec, nil
+}
+
+// UpdateProofs patches the sibling hash each proof shares with the path of
+// op.Idx, old is not needed.
+func (params *MerkleParams) UpdateProofs(v Vector, proofs []Proof, op database.Update, _ database.Record) error {
+	tree := v.(*MerkleVector)
+	for _, p := range proofs {
+		if err := tree.UpdateProof(&p.(*MerkleProof).Proof, uint32(op.Idx)); err != nil {
+			return err
+		}
 	}
-	return &MerkleCommitment{Root: root}, vec
+	return nil
 }
-func (params *MerkleParams) Update(c Commitment, vec Vector, op database.Update) (Commitment, Vector) {
+
+// UpdateMultiProof patches the hashes of p on the paths of the updated
+// records.
+func (params *MerkleParams) UpdateMultiProof(v Vector, p Proof, idxs []int) (bool, error) {
+	mp, ok := p.(*MerkleMultiProof)
+	if !ok {
+		return false, fmt.Errorf("%w: unexpected proof %T", ErrParamMismatch, p)
+	}
+	indices := make([]uint32, len(idxs))
+	for i, idx := range idxs {
+		if idx < 0 {
+			return false, fmt.Errorf("%w: index %d out of range", ErrParamMismatch, idx)
+		}
+		indices[i] = uint32(idx)
+	}
+	return v.(*MerkleVector).UpdateMultiProof(&mp.Proof, indices)
+}
+
+func (params *MerkleParams) Update(c Commitment, vec Vector, op database.Update) (Commitment, Vector, error) {
 	root, err := vec.(*MerkleVector).MerkleTree.Update(op)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	return &MerkleCommitment{Root: root}, vec.(*MerkleVector)
+	return &MerkleCommitment{Root: root}, vec.(*MerkleVector), nil
 }
@@ -1,18 +1,22 @@
 package vc
 
 import (
+	"bytes"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"log"
+	"sync"
 	"tapir/modules/database"
 	"tapir/modules/pp"
 )
 
 func init() {
-	pp := PointProof{}
-	gob.Register(Proof(&pp))
+	p := PointProof{}
+	gob.Register(Proof(&p))
 	pc := PPCommitment{}
 	gob.Register(Commitment(&pc))
+	gob.Register(AggProof(&pp.G1{}))
 }
 
 type PPParams struct {
@@ -34,7 +38,7 @@ type PointProof struct {
 }
 
 func (params *PPParams) Equals(other VCParams) (bool, error) {
-	if params.N != other.(*PPParams).N {
+	if o, ok := other.(*PPParams); !ok || params.N != o.N || !bytes.Equal(params.Digest, o.Digest) {
 		return false, errors.New("VC Params not equal")
 	}
 	return true, nil
@@ -44,9 +48,9 @@ func (params *PPParams) Type() VcType {
 	return VC_PointProof
 }
 
-func (params *PPParams) VectorFromRecords(recs []database.Record) Vector {
-	if len(recs) != params.N {
-		panic("Vector length does not match setup")
+func (params *PPParams) VectorFromRecords(recs []database.Record) (Vector, error) {
+	if err := checkLength(len(recs), params.N); err != nil {
+		return nil, err
 	}
 
 	v := make([]*pp.Zr, params.N)
@@ -56,7 +60,7 @@ func (params *PPParams) VectorFromRecords(recs []database.Record) Vector {
 		v[i] = vecElem
 	}
 
-	return &PPVector{Vec: v}
+	return &PPVector{Vec: v}, nil
 }
 
 func (params *PPParams) ProofToBytes(p Proof) []byte {
@@ -71,44 +75,94 @@ func (params *PPParams) BytesToProof(in []byte) (Proof, error) {
 	return &PointProof{Point: *p}, nil
 }
 
-func SetupPointProof(n int, seed int) *PPParams {
+// PointProof parameters come from a trusted setup and must be shared by the
+// client and both servers. Parameters are kept per vector length n, either
+// loaded from a file (LoadPointProofParams) or, if AllowLocalSetup was
+// called, set up once per process.
+var ppParams = struct {
+	sync.Mutex
+	byN map[int]*pp.PP
+}{byN: make(map[int]*pp.PP)}
 
-	params := pp.NewPublicParams(n)
-	return &PPParams{params}
+// LoadPointProofParams loads public parameters from path, subsequent calls
+// to NewVc(VC_PointProof, n) with n equal to their vector length use them.
+func LoadPointProofParams(path string) (*PPParams, error) {
+	params, err := pp.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	SetPointProofParams(params)
+	return &PPParams{params}, nil
+}
+
+// SetPointProofParams makes NewVc(VC_PointProof, params.N) use params
+func SetPointProofParams(params *pp.PP) {
+	ppParams.Lock()
+	defer ppParams.Unlock()
+	ppParams.byN[params.N] = params
+}
+
+// SetupPointProof returns the loaded parameters for vectors of length n
+func SetupPointProof(n int) (*PPParams, error) {
+	ppParams.Lock()
+	defer ppParams.Unlock()
+	params, ok := ppParams.byN[n]
+	if !ok {
+		if !localSetup.Load() {
+			return nil, fmt.Errorf("%w: PointProof for n=%d", ErrNoParams, n)
+		}
+		log.Printf("no PointProof parameters loaded for n=%d, running a process-local setup", n)
+		params = pp.NewPublicParams(n)
+		ppParams.byN[n] = params
+	}
+	return &PPParams{params}, nil
+}
+
+// ParamsDigest identifies the public parameters, all parties must agree on it
+func (params *PPParams) ParamsDigest() []byte {
+	return params.Digest
 }
 
 func (params *PPParams) Commit(v Vector) Commitment {
 	return &PPCommitment{Commitment: *pp.Commit(params.PP, v.(*PPVector).Vec)}
 }
-func (params *PPParams) Open(v Vector, idx int, _ Commitment) Proof {
-
+func (params *PPParams) Open(v Vector, idx int, _ Commitment) (Proof, error) {
 	vec := v.(*PPVector)
+	if !(0 <= idx && idx < len(vec.Vec)) {
+		return nil, fmt.Errorf("%w: index %d out of range", ErrParamMismatch, idx)
+	}
 
 	_, proof := pp.Open(params.PP, idx, vec.Vec)
-	return &PointProof{Point: *proof}
+	return &PointProof{Point: *proof}, nil
 }
 
 func (params *PPParams) Verify(c Commitment, p Proof, idx int, elem database.Record) bool {
+	pr, ok := p.(*PointProof)
+	com, okc := c.(*PPCommitment)
 	// Making sure in index lies in the boundaries
-	if !(0 <= idx && idx < params.N) {
-		panic("out of range index")
+	if !ok || !okc || !(0 <= idx && idx < params.N) {
+		return false
 	}
-	err := pp.Verify(params.PP, pp.FieldElementFromBytes(elem), &p.(*PointProof).Point, &c.(*PPCommitment).Commitment, idx)
+	err := pp.Verify(params.PP, pp.FieldElementFromBytes(elem), &pr.Point, &com.Commitment, idx)
 
 	return err == nil
 }
 
 func (params *PPParams) EqualCommitments(c1, c2 Commitment) bool {
-	return c1.(*PPCommitment).Commitment.Equals(&c2.(*PPCommitment).Commitment)
+	pc1, ok1 := c1.(*PPCommitment)
+	pc2, ok2 := c2.(*PPCommitment)
+	return ok1 && ok2 && pc1.Commitment.Equals(&pc2.Commitment)
 }
 
 func (params *PPParams) EqualProofs(c1, c2 Proof) bool {
-	return c1.(*PointProof).Point.Equals(&c2.(*PointProof).Point)
+	p1, ok1 := c1.(*PointProof)
+	p2, ok2 := c2.(*PointProof)
+	return ok1 && ok2 && p1.Point.Equals(&p2.Point)
 }
 
-func (params *PPParams) Aggregate(proofs *[]Proof, coms *[]Commitment) AggProof {
+func (params *PPParams) Aggregate(proofs *[]Proof, coms *[]Commitment) (AggProof, error) {
 	if len(*proofs) != len(*coms) {
-		panic(fmt.Sprintf("cannot aggregate %d proofs corresponding to %d commitments", len(*proofs), len(*coms)))
+		return nil, fmt.Errorf("%w: cannot aggregate %d proofs corresponding to %d commitments", ErrParamMismatch, len(*proofs), len(*coms))
 	}
 	ps := make([]*pp.G1, len(*proofs))
 	cs := make([]*pp.G1, len(*proofs))
@@ -120,35 +174,56 @@ func (params *PPParams) Aggregate(proofs *[]Proof, coms *[]Commitment) AggProof
 
 	aggP := pp.Aggregate(params.PP, cs, ps, pp.RO)
 
-	return AggProof(aggP)
+	return AggProof(aggP), nil
 }
 
 func (params *PPParams) VerifyAggregation(aggProof AggProof, coms *[]Commitment, indices []int, elems []database.Record) bool {
+	agg, ok := aggProof.(*pp.G1)
+	if !ok || len(indices) != len(*coms) || len(elems) != len(*coms) {
+		return false
+	}
 	cs := make([]*pp.G1, len(*coms))
 	for i := range *coms {
-		cs[i] = &(*coms)[i].(*PPCommitment).Commitment
+		c, ok := (*coms)[i].(*PPCommitment)
+		if !ok || !(0 <= indices[i] && indices[i] < params.N) {
+			return false
+		}
+		cs[i] = &c.Commitment
 	}
-	res := pp.VerifyAggregationRecords(params.PP, indices, cs, aggProof.(*pp.G1), elems, pp.RO)
+	res := pp.VerifyAggregationRecords(params.PP, indices, cs, agg, elems, pp.RO)
 	return res == nil
 }
 
-func (params *PPParams) UpdateMulti(c Commitment, v Vector, ops []database.Update) (Commitment, Vector) {
-	vec := v.(*PPVector)
+func (params *PPParams) UpdateMulti(c Commitment, v Vector, ops []database.Update) (Commitment, Vector, error) {
 	for _, op := range ops {
-		fieldElem := pp.FieldElementFromBytes(op.Val)
-		pp.Update(params.PP, &(c.(*PPCommitment).Commitment), vec.Vec, fieldElem, op.Idx%len(vec.Vec))
-
-		vec.Vec[op.Idx] = fieldElem
-
+		var err error
+		if c, v, err = params.Update(c, v, database.Update{Op: op.Op, Idx: op.Idx % params.N, Val: op.Val}); err != nil {
+			return nil, nil, err
+		}
+	}
+	return c, v, nil
+}
+func (params *PPParams) UpdateProofs(_ Vector, proofs []Proof, op database.Update, old database.Record) error {
+	if !(0 <= op.Idx && op.Idx < len(proofs)) {
+		return fmt.Errorf("%w: index %d out of range", ErrParamMismatch, op.Idx)
+	}
+	prev := pp.FieldElementFromBytes(old)
+	mi := pp.FieldElementFromBytes(op.Val)
+	for j, p := range proofs {
+		pp.UpdateProof(params.PP, &p.(*PointProof).Point, j, prev, mi, op.Idx)
 	}
-	return c, vec
+	return nil
 }
-func (params *PPParams) Update(c Commitment, v Vector, op database.Update) (Commitment, Vector) {
+
+func (params *PPParams) Update(c Commitment, v Vector, op database.Update) (Commitment, Vector, error) {
 	vec := v.(*PPVector)
+	if !(0 <= op.Idx && op.Idx < len(vec.Vec)) {
+		return nil, nil, fmt.Errorf("%w: index %d out of range", ErrParamMismatch, op.Idx)
+	}
 	fieldElem := pp.FieldElementFromBytes(op.Val)
 	com := c.(*PPCommitment)
 	pp.Update(params.PP, &(com.Commitment), vec.Vec, fieldElem, op.Idx)
 	vec.Vec[op.Idx] = fieldElem
 
-	return com, vec
+	return com, vec, nil
 }
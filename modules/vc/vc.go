@@ -2,25 +2,79 @@ package vc
 
 import (
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync/atomic"
 	"tapir/modules/database"
 )
 
-const VC_SEED = 42
+var (
+	ErrUnsupported   = errors.New("unsupported vector commitment")
+	ErrParamMismatch = errors.New("vector commitment parameter mismatch")
+	// ErrNoParams is returned for a scheme with a trusted setup if no
+	// parameters for the vector length were loaded
+	ErrNoParams = errors.New("no vector commitment parameters loaded")
+)
+
+// localSetup allows a process-local trusted setup, see AllowLocalSetup
+var localSetup atomic.Bool
 
+// AllowLocalSetup makes NewVc, SetupPointProof and SetupKZG run a trusted
+// setup for vector lengths without loaded parameters instead of failing with
+// ErrNoParams. Parameters set up this way are not shared with other
+// processes, so this is only suitable for tests and benchmarks where all
+// parties run in the same process.
+func AllowLocalSetup(allow bool) {
+	localSetup.Store(allow)
+}
+
+// VCParams is a vector commitment scheme. The verification methods get
+// commitments and proofs from untrusted parties, they return false for
+// malformed values, e.g., a proof of another scheme, instead of panicking.
 type VCParams interface {
-	VectorFromRecords([]database.Record) Vector
+	VectorFromRecords([]database.Record) (Vector, error)
 	Commit(v Vector) Commitment
-	Open(v Vector, idx int, c Commitment) Proof
+	Open(v Vector, idx int, c Commitment) (Proof, error)
 	Verify(c Commitment, p Proof, idx int, elem database.Record) bool
-	UpdateMulti(c Commitment, vec Vector, ops []database.Update) (Commitment, Vector)
-	Update(c Commitment, vec Vector, op database.Update) (Commitment, Vector)
+	UpdateMulti(c Commitment, vec Vector, ops []database.Update) (Commitment, Vector, error)
+	Update(c Commitment, vec Vector, op database.Update) (Commitment, Vector, error)
 	ProofToBytes(p Proof) []byte
 	BytesToProof(in []byte) (Proof, error)
 	Type() VcType
 	EqualCommitments(c0 Commitment, c1 Commitment) bool
 	EqualProofs(p0 Proof, p1 Proof) bool
-	Aggregate(*[]Proof, *[]Commitment) AggProof
+	Aggregate(*[]Proof, *[]Commitment) (AggProof, error)
 	VerifyAggregation(AggProof, *[]Commitment, []int, []database.Record) bool
+	// ParamsDigest identifies the public parameters of the scheme, it is
+	// nil for schemes without a setup
+	ParamsDigest() []byte
+}
+
+// MultiOpener is implemented by schemes whose opening of several indices of
+// one commitment is smaller than the individual openings, e.g., Merkle
+// multiproofs, where sibling hashes shared by several paths are sent once.
+type MultiOpener interface {
+	OpenMulti(v Vector, idxs []int, c Commitment) (Proof, error)
+	VerifyMulti(c Commitment, p Proof, idxs []int, elems []database.Record) bool
+	MultiProofToBytes(p Proof) []byte
+	BytesToMultiProof(in []byte) (Proof, error)
+}
+
+// MultiProofUpdater is implemented by MultiOpeners whose multiproofs can be
+// brought up to date after updates faster than by opening them again.
+type MultiProofUpdater interface {
+	// UpdateMultiProof updates p, a multiproof of v, after the records at
+	// idxs were updated in v, and reports whether p changed.
+	UpdateMultiProof(v Vector, p Proof, idxs []int) (bool, error)
+}
+
+// ProofUpdater is implemented by schemes whose opening proofs can be brought
+// up to date after an update faster than by opening all indices again, e.g.,
+// PointProofs, where each proof changes by a single group element.
+type ProofUpdater interface {
+	// UpdateProofs updates proofs, the proofs of all indices of v, after op
+	// was applied to v. old is the record previously stored at op.Idx.
+	UpdateProofs(v Vector, proofs []Proof, op database.Update, old database.Record) error
 }
 
 type AggProof interface{}
@@ -38,6 +92,7 @@ const (
 	None VcType = iota
 	VC_PointProof
 	VC_MerkleTree
+	VC_KZG
 )
 
 func (t VcType) String() string {
@@ -45,22 +100,67 @@ func (t VcType) String() string {
 		"None",
 		"PointProof",
 		"MerkleTree",
+		"KZG",
 	}[t]
 }
 
-func NewVc(t VcType, n int) VCParams {
+// NewVc returns the parameters of scheme t for vectors of length n, nil for
+// None. PointProof and KZG require parameters for n to be loaded, see
+// AllowLocalSetup.
+func NewVc(t VcType, n int) (VCParams, error) {
 	switch t {
 	case VC_PointProof:
-		vc := SetupPointProof(n, VC_SEED)
+		vc, err := SetupPointProof(n)
+		if err != nil {
+			return nil, err
+		}
 		gob.Register(VCParams(vc))
-		return vc
+		return vc, nil
 	case VC_MerkleTree:
 		vc := SetupMerkle(n)
 		gob.Register(VCParams(vc))
-		return vc
+		return vc, nil
+	case VC_KZG:
+		vc, err := SetupKZG(n)
+		if err != nil {
+			return nil, err
+		}
+		gob.Register(VCParams(vc))
+		return vc, nil
 	case None:
-		return nil
+		return nil, nil
 	default:
-		panic("Unknown VC type")
+		return nil, fmt.Errorf("%w: type %d", ErrUnsupported, int(t))
+	}
+}
+
+// LoadParams loads the parameter file at path for scheme t, see
+// LoadPointProofParams and LoadKZGParams. PointProof and KZG require the
+// file, the other schemes ignore path and return nil parameters.
+func LoadParams(t VcType, path string) (VCParams, error) {
+	switch {
+	case t == VC_PointProof && path != "":
+		params, err := LoadPointProofParams(path)
+		if err != nil {
+			return nil, err
+		}
+		return params, nil
+	case t == VC_KZG && path != "":
+		params, err := LoadKZGParams(path)
+		if err != nil {
+			return nil, err
+		}
+		return params, nil
+	case t == VC_PointProof || t == VC_KZG:
+		return nil, fmt.Errorf("%w: %v requires a parameter file", ErrNoParams, t)
+	}
+	return nil, nil
+}
+
+// checkLength checks that a vector of n elements fits the parameters
+func checkLength(n, expected int) error {
+	if n != expected {
+		return fmt.Errorf("%w: vector of length %d, setup for %d", ErrParamMismatch, n, expected)
 	}
+	return nil
 }
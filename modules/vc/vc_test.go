@@ -2,35 +2,97 @@ package vc
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand/v2"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
 	"tapir/modules/database"
+	"tapir/modules/kzg"
+	"tapir/modules/pp"
 	"tapir/modules/utils"
 )
 
 const RECSIZE = 32
 
+// Parties of the tests run in the same process and share the parameters of
+// a process-local trusted setup
+func TestMain(m *testing.M) {
+	AllowLocalSetup(true)
+	os.Exit(m.Run())
+}
+
+func newVc(t testing.TB, vcType VcType, n int) VCParams {
+	vc, err := NewVc(vcType, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vc
+}
+
+func vector(t testing.TB, vc VCParams, recs []database.Record) Vector {
+	v, err := vc.VectorFromRecords(recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func open(t testing.TB, vc VCParams, v Vector, idx int, c Commitment) Proof {
+	p, err := vc.Open(v, idx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// openedIndices returns the indices a test opens for a vector of length n:
+// all of them, except for KZG, whose openings take time linear in n, where
+// every 37th index and the last one are opened
+func openedIndices(vcType VcType, n int) []int {
+	step := 1
+	if vcType == VC_KZG {
+		step = 37
+	}
+	var idxs []int
+	for i := 0; i < n; i += step {
+		idxs = append(idxs, i)
+	}
+	if idxs[len(idxs)-1] != n-1 {
+		idxs = append(idxs, n-1)
+	}
+	return idxs
+}
+
+func aggregate(t testing.TB, vc VCParams, proofs *[]Proof, coms *[]Commitment) AggProof {
+	agg, err := vc.Aggregate(proofs, coms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return agg
+}
+
 func TestVC(t *testing.T) {
 	n := 1000          // 1000
 	recSize := RECSIZE // NOTE: was 16 before RECSIZE, so it is the same // 128 does not work
 
-	vcTypes := []VcType{VC_MerkleTree, VC_PointProof}
+	vcTypes := []VcType{VC_MerkleTree, VC_PointProof, VC_KZG}
 	for _, vcType := range vcTypes {
 
 		log.Println("TestVC:", vcType)
 
 		// Create a new PointProofParams
-		vc := NewVc(vcType, n)
-		vc2 := NewVc(vcType, n)
+		vc := newVc(t, vcType, n)
+		vc2 := newVc(t, vcType, n)
 		seed := [32]byte{34}
 		prg := rand.NewChaCha8(seed)
 		db := database.MakeRandomRows(prg, n, recSize)
-		v := vc.VectorFromRecords(db)
-		v2 := vc2.VectorFromRecords(db)
+		v := vector(t, vc, db)
+		v2 := vector(t, vc2, db)
 
 		// Commit the vector
 		commitment := vc.Commit(v)
@@ -43,9 +105,10 @@ func TestVC(t *testing.T) {
 			t.Fatalf("commitments not equal (check via vc2)")
 		}
 
-		for i, rec := range db {
-			proof := vc.Open(v, i, commitment)
-			proof2 := vc2.Open(v2, i, commitment2)
+		for _, i := range openedIndices(vcType, n) {
+			rec := db[i]
+			proof := open(t, vc, v, i, commitment)
+			proof2 := open(t, vc2, v2, i, commitment2)
 
 			if !vc.EqualProofs(proof, proof2) {
 				t.Fatalf("proofs not equal (check via vc)")
@@ -71,23 +134,24 @@ func TestProofEncodeDecode(t *testing.T) {
 	n := 1000          // 1000
 	recSize := RECSIZE // NOTE: was 16 before RECSIZE, so it is the same // 128 does not work
 
-	vcTypes := []VcType{VC_MerkleTree, VC_PointProof}
+	vcTypes := []VcType{VC_MerkleTree, VC_PointProof, VC_KZG}
 	for _, vcType := range vcTypes {
 
 		log.Println("TestProofEncodeDecode:", vcType)
 
 		// Create a new PointProofParams
-		vc := NewVc(vcType, n)
+		vc := newVc(t, vcType, n)
 		seed := [32]byte{34}
 		prg := rand.NewChaCha8(seed)
 		db := database.MakeRandomRows(prg, n, recSize)
-		v := vc.VectorFromRecords(db)
+		v := vector(t, vc, db)
 
 		// Commit the vector
 		commitment := vc.Commit(v)
 
-		for i, rec := range db {
-			proof := vc.Open(v, i, nil)
+		for _, i := range openedIndices(vcType, n) {
+			rec := db[i]
+			proof := open(t, vc, v, i, nil)
 			encP := vc.ProofToBytes(proof)
 			decP, err := vc.BytesToProof(encP)
 			if err != nil {
@@ -104,6 +168,11 @@ func TestProofEncodeDecode(t *testing.T) {
 				if !reflect.DeepEqual(ogP.Point, decP.(*PointProof).Point) {
 					t.Fatal(vcType.String(), ": proof and decrypted proof are not equal")
 				}
+			} else if vcType == VC_KZG {
+				ogP := proof.(*KZGProof)
+				if !reflect.DeepEqual(ogP.Point, decP.(*KZGProof).Point) {
+					t.Fatal(vcType.String(), ": proof and decrypted proof are not equal")
+				}
 			}
 			//log.Println("len", i, ":", lens[i])
 			if !vc.Verify(commitment, proof, i, rec) {
@@ -132,7 +201,7 @@ func TestVCAggregation(t *testing.T) {
 	prg := rand.NewChaCha8(seed)
 	db := database.MakeRandomRows(prg, n, recSize)
 
-	vcTypes := []VcType{VC_MerkleTree} //, VC_PointProof}
+	vcTypes := []VcType{VC_MerkleTree, VC_KZG} //, VC_PointProof}
 
 	vecs := make([]Vector, numParts)
 	coms := make([]Commitment, numParts)
@@ -140,18 +209,18 @@ func TestVCAggregation(t *testing.T) {
 
 	for _, vcType := range vcTypes {
 
-		vc := NewVc(vcType, partSize)
+		vc := newVc(t, vcType, partSize)
 		log.Println("TestVCAggregation:", vcType)
 
 		for i := 0; i < numParts; i++ {
 			partition := db[i*partSize : (i+1)*partSize]
 			// Create a new PointProofParams
-			vecs[i] = vc.VectorFromRecords(partition)
+			vecs[i] = vector(t, vc, partition)
 			coms[i] = vc.Commit(vecs[i])
 			proofs[i] = make([]Proof, partSize)
 
 			for j, rec := range partition {
-				proofs[i][j] = vc.Open(vecs[i], j, coms[i])
+				proofs[i][j] = open(t, vc, vecs[i], j, coms[i])
 				// test proof correctness for first instance
 				if vc.Verify(coms[i], proofs[i][j], (j+1)%partSize, rec) {
 					t.Fatalf("%v proof %v should not have verified", vcType, j)
@@ -171,7 +240,7 @@ func TestVCAggregation(t *testing.T) {
 			toaggProofs[i] = proofs[i][indices[i]]
 			aggRecs[i] = db[i*partSize+indices[i]]
 		} // Aggregate the proofs
-		aggProof := vc.Aggregate(&toaggProofs, &coms)
+		aggProof := aggregate(t, vc, &toaggProofs, &coms)
 		if aggProof == nil {
 			t.Fatalf("%v aggregation failed", vcType)
 		}
@@ -186,14 +255,14 @@ func TestPointProof(t *testing.T) {
 
 	n := 1000
 	// Create a new PointProofParams
-	vc := NewVc(VC_PointProof, n)
+	vc := newVc(t, VC_PointProof, n)
 
 	// Create a new PointProofVector
 
 	seed := [32]byte{1}
 	prg := rand.NewChaCha8(seed)
 	records := database.MakeRandomRows(prg, n, RECSIZE)
-	v := vc.VectorFromRecords(records)
+	v := vector(t, vc, records)
 
 	// Commit the vector
 	commitment := vc.Commit(v)
@@ -201,7 +270,7 @@ func TestPointProof(t *testing.T) {
 	for i, rec := range records {
 
 		// Open the vector at index 1
-		proof := vc.Open(v, i, nil)
+		proof := open(t, vc, v, i, nil)
 
 		// Verify the proof
 		if !vc.Verify(commitment, proof, i, rec) {
@@ -225,14 +294,14 @@ func TestPointProofAggregation(t *testing.T) {
 	log.Println("TestPointProofAggregation")
 	n := 1000
 	// Create a new PointProofParams
-	vc := NewVc(VC_PointProof, n)
+	vc := newVc(t, VC_PointProof, n)
 
 	// Create a new PointProofVector
 
 	seed := [32]byte{1}
 	prg := rand.NewChaCha8(seed)
 	records := database.MakeRandomRows(prg, n, RECSIZE)
-	v := vc.VectorFromRecords(records)
+	v := vector(t, vc, records)
 
 	// Commit the vector
 	commitment := vc.Commit(v)
@@ -240,7 +309,7 @@ func TestPointProofAggregation(t *testing.T) {
 	for i, rec := range records {
 
 		// Open the vector at index 1
-		proof := vc.Open(v, i, nil)
+		proof := open(t, vc, v, i, nil)
 
 		// Verify the proof
 		if !vc.Verify(commitment, proof, i, rec) {
@@ -267,7 +336,7 @@ func TestVCUpdate(t *testing.T) {
 	seed := [32]byte{42}
 	prg := rand.NewChaCha8(seed)
 
-	vcTypes := []VcType{VC_MerkleTree, VC_PointProof}
+	vcTypes := []VcType{VC_MerkleTree, VC_PointProof, VC_KZG}
 	for _, vcType := range vcTypes {
 		rows := database.MakeRandomRows(prg, n, recSize)
 		db := database.DBFromRecords(rows)
@@ -286,8 +355,8 @@ func TestVCUpdate(t *testing.T) {
 		log.Println("TestVCUpdate:", vcType)
 
 		// Create a new PointProofParams
-		vc := NewVc(vcType, n)
-		v := vc.VectorFromRecords(rows)
+		vc := newVc(t, vcType, n)
+		v := vector(t, vc, rows)
 
 		// Commit the vector
 		c := vc.Commit(v)
@@ -298,13 +367,16 @@ func TestVCUpdate(t *testing.T) {
 			db2.Update([]database.Update{op})
 			newVal := db2.GetRecord(i)
 
-			c, v := vc.Update(c, v, op)
+			c, v, err := vc.Update(c, v, op)
+			if err != nil {
+				t.Fatal(err)
+			}
 
 			if i < db.N {
 				oldVal = db.GetRecord(i)
 			}
 
-			proof := vc.Open(v, i, c)
+			proof := open(t, vc, v, i, c)
 
 			if !vc.Verify(c, proof, i, newVal) {
 				t.Fatal(vcType, ": proof did not verify but should have")
@@ -346,8 +418,8 @@ func TestVCUpdate(t *testing.T) {
 // 		log.Println("TestVCUpdate:", vcType)
 
 // 		// Create a new PointProofParams
-// 		vc := NewVc(vcType, n)
-// 		v := vc.VectorFromRecords(rows)
+// 		vc := newVc(t, vcType, n)
+// 		v := vector(t, vc, rows)
 
 // 		// Commit the vector
 // 		commitment := vc.Commit(v)
@@ -355,7 +427,7 @@ func TestVCUpdate(t *testing.T) {
 
 // 		rows2 := db2.GetRecords(0, db2.N)
 
-// 		v2 := vc.VectorFromRecords(rows2)
+// 		v2 := vector(t, vc, rows2)
 
 // 		for i := range db2.N {
 // 			var oldVal = make([]byte, recSize)
@@ -364,7 +436,7 @@ func TestVCUpdate(t *testing.T) {
 // 				oldVal = db.GetRecord(i)
 // 			}
 
-// 			proof := vc.Open(v2, i, c2)
+// 			proof := open(t, vc, v2, i, c2)
 
 // 			if !vc.Verify(c2, proof, i, newVal) {
 // 				t.Fatal(vcType, ": proof did not verify but should have")
@@ -383,10 +455,10 @@ func ExamplePointProof() {
 
 	n := 3
 	// Create a new PointProofParams
-	vc := NewVc(VC_PointProof, n)
+	vc, _ := NewVc(VC_PointProof, n)
 
 	// Create a new PointProofVector
-	v := vc.VectorFromRecords([]database.Record{
+	v, _ := vc.VectorFromRecords([]database.Record{
 		[]byte{0, 0, 0, 0},
 		[]byte{1, 1, 1, 1},
 		[]byte{2, 2, 2, 2},
@@ -396,7 +468,7 @@ func ExamplePointProof() {
 	commitment := vc.Commit(v)
 
 	// Open the vector at index 1
-	proof := vc.Open(v, 1, nil)
+	proof, _ := vc.Open(v, 1, nil)
 
 	// Verify the proof
 	if vc.Verify(commitment, proof, 1, []byte{1, 1, 1, 1}) {
@@ -429,10 +501,10 @@ func ExampleMerkleProof() {
 
 	n := 10
 	// Create new MerkleParams
-	vc := NewVc(VC_MerkleTree, n)
+	vc, _ := NewVc(VC_MerkleTree, n)
 
 	// Create a new PointProofVector
-	v := vc.VectorFromRecords([]database.Record{
+	v, _ := vc.VectorFromRecords([]database.Record{
 		[]byte{0, 0, 0, 0},
 		[]byte{1, 1, 1, 1},
 		[]byte{2, 2, 2, 2},
@@ -449,7 +521,7 @@ func ExampleMerkleProof() {
 	commitment := vc.Commit(v)
 
 	// Open the vector at index 1
-	proof := vc.Open(v, 1, commitment)
+	proof, _ := vc.Open(v, 1, commitment)
 
 	// Verify the proof
 	if vc.Verify(commitment, proof, 1, []byte{1, 1, 1, 1}) {
@@ -477,3 +549,247 @@ func ExampleMerkleProof() {
 	// Proof not verified
 	// Proof not verified
 }
+
+func TestPointProofLoadParams(t *testing.T) {
+	log.Println("TestPointProofLoadParams")
+
+	// use a size no other test sets up, so the parameters are not cached yet
+	n := 13
+	params := pp.NewPublicParams(n)
+	path := filepath.Join(t.TempDir(), "pp.bin")
+	if err := params.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	// without the parameters or a local setup NewVc fails
+	AllowLocalSetup(false)
+	_, err := NewVc(VC_PointProof, n)
+	AllowLocalSetup(true)
+	if !errors.Is(err, ErrNoParams) {
+		t.Fatal("expected missing parameters, got", err)
+	}
+	if _, err := LoadPointProofParams(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// all parties calling NewVc now use the loaded parameters
+	vc0 := newVc(t, VC_PointProof, n)
+	vc1 := newVc(t, VC_PointProof, n)
+	if !bytes.Equal(vc0.ParamsDigest(), params.Digest) || !bytes.Equal(vc1.ParamsDigest(), params.Digest) {
+		t.Fatal("NewVc did not use the loaded parameters")
+	}
+
+	// parameters of an independent setup are distinguishable
+	other := &PPParams{pp.NewPublicParams(n)}
+	if bytes.Equal(other.ParamsDigest(), vc0.ParamsDigest()) {
+		t.Fatal("independent setups have the same digest")
+	}
+	if ok, _ := vc0.(*PPParams).Equals(other); ok {
+		t.Fatal("parameters of independent setups are equal")
+	}
+}
+
+func TestKZGAggregationRejectsWrongRecord(t *testing.T) {
+	log.Println("TestKZGAggregationRejectsWrongRecord")
+
+	n := 64
+	numParts := 4
+	vc := newVc(t, VC_KZG, n)
+
+	seed := [32]byte{5}
+	prg := rand.NewChaCha8(seed)
+	coms := make([]Commitment, numParts)
+	proofs := make([]Proof, numParts)
+	recs := make([]database.Record, numParts)
+	indices := make([]int, numParts)
+	for i := range coms {
+		db := database.MakeRandomRows(prg, n, RECSIZE)
+		v := vector(t, vc, db)
+		coms[i] = vc.Commit(v)
+		// partitions 1 and 2 are opened at the same index
+		indices[i] = min(i, 2) * 7
+		proofs[i] = open(t, vc, v, indices[i], coms[i])
+		recs[i] = db[indices[i]]
+	}
+
+	aggProof := aggregate(t, vc, &proofs, &coms)
+	if !vc.VerifyAggregation(aggProof, &coms, indices, recs) {
+		t.Fatal("aggregation did not verify but should have")
+	}
+	wrong := append([]database.Record(nil), recs...)
+	wrong[2] = recs[1]
+	if vc.VerifyAggregation(aggProof, &coms, indices, wrong) {
+		t.Fatal("aggregation verified for a wrong record")
+	}
+
+	// aggregated proofs survive encoding
+	b, err := MarshalAggProof(aggProof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := UnmarshalAggProof(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !vc.VerifyAggregation(dec, &coms, indices, recs) {
+		t.Fatal("decoded aggregation did not verify")
+	}
+}
+
+func TestKZGLoadParams(t *testing.T) {
+	log.Println("TestKZGLoadParams")
+
+	// use a size no other test sets up, so the parameters are not cached yet
+	n := 13
+	srs := kzg.NewSRS(n)
+	path := filepath.Join(t.TempDir(), "kzg.bin")
+	if err := srs.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	AllowLocalSetup(false)
+	_, err := NewVc(VC_KZG, n)
+	AllowLocalSetup(true)
+	if !errors.Is(err, ErrNoParams) {
+		t.Fatal("expected missing parameters, got", err)
+	}
+	// the parameter file is required and loaded by type
+	if _, err := LoadParams(VC_KZG, ""); !errors.Is(err, ErrNoParams) {
+		t.Fatal("expected missing parameter file, got", err)
+	}
+	if params, err := LoadParams(VC_MerkleTree, path); params != nil || err != nil {
+		t.Fatal("Merkle tree loaded parameters", err)
+	}
+	params, err := LoadParams(VC_KZG, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(params.ParamsDigest(), srs.Digest) {
+		t.Fatal("loaded parameters differ")
+	}
+
+	vc0 := newVc(t, VC_KZG, n)
+	vc1 := newVc(t, VC_KZG, n)
+	if !bytes.Equal(vc0.ParamsDigest(), srs.Digest) || !bytes.Equal(vc1.ParamsDigest(), srs.Digest) {
+		t.Fatal("NewVc did not use the loaded parameters")
+	}
+	if ok, _ := vc0.(*KZGParams).Equals(&KZGParams{kzg.NewSRS(n)}); ok {
+		t.Fatal("parameters of independent setups are equal")
+	}
+}
+
+func TestMerkleAggregationSharedCommitment(t *testing.T) {
+	log.Println("TestMerkleAggregationSharedCommitment")
+
+	n := 256
+	vc := newVc(t, VC_MerkleTree, n)
+	prg := rand.NewChaCha8([32]byte{6})
+	db0 := database.MakeRandomRows(prg, n, RECSIZE)
+	db1 := database.MakeRandomRows(prg, n, RECSIZE)
+	v0, v1 := vector(t, vc, db0), vector(t, vc, db1)
+	c0, c1 := vc.Commit(v0), vc.Commit(v1)
+
+	// three openings of the first commitment, one of the second
+	coms := []Commitment{c0, c1, c0, c0}
+	indices := []int{4, 4, 5, 200}
+	recs := []database.Record{db0[4], db1[4], db0[5], db0[200]}
+	proofs := []Proof{open(t, vc, v0, 4, c0), open(t, vc, v1, 4, c1), open(t, vc, v0, 5, c0), open(t, vc, v0, 200, c0)}
+
+	aggProof := aggregate(t, vc, &proofs, &coms)
+	if n := len(aggProof.(*MerkleAggProof).Proofs); n != 2 {
+		t.Fatalf("expected one multiproof per commitment, got %d", n)
+	}
+	b, err := MarshalAggProof(aggProof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single := 0
+	for _, p := range proofs {
+		single += len(vc.ProofToBytes(p))
+	}
+	if len(b) >= single {
+		t.Fatalf("aggregated proof of %d bytes not smaller than %d bytes of single proofs", len(b), single)
+	}
+	dec, err := UnmarshalAggProof(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !vc.VerifyAggregation(dec, &coms, indices, recs) {
+		t.Fatal("aggregation did not verify but should have")
+	}
+	recs[2] = db0[6]
+	if vc.VerifyAggregation(dec, &coms, indices, recs) {
+		t.Fatal("aggregation verified for a wrong record")
+	}
+}
+
+func TestMerkleAppend(t *testing.T) {
+	log.Println("TestMerkleAppend")
+
+	n := 8
+	vc := newVc(t, VC_MerkleTree, n)
+	prg := rand.NewChaCha8([32]byte{8})
+	db := database.MakeRandomRows(prg, 2*n+1, RECSIZE)
+	v := vector(t, vc, db[:n])
+	c := vc.Commit(v)
+
+	// ADDs after the last leaf grow the tree beyond n leaves
+	for i := n; i < len(db); i++ {
+		var err error
+		if c, v, err = vc.Update(c, v, database.Update{Op: database.ADD, Idx: i, Val: db[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, rec := range db {
+		if !vc.Verify(c, open(t, vc, v, i, c), i, rec) {
+			t.Fatal("proof", i, "did not verify after appending")
+		}
+	}
+	idxs := []int{0, n, 2 * n}
+	recs := []database.Record{db[0], db[n], db[2*n]}
+	mp, err := vc.(MultiOpener).OpenMulti(v, idxs, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !vc.(MultiOpener).VerifyMulti(c, mp, idxs, recs) {
+		t.Fatal("multiproof did not verify after appending")
+	}
+}
+
+func TestMalformedInput(t *testing.T) {
+	log.Println("TestMalformedInput")
+
+	n := 16
+	if _, err := NewVc(VcType(42), n); !errors.Is(err, ErrUnsupported) {
+		t.Fatal("expected unsupported type, got", err)
+	}
+	db := database.MakeRandomRows(rand.NewChaCha8([32]byte{9}), n, RECSIZE)
+	vcTypes := []VcType{VC_MerkleTree, VC_PointProof, VC_KZG}
+	for i, vcType := range vcTypes {
+		vc := newVc(t, vcType, n)
+		if _, err := vc.VectorFromRecords(db[:n-1]); !errors.Is(err, ErrParamMismatch) {
+			t.Fatal(vcType, ": expected parameter mismatch, got", err)
+		}
+		v := vector(t, vc, db)
+		c := vc.Commit(v)
+		p := open(t, vc, v, 3, c)
+
+		// proofs and commitments of another scheme or out of range indices
+		// are rejected instead of crashing the verifier
+		other := newVc(t, vcTypes[(i+1)%len(vcTypes)], n)
+		ov := vector(t, other, db)
+		oc := other.Commit(ov)
+		op := open(t, other, ov, 3, oc)
+		if vc.Verify(c, op, 3, db[3]) || vc.Verify(oc, p, 3, db[3]) || vc.Verify(c, nil, 3, db[3]) {
+			t.Fatal(vcType, ": verified a proof of another scheme")
+		}
+		if vc.Verify(c, p, -1, db[3]) || vc.Verify(c, p, n, db[3]) {
+			t.Fatal(vcType, ": verified an out of range index")
+		}
+		if vc.EqualCommitments(c, oc) || vc.EqualProofs(p, op) {
+			t.Fatal(vcType, ": values of another scheme are equal")
+		}
+		coms := []Commitment{c, c}
+		if vc.VerifyAggregation(op, &coms, []int{3, 4}, db[3:5]) || vc.VerifyAggregation(nil, &coms, []int{3}, db[3:4]) {
+			t.Fatal(vcType, ": verified a malformed aggregation")
+		}
+	}
+}
@@ -2,9 +2,9 @@ package pir
 
 import (
 	"bytes"
+	crand "crypto/rand"
 	"errors"
-	"log"
-	"math/rand"
+	"fmt"
 	"tapir/modules/database"
 	oc "tapir/modules/osu_crypto"
 	"tapir/modules/vc"
@@ -39,14 +39,40 @@ type DPF128Answer struct {
 	AuthRecord  []byte
 }
 
+// Batch query types, one query and answer per cuckoo bucket (see batch.go).
+// The query of an empty bucket is empty.
+type DPF128BatchQuery struct {
+	Queries []DPF128Query
+}
+type DPF128BatchAnswer struct {
+	Answers []DPF128Answer
+}
+
 type DPF128Server struct {
 	Db   *database.DB
 	Role byte
+	// Workers is the number of goroutines BatchAnswer uses, runtime.NumCPU()
+	// if not positive
+	Workers int
+
+	cuckoo cuckooCache
 }
 type DPF128Client struct {
-	N          int
-	queriedIdx int
-	alpha      *oc.FieldElem
+	N int
+
+	cuckoo cuckooCache
+}
+
+// dpf128Query is the state of a query, alpha is the MAC key of its DPF keys
+type dpf128Query struct {
+	alpha *oc.FieldElem
+}
+
+// dpf128Batch is the state of a batch query, with one MAC key for all
+// buckets
+type dpf128Batch struct {
+	alpha *oc.FieldElem
+	batchState
 }
 
 ////////////////////////////////////////////////////////////
@@ -56,7 +82,10 @@ type DPF128Client struct {
 // There is no offline phase, so these functions do nothing
 
 func (s *DPF128Server) Equals(other APIRServer) (bool, error) {
-	s2 := other.(*DPF128Server)
+	s2, ok := other.(*DPF128Server)
+	if !ok {
+		return false, errors.New("server types not equal")
+	}
 	if b, err := s.Db.Equals(s2.Db); !b {
 		return false, err
 	}
@@ -69,8 +98,9 @@ func (s *DPF128Server) Equals(other APIRServer) (bool, error) {
 func (s *DPF128Server) GetVCType() vc.VcType {
 	return vc.VcType(0)
 }
-func (s *DPF128Server) SetVC(vc.VcType) {
+func (s *DPF128Server) SetVC(vc.VcType) error {
 	// Server has no VC
+	return nil
 }
 
 func (s *DPF128Server) GenDigest() (Digest, error) {
@@ -81,9 +111,8 @@ func (s *DPF128Server) GetDigest() Digest {
 	return &DPF128Digest{}
 }
 
-func (s *DPF128Server) Update(_ []database.Update) (Nt, Qt int, dt Digest, opst []database.Update) {
-	log.Fatalf("not implemented")
-	return
+func (s *DPF128Server) Update(_ []database.Update) (Nt, Qt int, dt Digest, opst []database.Update, err error) {
+	return -1, -1, nil, nil, fmt.Errorf("%w: updates of APIR_DPF128", ErrUnsupported)
 }
 
 func (s *DPF128Server) GetDB() *database.DB {
@@ -110,11 +139,26 @@ func (c *DPF128Client) EqualDigests(d0 Digest, d1 Digest) bool {
 // ONLINE PHASE
 ////////////////////////////////////////////////////////////
 
-func (c *DPF128Client) Query(i int) (Query, Query, error) {
+// Query uses a fresh random MAC key alpha for each query
+func (c *DPF128Client) Query(i int) (*QueryHandle, error) {
+	alpha := oc.NewRandomElem()
+	q0, q1, err := c.queryAlpha(i, alpha)
+	if err != nil {
+		return nil, err
+	}
+	return newHandle(c, q0, q1, dpf128Query{alpha: alpha}, nil), nil
+}
 
-	// make random seed of 16 bytes
-	seed := rand.Uint64()
-	seedAuth := rand.Uint64()
+// queryAlpha returns the DPF keys for index i with MAC key alpha
+func (c *DPF128Client) queryAlpha(i int, alpha *oc.FieldElem) (*DPF128Query, *DPF128Query, error) {
+	// independent seeds for the two pairs of keys
+	var seedAuth, seed [16]byte
+	if _, err := crand.Read(seedAuth[:]); err != nil {
+		return nil, nil, err
+	}
+	if _, err := crand.Read(seed[:]); err != nil {
+		return nil, nil, err
+	}
 
 	domain := uint64(c.N)
 
@@ -123,12 +167,8 @@ func (c *DPF128Client) Query(i int) (Query, Query, error) {
 
 	// AUTH PIR /////////////////////////////////////////////////
 
-	if c.alpha == nil {
-		c.alpha = oc.NewFieldElem()
-	}
-
 	// make some keys
-	keyAuth0, keyAuth1, keySizeAuth := oc.KeyGen(domain, points, c.alpha, seedAuth)
+	keyAuth0, keyAuth1, keySizeAuth := oc.KeyGen(domain, points, alpha, seedAuth)
 
 	// NORMAL PIR ////////////////////////////////////////////////
 
@@ -141,37 +181,173 @@ func (c *DPF128Client) Query(i int) (Query, Query, error) {
 	if keySize != keySizeAuth {
 		return nil, nil, errors.New("key sizes do not match")
 	}
+	if keySize == 0 {
+		return nil, nil, errors.New("error generating DPF keys")
+	}
 
-	return &DPF128Query{queryKey0, keyAuth0, keySize},
-		&DPF128Query{queryKey1, keyAuth1, keySize}, nil
-}
-
-func (c *DPF128Client) QueryAlpha(i int, alpha *oc.FieldElem) (Query, Query, error) {
-
-	c.alpha = alpha
-
-	return c.Query(i)
+	return &DPF128Query{queryKey0, keyAuth0, keySize}, &DPF128Query{queryKey1, keyAuth1, keySize}, nil
 }
 
 func (s *DPF128Server) Answer(query Query) (Answer, error) {
-	q := query.(*DPF128Query)
+	q, ok := query.(*DPF128Query)
+	if !ok {
+		return nil, malformedQuery(query)
+	}
+	return s.answer(q, nil)
+}
 
+// answer evaluates the keys of q on the records at indices, on all records
+// of the database if indices is nil. The keys must have the size of the
+// keys of the domain, which the client does not necessarily respect.
+func (s *DPF128Server) answer(q *DPF128Query, indices []uint32) (*DPF128Answer, error) {
 	domain := uint64(s.Db.N)
+	if indices != nil {
+		domain = uint64(len(indices))
+	}
+	size := oc.KeySize(domain)
+	if q.KeySize != size || uint64(len(q.QueryKey)) != size || uint64(len(q.AuthKey)) != size {
+		return nil, fmt.Errorf("%w: DPF keys of %d and %d bytes with key size %d, expected %d",
+			ErrMalformedQuery, len(q.QueryKey), len(q.AuthKey), q.KeySize, size)
+	}
 
 	keyExp := oc.Expand(uint64(s.Role), domain, test_numpoints, q.QueryKey, q.KeySize)
 
 	keyExpAuth := oc.Expand(uint64(s.Role), domain, test_numpoints, q.AuthKey, q.KeySize)
 
 	// multiply the keys by the database
+	if indices != nil {
+		resQuery := oc.MultiplyDBIndices(keyExp, s.Db.Data, indices)
+		resAuth := oc.MultiplyDBIndices(keyExpAuth, s.Db.Data, indices)
+		return &DPF128Answer{resQuery.Data, resAuth.Data}, nil
+	}
 	resQuery := oc.MultiplyDB(keyExp, s.Db.Data, int(domain))
 	resAuth := oc.MultiplyDB(keyExpAuth, s.Db.Data, int(domain))
 
 	return &DPF128Answer{resQuery.Data, resAuth.Data}, nil
 }
 
-func (c *DPF128Client) Reconstruct(_ Digest, _ Hint, answer0 Answer, answer1 Answer) (database.Record, error) {
+// BatchQuery generates the keys of a query per cuckoo bucket (see batch.go),
+// all with the same random MAC key alpha
+func (c *DPF128Client) BatchQuery(indices []int) (*QueryHandle, error) {
+	distinct, slot, err := checkBatch(indices, c.N)
+	if err != nil {
+		return nil, err
+	}
+	numBuckets := batchNumBuckets(len(distinct))
+	assigned, err := cuckooAssign(distinct, numBuckets)
+	if err != nil {
+		return nil, err
+	}
+	l := c.cuckoo.layout(c.N, numBuckets)
+
+	alpha := oc.NewRandomElem()
+	q0 := &DPF128BatchQuery{Queries: make([]DPF128Query, numBuckets)}
+	q1 := &DPF128BatchQuery{Queries: make([]DPF128Query, numBuckets)}
+	for b, i := range assigned {
+		size := len(l.buckets[b])
+		if size == 0 {
+			continue
+		}
+		sub := &DPF128Client{N: size}
+		b0, b1, err := sub.queryAlpha(bucketPosition(l, b, i), alpha)
+		if err != nil {
+			return nil, err
+		}
+		q0.Queries[b], q1.Queries[b] = *b0, *b1
+	}
+	return newHandle(c, q0, q1, dpf128Batch{alpha, newBatchState(distinct, slot, assigned)}, nil), nil
+}
+
+func (s *DPF128Server) BatchAnswer(query Query) (Answer, error) {
+	q, ok := query.(*DPF128BatchQuery)
+	if !ok {
+		return nil, malformedQuery(query)
+	}
+	if err := checkNumBuckets(len(q.Queries), s.Db.N); err != nil {
+		return nil, err
+	}
+	l := s.cuckoo.layout(s.Db.N, len(q.Queries))
+	answers := make([]DPF128Answer, len(q.Queries))
+	err := parallelForErr(s.Workers, len(q.Queries), func(b int) error {
+		bucket := l.buckets[b]
+		if len(bucket) == 0 {
+			answers[b] = DPF128Answer{make([]byte, BLOCKSIZE), make([]byte, BLOCKSIZE)}
+			return nil
+		}
+		a, err := s.answer(&q.Queries[b], bucket)
+		if err != nil {
+			return err
+		}
+		answers[b] = *a
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DPF128BatchAnswer{Answers: answers}, nil
+}
+
+// BatchReconstruct checks the MAC of every bucket holding a queried index
+func (c *DPF128Client) BatchReconstruct(h *QueryHandle, _ Digest, _ Hint, answer0 Answer, answer1 Answer) ([]database.Record, error) {
+	q, err := takeState[dpf128Batch](h, c)
+	if err != nil {
+		return nil, err
+	}
+	a0, ok := answer0.(*DPF128BatchAnswer)
+	if !ok {
+		return nil, malformedType(answer0)
+	}
+	a1, ok := answer1.(*DPF128BatchAnswer)
+	if !ok {
+		return nil, malformedType(answer1)
+	}
+	return q.reconstruct(func(b int) (database.Record, error) {
+		if b >= len(a0.Answers) || b >= len(a1.Answers) {
+			return nil, fmt.Errorf("%w: batch answers do not match the query", ErrMalformedAnswer)
+		}
+		rec, err := reconstructDPF128(&a0.Answers[b], &a1.Answers[b], q.alpha)
+		if err == errDPF128MAC {
+			return nil, misbehaviorDPF128(fmt.Sprintf("MAC check of bucket %d failed", b), h, q.alpha, a0, a1)
+		}
+		return rec, err
+	})
+}
+
+func (c *DPF128Client) Reconstruct(h *QueryHandle, _ Digest, _ Hint, answer0 Answer, answer1 Answer) (database.Record, error) {
+	q, err := takeState[dpf128Query](h, c)
+	if err != nil {
+		return nil, err
+	}
+	a0, ok := answer0.(*DPF128Answer)
+	if !ok {
+		return nil, malformedType(answer0)
+	}
+	a1, ok := answer1.(*DPF128Answer)
+	if !ok {
+		return nil, malformedType(answer1)
+	}
+	rec, err := reconstructDPF128(a0, a1, q.alpha)
+	if err == errDPF128MAC {
+		return nil, misbehaviorDPF128(err.Error(), h, q.alpha, answer0, answer1)
+	}
+	return rec, err
+}
 
-	a0, a1 := answer0.(*DPF128Answer), answer1.(*DPF128Answer)
+var errDPF128MAC = errors.New("authentication failed during DPF128 reconstruction")
+
+// misbehaviorDPF128 returns the evidence that the combined answers to the
+// query of h failed the MAC check, the MAC key alpha is revealed with it
+func misbehaviorDPF128(reason string, h *QueryHandle, alpha *oc.FieldElem, a0, a1 Answer) *MisbehaviorError {
+	return newMisbehavior(APIR_DPF128, -1, reason, nil, h.Queries[:], []Answer{a0, a1}, bytes.Clone(alpha.Data))
+}
+
+// reconstructDPF128 combines the answers and checks the MAC with the key
+// alpha of the query
+func reconstructDPF128(a0, a1 *DPF128Answer, alpha *oc.FieldElem) (database.Record, error) {
+	if len(a0.QueryRecord) != BLOCKSIZE || len(a1.QueryRecord) != BLOCKSIZE ||
+		len(a0.AuthRecord) != BLOCKSIZE || len(a1.AuthRecord) != BLOCKSIZE {
+		return nil, fmt.Errorf("%w: DPF128 answer of wrong length", ErrMalformedAnswer)
+	}
 
 	a0Rec := a0.QueryRecord
 	a1Rec := a1.QueryRecord
@@ -187,24 +363,139 @@ func (c *DPF128Client) Reconstruct(_ Digest, _ Hint, answer0 Answer, answer1 Ans
 	// MULTIPLY FOR AUTH CHECK ////////////////////////////////////
 
 	// if normal * alpha = auth, we are good
-	prod := oc.FieldMul(queriedRecord, c.alpha)
+	prod := oc.FieldMul(queriedRecord, alpha)
 
 	if !bytes.Equal(authRecon.Data, prod.Data) {
-		return nil, errors.New("authentication failed during DPF128 reconstruction")
+		return nil, errDPF128MAC
 	}
 
 	return queriedRecord.Data, nil
 }
 
-func (c *DPF128Client) ReconstructAlpha(_ Digest, _ Hint, answer0 Answer, answer1 Answer, alpha *oc.FieldElem) (database.Record, error) {
-	a0, a1 := answer0.(*DPF128Answer), answer1.(*DPF128Answer)
+func (c *DPF128Client) UpdateHint(newN0, newN1, newQ0, newQ1 int, newDigest0, newDigest1 Digest, ops0, ops1 []database.Update) (N int, Q int, d Digest, hint Hint, err error) {
+	return -1, -1, nil, nil, fmt.Errorf("%w: updates of APIR_DPF128", ErrUnsupported)
+}
+
+////////////////////////////////////////////////////////////
+// ENCODING
+////////////////////////////////////////////////////////////
 
-	c.alpha = alpha
+func (*DPF128Digest) MarshalBinary() ([]byte, error) {
+	return newWriter(APIR_DPF128, kindDigest).Buf, nil
+}
 
-	return c.Reconstruct(nil, nil, a0, a1)
+func (*DPF128Digest) UnmarshalBinary(data []byte) error {
+	return newReader(data, APIR_DPF128, kindDigest).Finish()
 }
 
-func (c *DPF128Client) UpdateHint(newN0, newN1, newQ0, newQ1 int, newDigest0, newDigest1 Digest, ops0, ops1 []database.Update) (N int, Q int, d Digest, hint Hint, err error) {
-	log.Fatal("not implemented yet")
-	return
+func (*DPF128HintQuery) MarshalBinary() ([]byte, error) {
+	return newWriter(APIR_DPF128, kindHintQuery).Buf, nil
+}
+
+func (*DPF128HintQuery) UnmarshalBinary(data []byte) error {
+	return newReader(data, APIR_DPF128, kindHintQuery).Finish()
+}
+
+func (*DPF128HintResp) MarshalBinary() ([]byte, error) {
+	return newWriter(APIR_DPF128, kindHintResp).Buf, nil
+}
+
+func (*DPF128HintResp) UnmarshalBinary(data []byte) error {
+	return newReader(data, APIR_DPF128, kindHintResp).Finish()
+}
+
+func (*DPF128Hint) MarshalBinary() ([]byte, error) {
+	return newWriter(APIR_DPF128, kindHint).Buf, nil
+}
+
+func (*DPF128Hint) UnmarshalBinary(data []byte) error {
+	return newReader(data, APIR_DPF128, kindHint).Finish()
+}
+
+func (q *DPF128Query) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_DPF128, kindQuery)
+	w.Bytes(q.QueryKey)
+	w.Bytes(q.AuthKey)
+	w.Uint64(q.KeySize)
+	return w.Buf, nil
+}
+
+func (q *DPF128Query) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_DPF128, kindQuery)
+	queryKey := r.Bytes()
+	authKey := r.Bytes()
+	keySize := r.Uint64()
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	q.QueryKey, q.AuthKey, q.KeySize = queryKey, authKey, keySize
+	return nil
+}
+
+func (a *DPF128Answer) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_DPF128, kindAnswer)
+	w.Bytes(a.QueryRecord)
+	w.Bytes(a.AuthRecord)
+	return w.Buf, nil
+}
+
+func (a *DPF128Answer) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_DPF128, kindAnswer)
+	queryRecord := r.Bytes()
+	authRecord := r.Bytes()
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	a.QueryRecord, a.AuthRecord = queryRecord, authRecord
+	return nil
+}
+
+func (q *DPF128BatchQuery) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_DPF128, kindBatchQuery)
+	w.Uint32(uint32(len(q.Queries)))
+	for _, sub := range q.Queries {
+		w.Bytes(sub.QueryKey)
+		w.Bytes(sub.AuthKey)
+		w.Uint64(sub.KeySize)
+	}
+	return w.Buf, nil
+}
+
+func (q *DPF128BatchQuery) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_DPF128, kindBatchQuery)
+	queries := make([]DPF128Query, r.Len(16))
+	for i := range queries {
+		queries[i].QueryKey = r.Bytes()
+		queries[i].AuthKey = r.Bytes()
+		queries[i].KeySize = r.Uint64()
+	}
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	q.Queries = queries
+	return nil
+}
+
+func (a *DPF128BatchAnswer) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_DPF128, kindBatchAnswer)
+	w.Uint32(uint32(len(a.Answers)))
+	for _, sub := range a.Answers {
+		w.Bytes(sub.QueryRecord)
+		w.Bytes(sub.AuthRecord)
+	}
+	return w.Buf, nil
+}
+
+func (a *DPF128BatchAnswer) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_DPF128, kindBatchAnswer)
+	answers := make([]DPF128Answer, r.Len(8))
+	for i := range answers {
+		answers[i].QueryRecord = r.Bytes()
+		answers[i].AuthRecord = r.Bytes()
+	}
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	a.Answers = answers
+	return nil
 }
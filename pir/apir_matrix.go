@@ -1,11 +1,13 @@
 package pir
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
-	"log"
+	"fmt"
 	"math/rand"
+	"sync"
 	"tapir/modules/database"
-	"tapir/modules/utils"
 	"tapir/modules/vc"
 )
 
@@ -13,6 +15,13 @@ import (
 type APIR_MatrixDigest struct {
 	Digest    vc.Commitment
 	ProofSize int
+	// digest of the VC public parameters used by the server
+	ParamsDigest []byte
+	// If the VC supports multiproofs (vc.MultiOpener), each row of the
+	// matrix holds its records followed by a single multiproof for all of
+	// them, stored in a slot of RowProofSize bytes. Otherwise RowProofSize
+	// is 0 and every record is followed by its own proof of ProofSize bytes.
+	RowProofSize int
 }
 type APIR_MatrixHintQuery struct{}
 type APIR_MatrixHintResp struct {
@@ -36,6 +45,13 @@ type APIR_MatrixServer struct {
 	Digest    *APIR_MatrixDigest // contains commitments
 	VcType    vc.VcType
 	Vc        vc.VCParams
+	// Workers is the number of goroutines GenDigest and Answer use,
+	// runtime.NumCPU() if not positive
+	Workers int
+
+	// committed vector, kept to apply updates incrementally, it is rebuilt
+	// from the database if missing (e.g., after decoding)
+	vec vc.Vector
 }
 
 type APIR_MatrixClient struct {
@@ -45,15 +61,19 @@ type APIR_MatrixClient struct {
 	RecSize int
 
 	RandSource *rand.Rand
+	randMu     sync.Mutex // guards RandSource
 
 	vc vc.VCParams
-
-	// State
-	queriedIdx int
+	// guards N, Height, Width and vc, which UpdateHint changes while
+	// queries are made
+	mu sync.RWMutex
 }
 
 func (s *APIR_MatrixServer) Equals(other APIRServer) (bool, error) {
-	s2 := other.(*APIR_MatrixServer)
+	s2, ok := other.(*APIR_MatrixServer)
+	if !ok {
+		return false, errors.New("server types not equal")
+	}
 	if b, err := s.Db.Equals(s2.Db); !b {
 		return false, err
 	}
@@ -69,129 +89,728 @@ func (s *APIR_MatrixServer) Equals(other APIRServer) (bool, error) {
 func (s *APIR_MatrixServer) GetVCType() vc.VcType {
 	return s.VcType
 }
-func (s *APIR_MatrixServer) SetVC(vctype vc.VcType) {
-	s.Vc = vc.NewVc(vctype, s.Db.N)
+func (s *APIR_MatrixServer) SetVC(vctype vc.VcType) error {
+	params, err := newVc(vctype, s.Db.N)
+	if err != nil {
+		return err
+	}
+	s.Vc = params
+	return nil
 }
 
 ////////////////////////////////////////////////////////////
 // OFFLINE PHASE
 ////////////////////////////////////////////////////////////
 
-func SetupAPIR_MatrixClient(N, recSize int, vctype vc.VcType) *APIR_MatrixClient {
+func SetupAPIR_MatrixClient(N, recSize int, vctype vc.VcType) (*APIR_MatrixClient, error) {
 	c := APIR_MatrixClient{N: N}
-	c.RandSource = rand.New(utils.NewBufPRG(utils.NewPRG(&masterKey)))
+	src, err := newQueryRand(nil)
+	if err != nil {
+		return nil, err
+	}
+	c.RandSource = src
 	c.RecSize = recSize
-	c.vc = vc.NewVc(vctype, N)
-	return &c
+	params, err := newVc(vctype, N)
+	if err != nil {
+		return nil, err
+	}
+	c.vc = params
+	return &c, nil
 }
-func SetupAPIR_MatrixServer(db *database.DB, vctype vc.VcType) *APIR_MatrixServer {
-	s := APIR_MatrixServer{Db: db, Vc: vc.NewVc(vctype, db.N), VcType: vctype}
-	return &s
+
+// SetTestSeed makes the query bit vectors deterministic, see SeedableClient.
+func (c *APIR_MatrixClient) SetTestSeed(seed [32]byte) {
+	src, _ := newQueryRand(&seed)
+	c.randMu.Lock()
+	defer c.randMu.Unlock()
+	c.RandSource = src
+}
+func SetupAPIR_MatrixServer(db *database.DB, vctype vc.VcType) (*APIR_MatrixServer, error) {
+	s := APIR_MatrixServer{Db: db, VcType: vctype}
+	if err := s.SetVC(vctype); err != nil {
+		return nil, err
+	}
+	return &s, nil
 }
 
 func (c *APIR_MatrixClient) RequestHint() (HintQuery, HintQuery, error) {
 	return &APIR_MatrixHintQuery{}, &APIR_MatrixHintQuery{}, nil
 }
 
-func (c *APIR_MatrixClient) VerSetup(d0 Digest, d1 Digest, resp0 HintResp, resp1 HintResp) (Digest, Hint, error) {
-	if !c.EqualDigests(d0, d1) {
+func (c *APIR_MatrixClient) VerSetup(d0 Digest, d1 Digest, _ HintResp, _ HintResp) (Digest, Hint, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.verSetup(d0, d1)
+}
+
+func (c *APIR_MatrixClient) verSetup(d0, d1 Digest) (Digest, Hint, error) {
+	md, ok := d0.(*APIR_MatrixDigest)
+	if !ok {
+		return nil, nil, malformedType(d0)
+	}
+	if _, ok := d1.(*APIR_MatrixDigest); !ok {
+		return nil, nil, malformedType(d1)
+	}
+	if !c.equalDigests(d0, d1) {
 		return nil, nil, errors.New("digests do not match")
 	}
-	c.Width, c.Height = getHeightWidth(c.N, c.RecSize+d0.(*APIR_MatrixDigest).ProofSize)
+	if md.ProofSize < 0 || md.RowProofSize < 0 {
+		return nil, nil, fmt.Errorf("%w: negative proof size", ErrMalformedAnswer)
+	}
+	if md.RowProofSize > 0 {
+		c.Width, c.Height = getHeightWidth(c.N, c.RecSize)
+	} else {
+		c.Width, c.Height = getHeightWidth(c.N, c.RecSize+md.ProofSize)
+	}
 
 	return d0, &APIR_MatrixHint{}, nil
 }
 
+// rowIndices returns the indices of the records in row rowNum
+func rowIndices(rowNum, width, n int) []int {
+	idxs := make([]int, 0, width)
+	for i := rowNum * width; i < min((rowNum+1)*width, n); i++ {
+		idxs = append(idxs, i)
+	}
+	return idxs
+}
+
 func (s *APIR_MatrixServer) GenDigest() (Digest, error) {
-	vec := s.Vc.VectorFromRecords(s.Db.GetRecords(0, s.Db.N))
+	vec, err := s.Vc.VectorFromRecords(s.Db.GetRecords(0, s.Db.N))
+	if err != nil {
+		return nil, err
+	}
 	com := s.Vc.Commit(vec)
+	s.vec = vec
+
+	if mo, ok := s.Vc.(vc.MultiOpener); ok {
+		if err := s.genRowProofs(mo, vec, com); err != nil {
+			return nil, err
+		}
+		return s.Digest, nil
+	}
 
-	s.ProofSize = len(s.Vc.ProofToBytes(s.Vc.Open(vec, 0, com)))
+	p0, err := s.Vc.Open(vec, 0, com)
+	if err != nil {
+		return nil, err
+	}
+	s.ProofSize = len(s.Vc.ProofToBytes(p0))
 	augDB := make([]byte, s.Db.N*(s.Db.RecSize+s.ProofSize))
 
-	for i := 0; i < s.Db.N; i++ {
-		p_b := s.Vc.ProofToBytes(s.Vc.Open(vec, i, com))
+	// every worker writes the records and proofs of its own indices
+	err = parallelForErr(s.Workers, s.Db.N, func(i int) error {
+		p, err := s.Vc.Open(vec, i, com)
+		if err != nil {
+			return err
+		}
+		p_b := s.Vc.ProofToBytes(p)
 		copy(augDB[i*(s.Db.RecSize+s.ProofSize):(i)*(s.Db.RecSize+s.ProofSize)+s.Db.RecSize], s.Db.GetRecord(i))
 		copy(augDB[i*(s.Db.RecSize+s.ProofSize)+s.Db.RecSize:(i+1)*(s.Db.RecSize+s.ProofSize)], p_b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	s.AugDB = &database.DB{N: s.Db.N, RecSize: s.Db.RecSize + s.ProofSize, Data: augDB}
 
-	d := APIR_MatrixDigest{Digest: com, ProofSize: s.ProofSize}
+	d := APIR_MatrixDigest{Digest: com, ProofSize: s.ProofSize, ParamsDigest: s.Vc.ParamsDigest()}
 	s.Digest = &d
 	return s.Digest, nil
 }
 
+// genRowProofs builds the augmented database with one multiproof per row.
+// The slot of each multiproof starts with its length.
+func (s *APIR_MatrixServer) genRowProofs(mo vc.MultiOpener, vec vc.Vector, com vc.Commitment) error {
+	width, height := getHeightWidth(s.Db.N, s.Db.RecSize)
+
+	proofs := make([][]byte, height)
+	err := parallelForErr(s.Workers, height, func(r int) error {
+		p, err := mo.OpenMulti(vec, rowIndices(r, width, s.Db.N), com)
+		if err != nil {
+			return err
+		}
+		proofs[r] = mo.MultiProofToBytes(p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	rowProofSize := 0
+	for _, proof := range proofs {
+		rowProofSize = max(rowProofSize, 4+len(proof))
+	}
+
+	rowLen := width*s.Db.RecSize + rowProofSize
+	s.ProofSize = 0
+	s.AugDB = &database.DB{N: height, RecSize: rowLen, Data: make([]byte, height*rowLen)}
+	s.Digest = &APIR_MatrixDigest{Digest: com, RowProofSize: rowProofSize, ParamsDigest: s.Vc.ParamsDigest()}
+	for r, proof := range proofs {
+		for _, i := range rowIndices(r, width, s.Db.N) {
+			copy(s.augRecord(i), s.Db.GetRecord(i))
+		}
+		if err := s.setRowProof(r, proof); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// augRecord returns the slice of the augmented database holding record i
+func (s *APIR_MatrixServer) augRecord(i int) []byte {
+	if s.Digest.RowProofSize > 0 {
+		width, _ := getHeightWidth(s.Db.N, s.Db.RecSize)
+		start := (i/width)*s.AugDB.RecSize + (i%width)*s.Db.RecSize
+		return s.AugDB.Data[start : start+s.Db.RecSize]
+	}
+	start := i * s.AugDB.RecSize
+	return s.AugDB.Data[start : start+s.Db.RecSize]
+}
+
+// augProof returns the slice of the augmented database holding the proof of
+// record i, if every record has its own proof
+func (s *APIR_MatrixServer) augProof(i int) []byte {
+	start := i*s.AugDB.RecSize + s.Db.RecSize
+	return s.AugDB.Data[start : start+s.ProofSize]
+}
+
+// rowProof returns the multiproof in the proof slot of row r
+func (s *APIR_MatrixServer) rowProof(r int) []byte {
+	width, _ := getHeightWidth(s.Db.N, s.Db.RecSize)
+	slot := s.AugDB.Data[r*s.AugDB.RecSize+width*s.Db.RecSize : (r+1)*s.AugDB.RecSize]
+	return slot[4 : 4+binary.LittleEndian.Uint32(slot)]
+}
+
+// setRowProof writes proof to the proof slot of row r
+func (s *APIR_MatrixServer) setRowProof(r int, proof []byte) error {
+	width, _ := getHeightWidth(s.Db.N, s.Db.RecSize)
+	slot := s.AugDB.Data[r*s.AugDB.RecSize+width*s.Db.RecSize : (r+1)*s.AugDB.RecSize]
+	if 4+len(proof) > len(slot) {
+		return fmt.Errorf("multiproof of %d bytes does not fit row proof slot of %d bytes", len(proof), len(slot))
+	}
+	clear(slot)
+	binary.LittleEndian.PutUint32(slot, uint32(len(proof)))
+	copy(slot[4:], proof)
+	return nil
+}
+
+// vector returns the committed vector, rebuilding it from the database if it
+// is not available
+func (s *APIR_MatrixServer) vector() (vc.Vector, error) {
+	if s.vec == nil {
+		vec, err := s.Vc.VectorFromRecords(s.Db.GetRecords(0, s.Db.N))
+		if err != nil {
+			return nil, err
+		}
+		s.vec = vec
+	}
+	return s.vec, nil
+}
+
 func (s *APIR_MatrixServer) GetDigest() Digest {
 	return s.Digest
 }
 func (s *APIR_MatrixServer) GetDB() *database.DB {
 	return s.Db
 }
-func (s *APIR_MatrixServer) Update(_ []database.Update) (Nt, Qt int, dt Digest, opst []database.Update) {
-	log.Fatalf("not implemented")
-	return
+
+// Update applies the updates to the database and patches the augmented
+// database in place: the updated records are overwritten, the commitment is
+// updated with Vc.Update and only the proofs that change are recomputed.
+// ADDs fill free slots first. ADDs beyond the end of the database append
+// leaves to the Merkle tree and records to the last or new rows of the
+// matrix. Only if this changes the width of the matrix, the rows are
+// regrouped and all multiproofs are opened again. PointProof and KZG are set
+// up for the length of the vector, so appending records sets up the VC for
+// the new length and generates the digest again. This fails with
+// ErrUnsupported unless parameters for the new length were loaded.
+func (s *APIR_MatrixServer) Update(ops []database.Update) (Nt, Qt int, dt Digest, opst []database.Update, err error) {
+	// reject invalid ops before changing anything
+	appended, err := s.Db.CheckUpdates(ops)
+	if err != nil {
+		return -1, -1, nil, nil, err
+	}
+	var params vc.VCParams
+	if appended > 0 {
+		params, err = newVc(s.VcType, s.Db.N+appended)
+		if errors.Is(err, vc.ErrNoParams) {
+			return -1, -1, nil, nil, fmt.Errorf("%w: appending %d records: %w", ErrUnsupported, appended, err)
+		}
+		if err != nil {
+			return -1, -1, nil, nil, err
+		}
+		if s.VcType != vc.VC_MerkleTree {
+			return s.rebuild(params, ops)
+		}
+	}
+
+	vec, err := s.vector()
+	if err != nil {
+		return -1, -1, nil, nil, err
+	}
+	com := s.Digest.Digest
+	rowMode := s.Digest.RowProofSize > 0
+
+	oldN := s.Db.N
+	width, height := getHeightWidth(oldN, s.Db.RecSize)
+	newWidth, newHeight := getHeightWidth(oldN+appended, s.Db.RecSize)
+	regroup := rowMode && newWidth != width
+	s.Db.AssignIndices(ops)
+	if appended > 0 {
+		if err := s.Db.ExtendCapacity(appended); err != nil {
+			return -1, -1, nil, nil, err
+		}
+		if !regroup {
+			s.AugDB.Data = append(s.AugDB.Data, make([]byte, (newHeight-height)*s.AugDB.RecSize)...)
+			s.AugDB.N = newHeight
+		}
+	}
+
+	// proofs of single records are updated incrementally if the VC supports
+	// it, otherwise they are opened again once all updates are applied
+	pu, incremental := s.Vc.(vc.ProofUpdater)
+	var proofs []vc.Proof
+	if !rowMode && incremental {
+		proofs = make([]vc.Proof, s.Db.N)
+		for i := range proofs {
+			p, err := s.Vc.BytesToProof(s.augProof(i))
+			if err != nil {
+				return -1, -1, nil, nil, err
+			}
+			proofs[i] = p
+		}
+	}
+
+	for _, op := range ops {
+		old, err := s.Db.Apply(op)
+		if err != nil {
+			return -1, -1, nil, nil, err
+		}
+		if !regroup {
+			copy(s.augRecord(op.Idx), op.Val)
+		}
+		if com, vec, err = s.Vc.Update(com, vec, op); err != nil {
+			return -1, -1, nil, nil, err
+		}
+		if proofs != nil {
+			if err := pu.UpdateProofs(vec, proofs, op, old); err != nil {
+				return -1, -1, nil, nil, err
+			}
+		}
+	}
+	s.vec = vec
+	if params != nil {
+		s.Vc = params
+	}
+
+	switch {
+	case regroup:
+		if err := s.genRowProofs(s.Vc.(vc.MultiOpener), vec, com); err != nil {
+			return -1, -1, nil, nil, err
+		}
+	case rowMode:
+		if err := s.updateRowProofs(vec, com, ops, oldN); err != nil {
+			return -1, -1, nil, nil, err
+		}
+	case proofs != nil:
+		for i, p := range proofs {
+			copy(s.augProof(i), s.Vc.ProofToBytes(p))
+		}
+	default:
+		for i := range s.Db.N {
+			p, err := s.Vc.Open(vec, i, com)
+			if err != nil {
+				return -1, -1, nil, nil, err
+			}
+			copy(s.augProof(i), s.Vc.ProofToBytes(p))
+		}
+	}
+
+	d := *s.Digest
+	d.Digest = com
+	s.Digest = &d
+	if err := s.Db.Sync(); err != nil {
+		return -1, -1, nil, nil, err
+	}
+	return s.Db.N, -1, s.Digest, ops, nil
+}
+
+// rebuild applies ops, which append records, and generates the digest again
+// with params, the VC set up for the new length
+func (s *APIR_MatrixServer) rebuild(params vc.VCParams, ops []database.Update) (int, int, Digest, []database.Update, error) {
+	appended := s.Db.AssignIndices(ops)
+	if err := s.Db.ExtendCapacity(appended); err != nil {
+		return -1, -1, nil, nil, err
+	}
+	for _, op := range ops {
+		if _, err := s.Db.Apply(op); err != nil {
+			return -1, -1, nil, nil, err
+		}
+	}
+	s.Vc = params
+	if _, err := s.GenDigest(); err != nil {
+		return -1, -1, nil, nil, err
+	}
+	if err := s.Db.Sync(); err != nil {
+		return -1, -1, nil, nil, err
+	}
+	return s.Db.N, -1, s.Digest, ops, nil
+}
+
+// updateRowProofs brings the multiproofs of the rows up to date after ops
+// were applied to vec, the database had oldN records before. The multiproof
+// of every other row contains the sibling hash on the path of an updated
+// leaf where the paths diverge. Only these hashes are patched if the VC
+// supports it, multiproofs of rows with appended records and of other VCs
+// are opened again. The proof slots are resized if the longest multiproof
+// changed, e.g., because the tree grew, so that the augmented database
+// matches the one GenDigest generates.
+func (s *APIR_MatrixServer) updateRowProofs(vec vc.Vector, com vc.Commitment, ops []database.Update, oldN int) error {
+	mo := s.Vc.(vc.MultiOpener)
+	mu, patch := s.Vc.(vc.MultiProofUpdater)
+	idxs := make([]int, len(ops))
+	for i, op := range ops {
+		idxs[i] = op.Idx
+	}
+	width, height := getHeightWidth(s.Db.N, s.Db.RecSize)
+	proofs := make([][]byte, height)
+	size := 0
+	for r := range height {
+		if patch && min((r+1)*width, s.Db.N) <= oldN {
+			p, err := mo.BytesToMultiProof(s.rowProof(r))
+			if err != nil {
+				return err
+			}
+			changed, err := mu.UpdateMultiProof(vec, p, idxs)
+			if err != nil {
+				return err
+			}
+			if changed {
+				proofs[r] = mo.MultiProofToBytes(p)
+			}
+		} else {
+			p, err := mo.OpenMulti(vec, rowIndices(r, width, s.Db.N), com)
+			if err != nil {
+				return err
+			}
+			proofs[r] = mo.MultiProofToBytes(p)
+		}
+		if proofs[r] != nil {
+			size = max(size, 4+len(proofs[r]))
+		} else {
+			size = max(size, 4+len(s.rowProof(r)))
+		}
+	}
+	if size != s.Digest.RowProofSize {
+		s.setRowProofSize(size)
+	}
+	for r, proof := range proofs {
+		if proof == nil {
+			continue
+		}
+		if err := s.setRowProof(r, proof); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setRowProofSize changes the size of the proof slots of the rows, keeping
+// their records and multiproofs
+func (s *APIR_MatrixServer) setRowProofSize(size int) {
+	width, height := getHeightWidth(s.Db.N, s.Db.RecSize)
+	recsLen := width * s.Db.RecSize
+	old := s.AugDB
+	aug := &database.DB{N: height, RecSize: recsLen + size, Data: make([]byte, height*(recsLen+size))}
+	for r := range height {
+		row := aug.Data[r*aug.RecSize : (r+1)*aug.RecSize]
+		oldRow := old.Data[r*old.RecSize : (r+1)*old.RecSize]
+		copy(row, oldRow[:recsLen])
+		// a multiproof that does not fit is replaced by the caller
+		slot := oldRow[recsLen:]
+		if n := 4 + int(binary.LittleEndian.Uint32(slot)); n <= size {
+			copy(row[recsLen:], slot[:n])
+		}
+	}
+	s.AugDB = aug
+	d := *s.Digest
+	d.RowProofSize = size
+	s.Digest = &d
 }
 
 func (s *APIR_MatrixServer) GenHint(hq HintQuery) (HintResp, error) {
 	return &APIR_MatrixHintResp{}, nil
 }
 func (c *APIR_MatrixClient) EqualDigests(d0, d1 Digest) bool {
-	if !c.vc.EqualCommitments(d0.(*APIR_MatrixDigest).Digest, d1.(*APIR_MatrixDigest).Digest) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.equalDigests(d0, d1)
+}
+
+func (c *APIR_MatrixClient) equalDigests(d0, d1 Digest) bool {
+	md0, ok0 := d0.(*APIR_MatrixDigest)
+	md1, ok1 := d1.(*APIR_MatrixDigest)
+	if !ok0 || !ok1 {
+		return false
+	}
+	if !bytes.Equal(md0.ParamsDigest, c.vc.ParamsDigest()) || !bytes.Equal(md1.ParamsDigest, c.vc.ParamsDigest()) {
+		return false
+	}
+	if !c.vc.EqualCommitments(md0.Digest, md1.Digest) {
 		return false
 	}
 
-	return d0.(*APIR_MatrixDigest).ProofSize == d1.(*APIR_MatrixDigest).ProofSize
+	return md0.ProofSize == md1.ProofSize && md0.RowProofSize == md1.RowProofSize
 }
 
-func (c *APIR_MatrixClient) Query(idx int) (Query, Query, error) {
-	c.queriedIdx = idx
+func (c *APIR_MatrixClient) Query(idx int) (*QueryHandle, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	if idx >= c.N || idx < 0 {
-		return nil, nil, errors.New("Query index out of bounds of database")
+		return nil, errors.New("Query index out of bounds of database")
 	}
 	rowNum := idx / c.Width
 	// colNum := idx % c.width
 	qL := make([]bool, c.Height)
 	qR := make([]bool, c.Height)
+	c.randMu.Lock()
 	for i := 0; i < c.Height; i++ {
 		qL[i] = (c.RandSource.Uint64()&1 == 0)
 		qR[i] = (qL[i] != (i == rowNum))
 	}
-	return &APIR_MatrixQuery{qL}, &APIR_MatrixQuery{qR}, nil
+	c.randMu.Unlock()
+	return newHandle(c, &APIR_MatrixQuery{qL}, &APIR_MatrixQuery{qR}, idx, nil), nil
 }
 
-func (c *APIR_MatrixClient) Reconstruct(digest Digest, _ Hint, answer0 Answer, answer1 Answer) (database.Record, error) {
-
-	a0 := answer0.(*APIR_MatrixAnswer)
-	a1 := answer1.(*APIR_MatrixAnswer)
-	colNum := c.queriedIdx % c.Width
-	rowNum := c.queriedIdx / c.Width
+func (c *APIR_MatrixClient) Reconstruct(h *QueryHandle, digest Digest, _ Hint, answer0 Answer, answer1 Answer) (database.Record, error) {
+	idx, err := takeState[int](h, c)
+	if err != nil {
+		return nil, err
+	}
 
-	database.XorInto(a0.FlatRecords, a1.FlatRecords)
+	a0, ok := answer0.(*APIR_MatrixAnswer)
+	if !ok {
+		return nil, malformedType(answer0)
+	}
+	a1, ok := answer1.(*APIR_MatrixAnswer)
+	if !ok {
+		return nil, malformedType(answer1)
+	}
+	d, ok := digest.(*APIR_MatrixDigest)
+	if !ok {
+		return nil, malformedType(digest)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	colNum := idx % c.Width
+	rowNum := idx / c.Width
 
-	proofSize := digest.(*APIR_MatrixDigest).ProofSize
+	if d.RowProofSize > 0 {
+		return c.reconstructRow(h, d, rowNum, colNum, a0, a1)
+	}
 
-	for i := range len(a0.FlatProofs) / (c.RecSize + proofSize) {
+	proofSize := d.ProofSize
+	if len(a0.FlatRecords) != c.Width*(c.RecSize+proofSize) || len(a1.FlatRecords) != len(a0.FlatRecords) {
+		return nil, fmt.Errorf("%w: answer has wrong length", ErrMalformedAnswer)
+	}
+	// the answers are kept unchanged as evidence
+	row := bytes.Clone(a0.FlatRecords)
+	database.XorInto(row, a1.FlatRecords)
 
-		rec := a0.FlatRecords[i*(c.RecSize+proofSize) : i*(c.RecSize+proofSize)+c.RecSize]
-		proof, err := c.vc.BytesToProof(a0.FlatRecords[i*(c.RecSize+proofSize)+c.RecSize : (i+1)*(c.RecSize+proofSize)])
+	for i, idx := range rowIndices(rowNum, c.Width, c.N) {
+		rec := row[i*(c.RecSize+proofSize) : i*(c.RecSize+proofSize)+c.RecSize]
+		proofBytes := row[i*(c.RecSize+proofSize)+c.RecSize : (i+1)*(c.RecSize+proofSize)]
+		proof, err := c.vc.BytesToProof(proofBytes)
 		if err != nil {
-			return nil, err
+			return nil, c.misbehavior(h, fmt.Sprintf("malformed proof of record %d: %v", idx, err), d, a0, a1, proofBytes)
 		}
-		if !c.vc.Verify(digest.(*APIR_MatrixDigest).Digest, proof, rowNum+i, rec) {
-			return nil, errors.New("failed to verify proof")
+		if !c.vc.Verify(d.Digest, proof, idx, rec) {
+			return nil, c.misbehavior(h, fmt.Sprintf("failed to verify proof of record %d", idx), d, a0, a1, proofBytes)
 		}
 	}
-	return a0.FlatRecords[(c.RecSize+proofSize)*colNum : ((c.RecSize+proofSize)*(colNum) + c.RecSize)], nil
+	return row[(c.RecSize+proofSize)*colNum : ((c.RecSize+proofSize)*(colNum) + c.RecSize)], nil
+}
+
+// misbehavior returns the evidence that the combined answers failed
+// verification, the failing proof is part of both answers
+func (c *APIR_MatrixClient) misbehavior(h *QueryHandle, reason string, d *APIR_MatrixDigest, a0, a1 *APIR_MatrixAnswer, proof []byte) *MisbehaviorError {
+	return newMisbehavior(APIR_MATRIX, -1, reason, d, h.Queries[:], []Answer{a0, a1}, bytes.Clone(proof))
+}
+
+// reconstructRow verifies the multiproof of all records in the row
+func (c *APIR_MatrixClient) reconstructRow(h *QueryHandle, d *APIR_MatrixDigest, rowNum, colNum int, a0, a1 *APIR_MatrixAnswer) (database.Record, error) {
+	mo, ok := c.vc.(vc.MultiOpener)
+	if !ok {
+		return nil, errors.New("VC does not support multiproofs")
+	}
+	rowLen := c.Width*c.RecSize + d.RowProofSize
+	if len(a0.FlatRecords) != rowLen || len(a1.FlatRecords) != rowLen {
+		return nil, fmt.Errorf("%w: answer has wrong length", ErrMalformedAnswer)
+	}
+	row := bytes.Clone(a0.FlatRecords)
+	database.XorInto(row, a1.FlatRecords)
+
+	slot := row[c.Width*c.RecSize:]
+	proofLen := int(binary.LittleEndian.Uint32(slot))
+	if proofLen > len(slot)-4 {
+		return nil, c.misbehavior(h, fmt.Sprintf("multiproof of row %d exceeds its slot", rowNum), d, a0, a1, slot)
+	}
+	proof, err := mo.BytesToMultiProof(slot[4 : 4+proofLen])
+	if err != nil {
+		return nil, c.misbehavior(h, fmt.Sprintf("malformed multiproof of row %d: %v", rowNum, err), d, a0, a1, slot[4:4+proofLen])
+	}
+	idxs := rowIndices(rowNum, c.Width, c.N)
+	recs := make([]database.Record, len(idxs))
+	for i := range idxs {
+		recs[i] = row[i*c.RecSize : (i+1)*c.RecSize]
+	}
+	if !mo.VerifyMulti(d.Digest, proof, idxs, recs) {
+		return nil, c.misbehavior(h, fmt.Sprintf("failed to verify multiproof of row %d", rowNum), d, a0, a1, slot[4:4+proofLen])
+	}
+	return row[c.RecSize*colNum : c.RecSize*(colNum+1)], nil
 }
 
 func (s *APIR_MatrixServer) Answer(q Query) (Answer, error) {
-	recs := matBoolVecProduct(s.AugDB.Data, s.AugDB.N, s.AugDB.RecSize, q.(*APIR_MatrixQuery).BitVector)
+	mq, ok := q.(*APIR_MatrixQuery)
+	if !ok {
+		return nil, malformedQuery(q)
+	}
+	var recs []byte
+	if s.Digest.RowProofSize > 0 {
+		recs = matRowsXor(s.Workers, s.AugDB.Data, s.AugDB.RecSize, mq.BitVector)
+	} else {
+		recs = matBoolVecProduct(s.Workers, s.AugDB.Data, s.AugDB.N, s.AugDB.RecSize, mq.BitVector)
+	}
 
 	return &APIR_MatrixAnswer{
 		FlatRecords: recs,
 	}, nil
 }
-func (c *APIR_MatrixClient) UpdateHint(newN0, newN1, newQ0, newQ1 int, newDigest0, newDigest1 Digest, ops0, ops1 []database.Update) (N int, Q int, d Digest, hint Hint, err error) {
-	log.Fatal("not implemented yet")
-	return
+
+// UpdateHint checks that both servers committed to the same updated database
+// and adapts the shape of the matrix to the new number of records. There is
+// no hint to update.
+func (c *APIR_MatrixClient) UpdateHint(newN0, newN1, _, _ int, newDigest0, newDigest1 Digest, ops0, ops1 []database.Update) (N int, Q int, d Digest, hint Hint, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if newN0 != newN1 || len(ops0) != len(ops1) {
+		return -1, -1, nil, nil, errors.New("update parameters from servers do not match")
+	}
+	for i := range ops0 {
+		if !ops0[i].Equals(ops1[i]) {
+			return -1, -1, nil, nil, errors.New("update operations from servers do not match")
+		}
+	}
+
+	oldN, oldVc := c.N, c.vc
+	if newN0 != c.N {
+		// the committed vector grew, the servers set up the VC for the new
+		// length
+		params, err := newVc(c.vc.Type(), newN0)
+		if err != nil {
+			return -1, -1, nil, nil, err
+		}
+		c.N, c.vc = newN0, params
+	}
+	d, hint, err = c.verSetup(newDigest0, newDigest1)
+	if err != nil {
+		c.N, c.vc = oldN, oldVc
+		return -1, -1, nil, nil, err
+	}
+	return c.N, -1, d, hint, nil
+}
+
+////////////////////////////////////////////////////////////
+// ENCODING
+////////////////////////////////////////////////////////////
+
+func (d *APIR_MatrixDigest) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_MATRIX, kindDigest)
+	if err := writeCommitment(w, d.Digest); err != nil {
+		return nil, err
+	}
+	w.Uint64(uint64(d.ProofSize))
+	w.Bytes(d.ParamsDigest)
+	w.Uint64(uint64(d.RowProofSize))
+	return w.Buf, nil
+}
+
+func (d *APIR_MatrixDigest) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_MATRIX, kindDigest)
+	c := readCommitment(r)
+	proofSize := r.Uint64()
+	paramsDigest := r.Bytes()
+	rowProofSize := r.Uint64()
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	d.Digest, d.ProofSize, d.ParamsDigest, d.RowProofSize = c, int(proofSize), paramsDigest, int(rowProofSize)
+	return nil
+}
+
+func (*APIR_MatrixHintQuery) MarshalBinary() ([]byte, error) {
+	return newWriter(APIR_MATRIX, kindHintQuery).Buf, nil
+}
+
+func (*APIR_MatrixHintQuery) UnmarshalBinary(data []byte) error {
+	return newReader(data, APIR_MATRIX, kindHintQuery).Finish()
+}
+
+func (h *APIR_MatrixHintResp) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_MATRIX, kindHintResp)
+	if err := writeCommitment(w, h.Digest); err != nil {
+		return nil, err
+	}
+	return w.Buf, nil
+}
+
+func (h *APIR_MatrixHintResp) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_MATRIX, kindHintResp)
+	c := readCommitment(r)
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	h.Digest = c
+	return nil
+}
+
+func (*APIR_MatrixHint) MarshalBinary() ([]byte, error) {
+	return newWriter(APIR_MATRIX, kindHint).Buf, nil
+}
+
+func (*APIR_MatrixHint) UnmarshalBinary(data []byte) error {
+	return newReader(data, APIR_MATRIX, kindHint).Finish()
+}
+
+func (q *APIR_MatrixQuery) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_MATRIX, kindQuery)
+	writeBools(w, q.BitVector)
+	return w.Buf, nil
+}
+
+func (q *APIR_MatrixQuery) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_MATRIX, kindQuery)
+	v := readBools(r)
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	q.BitVector = v
+	return nil
+}
+
+func (a *APIR_MatrixAnswer) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_MATRIX, kindAnswer)
+	w.Bytes(a.FlatRecords)
+	w.Bytes(a.FlatProofs)
+	return w.Buf, nil
+}
+
+func (a *APIR_MatrixAnswer) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_MATRIX, kindAnswer)
+	flat := r.Bytes()
+	proofs := r.Bytes()
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	a.FlatRecords, a.FlatProofs = flat, proofs
+	return nil
 }
@@ -0,0 +1,374 @@
+package pir
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	rand2 "math/rand/v2"
+	"slices"
+	"sync"
+	"testing"
+
+	"tapir/modules/database"
+	"tapir/modules/vc"
+)
+
+func TestAPIRMatrix(t *testing.T) {
+	n := 100
+	recSize := 32
+	db := database.MakeRandomDB([32]byte{9}, n, recSize)
+
+	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_KZG} {
+		log.Println("TestAPIRMatrix with VC Type:", vctype)
+
+		server0 := newServer(t, APIR_MATRIX, db, 0, -1, vctype)
+		server1 := newServer(t, APIR_MATRIX, db, 1, -1, vctype)
+		client := newClient(t, APIR_MATRIX, n, -1, recSize, vctype)
+
+		d0, err := server0.GenDigest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d1, err := server1.GenDigest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		params, err := vc.NewVc(vctype, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := params.(vc.MultiOpener); ok != (d0.(*APIR_MatrixDigest).RowProofSize > 0) {
+			t.Fatal("row multiproofs not used for", vctype)
+		}
+		digest, hint, err := client.VerSetup(d0, d1, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range n {
+			h, err := client.Query(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q0, q1 := h.Queries[0], h.Queries[1]
+			a0, err := server0.Answer(q0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a1, err := server1.Answer(q1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec, err := client.Reconstruct(h, digest, hint, a0, a1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rec, db.GetRecord(i)) {
+				t.Fatal("retrieved record for ", i, " is incorrect")
+			}
+
+			// a modified record in the answer is detected
+			h, err = client.Query(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a0, _ = server0.Answer(h.Queries[0])
+			a1, _ = server1.Answer(h.Queries[1])
+			a0.(*APIR_MatrixAnswer).FlatRecords[0] ^= 1
+			var me *MisbehaviorError
+			if _, err := client.Reconstruct(h, digest, hint, a0, a1); !errors.As(err, &me) {
+				t.Fatal("modified answer for ", i, " was accepted")
+			}
+		}
+	}
+}
+
+func TestAPIRMatrixRowProofSize(t *testing.T) {
+	n := 1024
+	recSize := 32
+	db := database.MakeRandomDB([32]byte{9}, n, recSize)
+
+	s := newServer(t, APIR_MATRIX, db, 0, -1, vc.VC_MerkleTree)
+	d, err := s.GenDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	width, _ := getHeightWidth(n, recSize)
+	// a single proof has 10 hashes, the multiproof of a row shares all but
+	// the hashes above the row's subtree(s)
+	single := width * (10*32 + 8)
+	if rps := d.(*APIR_MatrixDigest).RowProofSize; rps*3 > single {
+		t.Fatalf("row multiproof of %d bytes not much smaller than %d bytes of single proofs", rps, single)
+	}
+}
+
+func TestAPIRMatrixUpdates(t *testing.T) {
+	n := 64
+	recSize := 32
+
+	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof, vc.VC_KZG} {
+		log.Println("TestAPIRMatrixUpdates with VC Type:", vctype)
+
+		server0 := newServer(t, APIR_MATRIX, database.MakeRandomDB([32]byte{10}, n, recSize), 0, -1, vctype).(*APIR_MatrixServer)
+		server1 := newServer(t, APIR_MATRIX, database.MakeRandomDB([32]byte{10}, n, recSize), 1, -1, vctype).(*APIR_MatrixServer)
+		client := newClient(t, APIR_MATRIX, n, -1, recSize, vctype)
+
+		d0, err := server0.GenDigest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d1, err := server1.GenDigest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := client.VerSetup(d0, d1, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		// the vector is rebuilt if missing, e.g., after decoding
+		server0.vec = nil
+
+		prg := rand2.NewChaCha8([32]byte{11})
+		adds := func(k int) []database.Update {
+			return database.MakeRandomUpdates(prg, n, k, recSize, []database.OpType{database.ADD})
+		}
+		batches := [][]database.Update{
+			database.MakeRandomUpdates(prg, n, 5, recSize, []database.OpType{database.EDIT}),
+			{{Op: database.DELETE, Idx: 7}, {Op: database.DELETE, Idx: 30}},
+			// fills the deleted slots, in place
+			adds(2),
+			// grows the database and the Merkle tree
+			adds(3),
+		}
+		appended := 3
+		if vctype == vc.VC_MerkleTree {
+			// appends to the rows of the matrix, then changes its width
+			batches = append(batches, adds(20), adds(50))
+			appended += 70
+		}
+		for _, ops := range batches {
+			// Merkle trees are updated in place, also when records are
+			// appended
+			tree := server0.vec
+			ops1 := make([]database.Update, len(ops))
+			for i, op := range ops {
+				ops1[i] = database.Update{Op: op.Op, Idx: op.Idx, Val: append([]byte{}, op.Val...)}
+			}
+			N0, Q0, d0, ops0 := update(t, server0, ops)
+			N1, Q1, d1, ops1 := update(t, server1, ops1)
+			N, _, digest, hint, err := client.UpdateHint(N0, N1, Q0, Q1, d0, d1, ops0, ops1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vctype == vc.VC_MerkleTree && tree != nil && server0.vec != tree {
+				t.Fatal("Merkle tree built again")
+			}
+
+			// the patched augmented database matches the one of a server
+			// set up from the updated database
+			fresh := newServer(t, APIR_MATRIX, database.DBFromRecords(server0.Db.GetRecords(0, N)), 0, -1, vctype).(*APIR_MatrixServer)
+			if _, err := fresh.GenDigest(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(server0.AugDB.Data, fresh.AugDB.Data) {
+				t.Fatal("augmented database differs from a fresh setup")
+			}
+			if !server0.Vc.EqualCommitments(server0.Digest.Digest, fresh.Digest.Digest) {
+				t.Fatal("commitment differs from a fresh setup")
+			}
+
+			for i := range N {
+				h, err := client.Query(i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				q0, q1 := h.Queries[0], h.Queries[1]
+				a0, err := server0.Answer(q0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				a1, err := server1.Answer(q1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rec, err := client.Reconstruct(h, digest, hint, a0, a1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(rec, server0.Db.GetRecord(i)) {
+					t.Fatal("retrieved record for ", i, " is incorrect")
+				}
+			}
+		}
+		if server0.Db.N != n+appended {
+			t.Fatalf("unexpected N=%d after updates", server0.Db.N)
+		}
+	}
+}
+
+// Queries are made while UpdateHint changes the shape of the matrix, run
+// with -race
+func TestAPIRMatrixConcurrentUpdate(t *testing.T) {
+	n := 64
+	recSize := 32
+	db0 := database.MakeRandomDB([32]byte{26}, n, recSize)
+	db1 := database.MakeRandomDB([32]byte{26}, n, recSize)
+	servers := [2]APIRServer{
+		newServer(t, APIR_MATRIX, db0, 0, -1, vc.VC_MerkleTree),
+		newServer(t, APIR_MATRIX, db1, 1, -1, vc.VC_MerkleTree),
+	}
+	client := newClient(t, APIR_MATRIX, n, -1, recSize, vc.VC_MerkleTree)
+	setupBatch(t, client, servers)
+
+	done := make(chan struct{})
+	queried := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for g := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			prg := rand2.New(rand2.NewPCG(uint64(g), 0))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				h, err := client.Query(prg.IntN(n))
+				if err != nil {
+					errs <- err
+					return
+				}
+				h.Release()
+				select {
+				case queried <- struct{}{}:
+				default:
+				}
+			}
+		}()
+	}
+
+	// the ADDs grow the database and change the width of the matrix
+	prg := rand2.NewChaCha8([32]byte{27})
+	var digest Digest
+	var hint Hint
+	for range 5 {
+		// updates while queries are running
+		<-queried
+		ops := database.MakeRandomUpdates(prg, db0.N, 7, recSize, []database.OpType{database.ADD, database.EDIT})
+		N0, Q0, d0, ops0 := update(t, servers[0], copyUpdates(ops))
+		N1, Q1, d1, ops1 := update(t, servers[1], ops)
+		var err error
+		if _, _, digest, hint, err = client.UpdateHint(N0, N1, Q0, Q1, d0, d1, ops0, ops1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for i := range db0.N {
+		h, err := client.Query(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a0, a1 := answer(t, servers, h)
+		rec, err := client.Reconstruct(h, digest, hint, a0, a1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rec, db0.GetRecord(i)) {
+			t.Fatal("wrong record after the updates", i)
+		}
+	}
+}
+
+// Appending records requires parameters for the new vector length
+func TestAPIRMatrixAppendParams(t *testing.T) {
+	// no other test sets up parameters for n+2
+	n := 27
+	recSize := 16
+	for _, vctype := range []vc.VcType{vc.VC_PointProof, vc.VC_KZG} {
+		s := newServer(t, APIR_MATRIX, database.MakeRandomDB([32]byte{15}, n, recSize), 0, -1, vctype).(*APIR_MatrixServer)
+		d, err := s.GenDigest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		vc.AllowLocalSetup(false)
+		ops := database.MakeRandomUpdates(rand2.NewChaCha8([32]byte{16}), n, 2, recSize, []database.OpType{database.ADD})
+		_, _, _, _, err = s.Update(ops)
+		vc.AllowLocalSetup(true)
+		if !errors.Is(err, ErrUnsupported) || !errors.Is(err, vc.ErrNoParams) {
+			t.Fatalf("%v: expected missing parameters, got %v", vctype, err)
+		}
+		if s.Db.N != n || s.Db.Capacity != n || s.GetDigest() != d {
+			t.Fatalf("%v: rejected update changed the server", vctype)
+		}
+	}
+}
+
+func TestAPIRMatrixParallelGenDigest(t *testing.T) {
+	n := 40
+	recSize := 16
+
+	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof, vc.VC_KZG} {
+		log.Println("TestAPIRMatrixParallelGenDigest with VC Type:", vctype)
+
+		serial := newServer(t, APIR_MATRIX, database.MakeRandomDB([32]byte{14}, n, recSize), 0, -1, vctype).(*APIR_MatrixServer)
+		serial.Workers = 1
+		if _, err := serial.GenDigest(); err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []int{3, 64, 0} {
+			par := newServer(t, APIR_MATRIX, database.MakeRandomDB([32]byte{14}, n, recSize), 0, -1, vctype).(*APIR_MatrixServer)
+			SetWorkers(par, workers)
+			if _, err := par.GenDigest(); err != nil {
+				t.Fatal(err)
+			}
+			if !serial.Vc.EqualCommitments(serial.Digest.Digest, par.Digest.Digest) {
+				t.Fatal("commitment differs with", workers, "workers")
+			}
+			if !bytes.Equal(serial.AugDB.Data, par.AugDB.Data) {
+				t.Fatal("augmented database differs with", workers, "workers")
+			}
+		}
+	}
+}
+
+// The bit vectors of the matrix queries are random unless a test seed is set
+func TestMatrixQueryRand(t *testing.T) {
+	bits := func(c APIRClient) []bool {
+		h, err := c.Query(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch q := h.Queries[0].(type) {
+		case *MatrixQuery:
+			return q.BitVector
+		case *APIR_MatrixQuery:
+			return q.BitVector
+		}
+		t.Fatalf("unexpected query %T", h.Queries[0])
+		return nil
+	}
+	n := 1 << 12
+	db := database.MakeRandomDB([32]byte{2}, n, 16)
+	for _, pt := range []PirType{PIR_MATRIX, APIR_MATRIX} {
+		servers := [2]APIRServer{newServer(t, pt, db, 0, -1, vc.VC_MerkleTree), newServer(t, pt, db, 1, -1, vc.VC_MerkleTree)}
+		c0 := newClient(t, pt, n, -1, 16, vc.VC_MerkleTree)
+		c1 := newClient(t, pt, n, -1, 16, vc.VC_MerkleTree)
+		setupBatch(t, c0, servers)
+		setupBatch(t, c1, servers)
+		if slices.Equal(bits(c0), bits(c1)) {
+			t.Fatalf("%v clients sampled the same query", pt)
+		}
+		c0.(SeedableClient).SetTestSeed([32]byte{1})
+		c1.(SeedableClient).SetTestSeed([32]byte{1})
+		if !slices.Equal(bits(c0), bits(c1)) {
+			t.Fatalf("%v clients with the same test seed sampled different queries", pt)
+		}
+	}
+}
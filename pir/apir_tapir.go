@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"maps"
 	"math/rand/v2"
+	"slices"
 
 	"tapir/modules/database"
 	"tapir/modules/psetggm"
@@ -13,10 +15,10 @@ import (
 	"tapir/modules/vc"
 )
 
-var seedHint = [32]byte{2}
-
 type TAPIRDigest struct {
 	Coms []vc.Commitment
+	// digest of the VC public parameters used by the server
+	ParamsDigest []byte
 }
 
 type TAPIRHintQuery struct {
@@ -42,6 +44,13 @@ type TAPIRAnswer struct {
 	AggProof    vc.AggProof
 }
 
+// TAPIRBatchQuery holds the index sets of several queries, the answer is a
+// TAPIRAnswer with the records of all queries in order and a single
+// aggregated proof
+type TAPIRBatchQuery struct {
+	Indices [][]uint32
+}
+
 type TAPIRServer struct {
 	Db     *database.DB //used offline
 	Proofs []vc.Proof
@@ -51,6 +60,16 @@ type TAPIRServer struct {
 	Digest *TAPIRDigest // contains commitments
 	Vc     vc.VCParams
 	VcType vc.VcType
+	// Workers is the number of goroutines GenDigest uses, runtime.NumCPU()
+	// if not positive
+	Workers int
+
+	// vectors of the partitions, kept to apply updates incrementally, they
+	// are rebuilt from the database if missing (e.g., after decoding)
+	vecs []vc.Vector
+
+	// results of all updates, for clients that missed some
+	updates UpdateLog
 }
 
 type TAPIRClient struct {
@@ -60,11 +79,10 @@ type TAPIRClient struct {
 	M       int
 	RecSize int
 
-	// query and refresh state
-	queriedIdx int
-	randSwaps  []uint32
-	setOffline []uint32 // query q_0 indices
-	setOnline  []uint32 // query q_1 indices
+	// guards the hint and the randomness, see hintLock
+	lock hintLock
+	// number of update rounds applied to the hint
+	epoch int
 
 	// Digest
 	Digest *TAPIRDigest
@@ -73,29 +91,63 @@ type TAPIRClient struct {
 
 	// randomness
 	Prg *rand.ChaCha8
+	// key for the partition permutations
+	PermKey  utils.PRGKey
+	testSeed *[32]byte
 
 	Vc vc.VCParams
 }
 
+// tapirQuery is the state of a single query until its answers are
+// reconstructed
+type tapirQuery struct {
+	idx        int    // queried index
+	pos        uint32 // hint set of idx
+	randSwaps  []uint32
+	setOffline []uint32 // query q_0 indices
+	setOnline  []uint32 // query q_1 indices
+}
+
+// tapirTarget locates the record of an index of a batch: the online answer
+// to the query with number query holds it in partition row
+type tapirTarget struct {
+	query, row int
+}
+
+type tapirBatch struct {
+	queries []tapirQuery
+	where   []tapirTarget // one per distinct index
+	state   batchState
+}
+
 ////////////////////////////////////////////////////////////
 // OFFLINE PHASE
 ////////////////////////////////////////////////////////////
 
-func NewTAPIRClient(n, q, recSize int, vcType vc.VcType) *TAPIRClient {
+func NewTAPIRClient(n, q, recSize int, vcType vc.VcType) (*TAPIRClient, error) {
 	c := &TAPIRClient{N: n, Q: q, M: n / q}
-	c.Vc = vc.NewVc(vcType, c.M)
+	params, err := newVc(vcType, c.M)
+	if err != nil {
+		return nil, err
+	}
+	c.Vc = params
 	c.RecSize = recSize
-	return c
+	return c, nil
 }
 
-func NewTAPIRServer(db *database.DB, Q int, role int, vcType vc.VcType) *TAPIRServer {
+func NewTAPIRServer(db *database.DB, Q int, role int, vcType vc.VcType) (*TAPIRServer, error) {
 	s := &TAPIRServer{Db: db, Q: Q, M: db.N / Q, Role: role, VcType: vcType}
-	s.Vc = vc.NewVc(vcType, s.M)
-	return s
+	if err := s.SetVC(vcType); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 func (s *TAPIRServer) Equals(other APIRServer) (bool, error) {
-	s2 := other.(*TAPIRServer)
+	s2, ok := other.(*TAPIRServer)
+	if !ok {
+		return false, errors.New("server types not equal")
+	}
 	if b, err := s.Db.Equals(s2.Db); !b {
 		return false, err
 	}
@@ -124,37 +176,79 @@ func (s *TAPIRServer) Equals(other APIRServer) (bool, error) {
 func (s *TAPIRServer) GetVCType() vc.VcType {
 	return s.VcType
 }
-func (s *TAPIRServer) SetVC(vctype vc.VcType) {
-	s.Vc = vc.NewVc(vctype, s.M)
+func (s *TAPIRServer) SetVC(vctype vc.VcType) error {
+	params, err := newVc(vctype, s.M)
+	if err != nil {
+		return err
+	}
+	s.Vc = params
+	return nil
 }
 
 func (s *TAPIRServer) GenDigest() (Digest, error) {
 	// initialize TAPIRDigest
-	d := TAPIRDigest{}
+	d := TAPIRDigest{ParamsDigest: s.Vc.ParamsDigest()}
 	d.Coms = make([]vc.Commitment, s.Q)
-	proofs := make([]vc.Proof, s.Db.N)
+	proofs := make([]vc.Proof, s.Q*s.M)
 
 	// OUTER LOOP: Compute vector commitments for each row
-	var vec vc.Vector
-	for q := 0; q < s.Q; q++ { // there are Q rows
+	s.vecs = make([]vc.Vector, s.Q)
+	err := parallelForErr(s.Workers, s.Q, func(q int) error { // there are Q rows
 		// get s.m records starting from index q*s.m
 		recs := s.Db.GetRecords(q*s.M, s.M)
 		if recs == nil {
-			return nil, errors.New("error getting records when generating digest")
+			return errors.New("error getting records when generating digest")
+		}
+		vec, err := s.Vc.VectorFromRecords(recs)
+		if err != nil {
+			return err
 		}
-		vec = s.Vc.VectorFromRecords(recs)
+		s.vecs[q] = vec
 		d.Coms[q] = s.Vc.Commit(vec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		// INNER LOOP: Compute opening proof, save in augmented database
-		for i := 0; i < s.M; i++ {
-			proofs[i+q*s.M] = s.Vc.Open(vec, i, d.Coms[q])
-		}
+	// INNER LOOP: Compute opening proof, save in augmented database. The
+	// proofs of all partitions are distributed over the workers, as there
+	// may be fewer partitions than workers.
+	err = parallelForErr(s.Workers, s.Q*s.M, func(j int) error {
+		q, i := j/s.M, j%s.M
+		p, err := s.Vc.Open(s.vecs[q], i, d.Coms[q])
+		proofs[j] = p
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 	s.Proofs = proofs
 	s.Digest = &d
 	return &d, nil
 }
 
+// vector returns the vector of partition q, rebuilding the vectors from the
+// database if they are not available
+func (s *TAPIRServer) vector(q int) (vc.Vector, error) {
+	if len(s.vecs) != s.Q {
+		vecs := make([]vc.Vector, s.Q)
+		for p := range vecs {
+			recs := s.Db.GetRecords(p*s.M, s.M)
+			if recs == nil {
+				return nil, errors.New("error getting db records")
+			}
+			vec, err := s.Vc.VectorFromRecords(recs)
+			if err != nil {
+				return nil, err
+			}
+			vecs[p] = vec
+		}
+		s.vecs = vecs
+	}
+	return s.vecs[q], nil
+}
+
 func (s *TAPIRServer) GetDigest() Digest {
 	return s.Digest
 }
@@ -163,15 +257,22 @@ func (s *TAPIRServer) GetDB() *database.DB {
 }
 
 // Updates TAPIR Database returns N, Q, digest, updateOps
-func (s *TAPIRServer) Update(ops []database.Update) (int, int, Digest, []database.Update) {
+func (s *TAPIRServer) Update(ops []database.Update) (int, int, Digest, []database.Update, error) {
+	// reject invalid ops before changing anything; appended ADDs may fill
+	// the last partition and at most one new partition
+	appended, err := s.Db.CheckUpdates(ops)
+	if err != nil {
+		return -1, -1, nil, nil, err
+	}
+	if s.Db.N+appended > (s.Q+1)*s.M {
+		return -1, -1, nil, nil, fmt.Errorf("%w: %d ADDs beyond a new partition of %d records", ErrUnsupported, appended, s.M)
+	}
+
 	// get updates for each partition
 	partitionOps := make([][]database.Update, s.Q)
-	addCtr := 0
+	// deleted slots are reused before new ones are appended
+	s.Db.AssignIndices(ops)
 	for i := range ops {
-		if ops[i].Op == database.ADD {
-			ops[i].Idx = s.Db.N + addCtr
-			addCtr++
-		}
 		q := ops[i].Idx / s.M
 		if q >= len(partitionOps) {
 			partitionOps = append(partitionOps, []database.Update{ops[i]})
@@ -180,6 +281,12 @@ func (s *TAPIRServer) Update(ops []database.Update) (int, int, Digest, []databas
 		}
 	}
 
+	// make sure the vectors of the existing partitions are available before
+	// new partitions are appended
+	if _, err := s.vector(0); err != nil {
+		return -1, -1, nil, nil, err
+	}
+
 	// Apply updates to each partition
 	for q, partitionOp := range partitionOps {
 		if len(partitionOp) == 0 {
@@ -189,11 +296,10 @@ func (s *TAPIRServer) Update(ops []database.Update) (int, int, Digest, []databas
 
 		// add new partition
 		if q >= s.Q {
-			if len(partitionOp) > s.M {
-				log.Fatalln("number of ops too big for new partition")
-			}
 			// extend DB capacity by another partition of size M
-			s.Db.ExtendCapacity(s.M)
+			if err := s.Db.ExtendCapacity(s.M); err != nil {
+				return -1, -1, nil, nil, err
+			}
 
 			newProofs := make([]vc.Proof, s.M)
 			s.Proofs = append(s.Proofs, newProofs...)
@@ -201,138 +307,224 @@ func (s *TAPIRServer) Update(ops []database.Update) (int, int, Digest, []databas
 			// Add new records to DB
 			for _, op := range partitionOp {
 				// Copy the new record data
-				s.Db.SetRecord(op.Idx, op.Val)
-				s.Db.N++
+				if _, err := s.Db.Apply(op); err != nil {
+					return -1, -1, nil, nil, err
+				}
 			}
 
 			recs := s.Db.GetRecords(q*s.M, s.M)
 			if recs == nil {
-				log.Fatal("error getting db records")
+				return -1, -1, nil, nil, errors.New("error getting db records")
 			}
 			// Commit to new partition
-			vec = s.Vc.VectorFromRecords(recs)
+			var err error
+			if vec, err = s.Vc.VectorFromRecords(recs); err != nil {
+				return -1, -1, nil, nil, err
+			}
+			s.vecs = append(s.vecs, vec)
 			s.Digest.Coms = append(s.Digest.Coms, s.Vc.Commit(vec))
 
-		} else { // q < s.Q // edit existing partition
-			recs := s.Db.GetRecords(q*s.M, s.M)
-			if recs == nil {
-				log.Fatal("error getting db records")
+		} else { // q < s.Q // edit existing partition, updating its vector in place
+			var err error
+			if vec, err = s.vector(q); err != nil {
+				return -1, -1, nil, nil, err
 			}
-			vec = s.Vc.VectorFromRecords(recs)
+			pu, incremental := s.Vc.(vc.ProofUpdater)
 			for i, op := range partitionOp {
-				valOld := s.Db.GetRecord(op.Idx)
-
-				s.Db.SetRecord(op.Idx, op.Val)
-				if op.Op == database.ADD {
-					s.Db.N++
+				valOld, err := s.Db.Apply(op)
+				if err != nil {
+					return -1, -1, nil, nil, err
 				}
 				// update commitment
-				s.Digest.Coms[q], vec = s.Vc.Update(
-					s.Digest.Coms[q],
-					vec,
-					database.Update{Idx: op.Idx % s.M, Val: op.Val, Op: op.Op},
-				)
-
-				// Save delta of op: val_old XOR val_new to set
-				psetggm.FastXorInto(partitionOps[q][i].Val, valOld, s.Db.RecSize)
+				localOp := database.Update{Idx: op.Idx % s.M, Val: op.Val, Op: op.Op}
+				s.Digest.Coms[q], s.vecs[q], err = s.Vc.Update(s.Digest.Coms[q], vec, localOp)
+				if err != nil {
+					return -1, -1, nil, nil, err
+				}
+				// update the opening proofs of the partition before op.Val
+				// is overwritten with the delta
+				if incremental {
+					if err := pu.UpdateProofs(s.vecs[q], s.Proofs[q*s.M:(q+1)*s.M], localOp, valOld); err != nil {
+						return -1, -1, nil, nil, err
+					}
+				}
+
+				// Save delta of op: val_old XOR val_new to set, for a
+				// DELETE this is val_old
+				if err := psetggm.FastXorInto(partitionOps[q][i].Val, valOld, s.Db.RecSize); err != nil {
+					return -1, -1, nil, nil, err
+				}
 				// }
 			}
+			vec = s.vecs[q]
+			if incremental {
+				continue
+			}
 		}
 		// for each value in partition q update opening proof
 		if len(partitionOp) != 0 {
 			for m := range s.M {
-				s.Proofs[m+q*s.M] = s.Vc.Open(vec, m, s.Digest.Coms[q])
+				p, err := s.Vc.Open(vec, m, s.Digest.Coms[q])
+				if err != nil {
+					return -1, -1, nil, nil, err
+				}
+				s.Proofs[m+q*s.M] = p
 			}
 		}
 	}
 	s.Q = len(partitionOps)
-	return s.Db.N, s.Q, s.Digest, ops
+	if err := s.Db.Sync(); err != nil {
+		return -1, -1, nil, nil, err
+	}
+	if _, err := s.updates.Append(s.Db.N, s.Q, s.Digest, ops); err != nil {
+		return -1, -1, nil, nil, err
+	}
+	return s.Db.N, s.Q, s.Digest, ops, nil
+}
+
+// Epoch returns the number of updates applied to the database
+func (s *TAPIRServer) Epoch() int {
+	return s.updates.Epoch()
+}
+
+// UpdatesSince returns the results of the updates after epoch, each with
+// the digest of its epoch
+func (s *TAPIRServer) UpdatesSince(epoch int) ([]EpochUpdate, error) {
+	return s.updates.UpdatesSince(epoch)
 }
 
 func (c *TAPIRClient) UpdateHint(newN0, newN1, newQ0, newQ1 int, newDigest0, newDigest1 Digest, ops0, ops1 []database.Update) (int, int, Digest, Hint, error) {
-	if newN0 != newN1 || newQ0 != newQ1 || !c.EqualDigests(newDigest0, newDigest1) || len(ops0) != len(ops1) {
+	c.lock.lockExclusive()
+	defer c.lock.unlock()
+
+	newDigest, ok := newDigest0.(*TAPIRDigest)
+	if !ok {
+		return -1, -1, nil, nil, malformedType(newDigest0)
+	}
+	if len(newDigest.Coms) != newQ0 || newQ0 < c.Q {
+		return -1, -1, nil, nil, fmt.Errorf("%w: digest of %d partitions for Q=%d", ErrMalformedAnswer, len(newDigest.Coms), newQ0)
+	}
+	// the commitments of partitions added by the update are compared too
+	if newN0 != newN1 || newQ0 != newQ1 || !c.equalDigests(newDigest0, newDigest1, newQ0) || len(ops0) != len(ops1) {
 		return -1, -1, nil, nil, errors.New("update parameters from servers do not match")
 	}
-	oldQ := c.Q
-	c.Q = newQ0
-
-	c.Prg = rand.NewChaCha8(seedHint)
-	randSeed := *utils.RandomPRGKey(c.Prg)
+	if newN0 > newQ0*c.M {
+		return -1, -1, nil, nil, errors.New("invalid database size after update")
+	}
+	// check all ops before the hint is changed
+	for i, op := range ops0 {
+		if !op.Equals(ops1[i]) {
+			return -1, -1, nil, nil, errors.New("update operations from servers do not match")
+		}
+		if op.Idx < 0 || op.Idx >= newN0 || len(op.Val) != c.RecSize {
+			return -1, -1, nil, nil, fmt.Errorf("%w: update of index %d with %d bytes", ErrMalformedAnswer, op.Idx, len(op.Val))
+		}
+		if op.Idx >= c.Q*c.M && op.Op != database.ADD {
+			return -1, -1, nil, nil, errors.New("only ADD ops in new partition possible")
+		}
+	}
 
-	squash_rand := 0
-	for i := range len(randSeed) {
-		squash_rand += int(randSeed[i])
+	// Generate the permutations of the new partitions
+	perms, invs, err := newPartitionPerms(c.M, c.PermKey[:], c.Q, newQ0)
+	if err != nil {
+		return -1, -1, nil, nil, err
 	}
+	c.Hint.IdxToSetIdx = append(c.Hint.IdxToSetIdx, perms...)
+	c.Hint.SetIdxToIdx = append(c.Hint.SetIdxToIdx, invs...)
+	c.Q = newQ0
 
-	// Apply updates to each partition
-	for q := range newQ0 {
-		// Check if need to add new partition
-		if q >= oldQ {
-			// Generate a new permutation for this partition & set up permutation maps
-			c.Hint.IdxToSetIdx = append(c.Hint.IdxToSetIdx, make([]uint32, c.M))
-			c.Hint.SetIdxToIdx = append(c.Hint.SetIdxToIdx, make([]uint32, c.M))
-			psetggm.GenerateSinglePerm(c.M, squash_rand, c.Hint.IdxToSetIdx[oldQ], c.Hint.SetIdxToIdx[oldQ])
-
-			// get all ops for this new partition
-			for i, op := range ops0 {
-				if op.Idx < (q+1)*c.M && op.Idx >= (q)*c.M {
-					// Check Equality of ops
-					if !ops0[i].Equals(ops1[i]) {
-						return -1, -1, nil, nil, errors.New("update operations from servers do not match")
-					}
-					if op.Op != database.ADD {
-						return -1, -1, nil, nil, errors.New("only ADD ops in new partition possible")
-					}
-					_, _, pos := c.findIndex(op.Idx)
-					// update hint
-					psetggm.FastXorInto(c.Hint.Parities[pos], op.Val, c.RecSize)
-				}
-			}
-		} else { // q < s.Q
-			for i, op := range ops0 {
-				if op.Idx < (q+1)*c.M && op.Idx >= (q)*c.M {
-					// Check Equality of ops
-					if !ops0[i].Equals(ops1[i]) {
-						return -1, -1, nil, nil, errors.New("update operations from servers do not match")
-					}
-					_, _, pos := c.findIndex(op.Idx)
-					// update hint
-					psetggm.FastXorInto(c.Hint.Parities[pos], op.Val, c.RecSize)
-				}
-			}
+	for _, op := range ops0 {
+		_, _, pos := c.findIndex(op.Idx)
+		// update hint with the delta of the record, which for a DELETE is
+		// the old value
+		if err := psetggm.FastXorInto(c.Hint.Parities[pos], op.Val, c.RecSize); err != nil {
+			return -1, -1, nil, nil, err
 		}
 	}
 	c.N = newN0
-	c.Digest = newDigest0.(*TAPIRDigest)
+	c.Digest = newDigest
+	c.epoch++
 
-	return c.N, c.Q, newDigest0.(*TAPIRDigest), &c.Hint, nil
+	return c.N, c.Q, newDigest, &c.Hint, nil
 }
 
+// UpdateHintRange applies the updates of a range of epochs, e.g., from
+// UpdatesSince, starting at the epoch of the client. The digests of both
+// servers must match after every epoch.
+func (c *TAPIRClient) UpdateHintRange(u0, u1 []EpochUpdate) (Digest, Hint, error) {
+	return updateHintRange(c, u0, u1)
+}
+
+func (c *TAPIRClient) Epoch() int {
+	c.lock.lock()
+	defer c.lock.unlock()
+	return c.epoch
+}
+
+func (c *TAPIRClient) SetEpoch(epoch int) {
+	c.lock.lock()
+	defer c.lock.unlock()
+	c.epoch = epoch
+}
+
+// EqualDigests checks that both servers committed to the same database using
+// the same VC public parameters as the client. The digests may be of a later
+// epoch, with partitions the client does not know yet.
 func (c *TAPIRClient) EqualDigests(d0, d1 Digest) bool {
-	for i := 0; i < c.Q; i++ {
-		if !c.Vc.EqualCommitments(d0.(*TAPIRDigest).Coms[i], d1.(*TAPIRDigest).Coms[i]) {
+	c.lock.lock()
+	defer c.lock.unlock()
+	td0, ok := d0.(*TAPIRDigest)
+	if !ok || len(td0.Coms) < c.Q {
+		return false
+	}
+	return c.equalDigests(d0, d1, len(td0.Coms))
+}
+
+// equalDigests checks that both digests hold the same q commitments
+func (c *TAPIRClient) equalDigests(d0, d1 Digest, q int) bool {
+	td0, ok0 := d0.(*TAPIRDigest)
+	td1, ok1 := d1.(*TAPIRDigest)
+	if !ok0 || !ok1 || len(td0.Coms) != q || len(td1.Coms) != q {
+		return false
+	}
+	if !bytes.Equal(td0.ParamsDigest, c.Vc.ParamsDigest()) || !bytes.Equal(td1.ParamsDigest, c.Vc.ParamsDigest()) {
+		return false
+	}
+	for i := 0; i < q; i++ {
+		if !c.Vc.EqualCommitments(td0.Coms[i], td1.Coms[i]) {
 			return false
 		}
 	}
 	return true
 }
 
+// SetTestSeed makes the client randomness deterministic, see SeedableClient.
+func (c *TAPIRClient) SetTestSeed(seed [32]byte) {
+	c.lock.lock()
+	defer c.lock.unlock()
+	c.testSeed = &seed
+}
+
 func (c *TAPIRClient) RequestHint() (HintQuery, HintQuery, error) {
+	c.lock.lockExclusive()
+	defer c.lock.unlock()
 
+	c.lock.reset()
 	c.Hint = &TAPIRHint{} // initialize hint
-	c.Prg = rand.NewChaCha8(seedHint)
-	randSeed := *utils.RandomPRGKey(c.Prg)
-
-	squash_rand := 0
-	for i := range len(randSeed) {
-		squash_rand += int(randSeed[i])
+	prg, err := newClientPrg(c.testSeed)
+	if err != nil {
+		return nil, nil, err
 	}
+	c.Prg = prg
+	c.PermKey = *utils.RandomPRGKey(c.Prg)
 
 	// We initially assume that N = Q*M, but this might not hold after updates
 	permutations := make([]uint32, c.N)
 	inverse_permutations := make([]uint32, c.N)
 
-	psetggm.GeneratePerms(c.N, c.Q, squash_rand, permutations, inverse_permutations)
+	if err := psetggm.GeneratePerms(c.N, c.Q, c.PermKey[:], permutations, inverse_permutations); err != nil {
+		return nil, nil, err
+	}
 
 	// Set up permutation maps
 	// Each array in idxToSetIdx is a permutation of the set {0, 1, ..., m-1}
@@ -362,20 +554,38 @@ func (s *TAPIRServer) GenHint(hintQuery HintQuery) (HintResp, error) {
 }
 
 func (c *TAPIRClient) VerSetup(d0 Digest, d1 Digest, resp0 HintResp, resp1 HintResp) (Digest, Hint, error) {
+	c.lock.lockExclusive()
+	defer c.lock.unlock()
 
 	// PROCESS DIGEST RESPONSES /////////////////////////////////
 	// check equality of vector commitments
-	if !c.EqualDigests(d0, d1) {
+	digest, ok := d0.(*TAPIRDigest)
+	if !ok {
+		return nil, nil, malformedType(d0)
+	}
+	if len(digest.Coms) != c.Q {
+		return nil, nil, fmt.Errorf("%w: digest of %d partitions for Q=%d", ErrMalformedAnswer, len(digest.Coms), c.Q)
+	}
+	if !c.equalDigests(d0, d1, c.Q) {
 		return nil, nil, errors.New("vector commitments are not equal")
 	}
-	digest := d0.(*TAPIRDigest)
 	// save digest data
 	c.Digest = digest
 
 	// PROCESS HINT RESPONSES ///////////////////////////////////
 
-	db0 := resp0.(*TAPIRHintResp).Answers
-	db1 := resp1.(*TAPIRHintResp).Answers
+	r0, ok := resp0.(*TAPIRHintResp)
+	if !ok {
+		return nil, nil, malformedType(resp0)
+	}
+	r1, ok := resp1.(*TAPIRHintResp)
+	if !ok {
+		return nil, nil, malformedType(resp1)
+	}
+	db0, db1 := r0.Answers, r1.Answers
+	if len(db0) < c.Q*c.M || len(db1) < c.Q*c.M {
+		return nil, nil, fmt.Errorf("%w: hint responses of %d and %d records", ErrMalformedAnswer, len(db0), len(db1))
+	}
 
 	// initialize hint parities
 	c.Hint.Parities = make([]database.Record, c.M)
@@ -389,7 +599,12 @@ func (c *TAPIRClient) VerSetup(d0 Digest, d1 Digest, resp0 HintResp, resp1 HintR
 			if !bytes.Equal(db0[idx], db1[idx]) {
 				return nil, nil, errors.New("received databases not equal")
 			}
-			psetggm.FastXorInto(c.Hint.Parities[m], db0[idx], c.RecSize)
+			if len(db0[idx]) != c.RecSize {
+				return nil, nil, fmt.Errorf("%w: record of %d bytes", ErrMalformedAnswer, len(db0[idx]))
+			}
+			if err := psetggm.FastXorInto(c.Hint.Parities[m], db0[idx], c.RecSize); err != nil {
+				return nil, nil, err
+			}
 		}
 	}
 	return c.Digest, c.Hint, nil
@@ -418,87 +633,193 @@ func (c *TAPIRClient) randomIdx(rangeMax int) uint32 {
 	return uint32(c.Prg.Uint64() % uint64(rangeMax))
 }
 
-func (c *TAPIRClient) Query(i int) (Query, Query, error) {
-	if len(c.Hint.Parities) < 1 {
-		return nil, nil, errors.New("Hint is not set")
+// randomSwap samples a position of partition j not used by a pending query
+func (c *TAPIRClient) randomSwap(j int) uint32 {
+	for {
+		if x := c.randomIdx(c.M); c.lock.swappable(j, x) {
+			return x
+		}
+	}
+}
+
+// Query waits while the hint set of i is used by a pending query. If the
+// hint set of i is burned, see HintRefresher, the burned queries are sent
+// again if they queried i and ErrHintSetBurned is returned otherwise.
+func (c *TAPIRClient) Query(i int) (*QueryHandle, error) {
+	c.lock.lock()
+	defer c.lock.unlock()
+	if c.Hint == nil || len(c.Hint.Parities) < 1 {
+		return nil, errors.New("Hint is not set")
 	}
 	if i >= (c.M*c.Q) || i < 0 {
-		return nil, nil, errors.New("Query index out of bounds of database")
+		return nil, errors.New("Query index out of bounds of database")
+	}
+
+	var pos int
+	var burned any
+	c.lock.wait(func() bool {
+		_, _, pos = c.findIndex(i)
+		burned = c.lock.burned[uint32(pos)]
+		return burned != nil || c.lock.blocked(1, c.M, uint32(pos)) || c.lock.free(1, c.M, uint32(pos))
+	})
+	if burned != nil {
+		if q := burned.(tapirQuery); q.idx == i {
+			return c.resend(q.pos), nil
+		}
+		return nil, fmt.Errorf("%w: hint set of index %d", ErrHintSetBurned, i)
+	}
+	if c.lock.blocked(1, c.M, uint32(pos)) {
+		return nil, fmt.Errorf("%w: no free hint set for index %d", ErrHintSetBurned, i)
 	}
+	q := c.newQuery(i, c.randomSwap)
+	c.lock.reserve(q.pos, q.randSwaps)
+	return c.handle(q), nil
+}
+
+// RefreshQuery sends the queries of a burned hint set again, see
+// HintRefresher
+func (c *TAPIRClient) RefreshQuery() *QueryHandle {
+	c.lock.lock()
+	defer c.lock.unlock()
+	for pos := range c.lock.burned {
+		return c.resend(pos)
+	}
+	return nil
+}
 
-	c.queriedIdx = i
+// resend reserves the burned query of hint set pos again. Partitions added
+// since it was sent get fresh swapped positions.
+func (c *TAPIRClient) resend(pos uint32) *QueryHandle {
+	q := c.lock.takeBurned(pos).(tapirQuery)
+	for j := len(q.randSwaps); j < c.Q; j++ {
+		x := c.randomSwap(j)
+		q.randSwaps = append(q.randSwaps, x)
+		q.setOnline = append(q.setOnline, c.Hint.IdxToSetIdx[j][pos])
+		q.setOffline = append(q.setOffline, c.Hint.IdxToSetIdx[j][x])
+	}
+	c.lock.reserve(q.pos, q.randSwaps)
+	return c.handle(q)
+}
+
+// handle returns the handle of the reserved query q
+func (c *TAPIRClient) handle(q tapirQuery) *QueryHandle {
+	return newHandle(c, &TAPIRQuery{Indices: q.setOffline}, &TAPIRQuery{Indices: q.setOnline}, q, func(burn bool) {
+		c.release(burn, q)
+	})
+}
+
+// release frees the hint sets used by the queries qs, or burns them
+func (c *TAPIRClient) release(burn bool, qs ...tapirQuery) {
+	c.lock.lock()
+	defer c.lock.unlock()
+	for _, q := range qs {
+		if burn {
+			c.lock.burn(q.pos, q)
+		} else {
+			c.lock.release(q.pos, q.randSwaps)
+		}
+	}
+}
+
+// newQuery builds the query sets for index i, swap(j) samples the random
+// position swapped into the sets in partition j
+func (c *TAPIRClient) newQuery(i int, swap func(j int) uint32) tapirQuery {
 	// Where pos is "ind" in the paper
 	row, _, pos := c.findIndex(i)
 
-	c.setOnline = make([]uint32, c.Q)
-	c.setOffline = make([]uint32, c.Q)
-	randSwaps := make([]uint32, c.Q)
-
+	q := tapirQuery{
+		idx:        i,
+		pos:        uint32(pos),
+		setOnline:  make([]uint32, c.Q),
+		setOffline: make([]uint32, c.Q),
+		randSwaps:  make([]uint32, c.Q),
+	}
 	for j := range c.Q {
-		c.setOnline[j] = c.Hint.IdxToSetIdx[j][pos]
-		randSwaps[j] = c.randomIdx(c.M)
-		c.setOffline[j] = c.Hint.IdxToSetIdx[j][randSwaps[j]]
+		q.setOnline[j] = c.Hint.IdxToSetIdx[j][pos]
+		q.randSwaps[j] = swap(j)
+		q.setOffline[j] = c.Hint.IdxToSetIdx[j][q.randSwaps[j]]
 	}
-	c.setOnline[row] = c.Hint.IdxToSetIdx[row][randSwaps[row]]
-	c.randSwaps = randSwaps
-
-	return &TAPIRQuery{Indices: c.setOffline},
-		&TAPIRQuery{Indices: c.setOnline},
-		nil
+	q.setOnline[row] = c.Hint.IdxToSetIdx[row][q.randSwaps[row]]
+	return q
 }
 
 func (s *TAPIRServer) Answer(query Query) (Answer, error) {
-	q := query.(*TAPIRQuery)
-	answer := TAPIRAnswer{FlatRecords: make([]byte, s.Q*s.Db.RecSize)}
+	q, ok := query.(*TAPIRQuery)
+	if !ok {
+		return nil, malformedQuery(query)
+	}
+	return s.answer([][]uint32{q.Indices})
+}
+
+// answer returns the records of all index sets, one index per partition
+// each, with a single proof aggregating the openings of all of them
+func (s *TAPIRServer) answer(sets [][]uint32) (*TAPIRAnswer, error) {
+	for _, set := range sets {
+		if len(set) != s.Q {
+			return nil, fmt.Errorf("%w: %d indices for %d partitions", ErrMalformedQuery, len(set), s.Q)
+		}
+		for _, idx := range set {
+			if int(idx) >= s.M {
+				return nil, fmt.Errorf("%w: index %d out of bounds of partition", ErrMalformedQuery, idx)
+			}
+		}
+	}
 
-	currOffset := 0
-	ps := make([]vc.Proof, s.Q)
-	for i := range s.Q {
-		psetggm.CopyIn(answer.FlatRecords[i*s.Db.RecSize:(i+1)*s.Db.RecSize], s.Db.Data, s.M*i+int(q.Indices[i]), s.Db.RecSize)
-		currOffset += s.M
-		ps[i] = s.Proofs[s.M*i+int(q.Indices[i])]
+	answer := TAPIRAnswer{FlatRecords: make([]byte, len(sets)*s.Q*s.Db.RecSize)}
+	ps := make([]vc.Proof, 0, len(sets)*s.Q)
+	coms := make([]vc.Commitment, 0, len(sets)*s.Q)
+	for k, set := range sets {
+		for i := range s.Q {
+			j := k*s.Q + i
+			if err := psetggm.CopyIn(answer.FlatRecords[j*s.Db.RecSize:(j+1)*s.Db.RecSize], s.Db.Data, s.M*i+int(set[i]), s.Db.RecSize); err != nil {
+				return nil, err
+			}
+			ps = append(ps, s.Proofs[s.M*i+int(set[i])])
+			coms = append(coms, s.Digest.Coms[i])
+		}
 	}
 
 	// For aggregated verification
-	answer.AggProof = s.Vc.Aggregate(&ps, &s.Digest.Coms)
+	aggProof, err := s.Vc.Aggregate(&ps, &coms)
+	if err != nil {
+		return nil, err
+	}
+	answer.AggProof = aggProof
 
 	return &answer, nil
 }
 
-func (c *TAPIRClient) Reconstruct(digest Digest, hint Hint, answer0 Answer, answer1 Answer) (database.Record, error) {
+// Reconstruct verifies the answers while other queries are pending, only the
+// refresh of the hint is serialized
+func (c *TAPIRClient) Reconstruct(h *QueryHandle, digest Digest, hint Hint, answer0 Answer, answer1 Answer) (database.Record, error) {
+	q, err := takeState[tapirQuery](h, c)
+	if err != nil {
+		return nil, err
+	}
+	defer h.finish()
 
 	// Verify individual elements sent in the response
-	a0 := answer0.(*TAPIRAnswer)
-	a1 := answer1.(*TAPIRAnswer)
-	recSize := len(c.Hint.Parities[0])
+	a0, ok := answer0.(*TAPIRAnswer)
+	if !ok {
+		return nil, malformedType(answer0)
+	}
+	a1, ok := answer1.(*TAPIRAnswer)
+	if !ok {
+		return nil, malformedType(answer1)
+	}
+	recSize := c.RecSize
 
 	if len(a0.FlatRecords) != len(a1.FlatRecords) {
-		return nil, errors.New("answer lengths are not equal")
+		return nil, fmt.Errorf("%w: answer lengths are not equal", ErrMalformedAnswer)
 	}
-	if len(a1.FlatRecords)/(recSize) != c.Q {
-		return nil, errors.New("answer not of expected length")
+	if len(a1.FlatRecords) != c.Q*recSize {
+		return nil, fmt.Errorf("%w: answer not of expected length", ErrMalformedAnswer)
 	}
 
 	///////	 Aggregated verification 	///////
 	// NOTE: MT does not allow for proof aggregation, the standard verification for each element is used instead
-
-	recsOff := make([]database.Record, c.Q)
-	recsOn := make([]database.Record, c.Q)
-	indicesOff := make([]int, c.Q)
-	indicesOn := make([]int, c.Q)
-	for i := range c.Q {
-		recsOff[i] = a0.FlatRecords[i*recSize : (i+1)*recSize]
-		recsOn[i] = a1.FlatRecords[i*recSize : (i+1)*recSize]
-		indicesOff[i] = int(c.setOffline[i])
-		indicesOn[i] = int(c.setOnline[i])
-	}
-	okOff := c.Vc.VerifyAggregation(a0.AggProof, &c.Digest.Coms, indicesOff, recsOff)
-	if !okOff {
-		return nil, fmt.Errorf("answer verification failed for offline server")
-	}
-	okOn := c.Vc.VerifyAggregation(a1.AggProof, &c.Digest.Coms, indicesOn, recsOn)
-	if !okOn {
-		return nil, fmt.Errorf("answer verification failed for online server")
+	if err := c.verify([]tapirQuery{q}, false, a0, a1); err != nil {
+		return nil, err
 	}
 
 	///////	 Iterative verification without aggregation 	///////
@@ -514,45 +835,495 @@ func (c *TAPIRClient) Reconstruct(digest Digest, hint Hint, answer0 Answer, answ
 	// 	}
 	// }
 
+	c.lock.lock()
+	defer c.lock.unlock()
+	rec, err := c.refresh(&q, a0.FlatRecords, a1.FlatRecords)
+	h.refreshed = err == nil
+	return rec, err
+}
+
+// verify checks the aggregated proofs of both answers to the queries qs,
+// sent as a batch query if batch is set. It returns a *MisbehaviorError
+// naming the server whose proof fails.
+func (c *TAPIRClient) verify(qs []tapirQuery, batch bool, a0, a1 *TAPIRAnswer) error {
+	recSize := c.RecSize
+	n := len(qs) * c.Q
+	coms := make([]vc.Commitment, n)
+	recsOff := make([]database.Record, n)
+	recsOn := make([]database.Record, n)
+	indicesOff := make([]int, n)
+	indicesOn := make([]int, n)
+	for k, q := range qs {
+		for i := range c.Q {
+			j := k*c.Q + i
+			coms[j] = c.Digest.Coms[i]
+			recsOff[j] = a0.FlatRecords[j*recSize : (j+1)*recSize]
+			recsOn[j] = a1.FlatRecords[j*recSize : (j+1)*recSize]
+			indicesOff[j] = int(q.setOffline[i])
+			indicesOn[j] = int(q.setOnline[i])
+		}
+	}
+	okOff := c.Vc.VerifyAggregation(a0.AggProof, &coms, indicesOff, recsOff)
+	if !okOff {
+		return c.misbehavior(0, "answer verification failed for offline server", qs, batch, a0)
+	}
+	okOn := c.Vc.VerifyAggregation(a1.AggProof, &coms, indicesOn, recsOn)
+	if !okOn {
+		return c.misbehavior(1, "answer verification failed for online server", qs, batch, a1)
+	}
+	return nil
+}
+
+// misbehavior returns the evidence that the answer a of server to the
+// queries qs failed verification
+func (c *TAPIRClient) misbehavior(server int, reason string, qs []tapirQuery, batch bool, a *TAPIRAnswer) *MisbehaviorError {
+	sets := make([][]uint32, len(qs))
+	for k, q := range qs {
+		sets[k] = q.setOnline
+		if server == 0 {
+			sets[k] = q.setOffline
+		}
+	}
+	var query Query = &TAPIRQuery{Indices: sets[0]}
+	if batch {
+		query = &TAPIRBatchQuery{Indices: sets}
+	}
+	proof, _ := vc.MarshalAggProof(a.AggProof)
+	return newMisbehavior(APIR_TAPIR, server, reason, c.Digest, []Query{query}, []Answer{a}, proof)
+}
+
+// refresh reconstructs the record queried by q from the verified answers
+// flat0 and flat1, which hold one record per partition, and refreshes the
+// hint set used by q
+func (c *TAPIRClient) refresh(q *tapirQuery, flat0, flat1 []byte) (database.Record, error) {
 	///////	 Refresh Hint 	///////
 	// (same as Singlepass Reconstruct)
-	row, _, pos := c.findIndex(c.queriedIdx)
+	recSize := len(c.Hint.Parities[0])
+	row, _, pos := c.findIndex(q.idx)
 	out := make(database.Record, recSize)
 
 	xorResp0 := make(database.Record, recSize)
 	xorResp1 := make(database.Record, recSize)
 
-	psetggm.XorBlocksTogether(a0.FlatRecords, xorResp0, recSize, c.Q)
-	psetggm.XorBlocksTogether(a1.FlatRecords, xorResp1, recSize, c.Q)
+	psetggm.XorBlocksTogether(flat0, xorResp0, recSize, c.Q)
+	psetggm.XorBlocksTogether(flat1, xorResp1, recSize, c.Q)
 
 	upos := uint32(pos)
 
-	psetggm.FastXorInto(out, xorResp1, recSize)
-	psetggm.FastXorInto(out, c.Hint.Parities[pos], recSize)
-	psetggm.FastXorInto(out, a1.FlatRecords[row*recSize:(row+1)*recSize], recSize)
+	// the sizes are checked by the first XOR, before the hint changes
+	if err := psetggm.FastXorInto(out, xorResp1, recSize); err != nil {
+		return nil, err
+	}
+	if err := psetggm.FastXorInto(out, c.Hint.Parities[pos], recSize); err != nil {
+		return nil, err
+	}
+	if err := psetggm.FastXorInto(out, flat1[row*recSize:(row+1)*recSize], recSize); err != nil {
+		return nil, err
+	}
 
 	c.Hint.Parities[pos] = xorResp0
 	for i := range c.Q {
 		//3)
-		psetggm.FastXorInto(c.Hint.Parities[c.randSwaps[i]], a0.FlatRecords[i*recSize:(i+1)*recSize], recSize)
-		psetggm.FastXorInto(c.Hint.Parities[c.randSwaps[i]], a1.FlatRecords[i*recSize:(i+1)*recSize], recSize)
+		if err := psetggm.FastXorInto(c.Hint.Parities[q.randSwaps[i]], flat0[i*recSize:(i+1)*recSize], recSize); err != nil {
+			return nil, err
+		}
+		if err := psetggm.FastXorInto(c.Hint.Parities[q.randSwaps[i]], flat1[i*recSize:(i+1)*recSize], recSize); err != nil {
+			return nil, err
+		}
 		//4)
 		temp1 := c.Hint.IdxToSetIdx[i][pos]
 		//can remove temp2 if not updatable
-		temp2 := c.Hint.IdxToSetIdx[i][c.randSwaps[i]]
+		temp2 := c.Hint.IdxToSetIdx[i][q.randSwaps[i]]
 		//5)
-		c.Hint.IdxToSetIdx[i][pos] = c.Hint.IdxToSetIdx[i][c.randSwaps[i]]
+		c.Hint.IdxToSetIdx[i][pos] = c.Hint.IdxToSetIdx[i][q.randSwaps[i]]
 		//6)
-		c.Hint.IdxToSetIdx[i][c.randSwaps[i]] = temp1
+		c.Hint.IdxToSetIdx[i][q.randSwaps[i]] = temp1
 		//7)
 		//for updatable: need to update new datastructure setIdxToIdx
-		c.Hint.SetIdxToIdx[i][temp1] = c.randSwaps[i]
+		c.Hint.SetIdxToIdx[i][temp1] = q.randSwaps[i]
 		c.Hint.SetIdxToIdx[i][temp2] = upos
 
 	}
 	//fix xoring once more than necessary
-	psetggm.FastXorInto(c.Hint.Parities[c.randSwaps[row]], a1.FlatRecords[row*recSize:(row+1)*recSize], recSize)
-	psetggm.FastXorInto(c.Hint.Parities[c.randSwaps[row]], out, recSize)
+	if err := psetggm.FastXorInto(c.Hint.Parities[q.randSwaps[row]], flat1[row*recSize:(row+1)*recSize], recSize); err != nil {
+		return nil, err
+	}
+	if err := psetggm.FastXorInto(c.Hint.Parities[q.randSwaps[row]], out, recSize); err != nil {
+		return nil, err
+	}
 
 	return database.Record(out), nil
 }
+
+// BatchQuery queries the indices with one query per hint set. An index in
+// the hint set of another index of the batch, i.e., in the same column of
+// the hint but a different partition, is part of the online answer to that
+// query. The batch is padded with queries for random unused hint sets to
+// one query per index, so the servers learn neither repetitions nor shared
+// hint sets. The queries use distinct hint sets and swapped positions, as
+// refreshing the hint after one query changes both. It returns
+// ErrHintSetBurned if any of the hint sets is burned, see HintRefresher.
+func (c *TAPIRClient) BatchQuery(indices []int) (*QueryHandle, error) {
+	c.lock.lock()
+	defer c.lock.unlock()
+	if c.Hint == nil || len(c.Hint.Parities) < 1 {
+		return nil, errors.New("Hint is not set")
+	}
+	distinct, slot, err := checkBatch(indices, c.M*c.Q)
+	if err != nil {
+		return nil, err
+	}
+	numQueries := len(indices)
+	if 2*numQueries > c.M {
+		return nil, fmt.Errorf("batch of %d indices exceeds half the partition size %d", numQueries, c.M)
+	}
+
+	// hint set of each query and the query answering each distinct index,
+	// waiting while pending queries use any of the hint sets
+	var queried []int
+	var owner map[uint32]int
+	var where []tapirTarget
+	c.lock.wait(func() bool {
+		queried, owner, where = nil, make(map[uint32]int), make([]tapirTarget, len(distinct))
+		for j, i := range distinct {
+			row, _, pos := c.findIndex(i)
+			k, ok := owner[uint32(pos)]
+			if !ok {
+				k = len(queried)
+				owner[uint32(pos)] = k
+				queried = append(queried, i)
+			}
+			where[j] = tapirTarget{query: k, row: row}
+		}
+		pos := slices.Collect(maps.Keys(owner))
+		return c.lock.blocked(numQueries, c.M, pos...) || c.lock.free(numQueries, c.M, pos...)
+	})
+	if c.lock.blocked(numQueries, c.M, slices.Collect(maps.Keys(owner))...) {
+		return nil, fmt.Errorf("%w: hint sets of the batch", ErrHintSetBurned)
+	}
+	for len(queried) < numQueries {
+		pos := c.randomIdx(c.M)
+		if _, ok := owner[pos]; ok || c.lock.used(pos) {
+			continue
+		}
+		row := int(c.randomIdx(c.Q))
+		owner[pos] = len(queried)
+		queried = append(queried, row*c.M+int(c.Hint.IdxToSetIdx[row][pos]))
+	}
+
+	swapped := make([]map[uint32]bool, c.Q)
+	for j := range swapped {
+		swapped[j] = make(map[uint32]bool)
+	}
+	qs := make([]tapirQuery, numQueries)
+	q0 := &TAPIRBatchQuery{Indices: make([][]uint32, numQueries)}
+	q1 := &TAPIRBatchQuery{Indices: make([][]uint32, numQueries)}
+	for k, i := range queried {
+		qs[k] = c.newQuery(i, func(j int) uint32 {
+			for {
+				x := c.randomIdx(c.M)
+				if k2, ok := owner[x]; (ok && k2 != k) || swapped[j][x] || !c.lock.swappable(j, x) {
+					continue
+				}
+				swapped[j][x] = true
+				return x
+			}
+		})
+		q0.Indices[k], q1.Indices[k] = qs[k].setOffline, qs[k].setOnline
+	}
+	for _, q := range qs {
+		c.lock.reserve(q.pos, q.randSwaps)
+	}
+	batch := tapirBatch{queries: qs, where: where, state: batchState{slot: slot}}
+	return newHandle(c, q0, q1, batch, func(burn bool) {
+		c.release(burn, qs...)
+	}), nil
+}
+
+func (s *TAPIRServer) BatchAnswer(query Query) (Answer, error) {
+	q, ok := query.(*TAPIRBatchQuery)
+	if !ok {
+		return nil, malformedQuery(query)
+	}
+	if len(q.Indices) == 0 || 2*len(q.Indices) > s.M {
+		return nil, fmt.Errorf("%w: batch of %d queries for partitions of size %d", ErrMalformedQuery, len(q.Indices), s.M)
+	}
+	return s.answer(q.Indices)
+}
+
+// BatchReconstruct verifies the single aggregated proof of each answer and
+// refreshes the hint after every query of the batch
+func (c *TAPIRClient) BatchReconstruct(h *QueryHandle, _ Digest, _ Hint, answer0 Answer, answer1 Answer) ([]database.Record, error) {
+	batch, err := takeState[tapirBatch](h, c)
+	if err != nil {
+		return nil, err
+	}
+	defer h.finish()
+
+	a0, ok := answer0.(*TAPIRAnswer)
+	if !ok {
+		return nil, malformedType(answer0)
+	}
+	a1, ok := answer1.(*TAPIRAnswer)
+	if !ok {
+		return nil, malformedType(answer1)
+	}
+	recSize := c.RecSize
+	size := c.Q * recSize
+	if len(a0.FlatRecords) != len(batch.queries)*size || len(a1.FlatRecords) != len(batch.queries)*size {
+		return nil, fmt.Errorf("%w: answer not of expected length", ErrMalformedAnswer)
+	}
+	if err := c.verify(batch.queries, true, a0, a1); err != nil {
+		return nil, err
+	}
+
+	c.lock.lock()
+	defer c.lock.unlock()
+
+	// records in the online answer are taken before the refresh
+	recs := make([]database.Record, len(batch.where))
+	for j, w := range batch.where {
+		if row, _, _ := c.findIndex(batch.queries[w.query].idx); row != w.row {
+			start := w.query*size + w.row*recSize
+			recs[j] = append(database.Record(nil), a1.FlatRecords[start:start+recSize]...)
+		}
+	}
+	refreshed := make([]database.Record, len(batch.queries))
+	for k := range batch.queries {
+		refreshed[k], err = c.refresh(&batch.queries[k], a0.FlatRecords[k*size:(k+1)*size], a1.FlatRecords[k*size:(k+1)*size])
+		if err != nil {
+			return nil, err
+		}
+	}
+	h.refreshed = true
+	for j, w := range batch.where {
+		if recs[j] == nil {
+			recs[j] = refreshed[w.query]
+		}
+	}
+	return batch.state.reconstruct(func(j int) (database.Record, error) {
+		return recs[j], nil
+	})
+}
+
+////////////////////////////////////////////////////////////
+// ENCODING
+////////////////////////////////////////////////////////////
+
+func (d *TAPIRDigest) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_TAPIR, kindDigest)
+	w.Uint32(uint32(len(d.Coms)))
+	for _, c := range d.Coms {
+		if err := writeCommitment(w, c); err != nil {
+			return nil, err
+		}
+	}
+	w.Bytes(d.ParamsDigest)
+	return w.Buf, nil
+}
+
+func (d *TAPIRDigest) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_TAPIR, kindDigest)
+	coms := make([]vc.Commitment, r.Len(5))
+	for i := range coms {
+		coms[i] = readCommitment(r)
+	}
+	paramsDigest := r.Bytes()
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	d.Coms, d.ParamsDigest = coms, paramsDigest
+	return nil
+}
+
+func (*TAPIRHintQuery) MarshalBinary() ([]byte, error) {
+	return newWriter(APIR_TAPIR, kindHintQuery).Buf, nil
+}
+
+func (*TAPIRHintQuery) UnmarshalBinary(data []byte) error {
+	return newReader(data, APIR_TAPIR, kindHintQuery).Finish()
+}
+
+func (h *TAPIRHintResp) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_TAPIR, kindHintResp)
+	if err := writeRecords(w, h.Answers); err != nil {
+		return nil, err
+	}
+	return w.Buf, nil
+}
+
+func (h *TAPIRHintResp) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_TAPIR, kindHintResp)
+	answers := readRecords(r)
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	h.Answers = answers
+	return nil
+}
+
+func (h *TAPIRHint) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_TAPIR, kindHint)
+	if err := writeRecords(w, h.Parities); err != nil {
+		return nil, err
+	}
+	writeUint32Matrix(w, h.IdxToSetIdx)
+	writeUint32Matrix(w, h.SetIdxToIdx)
+	return w.Buf, nil
+}
+
+func (h *TAPIRHint) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_TAPIR, kindHint)
+	parities := readRecords(r)
+	idxToSetIdx := readUint32Matrix(r)
+	setIdxToIdx := readUint32Matrix(r)
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	h.Parities, h.IdxToSetIdx, h.SetIdxToIdx = parities, idxToSetIdx, setIdxToIdx
+	return nil
+}
+
+func (q *TAPIRQuery) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_TAPIR, kindQuery)
+	writeUint32s(w, q.Indices)
+	return w.Buf, nil
+}
+
+func (q *TAPIRQuery) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_TAPIR, kindQuery)
+	indices := readUint32s(r)
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	q.Indices = indices
+	return nil
+}
+
+func (a *TAPIRAnswer) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_TAPIR, kindAnswer)
+	w.Bytes(a.FlatRecords)
+	p, err := vc.MarshalAggProof(a.AggProof)
+	if err != nil {
+		return nil, err
+	}
+	w.Bytes(p)
+	return w.Buf, nil
+}
+
+func (a *TAPIRAnswer) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_TAPIR, kindAnswer)
+	flat := r.Bytes()
+	p := r.Bytes()
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	aggProof, err := vc.UnmarshalAggProof(p)
+	if err != nil {
+		return err
+	}
+	a.FlatRecords, a.AggProof = flat, aggProof
+	return nil
+}
+
+func (q *TAPIRBatchQuery) MarshalBinary() ([]byte, error) {
+	w := newWriter(APIR_TAPIR, kindBatchQuery)
+	writeUint32Matrix(w, q.Indices)
+	return w.Buf, nil
+}
+
+func (q *TAPIRBatchQuery) UnmarshalBinary(data []byte) error {
+	r := newReader(data, APIR_TAPIR, kindBatchQuery)
+	indices := readUint32Matrix(r)
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	q.Indices = indices
+	return nil
+}
+
+// SaveState writes the database parameters, digest, hint and randomness of
+// the client to w
+func (c *TAPIRClient) SaveState(w io.Writer) error {
+	c.lock.lockExclusive()
+	defer c.lock.unlock()
+	if c.Hint == nil || c.Digest == nil {
+		return errors.New("Hint is not set")
+	}
+	if len(c.lock.burned) > 0 {
+		return fmt.Errorf("%w: refresh the burned hint sets before saving the state", ErrHintSetBurned)
+	}
+	digest, err := c.Digest.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	hint, err := c.Hint.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	sw := newStateWriter(APIR_TAPIR)
+	for _, v := range []int{c.N, c.Q, c.M, c.RecSize, c.epoch} {
+		sw.Uint64(uint64(v))
+	}
+	sw.Byte(byte(c.Vc.Type()))
+	sw.Raw(c.PermKey[:])
+	if err := writePrg(sw, c.Prg); err != nil {
+		return err
+	}
+	sw.Bytes(digest)
+	sw.Bytes(hint)
+	return writeState(w, sw)
+}
+
+// LoadState restores a state saved by SaveState, the client must use the
+// same VC type and parameters. Every state must be loaded at most once:
+// the hint sets of an older state may have been sent to the servers since
+// it was saved, and querying them again reveals the queried indices.
+func (c *TAPIRClient) LoadState(r io.Reader) error {
+	c.lock.lockExclusive()
+	defer c.lock.unlock()
+	sr, err := readState(r, APIR_TAPIR)
+	if err != nil {
+		return err
+	}
+	n, q, m, recSize, epoch := readInt(sr), readInt(sr), readInt(sr), readInt(sr), readInt(sr)
+	vcType := vc.VcType(sr.Byte())
+	permKey := readPermKey(sr)
+	prg := readPrg(sr)
+	digestBytes, hintBytes := sr.Bytes(), sr.Bytes()
+	if err := sr.Finish(); err != nil {
+		return err
+	}
+	if vcType != c.Vc.Type() {
+		return fmt.Errorf("state of VC type %v, client uses %v", vcType, c.Vc.Type())
+	}
+	var digest TAPIRDigest
+	if err := digest.UnmarshalBinary(digestBytes); err != nil {
+		return err
+	}
+	var hint TAPIRHint
+	if err := hint.UnmarshalBinary(hintBytes); err != nil {
+		return err
+	}
+	if q < 1 || n > q*m || len(digest.Coms) != q || !checkParities(hint.Parities, m, recSize) ||
+		!checkPermutations(hint.IdxToSetIdx, hint.SetIdxToIdx, q, m) {
+		return errors.New("client state does not match its database parameters")
+	}
+
+	params := c.Vc
+	if m != c.M {
+		params, err = newVc(vcType, m)
+		if err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(digest.ParamsDigest, params.ParamsDigest()) {
+		return fmt.Errorf("%w: state digest of different VC parameters", ErrParamMismatch)
+	}
+	c.lock.reset()
+	c.Vc = params
+	c.N, c.Q, c.M, c.RecSize, c.epoch = n, q, m, recSize, epoch
+	c.PermKey, c.Prg = permKey, prg
+	c.Digest, c.Hint = &digest, &hint
+	return nil
+}
@@ -0,0 +1,265 @@
+package pir
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand/v2"
+	"slices"
+	"sync"
+
+	"tapir/modules/database"
+)
+
+////////////////////////////////////////////////////////////
+// BATCH QUERIES
+////////////////////////////////////////////////////////////
+
+// BatchClient is implemented by clients that retrieve several records in a
+// single round trip. BatchReconstruct consumes the handle of BatchQuery and
+// returns the records in the order of its indices, indices may repeat.
+type BatchClient interface {
+	BatchQuery(indices []int) (*QueryHandle, error)
+	BatchReconstruct(h *QueryHandle, digest Digest, hint Hint, a0 Answer, a1 Answer) ([]database.Record, error)
+}
+
+// BatchServer answers the queries of a BatchClient of the same scheme
+type BatchServer interface {
+	BatchAnswer(q Query) (Answer, error)
+}
+
+// checkBatch checks that the indices are in [0, n) and returns the distinct
+// indices in the order of their first occurrence and, for each index, its
+// position among the distinct ones
+func checkBatch(indices []int, n int) ([]int, []int, error) {
+	if len(indices) == 0 {
+		return nil, nil, errors.New("empty batch")
+	}
+	var distinct []int
+	slot := make([]int, len(indices))
+	seen := make(map[int]int, len(indices))
+	for k, i := range indices {
+		if i < 0 || i >= n {
+			return nil, nil, fmt.Errorf("batch index %d out of bounds of database", i)
+		}
+		j, ok := seen[i]
+		if !ok {
+			j = len(distinct)
+			seen[i] = j
+			distinct = append(distinct, i)
+		}
+		slot[k] = j
+	}
+	return distinct, slot, nil
+}
+
+// batchState maps the indices of a batch query to the parts of the answer
+// holding their records, e.g., cuckoo buckets
+type batchState struct {
+	// slot[k] is the part holding the k-th queried index
+	slot []int
+}
+
+// newBatchState maps the indices to the buckets they are assigned to
+func newBatchState(distinct, slot []int, assigned []int) batchState {
+	bucket := make(map[int]int, len(distinct))
+	for b, i := range assigned {
+		if i != -1 {
+			bucket[i] = b
+		}
+	}
+	st := batchState{slot: make([]int, len(slot))}
+	for k, j := range slot {
+		st.slot[k] = bucket[distinct[j]]
+	}
+	return st
+}
+
+// reconstruct returns the records of the queried indices, part(j) returns
+// the record held by part j of the answers. Each part is reconstructed
+// once.
+func (st batchState) reconstruct(part func(j int) (database.Record, error)) ([]database.Record, error) {
+	done := make(map[int]database.Record)
+	recs := make([]database.Record, len(st.slot))
+	for k, j := range st.slot {
+		rec, ok := done[j]
+		if !ok {
+			var err error
+			if rec, err = part(j); err != nil {
+				return nil, err
+			}
+			done[j] = rec
+		}
+		recs[k] = append(database.Record(nil), rec...)
+	}
+	return recs, nil
+}
+
+////////////////////////////////////////////////////////////
+// CUCKOO-HASHED BUCKETS
+////////////////////////////////////////////////////////////
+
+// Batch queries of the DPF schemes use a bucket layout as in batch PIR from
+// cuckoo hashing: every record is stored in the cuckooHashes distinct
+// buckets given by public hash functions. The client places each queried
+// index in one of its buckets such that no bucket holds two indices and
+// sends one DPF key per bucket, for a random position if the bucket is
+// empty. The servers evaluate each key over its bucket only, so their work
+// is cuckooHashes*N records regardless of the batch size. Buckets index the
+// records of the database rather than copying them, and clients round the
+// batch size up to a power of two so that servers only build the layouts of
+// a few batch sizes.
+
+const (
+	cuckooHashes = 3
+	// maximum number of evictions before inserting an index fails
+	cuckooMaxEvictions = 1000
+	// number of bucket layouts kept by a cuckooCache
+	cuckooCacheSize = 8
+)
+
+// cuckooNumBuckets returns the number of buckets for a batch of k distinct
+// indices, 1.5k and at least cuckooHashes
+func cuckooNumBuckets(k int) int {
+	return max(cuckooHashes, (3*k+1)/2)
+}
+
+// batchNumBuckets returns the number of buckets of a batch query for k > 0
+// distinct indices, those of k rounded up to a power of two
+func batchNumBuckets(k int) int {
+	return cuckooNumBuckets(1 << bits.Len(uint(k-1)))
+}
+
+// mix64 is the finalizer of splitmix64, the hash functions only need to
+// spread the records evenly over the buckets
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// cuckooBuckets returns the distinct buckets of record i among numBuckets
+// buckets, numBuckets must be at least cuckooHashes
+func cuckooBuckets(i, numBuckets int) [cuckooHashes]int {
+	var bs [cuckooHashes]int
+	n := 0
+	for t := uint64(0); n < cuckooHashes; t++ {
+		b := int(mix64(uint64(i)<<16|t) % uint64(numBuckets))
+		if !slices.Contains(bs[:n], b) {
+			bs[n] = b
+			n++
+		}
+	}
+	return bs
+}
+
+// cuckooLayout lists the indices of the records stored in each bucket in
+// ascending order
+type cuckooLayout struct {
+	buckets [][]uint32
+}
+
+func newCuckooLayout(n, numBuckets int) *cuckooLayout {
+	l := &cuckooLayout{buckets: make([][]uint32, numBuckets)}
+	for i := range n {
+		for _, b := range cuckooBuckets(i, numBuckets) {
+			l.buckets[b] = append(l.buckets[b], uint32(i))
+		}
+	}
+	return l
+}
+
+// position returns the position of record i in bucket b
+func (l *cuckooLayout) position(b, i int) int {
+	p, ok := slices.BinarySearch(l.buckets[b], uint32(i))
+	if !ok {
+		panic(fmt.Sprintf("record %d is not in bucket %d", i, b))
+	}
+	return p
+}
+
+// cuckooAssign places each of the distinct indices in one of its buckets,
+// such that no bucket holds two indices. It returns the index assigned to
+// each bucket, -1 for empty buckets.
+func cuckooAssign(indices []int, numBuckets int) ([]int, error) {
+	assigned := make([]int, numBuckets)
+	for b := range assigned {
+		assigned[b] = -1
+	}
+	for _, i := range indices {
+		cur := i
+		for evictions := 0; ; evictions++ {
+			if evictions > cuckooMaxEvictions {
+				return nil, errors.New("cuckoo hashing of the batch failed, retry with a different batch")
+			}
+			bs := cuckooBuckets(cur, numBuckets)
+			placed := false
+			for _, b := range bs {
+				if assigned[b] == -1 {
+					assigned[b] = cur
+					placed = true
+					break
+				}
+			}
+			if placed {
+				break
+			}
+			// evict the index of a random bucket and place it elsewhere
+			b := bs[rand.IntN(cuckooHashes)]
+			assigned[b], cur = cur, assigned[b]
+		}
+	}
+	return assigned, nil
+}
+
+// cuckooCache holds the bucket layouts of the batch sizes used so far. The
+// zero value is ready to use.
+type cuckooCache struct {
+	mu      sync.Mutex
+	n       int
+	layouts map[int]*cuckooLayout
+}
+
+// layout returns the layout of numBuckets buckets for n records
+func (c *cuckooCache) layout(n, numBuckets int) *cuckooLayout {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.layouts == nil || c.n != n {
+		c.n = n
+		c.layouts = make(map[int]*cuckooLayout)
+	}
+	l, ok := c.layouts[numBuckets]
+	if !ok {
+		// the number of buckets is chosen by the clients, so only the
+		// layouts of a few batch sizes are kept
+		if len(c.layouts) >= cuckooCacheSize {
+			clear(c.layouts)
+		}
+		l = newCuckooLayout(n, numBuckets)
+		c.layouts[numBuckets] = l
+	}
+	return l
+}
+
+// bucketPosition returns the position of index i in bucket b, a random
+// position if the bucket is empty (i == -1)
+func bucketPosition(l *cuckooLayout, b, i int) int {
+	if i == -1 {
+		return rand.IntN(len(l.buckets[b]))
+	}
+	return l.position(b, i)
+}
+
+// checkNumBuckets accepts the number of buckets of batchNumBuckets for the
+// batch sizes up to n, a batch never holds more than n distinct indices
+func checkNumBuckets(numBuckets, n int) error {
+	for k := 1; k < 2*n; k *= 2 {
+		if batchNumBuckets(k) == numBuckets {
+			return nil
+		}
+	}
+	return fmt.Errorf("batch query for %d buckets of %d records", numBuckets, n)
+}
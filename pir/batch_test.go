@@ -0,0 +1,242 @@
+package pir
+
+import (
+	"bytes"
+	"log"
+	"math/bits"
+	"math/rand/v2"
+	"testing"
+
+	"tapir/modules/database"
+	"tapir/modules/vc"
+
+	"github.com/dkales/dpf-go/dpf"
+)
+
+// setupBatch runs the offline phase for client and both servers
+func setupBatch(t *testing.T, client APIRClient, servers [2]APIRServer) (Digest, Hint) {
+	d0, err := servers[0].GenDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1, err := servers[1].GenDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hq0, hq1, err := client.RequestHint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h0, err := servers[0].GenHint(hq0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h1, err := servers[1].GenHint(hq1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, hint, err := client.VerSetup(d0, d1, h0, h1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest, hint
+}
+
+// retrieveBatch retrieves the records of indices with a single batch query
+func retrieveBatch(t *testing.T, client APIRClient, servers [2]APIRServer, digest Digest, hint Hint, indices []int) []database.Record {
+	bc := client.(BatchClient)
+	h, err := bc.BatchQuery(indices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q0, q1 := h.Queries[0], h.Queries[1]
+	a0, err := servers[0].(BatchServer).BatchAnswer(q0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1, err := servers[1].(BatchServer).BatchAnswer(q1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := bc.BatchReconstruct(h, digest, hint, a0, a1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+func TestBatchQuery(t *testing.T) {
+	type scheme struct {
+		pirType PirType
+		n       int
+		Q       int
+		recSize int
+		vctype  vc.VcType
+	}
+	schemes := []scheme{
+		{PIR_DPF, 1000, -1, 32, vc.None},
+		{PIR_DPF, 5, -1, 32, vc.None},
+		{APIR_DPF128, 1000, -1, BLOCKSIZE, vc.None},
+		{APIR_TAPIR, 400, 8, 32, vc.VC_MerkleTree},
+		{APIR_TAPIR, 400, 8, 32, vc.VC_PointProof},
+		{APIR_TAPIR, 400, 8, 32, vc.VC_KZG},
+	}
+	prg := rand.New(rand.NewChaCha8([32]byte{16}))
+	for _, s := range schemes {
+		log.Println("TestBatchQuery with", s.pirType, "for N:", s.n, "and VC type:", s.vctype)
+
+		db := database.MakeRandomDB([32]byte{16}, s.n, s.recSize)
+		client := newClient(t, s.pirType, s.n, s.Q, s.recSize, s.vctype)
+		servers := [2]APIRServer{
+			newServer(t, s.pirType, db, 0, s.Q, s.vctype),
+			newServer(t, s.pirType, db, 1, s.Q, s.vctype),
+		}
+		digest, hint := setupBatch(t, client, servers)
+
+		batches := [][]int{
+			{0},
+			{s.n - 1, 0, s.n - 1, 0},
+		}
+		for _, k := range []int{2, 5, 20} {
+			batch := make([]int, k)
+			for j := range batch {
+				batch[j] = prg.IntN(s.n)
+			}
+			batches = append(batches, batch)
+		}
+		if s.pirType == APIR_TAPIR {
+			// indices in the same hint set, i.e., the same column of all partitions
+			m := s.n / s.Q
+			batches = append(batches, []int{3, m + 3, 2*m + 3, 4})
+		}
+		// the hint of TAPIR must stay consistent over several batches
+		for _, batch := range batches {
+			recs := retrieveBatch(t, client, servers, digest, hint, batch)
+			if len(recs) != len(batch) {
+				t.Fatalf("got %d records for a batch of %d", len(recs), len(batch))
+			}
+			for j, i := range batch {
+				if !bytes.Equal(recs[j], db.GetRecord(i)) {
+					t.Fatalf("wrong record %d in batch %v", i, batch)
+				}
+			}
+		}
+
+		// single queries still work after batches
+		for _, i := range []int{0, s.n / 2} {
+			h, err := client.Query(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q0, q1 := h.Queries[0], h.Queries[1]
+			a0, err := servers[0].Answer(q0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a1, err := servers[1].Answer(q1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec, err := client.Reconstruct(h, digest, hint, a0, a1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rec, db.GetRecord(i)) {
+				t.Fatal("wrong record", i)
+			}
+		}
+
+		// out of bounds and empty batches are rejected
+		bc := client.(BatchClient)
+		if _, err := bc.BatchQuery([]int{0, s.n}); err == nil {
+			t.Fatal("accepted out of bounds index")
+		}
+		if _, err := bc.BatchQuery(nil); err == nil {
+			t.Fatal("accepted empty batch")
+		}
+	}
+}
+
+func TestBatchQueryModifiedAnswer(t *testing.T) {
+	n := 400
+	Q := 8
+	recSize := 32
+	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof, vc.VC_KZG} {
+		db := database.MakeRandomDB([32]byte{17}, n, recSize)
+		client := newClient(t, APIR_TAPIR, n, Q, recSize, vctype)
+		servers := [2]APIRServer{
+			newServer(t, APIR_TAPIR, db, 0, Q, vctype),
+			newServer(t, APIR_TAPIR, db, 1, Q, vctype),
+		}
+		digest, hint := setupBatch(t, client, servers)
+
+		bc := client.(BatchClient)
+		h, err := bc.BatchQuery([]int{1, 2, 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q0, q1 := h.Queries[0], h.Queries[1]
+		a0, err := servers[0].(BatchServer).BatchAnswer(q0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a1, err := servers[1].(BatchServer).BatchAnswer(q1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a single modified record invalidates the aggregated proof
+		a1.(*TAPIRAnswer).FlatRecords[2*Q*recSize] ^= 1
+		if _, err := bc.BatchReconstruct(h, digest, hint, a0, a1); err == nil {
+			t.Fatal("accepted modified record with", vctype)
+		}
+	}
+}
+
+func TestCuckooAssign(t *testing.T) {
+	for _, k := range []int{1, 2, 10, 100, 1000} {
+		indices := rand.Perm(10 * k)[:k]
+		numBuckets := cuckooNumBuckets(k)
+		assigned, err := cuckooAssign(indices, numBuckets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := newCuckooLayout(10*k, numBuckets)
+		placed := 0
+		for b, i := range assigned {
+			if i == -1 {
+				continue
+			}
+			placed++
+			// panics if i is not in bucket b
+			l.position(b, i)
+		}
+		if placed != k {
+			t.Fatalf("placed %d of %d indices", placed, k)
+		}
+	}
+}
+
+func TestBatchNumBuckets(t *testing.T) {
+	n := 1000
+	for k := 1; k <= n; k++ {
+		if err := checkNumBuckets(batchNumBuckets(k), n); err != nil {
+			t.Fatalf("batch of %d indices: %v", k, err)
+		}
+	}
+	// one layout per power of two up to n
+	accepted := 0
+	for numBuckets := range 2 * n {
+		if checkNumBuckets(numBuckets, n) == nil {
+			accepted++
+		}
+	}
+	if accepted > bits.Len(uint(n)) {
+		t.Fatalf("accepted %d bucket counts for %d records", accepted, n)
+	}
+
+	s := newServer(t, PIR_DPF, database.MakeRandomDB([32]byte{18}, n, 32), 0, -1, vc.None).(*DPFServer)
+	q := &DPFBatchQuery{Keys: make([]dpf.DPFkey, batchNumBuckets(10)+1)}
+	if _, err := s.BatchAnswer(q); err == nil {
+		t.Fatal("accepted a batch query with an unexpected number of buckets")
+	}
+}
@@ -0,0 +1,80 @@
+package pir
+
+import (
+	"bytes"
+	"errors"
+	"tapir/modules/database"
+	"tapir/modules/vc"
+	"testing"
+)
+
+func TestDPF128RandomDB(t *testing.T) {
+	n := 100
+	recSize := 16
+	db := database.MakeRandomDB([32]byte{5}, n, recSize)
+
+	server0 := newServer(t, APIR_DPF128, db, 0, -1, vc.None)
+	server1 := newServer(t, APIR_DPF128, db, 1, -1, vc.None)
+	client := newClient(t, APIR_DPF128, n, -1, recSize, vc.None)
+
+	for i := range n {
+		h, err := client.Query(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q0, q1 := h.Queries[0], h.Queries[1]
+		a0, err := server0.Answer(q0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a1, err := server1.Answer(q1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := client.Reconstruct(h, nil, nil, a0, a1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rec, db.GetRecord(i)) {
+			t.Fatalf("record %d does not match", i)
+		}
+
+		// the handle is consumed
+		if _, err := client.Reconstruct(h, nil, nil, a0, a1); !errors.Is(err, ErrHandle) {
+			t.Fatal("handle reused, got", err)
+		}
+
+		// a modified answer must be detected
+		h, err = client.Query(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a0, _ = server0.Answer(h.Queries[0])
+		a1, _ = server1.Answer(h.Queries[1])
+		a1.(*DPF128Answer).QueryRecord[0] ^= 1
+		var me *MisbehaviorError
+		if _, err := client.Reconstruct(h, nil, nil, a0, a1); !errors.As(err, &me) {
+			t.Fatalf("modified answer for record %d not detected", i)
+		}
+	}
+}
+
+// Keys are generated from fresh seeds, with the pure-Go backend and with
+// -tags libote
+func TestDPF128FreshKeys(t *testing.T) {
+	client := newClient(t, APIR_DPF128, 100, -1, 16, vc.None)
+	h0, err := client.Query(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h1, err := client.Query(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for s := range 2 {
+		q0, q1 := h0.Queries[s].(*DPF128Query), h1.Queries[s].(*DPF128Query)
+		if bytes.Equal(q0.QueryKey, q1.QueryKey) || bytes.Equal(q0.AuthKey, q1.AuthKey) {
+			t.Fatal("two queries for the same index share a key")
+		}
+	}
+}
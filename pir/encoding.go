@@ -0,0 +1,207 @@
+package pir
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"errors"
+	"fmt"
+
+	"tapir/modules/database"
+	"tapir/modules/utils"
+	"tapir/modules/vc"
+)
+
+////////////////////////////////////////////////////////////
+// BINARY ENCODING
+////////////////////////////////////////////////////////////
+
+// All offline and online phase types implement encoding.BinaryMarshaler
+// and encoding.BinaryUnmarshaler. Every encoding starts with a header of
+//
+//	| version (1 byte) | PirType (1 byte) | message kind (1 byte) |
+//
+// followed by the fields of the type (see modules/utils/encoding.go).
+// Decoding fails if the header does not match the type or if the input is
+// not fully consumed.
+
+const EncodingVersion byte = 1
+
+type msgKind byte
+
+const (
+	kindDigest msgKind = iota + 1
+	kindHintQuery
+	kindHintResp
+	kindHint
+	kindQuery
+	kindAnswer
+	kindBatchQuery
+	kindBatchAnswer
+	kindClientState
+	kindMisbehavior
+)
+
+var (
+	ErrEncodingVersion = errors.New("unsupported encoding version")
+	ErrSchemeMismatch  = errors.New("encoding of different scheme or message")
+)
+
+func newWriter(t PirType, k msgKind) *utils.BinWriter {
+	w := &utils.BinWriter{}
+	w.Byte(EncodingVersion)
+	w.Byte(byte(t))
+	w.Byte(byte(k))
+	return w
+}
+
+// Fingerprint returns the SHA-256 hash of the encoding of digest d, e.g., for
+// the operators of both servers to check that they serve the same database.
+// The digests of the unauthenticated schemes do not depend on the database.
+func Fingerprint(d Digest) ([]byte, error) {
+	m, ok := d.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%w: digest of type %T", ErrUnsupported, d)
+	}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+// newReader reads and checks the header of data
+func newReader(data []byte, t PirType, k msgKind) *utils.BinReader {
+	r := utils.NewBinReader(data)
+	v := r.Byte()
+	gotT := PirType(r.Byte())
+	gotK := msgKind(r.Byte())
+	if r.Err() != nil {
+		return r
+	}
+	if v != EncodingVersion {
+		r.Fail(fmt.Errorf("%w: %d", ErrEncodingVersion, v))
+	} else if gotT != t || gotK != k {
+		r.Fail(fmt.Errorf("%w: got scheme %d kind %d, expected scheme %d kind %d",
+			ErrSchemeMismatch, gotT, gotK, t, k))
+	}
+	return r
+}
+
+// Records of equal length are encoded as count, record size and data
+func writeRecords(w *utils.BinWriter, recs []database.Record) error {
+	recSize := 0
+	if len(recs) > 0 {
+		recSize = len(recs[0])
+	}
+	w.Uint32(uint32(len(recs)))
+	w.Uint32(uint32(recSize))
+	for i := range recs {
+		if len(recs[i]) != recSize {
+			return fmt.Errorf("cannot encode records of unequal size %d and %d", recSize, len(recs[i]))
+		}
+		w.Raw(recs[i])
+	}
+	return nil
+}
+
+func readRecords(r *utils.BinReader) []database.Record {
+	n := uint64(r.Uint32())
+	recSize := uint64(r.Uint32())
+	if r.Err() != nil {
+		return nil
+	}
+	if n*recSize > uint64(r.Remaining()) || (recSize == 0 && n > 0) {
+		r.Fail(fmt.Errorf("%w: %d records of %d bytes exceed input", utils.ErrMalformed, n, recSize))
+		return nil
+	}
+	recs := make([]database.Record, n)
+	for i := range recs {
+		recs[i] = r.Raw(int(recSize))
+	}
+	return recs
+}
+
+func writeUint32s(w *utils.BinWriter, v []uint32) {
+	w.Uint32(uint32(len(v)))
+	for _, x := range v {
+		w.Uint32(x)
+	}
+}
+
+func readUint32s(r *utils.BinReader) []uint32 {
+	v := make([]uint32, r.Len(4))
+	for i := range v {
+		v[i] = r.Uint32()
+	}
+	return v
+}
+
+func writeUint32Matrix(w *utils.BinWriter, m [][]uint32) {
+	w.Uint32(uint32(len(m)))
+	for _, v := range m {
+		writeUint32s(w, v)
+	}
+}
+
+func readUint32Matrix(r *utils.BinReader) [][]uint32 {
+	m := make([][]uint32, r.Len(4))
+	for i := range m {
+		m[i] = readUint32s(r)
+	}
+	return m
+}
+
+// Bit vectors are packed into bytes, least significant bit first
+func writeBools(w *utils.BinWriter, v []bool) {
+	w.Uint32(uint32(len(v)))
+	packed := make([]byte, (len(v)+7)/8)
+	for i, b := range v {
+		if b {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	w.Raw(packed)
+}
+
+func readBools(r *utils.BinReader) []bool {
+	n := int(r.Uint32())
+	if r.Err() != nil {
+		return nil
+	}
+	if (n+7)/8 > r.Remaining() {
+		r.Fail(fmt.Errorf("%w: %d bits exceed input", utils.ErrMalformed, n))
+		return nil
+	}
+	packed := r.Raw((n + 7) / 8)
+	if n%8 != 0 && packed[len(packed)-1]>>(n%8) != 0 {
+		r.Fail(fmt.Errorf("%w: non-zero padding bits", utils.ErrMalformed))
+		return nil
+	}
+	v := make([]bool, n)
+	for i := range v {
+		v[i] = packed[i/8]>>(i%8)&1 == 1
+	}
+	return v
+}
+
+func writeCommitment(w *utils.BinWriter, c vc.Commitment) error {
+	b, err := vc.MarshalCommitment(c)
+	if err != nil {
+		return err
+	}
+	w.Bytes(b)
+	return nil
+}
+
+func readCommitment(r *utils.BinReader) vc.Commitment {
+	b := r.Bytes()
+	if r.Err() != nil {
+		return nil
+	}
+	c, err := vc.UnmarshalCommitment(b)
+	if err != nil {
+		r.Fail(err)
+	}
+	return c
+}
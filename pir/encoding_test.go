@@ -0,0 +1,171 @@
+package pir
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"reflect"
+	"tapir/modules/database"
+	"tapir/modules/psetggm"
+	"tapir/modules/vc"
+	"testing"
+
+	"github.com/dkales/dpf-go/dpf"
+)
+
+type binaryMessage interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// roundTrip encodes m, decodes it into a new value of the same type and
+// checks that truncated or extended encodings are rejected
+func roundTrip(t *testing.T, m binaryMessage) binaryMessage {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("%T: error encoding: %v", m, err)
+	}
+	out := reflect.New(reflect.TypeOf(m).Elem()).Interface().(binaryMessage)
+	if err := out.UnmarshalBinary(b); err != nil {
+		t.Fatalf("%T: error decoding: %v", m, err)
+	}
+	b2, err := out.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b, b2) {
+		t.Fatalf("%T: encoding not canonical", m)
+	}
+	for i := 0; i < len(b); i++ {
+		if err := out.UnmarshalBinary(b[:i]); err == nil {
+			t.Fatalf("%T: accepted encoding truncated to %d of %d bytes", m, i, len(b))
+		}
+	}
+	if err := out.UnmarshalBinary(append(b, 0)); err == nil {
+		t.Fatalf("%T: accepted encoding with trailing byte", m)
+	}
+	return out
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	recs := []database.Record{{1, 2, 3, 4}, {5, 6, 7, 8}}
+	msgs := []binaryMessage{
+		&DPFDigest{}, &DPFHintQuery{}, &DPFHintResp{}, &DPFHint{},
+		&DPFQuery{QueryKey: []byte{1, 2, 3}},
+		&DPFAnswer{QueryRecord: database.Record{9, 9}},
+		&DPFBatchQuery{Keys: []dpf.DPFkey{{1, 2}, {3}}},
+		&DPFBatchAnswer{Records: recs},
+
+		&MatrixDigest{}, &MatrixHintQuery{}, &MatrixHintResp{}, &MatrixHint{},
+		&MatrixQuery{BitVector: []bool{true, false, true, true, false, false, false, false, true}},
+		&MatrixAnswer{FlatRecords: []byte{1, 2}},
+
+		&SinglePassDigest{},
+		&SinglePassHintQuery{PermKey: bytes.Repeat([]byte{7}, psetggm.PermKeySize)},
+		&SinglePassHintResp{Parities: recs},
+		&SinglePassHint{Parities: recs, IdxToSetIdx: [][]uint32{{0, 1}, {1, 0}}, SetIdxToIdx: [][]uint32{{0, 1}, {1, 0}}},
+		&SinglePassQuery{Indices: []uint32{3, 1, 4}},
+		&SinglePassAnswer{FlatRecords: []byte{1, 2, 3}},
+
+		&APIR_MatrixHintQuery{}, &APIR_MatrixHint{},
+		&APIR_MatrixQuery{BitVector: []bool{false, true}},
+		&APIR_MatrixAnswer{FlatRecords: []byte{1}, FlatProofs: []byte{2, 3}},
+
+		&DPF128Digest{}, &DPF128HintQuery{}, &DPF128HintResp{}, &DPF128Hint{},
+		&DPF128Query{QueryKey: []byte{1}, AuthKey: []byte{2}, KeySize: 1},
+		&DPF128Answer{QueryRecord: []byte{1}, AuthRecord: []byte{2}},
+		&DPF128BatchQuery{Queries: []DPF128Query{{QueryKey: []byte{1}, AuthKey: []byte{2}, KeySize: 1}, {QueryKey: []byte{3}, AuthKey: []byte{4}, KeySize: 1}}},
+		&DPF128BatchAnswer{Answers: []DPF128Answer{{QueryRecord: []byte{1}, AuthRecord: []byte{2}}}},
+
+		&TAPIRHintQuery{},
+		&TAPIRHintResp{Answers: recs},
+		&TAPIRHint{Parities: recs, IdxToSetIdx: [][]uint32{{0}}, SetIdxToIdx: [][]uint32{{0}}},
+		&TAPIRQuery{Indices: []uint32{7}},
+		&TAPIRBatchQuery{Indices: [][]uint32{{7, 1}, {2, 3}}},
+
+		&MisbehaviorError{Scheme: APIR_TAPIR, Server: 1, Reason: "proof", Digest: []byte{1},
+			Queries: [][]byte{{2}}, Answers: [][]byte{{3, 4}}, Proof: []byte{5}},
+		&MisbehaviorError{Scheme: APIR_MATRIX, Server: -1, Queries: [][]byte{{1}, {2}}, Answers: [][]byte{{3}, {4}}},
+	}
+	for _, m := range msgs {
+		roundTrip(t, m)
+	}
+}
+
+func TestEncodingAuthenticated(t *testing.T) {
+	n := 16
+	Q := 4
+	recSize := 32
+	db := database.MakeRandomDB([32]byte{3}, n, recSize)
+
+	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof, vc.VC_KZG} {
+		// TAPIR digest and answers
+		server := newServer(t, APIR_TAPIR, db, 0, Q, vctype)
+		client := newClient(t, APIR_TAPIR, n, Q, recSize, vctype).(*TAPIRClient)
+		d, err := server.GenDigest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec := roundTrip(t, d.(*TAPIRDigest))
+		if !client.EqualDigests(d, dec) {
+			t.Fatal("decoded digest differs")
+		}
+
+		a, err := server.Answer(&TAPIRQuery{Indices: []uint32{0, 1, 2, 3}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, a.(*TAPIRAnswer))
+
+		// APIR_Matrix digest and hint response
+		mserver := newServer(t, APIR_MATRIX, db, 0, -1, vctype)
+		md, err := mserver.GenDigest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, md.(*APIR_MatrixDigest))
+		roundTrip(t, &APIR_MatrixHintResp{Digest: md.(*APIR_MatrixDigest).Digest})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	db := database.MakeRandomDB([32]byte{4}, 16, 32)
+	other := database.MakeRandomDB([32]byte{5}, 16, 32)
+	fingerprint := func(db *database.DB, role int) []byte {
+		d, err := newServer(t, APIR_TAPIR, db, role, 4, vc.VC_MerkleTree).GenDigest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := Fingerprint(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	if !bytes.Equal(fingerprint(db, 0), fingerprint(db, 1)) {
+		t.Fatal("fingerprints of both servers differ")
+	}
+	if bytes.Equal(fingerprint(db, 0), fingerprint(other, 0)) {
+		t.Fatal("fingerprints of different databases are equal")
+	}
+	if _, err := Fingerprint(nil); !errors.Is(err, ErrUnsupported) {
+		t.Fatal("expected unsupported digest, got", err)
+	}
+}
+
+func TestEncodingRejectsOtherScheme(t *testing.T) {
+	b, err := (&TAPIRQuery{Indices: []uint32{1}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&SinglePassQuery{}).UnmarshalBinary(b); !errors.Is(err, ErrSchemeMismatch) {
+		t.Fatalf("expected scheme mismatch, got %v", err)
+	}
+	if err := (&TAPIRAnswer{}).UnmarshalBinary(b); !errors.Is(err, ErrSchemeMismatch) {
+		t.Fatalf("expected scheme mismatch, got %v", err)
+	}
+	b[0] = EncodingVersion + 1
+	if err := (&TAPIRQuery{}).UnmarshalBinary(b); !errors.Is(err, ErrEncodingVersion) {
+		t.Fatalf("expected version error, got %v", err)
+	}
+}
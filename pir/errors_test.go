@@ -0,0 +1,381 @@
+package pir
+
+import (
+	"errors"
+	"log"
+	"os"
+	"testing"
+
+	"tapir/modules/database"
+	"tapir/modules/vc"
+
+	"github.com/dkales/dpf-go/dpf"
+)
+
+// Parties of the tests run in the same process and share the parameters of
+// a process-local trusted setup
+func TestMain(m *testing.M) {
+	vc.AllowLocalSetup(true)
+	os.Exit(m.Run())
+}
+
+func newServer(t testing.TB, pirType PirType, db *database.DB, role, Q int, vctype vc.VcType) APIRServer {
+	s, err := NewServer(pirType, db, role, Q, vctype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newClient(t testing.TB, pirType PirType, n, Q, recSize int, vctype vc.VcType) APIRClient {
+	c, err := NewClient(pirType, n, Q, recSize, vctype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func update(t testing.TB, s APIRServer, ops []database.Update) (int, int, Digest, []database.Update) {
+	n, q, d, ops, err := s.Update(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, q, d, ops
+}
+
+func TestFactoryErrors(t *testing.T) {
+	db := database.MakeRandomDB([32]byte{21}, 64, 32)
+	for _, s := range []struct {
+		pirType PirType
+		Q       int
+		recSize int
+		vctype  vc.VcType
+		err     error
+	}{
+		{APIR_TAPIR, 7, 32, vc.VC_MerkleTree, ErrParamMismatch},
+		{APIR_TAPIR, 0, 32, vc.VC_MerkleTree, ErrParamMismatch},
+		{APIR_TAPIR, 8, 32, vc.None, ErrParamMismatch},
+		{APIR_TAPIR, 8, 32, vc.VcType(42), ErrUnsupported},
+		{PIR_SinglePass, 7, 32, vc.None, ErrParamMismatch},
+		{PIR_SinglePass, 8, 24, vc.None, ErrParamMismatch},
+		{APIR_TAPIR, 8, 8, vc.VC_MerkleTree, ErrParamMismatch},
+		{PIR_DPF, 8, 32, vc.None, ErrParamMismatch},
+		{APIR_DPF128, -1, 32, vc.None, ErrParamMismatch},
+		{APIR_MATRIX, -1, 32, vc.None, ErrParamMismatch},
+		{PirType(42), -1, 32, vc.None, ErrUnsupported},
+	} {
+		if _, err := NewClient(s.pirType, db.N, s.Q, s.recSize, s.vctype); !errors.Is(err, s.err) {
+			t.Fatalf("NewClient(%d, Q=%d, %d): expected %v, got %v", s.pirType, s.Q, s.vctype, s.err, err)
+		}
+		if s.recSize != db.RecSize {
+			continue
+		}
+		if _, err := NewServer(s.pirType, db, 0, s.Q, s.vctype); !errors.Is(err, s.err) {
+			t.Fatalf("NewServer(%d, Q=%d, %d): expected %v, got %v", s.pirType, s.Q, s.vctype, s.err, err)
+		}
+	}
+
+	// schemes without updates report them as unsupported
+	for _, pirType := range []PirType{PIR_DPF, PIR_MATRIX} {
+		server := newServer(t, pirType, db, 0, -1, vc.None)
+		if _, _, _, _, err := server.Update(nil); !errors.Is(err, ErrUnsupported) {
+			t.Fatal(pirType, ": expected unsupported update, got", err)
+		}
+		client := newClient(t, pirType, db.N, -1, db.RecSize, vc.None)
+		if _, _, _, _, err := client.UpdateHint(db.N, db.N, -1, -1, nil, nil, nil, nil); !errors.Is(err, ErrUnsupported) {
+			t.Fatal(pirType, ": expected unsupported hint update, got", err)
+		}
+	}
+}
+
+func TestMalformedAnswer(t *testing.T) {
+	n := 64
+	for _, s := range []struct {
+		pirType PirType
+		Q       int
+		recSize int
+		vctype  vc.VcType
+	}{
+		{PIR_DPF, -1, 32, vc.None},
+		{PIR_MATRIX, -1, 32, vc.None},
+		{PIR_SinglePass, 8, 32, vc.None},
+		{APIR_MATRIX, -1, 32, vc.VC_MerkleTree},
+		{APIR_MATRIX, -1, 32, vc.VC_KZG},
+		{APIR_DPF128, -1, BLOCKSIZE, vc.None},
+		{APIR_TAPIR, 8, 32, vc.VC_MerkleTree},
+		{APIR_TAPIR, 8, 32, vc.VC_PointProof},
+	} {
+		log.Println("TestMalformedAnswer with", s.pirType, "and VC type:", s.vctype)
+		db := database.MakeRandomDB([32]byte{22}, n, s.recSize)
+		servers := [2]APIRServer{
+			newServer(t, s.pirType, db, 0, s.Q, s.vctype),
+			newServer(t, s.pirType, db, 1, s.Q, s.vctype),
+		}
+		client := newClient(t, s.pirType, n, s.Q, s.recSize, s.vctype)
+		digest, hint := setupBatch(t, client, servers)
+
+		// answers of another scheme and empty answers of the scheme are
+		// rejected without crashing the client
+		var other Answer = &DPFAnswer{}
+		if s.pirType == PIR_DPF {
+			other = &TAPIRAnswer{}
+		}
+		for k, malformed := range []Answer{nil, other, emptyAnswer(s.pirType)} {
+			h, err := client.Query(3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q0, q1 := h.Queries[0], h.Queries[1]
+			a0, err := servers[0].Answer(q0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			servers[1].Answer(q1)
+			if _, err := client.Reconstruct(h, digest, hint, a0, malformed); !errors.Is(err, ErrMalformedAnswer) {
+				t.Fatalf("answer %d: expected malformed answer, got %v", k, err)
+			}
+		}
+
+		// queries of another scheme and indices out of bounds are
+		// rejected without crashing the server
+		var otherQuery Query = &DPFQuery{}
+		if s.pirType == PIR_DPF {
+			otherQuery = &TAPIRQuery{}
+		}
+		malformed := []Query{nil, otherQuery}
+		if s.Q > 0 {
+			indices := make([]uint32, s.Q)
+			indices[s.Q-1] = uint32(n / s.Q)
+			if s.pirType == APIR_TAPIR {
+				malformed = append(malformed, &TAPIRQuery{Indices: indices}, &TAPIRQuery{Indices: indices[1:]})
+			} else {
+				malformed = append(malformed, &SinglePassQuery{Indices: indices}, &SinglePassQuery{Indices: indices[1:]})
+			}
+		}
+		for k, q := range malformed {
+			if _, err := servers[0].Answer(q); !errors.Is(err, ErrMalformedQuery) {
+				t.Fatalf("query %d: expected malformed query, got %v", k, err)
+			}
+		}
+		if bs, ok := servers[0].(BatchServer); ok {
+			if _, err := bs.BatchAnswer(otherQuery); !errors.Is(err, ErrMalformedQuery) {
+				t.Fatal("expected malformed batch query, got", err)
+			}
+		}
+	}
+
+	// a proof of another VC fails verification instead of crashing the
+	// client
+	db := database.MakeRandomDB([32]byte{23}, n, 32)
+	servers := [2]APIRServer{
+		newServer(t, APIR_TAPIR, db, 0, 8, vc.VC_MerkleTree),
+		newServer(t, APIR_TAPIR, db, 1, 8, vc.VC_MerkleTree),
+	}
+	client := newClient(t, APIR_TAPIR, n, 8, 32, vc.VC_MerkleTree)
+	digest, hint := setupBatch(t, client, servers)
+	h, err := client.Query(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q0, q1 := h.Queries[0], h.Queries[1]
+	a0, err := servers[0].Answer(q0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1, err := servers[1].Answer(q1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a0.(*TAPIRAnswer).AggProof = &vc.KZGAggProof{}
+	var me *MisbehaviorError
+	if _, err := client.Reconstruct(h, digest, hint, a0, a1); !errors.As(err, &me) || me.Server != 0 {
+		t.Fatal("expected misbehavior of server 0, got", err)
+	}
+
+	// hint responses of another scheme are rejected
+	tc := newClient(t, APIR_TAPIR, n, 8, 32, vc.VC_MerkleTree)
+	if _, _, err := tc.RequestHint(); err != nil {
+		t.Fatal(err)
+	}
+	d0, _ := servers[0].GenDigest()
+	d1, _ := servers[1].GenDigest()
+	if _, _, err := tc.VerSetup(d0, d1, &SinglePassHintResp{}, &TAPIRHintResp{}); !errors.Is(err, ErrMalformedAnswer) {
+		t.Fatal("expected malformed hint response, got", err)
+	}
+}
+
+// Keys of the wrong size are rejected without crashing the server, for the
+// whole database and for the buckets of a batch
+func TestMalformedKeys(t *testing.T) {
+	for _, n := range []int{64, 1000} {
+		db := database.MakeRandomDB([32]byte{24}, n, 32)
+		s := newServer(t, PIR_DPF, db, 0, -1, vc.None)
+		c := newClient(t, PIR_DPF, n, -1, 32, vc.None)
+		h, err := c.Query(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := h.Queries[0].(*DPFQuery).QueryKey
+		for k, bad := range malformedKeys(key) {
+			if _, err := s.Answer(&DPFQuery{bad}); !errors.Is(err, ErrMalformedQuery) {
+				t.Fatalf("n=%d, key %d: expected malformed query, got %v", n, k, err)
+			}
+		}
+
+		h, err = c.(BatchClient).BatchQuery([]int{1, 5, 9})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := h.Queries[0].(*DPFBatchQuery).Keys
+		for b := range keys {
+			if len(keys[b]) == 0 {
+				continue
+			}
+			for k, bad := range malformedKeys(keys[b]) {
+				q := &DPFBatchQuery{Keys: append([]dpf.DPFkey(nil), keys...)}
+				q.Keys[b] = bad
+				if _, err := s.(BatchServer).BatchAnswer(q); !errors.Is(err, ErrMalformedQuery) {
+					t.Fatalf("n=%d, bucket %d, key %d: expected malformed batch query, got %v", n, b, k, err)
+				}
+			}
+		}
+	}
+
+	for _, n := range []int{64, 1000} {
+		db := database.MakeRandomDB([32]byte{25}, n, BLOCKSIZE)
+		s := newServer(t, APIR_DPF128, db, 0, -1, vc.None)
+		c := newClient(t, APIR_DPF128, n, -1, BLOCKSIZE, vc.None)
+		h, err := c.Query(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := *h.Queries[0].(*DPF128Query)
+		bad := malformedDPF128Queries(q)
+		for k := range bad {
+			if _, err := s.Answer(&bad[k]); !errors.Is(err, ErrMalformedQuery) {
+				t.Fatalf("n=%d, query %d: expected malformed query, got %v", n, k, err)
+			}
+		}
+
+		h, err = c.(BatchClient).BatchQuery([]int{1, 5, 9})
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries := h.Queries[0].(*DPF128BatchQuery).Queries
+		for b := range queries {
+			if len(queries[b].QueryKey) == 0 {
+				continue
+			}
+			for k, sub := range malformedDPF128Queries(queries[b]) {
+				q := &DPF128BatchQuery{Queries: append([]DPF128Query(nil), queries...)}
+				q.Queries[b] = sub
+				if _, err := s.(BatchServer).BatchAnswer(q); !errors.Is(err, ErrMalformedQuery) {
+					t.Fatalf("n=%d, bucket %d, query %d: expected malformed batch query, got %v", n, b, k, err)
+				}
+			}
+		}
+	}
+}
+
+// malformedDPF128Queries returns queries derived from q with keys of the
+// wrong size or a key size that does not match the domain
+func malformedDPF128Queries(q DPF128Query) []DPF128Query {
+	var qs []DPF128Query
+	for _, key := range malformedKeys(q.QueryKey) {
+		qs = append(qs, DPF128Query{key, q.AuthKey, q.KeySize}, DPF128Query{q.QueryKey, key, q.KeySize})
+		qs = append(qs, DPF128Query{key, key, uint64(len(key))})
+	}
+	return append(qs, DPF128Query{q.QueryKey, q.AuthKey, q.KeySize - 1}, DPF128Query{q.QueryKey, q.AuthKey, 1 << 40})
+}
+
+// malformedKeys returns keys of the wrong size derived from key: missing,
+// truncated, extended and garbage
+func malformedKeys(key []byte) [][]byte {
+	garbage := make([]byte, 1000)
+	for i := range garbage {
+		garbage[i] = byte(i)
+	}
+	return [][]byte{nil, key[:3], key[:len(key)-1], append(append([]byte(nil), key...), 0), garbage}
+}
+
+// emptyAnswer returns the zero answer of scheme t
+func emptyAnswer(t PirType) Answer {
+	switch t {
+	case PIR_DPF:
+		return &DPFAnswer{}
+	case PIR_MATRIX:
+		return &MatrixAnswer{}
+	case PIR_SinglePass:
+		return &SinglePassAnswer{}
+	case APIR_MATRIX:
+		return &APIR_MatrixAnswer{}
+	case APIR_DPF128:
+		return &DPF128Answer{}
+	default:
+		return &TAPIRAnswer{}
+	}
+}
+
+// Invalid updates are rejected without changing the server
+func TestInvalidUpdates(t *testing.T) {
+	n, q, recSize := 64, 8, 16
+	rec := make([]byte, recSize)
+	adds := func(k int) []database.Update {
+		ops := make([]database.Update, k)
+		for i := range ops {
+			ops[i] = database.Update{Op: database.ADD, Val: rec}
+		}
+		return ops
+	}
+	cases := []struct {
+		name string
+		ops  []database.Update
+		err  error
+	}{
+		{"edit after the last record", []database.Update{{Op: database.EDIT, Idx: 64, Val: rec}}, database.ErrInvalidUpdate},
+		{"edit beyond a new partition", []database.Update{{Op: database.EDIT, Idx: 80, Val: rec}}, database.ErrInvalidUpdate},
+		{"negative edit", []database.Update{{Op: database.EDIT, Idx: -20, Val: rec}}, database.ErrInvalidUpdate},
+		{"negative delete", []database.Update{{Op: database.DELETE, Idx: -1}}, database.ErrInvalidUpdate},
+		{"short value", []database.Update{{Op: database.EDIT, Idx: 3, Val: rec[:8]}}, database.ErrInvalidUpdate},
+		{"long add", []database.Update{{Op: database.ADD, Val: make([]byte, 2*recSize)}}, database.ErrInvalidUpdate},
+		{"unknown op", []database.Update{{Op: 7, Idx: 3, Val: rec}}, database.ErrInvalidUpdate},
+		{"add after invalid edit", append(adds(1), database.Update{Op: database.EDIT, Idx: 70, Val: rec}), database.ErrInvalidUpdate},
+		{"adds beyond a new partition", adds(10), ErrUnsupported},
+	}
+	for _, pt := range []PirType{APIR_TAPIR, PIR_SinglePass} {
+		for _, c := range cases {
+			if pt == PIR_SinglePass && c.err == ErrUnsupported {
+				// PIR_SinglePass appends any number of partitions
+				continue
+			}
+			// a deleted slot must stay free
+			db := database.MakeRandomDB([32]byte{3}, n, recSize)
+			vctype := vc.VC_MerkleTree
+			if pt == PIR_SinglePass {
+				vctype = vc.None
+			}
+			s := newServer(t, pt, db, 0, q, vctype)
+			ref := newServer(t, pt, database.MakeRandomDB([32]byte{3}, n, recSize), 0, q, vctype)
+			for _, s := range []APIRServer{s, ref} {
+				if _, err := s.GenDigest(); err != nil {
+					t.Fatal(err)
+				}
+				update(t, s, []database.Update{{Op: database.DELETE, Idx: 5}})
+			}
+
+			ops := make([]database.Update, len(c.ops))
+			for i, op := range c.ops {
+				ops[i] = database.Update{Op: op.Op, Idx: op.Idx, Val: append([]byte(nil), op.Val...)}
+			}
+			if _, _, _, _, err := s.Update(ops); !errors.Is(err, c.err) {
+				t.Fatalf("%v %s: expected %v, got %v", pt, c.name, c.err, err)
+			}
+			if ok, err := s.Equals(ref); !ok {
+				t.Fatalf("%v %s: server changed: %v", pt, c.name, err)
+			}
+			if ts, ok := s.(*TAPIRServer); ok && len(ts.Proofs) != ts.Db.Capacity {
+				t.Fatalf("%v %s: %d proofs for capacity %d", pt, c.name, len(ts.Proofs), ts.Db.Capacity)
+			}
+		}
+	}
+}
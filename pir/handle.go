@@ -0,0 +1,256 @@
+package pir
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+////////////////////////////////////////////////////////////
+// QUERY HANDLES
+////////////////////////////////////////////////////////////
+
+// QueryHandle is a pending query. Query and BatchQuery return a handle with
+// the queries for both servers, Reconstruct and BatchReconstruct consume it.
+// A client may have several pending queries, e.g., issued by different
+// goroutines, whose answers are reconstructed in any order. A handle is
+// consumed by the first reconstruction, successful or not, and must be
+// released if its answers never arrive.
+type QueryHandle struct {
+	// Queries holds the queries for server 0 and server 1
+	Queries [2]Query
+
+	owner APIRClient
+	state any
+	// frees the hint sets used by the query, or burns them if they were
+	// not refreshed, may be nil
+	release func(burn bool)
+	// set by the reconstruction once it refreshed the hint sets
+	refreshed bool
+	used      atomic.Bool
+}
+
+var (
+	// ErrHandle is returned for a handle that was already consumed or
+	// released, or that belongs to another client or kind of query
+	ErrHandle = errors.New("invalid query handle")
+	// ErrHintSetBurned is returned for a query that needs a burned hint
+	// set, see HintRefresher
+	ErrHintSetBurned = errors.New("hint set burned by a released or rejected query")
+)
+
+func newHandle(owner APIRClient, q0, q1 Query, state any, release func(burn bool)) *QueryHandle {
+	return &QueryHandle{Queries: [2]Query{q0, q1}, owner: owner, state: state, release: release}
+}
+
+// Release discards the pending query, e.g., if a server did not answer. It
+// does nothing if the handle was consumed. The hint sets of a SinglePass or
+// TAPIR query were sent to the servers but not refreshed, so they are
+// burned, see HintRefresher.
+func (h *QueryHandle) Release() {
+	if h.used.CompareAndSwap(false, true) {
+		h.finish()
+	}
+}
+
+// finish frees the hint sets of the query if the reconstruction refreshed
+// them and burns them otherwise
+func (h *QueryHandle) finish() {
+	if h.release != nil {
+		h.release(!h.refreshed)
+	}
+}
+
+// HintRefresher is implemented by clients that refresh a hint set after
+// every query (SinglePass, TAPIR). The sets of a query that is released or
+// whose answers fail to reconstruct were sent to the servers, and sending
+// them again with other sets reveals the queried indices. Such hint sets
+// are burned: queries of other indices in them fail with ErrHintSetBurned,
+// and a query of the same index sends the burned queries again, which
+// reveals nothing new. A burned set is refreshed by reconstructing the
+// answers to its queries.
+type HintRefresher interface {
+	// RefreshQuery returns a query that sends the queries of a burned hint
+	// set again, nil if no hint set is burned. Its reconstruction returns
+	// the record of the burned query.
+	RefreshQuery() *QueryHandle
+}
+
+// takeState consumes h, a handle of owner whose state is of type T. The
+// caller must finish the handle once it is done with the state.
+func takeState[T any](h *QueryHandle, owner APIRClient) (T, error) {
+	var st T
+	if h == nil || h.owner != owner {
+		return st, fmt.Errorf("%w: not a query of this client", ErrHandle)
+	}
+	st, ok := h.state.(T)
+	if !ok {
+		return st, fmt.Errorf("%w: state %T of another kind of query", ErrHandle, h.state)
+	}
+	if !h.used.CompareAndSwap(false, true) {
+		return st, fmt.Errorf("%w: query already reconstructed or released", ErrHandle)
+	}
+	return st, nil
+}
+
+////////////////////////////////////////////////////////////
+// HINT LOCK
+////////////////////////////////////////////////////////////
+
+// hintLock guards a hint that is refreshed after every query (SinglePass,
+// TAPIR). A query uses the hint set of the queried index and swaps a random
+// position of each partition into it, the refresh after the query changes
+// the parities and permutations at these positions. Queries using disjoint
+// positions can be pending at the same time and refresh the hint in any
+// order, a query for an index in a hint set used by a pending query waits
+// until that query is reconstructed or released. Changes of the whole hint,
+// e.g., updates, wait until no query is pending.
+//
+// Burned queries keep their hint set and swapped positions reserved until
+// they are sent again, see HintRefresher.
+//
+// The zero value is unlocked, mu guards the hint and the fields below.
+type hintLock struct {
+	mu   sync.Mutex
+	cond sync.Cond
+
+	// number of pending queries
+	n int
+	// hint sets of the pending and burned queries
+	owners map[uint32]bool
+	// positions swapped by the pending and burned queries, per partition
+	swaps []map[uint32]bool
+	// state of the burned queries, by hint set
+	burned map[uint32]any
+	// number of callers waiting for exclusive access
+	exclusive int
+}
+
+func (l *hintLock) lock() {
+	l.mu.Lock()
+	if l.cond.L == nil {
+		l.cond.L = &l.mu
+		l.owners = make(map[uint32]bool)
+		l.burned = make(map[uint32]any)
+	}
+}
+
+func (l *hintLock) unlock() {
+	l.mu.Unlock()
+}
+
+// lockExclusive locks the hint once no query is pending, new queries wait
+// until it is unlocked
+func (l *hintLock) lockExclusive() {
+	l.lock()
+	l.exclusive++
+	for l.n > 0 {
+		l.cond.Wait()
+	}
+	l.exclusive--
+	// queries waiting for the exclusive access to end proceed after unlock
+	l.cond.Broadcast()
+}
+
+// wait waits until ready returns true, which is called with the lock held
+// whenever pending queries were reconstructed or released
+func (l *hintLock) wait(ready func() bool) {
+	for l.exclusive > 0 || !ready() {
+		l.cond.Wait()
+	}
+}
+
+// free reports whether k more queries for the hint sets pos fit in
+// partitions of size m. Each pending query occupies its hint set and at
+// most one position per partition, so new queries find free positions to
+// swap as long as at most half of them are occupied.
+func (l *hintLock) free(k, m int, pos ...uint32) bool {
+	if l.n > 0 && 2*(l.n+len(l.burned)+k) > m {
+		return false
+	}
+	for _, p := range pos {
+		if l.used(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// blocked reports whether k more queries for the hint sets pos wait for
+// burned queries, which are only refreshed on request, rather than for
+// pending queries
+func (l *hintLock) blocked(k, m int, pos ...uint32) bool {
+	if l.n > 0 {
+		return false
+	}
+	return 2*(len(l.burned)+k) > m || slices.ContainsFunc(pos, l.used)
+}
+
+// used reports whether position p is the hint set or a swapped position of
+// a pending or burned query
+func (l *hintLock) used(p uint32) bool {
+	if l.owners[p] {
+		return true
+	}
+	for _, s := range l.swaps {
+		if s[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// swappable reports whether position x of partition j can be swapped into
+// a hint set, i.e., is neither the hint set nor a swapped position of a
+// pending or burned query
+func (l *hintLock) swappable(j int, x uint32) bool {
+	return !l.owners[x] && (j >= len(l.swaps) || !l.swaps[j][x])
+}
+
+// reserve marks the hint set pos and the positions swaps as used by a query
+func (l *hintLock) reserve(pos uint32, swaps []uint32) {
+	for len(l.swaps) < len(swaps) {
+		l.swaps = append(l.swaps, make(map[uint32]bool))
+	}
+	l.n++
+	l.owners[pos] = true
+	for j, x := range swaps {
+		l.swaps[j][x] = true
+	}
+}
+
+// release frees the positions reserved by a query
+func (l *hintLock) release(pos uint32, swaps []uint32) {
+	l.n--
+	delete(l.owners, pos)
+	for j, x := range swaps {
+		delete(l.swaps[j], x)
+	}
+	l.cond.Broadcast()
+}
+
+// burn ends a query whose hint set pos was not refreshed, its positions
+// stay reserved until takeBurned returns its state st
+func (l *hintLock) burn(pos uint32, st any) {
+	l.n--
+	l.burned[pos] = st
+	l.cond.Broadcast()
+}
+
+// takeBurned returns the state of the burned query of hint set pos, the
+// caller reserves its positions again
+func (l *hintLock) takeBurned(pos uint32) any {
+	st := l.burned[pos]
+	delete(l.burned, pos)
+	return st
+}
+
+// reset drops the burned queries when the hint is replaced, it is called
+// with exclusive access
+func (l *hintLock) reset() {
+	clear(l.owners)
+	clear(l.burned)
+	l.swaps = nil
+}
@@ -0,0 +1,315 @@
+package pir
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"tapir/modules/database"
+	"tapir/modules/vc"
+)
+
+// answer returns the answers of both servers to the queries of h
+func answer(t testing.TB, servers [2]APIRServer, h *QueryHandle) (Answer, Answer) {
+	a0, err := servers[0].Answer(h.Queries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1, err := servers[1].Answer(h.Queries[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a0, a1
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	n := 1024
+	Q := 16
+	for _, s := range []struct {
+		pirType PirType
+		Q       int
+		recSize int
+		vctype  vc.VcType
+	}{
+		{PIR_DPF, -1, 32, vc.None},
+		{PIR_MATRIX, -1, 32, vc.None},
+		{PIR_SinglePass, Q, 32, vc.None},
+		{APIR_MATRIX, -1, 32, vc.VC_MerkleTree},
+		{APIR_DPF128, -1, BLOCKSIZE, vc.None},
+		{APIR_TAPIR, Q, 32, vc.VC_MerkleTree},
+	} {
+		log.Println("TestConcurrentQueries with", s.pirType, "and VC type:", s.vctype)
+		db := database.MakeRandomDB([32]byte{24}, n, s.recSize)
+		servers := [2]APIRServer{
+			newServer(t, s.pirType, db, 0, s.Q, s.vctype),
+			newServer(t, s.pirType, db, 1, s.Q, s.vctype),
+		}
+		client := newClient(t, s.pirType, n, s.Q, s.recSize, s.vctype)
+		digest, hint := setupBatch(t, client, servers)
+
+		// every goroutine queries the same indices in a different order, so
+		// that queries for the same hint set are pending at the same time
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for g := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				prg := rand.New(rand.NewPCG(uint64(g), 0))
+				for _, i := range prg.Perm(n)[:20] {
+					h, err := client.Query(i)
+					if err != nil {
+						errs <- err
+						return
+					}
+					a0, err0 := servers[0].Answer(h.Queries[0])
+					a1, err1 := servers[1].Answer(h.Queries[1])
+					if err := errors.Join(err0, err1); err != nil {
+						errs <- err
+						return
+					}
+					rec, err := client.Reconstruct(h, digest, hint, a0, a1)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if !bytes.Equal(rec, db.GetRecord(i)) {
+						errs <- errors.New("wrong record")
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+
+		// the hint is consistent after the concurrent refreshes
+		for i := range 64 {
+			h, err := client.Query(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a0, a1 := answer(t, servers, h)
+			rec, err := client.Reconstruct(h, digest, hint, a0, a1)
+			if err != nil || !bytes.Equal(rec, db.GetRecord(i)) {
+				t.Fatal("wrong record", i, "after concurrent queries", err)
+			}
+		}
+	}
+}
+
+func TestQueryHandle(t *testing.T) {
+	n := 512
+	Q := 8
+	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof} {
+		log.Println("TestQueryHandle with VC type:", vctype)
+		db := database.MakeRandomDB([32]byte{25}, n, 32)
+		servers := [2]APIRServer{
+			newServer(t, APIR_TAPIR, db, 0, Q, vctype),
+			newServer(t, APIR_TAPIR, db, 1, Q, vctype),
+		}
+		client := newClient(t, APIR_TAPIR, n, Q, 32, vctype)
+		digest, hint := setupBatch(t, client, servers)
+		c := client.(*TAPIRClient)
+
+		// queries whose hint sets are free are pending at the same time and
+		// reconstructed in reverse order
+		var indices []int
+		var handles []*QueryHandle
+		for i := 0; len(handles) < 4; i++ {
+			c.lock.lock()
+			_, _, pos := c.findIndex(i)
+			free := c.lock.free(1, c.M, uint32(pos))
+			c.lock.unlock()
+			if !free {
+				continue
+			}
+			h, err := client.Query(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			indices = append(indices, i)
+			handles = append(handles, h)
+		}
+		for k := len(handles) - 1; k >= 0; k-- {
+			a0, a1 := answer(t, servers, handles[k])
+			rec, err := client.Reconstruct(handles[k], digest, hint, a0, a1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rec, db.GetRecord(indices[k])) {
+				t.Fatal("wrong record", indices[k])
+			}
+			// a handle is consumed by its reconstruction
+			if _, err := client.Reconstruct(handles[k], digest, hint, a0, a1); !errors.Is(err, ErrHandle) {
+				t.Fatal("expected consumed handle, got", err)
+			}
+		}
+
+		// a query for a hint set in use waits for the pending query
+		h, err := client.Query(7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := make(chan *QueryHandle)
+		go func() {
+			h, err := client.Query(7)
+			if err != nil {
+				t.Error(err)
+			}
+			next <- h
+		}()
+		select {
+		case <-next:
+			t.Fatal("query for a hint set in use did not wait")
+		case <-time.After(100 * time.Millisecond):
+		}
+		a0, a1 := answer(t, servers, h)
+		if _, err := client.Reconstruct(h, digest, hint, a0, a1); err != nil {
+			t.Fatal(err)
+		}
+		h = <-next
+
+		// released handles burn their hint sets and cannot be reconstructed,
+		// a query of the same index sends the burned queries again
+		h.Release()
+		if _, err := client.Reconstruct(h, digest, hint, a0, a1); !errors.Is(err, ErrHandle) {
+			t.Fatal("expected released handle, got", err)
+		}
+		if rec := retrieve(t, client, servers, 7); !bytes.Equal(rec, db.GetRecord(7)) {
+			t.Fatal("wrong record after release")
+		}
+
+		// handles of other clients and batch handles are rejected without
+		// being consumed
+		other := newClient(t, APIR_TAPIR, n, Q, 32, vctype)
+		setupBatch(t, other, servers)
+		h, err = other.Query(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a0, a1 = answer(t, servers, h)
+		if _, err := client.Reconstruct(h, digest, hint, a0, a1); !errors.Is(err, ErrHandle) {
+			t.Fatal("expected foreign handle, got", err)
+		}
+		if _, err := other.(BatchClient).BatchReconstruct(h, digest, hint, a0, a1); !errors.Is(err, ErrHandle) {
+			t.Fatal("expected single query handle, got", err)
+		}
+		if rec, err := other.Reconstruct(h, digest, hint, a0, a1); err != nil || !bytes.Equal(rec, db.GetRecord(3)) {
+			t.Fatal("handle was consumed by another client", err)
+		}
+	}
+}
+
+func TestBurnedHintSets(t *testing.T) {
+	n := 512
+	Q := 8
+	for _, s := range []struct {
+		pirType PirType
+		vctype  vc.VcType
+	}{
+		{PIR_SinglePass, vc.None},
+		{APIR_TAPIR, vc.VC_MerkleTree},
+	} {
+		log.Println("TestBurnedHintSets with", s.pirType)
+		db := database.MakeRandomDB([32]byte{26}, n, 32)
+		servers := [2]APIRServer{
+			newServer(t, s.pirType, db, 0, Q, s.vctype),
+			newServer(t, s.pirType, db, 1, Q, s.vctype),
+		}
+		client := newClient(t, s.pirType, n, Q, 32, s.vctype)
+		digest, hint := setupBatch(t, client, servers)
+		finder := client.(interface{ findIndex(int) (int, int, int) })
+		hintSet := func(i int) int {
+			_, _, pos := finder.findIndex(i)
+			return pos
+		}
+		// other index in the hint set of i
+		sameSet := func(i int) int {
+			j := (i + 1) % n
+			for hintSet(j) != hintSet(i) {
+				j = (j + 1) % n
+			}
+			return j
+		}
+
+		i := 5
+		h, err := client.Query(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		released := h.Queries
+		h.Release()
+
+		// other indices of the burned hint set cannot be queried
+		j := sameSet(i)
+		if _, err := client.Query(j); !errors.Is(err, ErrHintSetBurned) {
+			t.Fatal("expected burned hint set, got", err)
+		}
+
+		// queries of other hint sets never repeat the released queries
+		for k := range 128 {
+			if hintSet(k) == hintSet(i) {
+				continue
+			}
+			h, err := client.Query(k)
+			if errors.Is(err, ErrHintSetBurned) {
+				continue // swapped by the burned query
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, q := range h.Queries {
+				if reflect.DeepEqual(q, released[0]) || reflect.DeepEqual(q, released[1]) {
+					t.Fatal("query of index", k, "repeats a released query")
+				}
+			}
+			a0, a1 := answer(t, servers, h)
+			if rec, err := client.Reconstruct(h, digest, hint, a0, a1); err != nil || !bytes.Equal(rec, db.GetRecord(k)) {
+				t.Fatal("wrong record", k, err)
+			}
+		}
+
+		// the refresh sends the released queries again
+		refresher := client.(HintRefresher)
+		h = refresher.RefreshQuery()
+		if h == nil || !reflect.DeepEqual(h.Queries, released) {
+			t.Fatal("refresh does not repeat the released queries")
+		}
+		a0, a1 := answer(t, servers, h)
+		if rec, err := client.Reconstruct(h, digest, hint, a0, a1); err != nil || !bytes.Equal(rec, db.GetRecord(i)) {
+			t.Fatal("wrong record after refresh", err)
+		}
+		if refresher.RefreshQuery() != nil {
+			t.Fatal("refreshed hint set still burned")
+		}
+		if rec := retrieve(t, client, servers, j); !bytes.Equal(rec, db.GetRecord(j)) {
+			t.Fatal("wrong record", j, "after refresh")
+		}
+
+		// answers that fail to reconstruct burn the hint sets too
+		j = sameSet(i)
+		h, err = client.Query(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a0, _ = answer(t, servers, h)
+		if _, err := client.Reconstruct(h, digest, hint, a0, nil); err == nil {
+			t.Fatal("expected malformed answer")
+		}
+		if _, err := client.Query(j); !errors.Is(err, ErrHintSetBurned) {
+			t.Fatal("expected burned hint set, got", err)
+		}
+		if rec := retrieve(t, client, servers, i); !bytes.Equal(rec, db.GetRecord(i)) {
+			t.Fatal("wrong record after resending the burned queries")
+		}
+	}
+}
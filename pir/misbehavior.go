@@ -0,0 +1,136 @@
+package pir
+
+import (
+	"encoding"
+	"fmt"
+
+	"tapir/modules/utils"
+)
+
+////////////////////////////////////////////////////////////
+// MISBEHAVIOR EVIDENCE
+////////////////////////////////////////////////////////////
+
+// MisbehaviorError is returned by the clients of the authenticated schemes
+// if an answer fails verification. It names the misbehaving server and
+// holds the evidence in the binary encoding of the scheme, so that a third
+// party can decode it and repeat the verification.
+type MisbehaviorError struct {
+	Scheme PirType
+	// Server is the index of the server whose answer failed verification.
+	// It is -1 if the scheme verifies the combined answers of both servers
+	// (APIR_MATRIX, APIR_DPF128), which shows that one of them misbehaved
+	// but not which one.
+	Server int
+	Reason string
+
+	// Digest is the digest the answers were verified against, nil for
+	// schemes without a digest
+	Digest []byte
+	// Queries and Answers hold the query and answer of Server, or of both
+	// servers if Server is -1
+	Queries [][]byte
+	Answers [][]byte
+	// Proof is the proof that failed to verify: the aggregated proof for
+	// APIR_TAPIR, the proof of a record for APIR_MATRIX and the MAC key of
+	// the query for APIR_DPF128
+	Proof []byte
+}
+
+func (e *MisbehaviorError) Error() string {
+	if e.Server == -1 {
+		return fmt.Sprintf("%s: misbehaving server: %s", e.Scheme, e.Reason)
+	}
+	return fmt.Sprintf("%s: server %d misbehaved: %s", e.Scheme, e.Server, e.Reason)
+}
+
+// newMisbehavior encodes the evidence of the misbehavior of server
+func newMisbehavior(t PirType, server int, reason string, digest Digest, queries []Query, answers []Answer, proof []byte) *MisbehaviorError {
+	e := &MisbehaviorError{
+		Scheme: t,
+		Server: server,
+		Reason: reason,
+		Proof:  proof,
+	}
+	if digest != nil {
+		e.Digest = marshalEvidence(digest)
+	}
+	for _, q := range queries {
+		e.Queries = append(e.Queries, marshalEvidence(q))
+	}
+	for _, a := range answers {
+		e.Answers = append(e.Answers, marshalEvidence(a))
+	}
+	return e
+}
+
+// marshalEvidence encodes v, nil if it cannot be encoded, as the error
+// should still be reported
+func marshalEvidence(v any) []byte {
+	m, ok := v.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func writeByteSlices(w *utils.BinWriter, v [][]byte) {
+	w.Uint32(uint32(len(v)))
+	for _, b := range v {
+		w.Bytes(b)
+	}
+}
+
+func readByteSlices(r *utils.BinReader) [][]byte {
+	v := make([][]byte, r.Len(4))
+	for i := range v {
+		v[i] = r.Bytes()
+	}
+	return v
+}
+
+func (e *MisbehaviorError) MarshalBinary() ([]byte, error) {
+	w := newWriter(e.Scheme, kindMisbehavior)
+	w.Uint32(uint32(int32(e.Server)))
+	w.Bytes([]byte(e.Reason))
+	w.Bytes(e.Digest)
+	writeByteSlices(w, e.Queries)
+	writeByteSlices(w, e.Answers)
+	w.Bytes(e.Proof)
+	return w.Buf, nil
+}
+
+// UnmarshalBinary decodes the evidence of any scheme
+func (e *MisbehaviorError) UnmarshalBinary(data []byte) error {
+	scheme := e.Scheme
+	if len(data) > 1 {
+		scheme = PirType(data[1])
+	}
+	r := newReader(data, scheme, kindMisbehavior)
+	server := int(int32(r.Uint32()))
+	reason := string(r.Bytes())
+	digest := r.Bytes()
+	queries := readByteSlices(r)
+	answers := readByteSlices(r)
+	proof := r.Bytes()
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	if server < -1 || server > 1 {
+		return fmt.Errorf("%w: server %d", utils.ErrMalformed, server)
+	}
+	*e = MisbehaviorError{
+		Scheme:  scheme,
+		Server:  server,
+		Reason:  reason,
+		Digest:  digest,
+		Queries: queries,
+		Answers: answers,
+		Proof:   proof,
+	}
+	return nil
+}
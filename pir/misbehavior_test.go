@@ -0,0 +1,136 @@
+package pir
+
+import (
+	"errors"
+	"log"
+	"testing"
+
+	"tapir/modules/database"
+	"tapir/modules/vc"
+)
+
+// tamperedAnswer returns the answer of servers[k] with a flipped bit
+func tamperedAnswer(t *testing.T, servers [2]APIRServer, k int, q Query) Answer {
+	a, err := servers[k].Answer(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch a := a.(type) {
+	case *TAPIRAnswer:
+		a.FlatRecords[0] ^= 1
+	case *APIR_MatrixAnswer:
+		a.FlatRecords[0] ^= 1
+	case *DPF128Answer:
+		a.QueryRecord[0] ^= 1
+	}
+	return a
+}
+
+func TestMisbehaviorError(t *testing.T) {
+	n := 64
+	Q := 8
+	for _, s := range []struct {
+		pirType PirType
+		Q       int
+		recSize int
+		vctype  vc.VcType
+	}{
+		{APIR_TAPIR, Q, 32, vc.VC_MerkleTree},
+		{APIR_TAPIR, Q, 32, vc.VC_PointProof},
+		{APIR_MATRIX, -1, 32, vc.VC_MerkleTree},
+		{APIR_MATRIX, -1, 32, vc.VC_KZG},
+		{APIR_DPF128, -1, BLOCKSIZE, vc.None},
+	} {
+		log.Println("TestMisbehaviorError with", s.pirType, "and VC type:", s.vctype)
+		db := database.MakeRandomDB([32]byte{20}, n, s.recSize)
+		servers := [2]APIRServer{
+			newServer(t, s.pirType, db, 0, s.Q, s.vctype),
+			newServer(t, s.pirType, db, 1, s.Q, s.vctype),
+		}
+		client := newClient(t, s.pirType, n, s.Q, s.recSize, s.vctype)
+		digest, hint := setupBatch(t, client, servers)
+
+		for k := range servers {
+			h, err := client.Query(5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q0, q1 := h.Queries[0], h.Queries[1]
+			qs := [2]Query{q0, q1}
+			var as [2]Answer
+			for j := range servers {
+				if j == k {
+					as[j] = tamperedAnswer(t, servers, j, qs[j])
+				} else if as[j], err = servers[j].Answer(qs[j]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err = client.Reconstruct(h, digest, hint, as[0], as[1])
+			var me *MisbehaviorError
+			if !errors.As(err, &me) {
+				t.Fatal("expected misbehavior error, got", err)
+			}
+
+			// only TAPIR verifies the answers of the servers separately
+			server, numAnswers := k, 1
+			if s.pirType != APIR_TAPIR {
+				server, numAnswers = -1, 2
+			}
+			if me.Scheme != s.pirType || me.Server != server || len(me.Queries) != numAnswers || len(me.Answers) != numAnswers || len(me.Proof) == 0 {
+				t.Fatalf("unexpected evidence %+v", me)
+			}
+
+			// the evidence survives encoding and is the evidence of the
+			// tampered answer
+			b, err := me.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dec MisbehaviorError
+			if err := dec.UnmarshalBinary(b); err != nil {
+				t.Fatal(err)
+			}
+			if dec.Error() != me.Error() {
+				t.Fatal("decoded evidence differs")
+			}
+			if s.pirType == APIR_TAPIR {
+				checkTapirEvidence(t, &dec, s.vctype, as[k].(*TAPIRAnswer))
+			}
+		}
+	}
+}
+
+// checkTapirEvidence verifies the evidence as a third party holding only the
+// VC parameters would
+func checkTapirEvidence(t *testing.T, me *MisbehaviorError, vctype vc.VcType, tampered *TAPIRAnswer) {
+	var digest TAPIRDigest
+	var query TAPIRQuery
+	var answer TAPIRAnswer
+	if err := digest.UnmarshalBinary(me.Digest); err != nil {
+		t.Fatal(err)
+	}
+	if err := query.UnmarshalBinary(me.Queries[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := answer.UnmarshalBinary(me.Answers[0]); err != nil {
+		t.Fatal(err)
+	}
+	if string(answer.FlatRecords) != string(tampered.FlatRecords) {
+		t.Fatal("evidence does not hold the tampered answer")
+	}
+	q := len(digest.Coms)
+	recSize := len(answer.FlatRecords) / q
+	params, err := vc.NewVc(vctype, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := make([]database.Record, q)
+	indices := make([]int, q)
+	for i := range q {
+		recs[i] = answer.FlatRecords[i*recSize : (i+1)*recSize]
+		indices[i] = int(query.Indices[i])
+	}
+	if params.VerifyAggregation(answer.AggProof, &digest.Coms, indices, recs) {
+		t.Fatal("evidence verifies")
+	}
+}
@@ -0,0 +1,77 @@
+package pir
+
+import (
+	"runtime"
+	"sync"
+
+	"tapir/modules/database"
+)
+
+// numWorkers returns the number of goroutines to use for workers, which is
+// runtime.NumCPU() if workers is not positive
+func numWorkers(workers int) int {
+	if workers < 1 {
+		return runtime.NumCPU()
+	}
+	return workers
+}
+
+// parallelFor calls f(i) for every i in [0,n) using up to workers goroutines.
+// Each worker handles a contiguous range of indices. f must only write
+// results belonging to index i, then the result does not depend on the
+// number of workers.
+func parallelFor(workers, n int, f func(i int)) {
+	workers = min(numWorkers(workers), n)
+	if workers <= 1 {
+		for i := range n {
+			f(i)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				f(i)
+			}
+		}(w*n/workers, (w+1)*n/workers)
+	}
+	wg.Wait()
+}
+
+// parallelForErr is parallelFor for an f that can fail, it returns the error
+// of the smallest failing index
+func parallelForErr(workers, n int, f func(i int) error) error {
+	var mu sync.Mutex
+	var first error
+	firstIdx := n
+	parallelFor(workers, n, func(i int) {
+		if err := f(i); err != nil {
+			mu.Lock()
+			if i < firstIdx {
+				first, firstIdx = err, i
+			}
+			mu.Unlock()
+		}
+	})
+	return first
+}
+
+// parallelXor splits [0,n) into one contiguous range per worker and returns
+// the XOR of f(start, end) over all ranges, which must be of equal length.
+// As XOR is commutative, the result does not depend on the number of
+// workers.
+func parallelXor(workers, n int, f func(start, end int) []byte) []byte {
+	workers = max(min(numWorkers(workers), n), 1)
+	parts := make([][]byte, workers)
+	parallelFor(workers, workers, func(w int) {
+		parts[w] = f(w*n/workers, (w+1)*n/workers)
+	})
+	out := parts[0]
+	for _, part := range parts[1:] {
+		database.XorInto(out, part)
+	}
+	return out
+}
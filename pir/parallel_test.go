@@ -0,0 +1,74 @@
+package pir
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"tapir/modules/database"
+	"tapir/modules/vc"
+)
+
+func TestParallelAnswer(t *testing.T) {
+	for _, pirType := range []PirType{PIR_DPF, PIR_MATRIX} {
+		// sizes below and above the DPF subtree size, and not a power of two
+		for _, n := range []int{100, 1000, 5000} {
+			for _, recSize := range []int{32, 20} {
+				log.Println("TestParallelAnswer with", pirType, "for N:", n, "and record size:", recSize)
+
+				db := database.MakeRandomDB([32]byte{15}, n, recSize)
+				client := newClient(t, pirType, n, -1, recSize, vc.None)
+				servers := [2]APIRServer{
+					newServer(t, pirType, db, 0, -1, vc.None),
+					newServer(t, pirType, db, 1, -1, vc.None),
+				}
+				for _, i := range []int{0, n / 2, n - 1} {
+					h, err := client.Query(i)
+					if err != nil {
+						t.Fatal(err)
+					}
+					q := h.Queries
+
+					var serial [2]Answer
+					for k := range servers {
+						SetWorkers(servers[k], 1)
+						if serial[k], err = servers[k].Answer(q[k]); err != nil {
+							t.Fatal(err)
+						}
+						// the answers do not depend on the number of workers
+						for _, workers := range []int{3, 8, 0} {
+							SetWorkers(servers[k], workers)
+							a, err := servers[k].Answer(q[k])
+							if err != nil {
+								t.Fatal(err)
+							}
+							if !bytes.Equal(answerBytes(t, serial[k]), answerBytes(t, a)) {
+								t.Fatal("answer differs with", workers, "workers")
+							}
+						}
+					}
+
+					rec, err := client.Reconstruct(h, nil, nil, serial[0], serial[1])
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(rec, db.GetRecord(i)) {
+						t.Fatal("wrong record", i)
+					}
+				}
+			}
+		}
+	}
+}
+
+func answerBytes(t *testing.T, a Answer) []byte {
+	switch a := a.(type) {
+	case *DPFAnswer:
+		return a.QueryRecord
+	case *MatrixAnswer:
+		return a.FlatRecords
+	default:
+		t.Fatalf("unexpected answer type %T", a)
+		return nil
+	}
+}
@@ -1,6 +1,10 @@
 package pir
 
 import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+
 	"tapir/modules/database"
 	"tapir/modules/vc"
 )
@@ -19,27 +23,101 @@ type Hint interface{}
 type Query interface{}
 type Answer interface{}
 
+var (
+	// ErrUnsupported is returned for unknown schemes and VC types and for
+	// operations a scheme does not implement, e.g., updates of PIR_DPF
+	ErrUnsupported = errors.New("not supported")
+	// ErrMalformedAnswer is returned by the clients if a digest, hint
+	// response or answer of a server is not of the type or size the scheme
+	// expects
+	ErrMalformedAnswer = errors.New("malformed answer")
+	// ErrParamMismatch is returned for parameters that do not fit the
+	// scheme or each other, e.g., a Q that does not divide N
+	ErrParamMismatch = errors.New("parameter mismatch")
+	// ErrMalformedQuery is returned by the servers if a hint query or query
+	// is not of the type or size the scheme expects
+	ErrMalformedQuery = errors.New("malformed query")
+)
+
+// malformedType returns ErrMalformedAnswer for a value v of unexpected type
+func malformedType(v any) error {
+	return fmt.Errorf("%w: unexpected %T", ErrMalformedAnswer, v)
+}
+
+// malformedQuery returns ErrMalformedQuery for a query q of unexpected type
+func malformedQuery(q any) error {
+	return fmt.Errorf("%w: unexpected %T", ErrMalformedQuery, q)
+}
+
 type APIRServer interface {
 	GenDigest() (Digest, error)
 	GenHint(hq HintQuery) (HintResp, error)
 	Answer(q Query) (Answer, error)
 	Equals(other APIRServer) (bool, error)
 	GetVCType() vc.VcType
-	SetVC(vc.VcType)
+	SetVC(vc.VcType) error
 	GetDigest() Digest
 	GetDB() *database.DB
-	Update(ops []database.Update) (Nt, Qt int, dt Digest, opst []database.Update)
+	Update(ops []database.Update) (Nt, Qt int, dt Digest, opst []database.Update, err error)
 }
 
+// APIRClient is the client of a scheme. Query and Reconstruct are safe for
+// concurrent use, each query has its own handle. The offline phase and
+// updates change the whole hint and wait until no query is pending.
 type APIRClient interface {
 	RequestHint() (HintQuery, HintQuery, error)
 	VerSetup(d0 Digest, d1 Digest, resp0 HintResp, resp1 HintResp) (Digest, Hint, error)
-	Query(i int) (Query, Query, error)
-	Reconstruct(digest Digest, hint Hint, a0 Answer, a1 Answer) (database.Record, error)
+	Query(i int) (*QueryHandle, error)
+	Reconstruct(h *QueryHandle, digest Digest, hint Hint, a0 Answer, a1 Answer) (database.Record, error)
 	EqualDigests(d0, d1 Digest) bool
 	UpdateHint(newN0, newN1, newQ0, newQ1 int, newDigest0, newDigest1 Digest, ops0, ops1 []database.Update) (int, int, Digest, Hint, error)
 }
 
+// Needed to send the offline and online phase types as interface values
+// using gob, e.g., over the network (see pirnet/)
+func init() {
+	gob.Register(Digest(&TAPIRDigest{}))
+	gob.Register(HintQuery(&TAPIRHintQuery{}))
+	gob.Register(HintResp(&TAPIRHintResp{}))
+	gob.Register(Query(&TAPIRQuery{}))
+	gob.Register(Answer(&TAPIRAnswer{}))
+	gob.Register(Query(&TAPIRBatchQuery{}))
+
+	gob.Register(Digest(&SinglePassDigest{}))
+	gob.Register(HintQuery(&SinglePassHintQuery{}))
+	gob.Register(HintResp(&SinglePassHintResp{}))
+	gob.Register(Query(&SinglePassQuery{}))
+	gob.Register(Answer(&SinglePassAnswer{}))
+
+	gob.Register(Digest(&DPFDigest{}))
+	gob.Register(HintQuery(&DPFHintQuery{}))
+	gob.Register(HintResp(&DPFHintResp{}))
+	gob.Register(Query(&DPFQuery{}))
+	gob.Register(Answer(&DPFAnswer{}))
+	gob.Register(Query(&DPFBatchQuery{}))
+	gob.Register(Answer(&DPFBatchAnswer{}))
+
+	gob.Register(Digest(&MatrixDigest{}))
+	gob.Register(HintQuery(&MatrixHintQuery{}))
+	gob.Register(HintResp(&MatrixHintResp{}))
+	gob.Register(Query(&MatrixQuery{}))
+	gob.Register(Answer(&MatrixAnswer{}))
+
+	gob.Register(Digest(&APIR_MatrixDigest{}))
+	gob.Register(HintQuery(&APIR_MatrixHintQuery{}))
+	gob.Register(HintResp(&APIR_MatrixHintResp{}))
+	gob.Register(Query(&APIR_MatrixQuery{}))
+	gob.Register(Answer(&APIR_MatrixAnswer{}))
+
+	gob.Register(Digest(&DPF128Digest{}))
+	gob.Register(HintQuery(&DPF128HintQuery{}))
+	gob.Register(HintResp(&DPF128HintResp{}))
+	gob.Register(Query(&DPF128Query{}))
+	gob.Register(Answer(&DPF128Answer{}))
+	gob.Register(Query(&DPF128BatchQuery{}))
+	gob.Register(Answer(&DPF128BatchAnswer{}))
+}
+
 // Enum for different PIR types
 type PirType int
 
@@ -63,83 +141,102 @@ func (t PirType) String() string {
 	}[t]
 }
 
-// Usage: Q is -1 if not needed
-func NewClient(t PirType, n int, Q int, recSize int, vctype vc.VcType) APIRClient {
+// checkParams checks Q, the record size and the VC type of scheme t for n
+// records
+func checkParams(t PirType, n, Q, recSize int, vctype vc.VcType) error {
+	if (t == APIR_MATRIX || t == APIR_TAPIR) && vctype == vc.None {
+		return fmt.Errorf("%w: %s needs a vector commitment", ErrParamMismatch, t)
+	}
 	switch t {
-	case PIR_DPF:
-		if Q != -1 {
-			panic("DPF does not use Q")
-		}
-		return &DPFClient{N: n}
-	case PIR_MATRIX:
+	case PIR_DPF, PIR_MATRIX, APIR_MATRIX, APIR_DPF128:
 		if Q != -1 {
-			panic("DPF does not use Q")
+			return fmt.Errorf("%w: %s does not use Q", ErrParamMismatch, t)
 		}
-		return SetupMatrixClient(n, recSize, vctype)
-	case PIR_SinglePass:
-		if n%Q != 0 {
-			panic("Q does not divide N")
+		if t == APIR_DPF128 && recSize != BLOCKSIZE {
+			return fmt.Errorf("%w: DPF128 only supports %d-byte records", ErrParamMismatch, BLOCKSIZE)
 		}
+	case PIR_SinglePass, APIR_TAPIR:
 		if Q < 1 {
-			panic("Q is smaller than 1")
+			return fmt.Errorf("%w: Q is smaller than 1", ErrParamMismatch)
 		}
-		return &SinglePassClient{N: n, Q: Q, M: n / Q}
-	case APIR_TAPIR:
 		if n%Q != 0 {
-			panic("Q does not divide N")
+			return fmt.Errorf("%w: Q=%d does not divide N=%d", ErrParamMismatch, Q, n)
+		}
+		// the parities are XORed with SIMD instructions, see psetggm
+		if recSize <= 0 || recSize%16 != 0 {
+			return fmt.Errorf("%w: %s only supports records of a multiple of 16 bytes, got %d", ErrParamMismatch, t, recSize)
 		}
+	default:
+		return fmt.Errorf("%w: PIR type %d", ErrUnsupported, int(t))
+	}
+	return nil
+}
+
+// newVc sets up the VC of type vctype for vectors of length n
+func newVc(vctype vc.VcType, n int) (vc.VCParams, error) {
+	params, err := vc.NewVc(vctype, n)
+	if errors.Is(err, vc.ErrUnsupported) {
+		return nil, fmt.Errorf("%w: %w", ErrUnsupported, err)
+	}
+	return params, err
+}
+
+// Usage: Q is -1 if not needed
+func NewClient(t PirType, n int, Q int, recSize int, vctype vc.VcType) (APIRClient, error) {
+	if err := checkParams(t, n, Q, recSize, vctype); err != nil {
+		return nil, err
+	}
+	switch t {
+	case PIR_DPF:
+		return &DPFClient{N: n}, nil
+	case PIR_MATRIX:
+		return SetupMatrixClient(n, recSize, vctype)
+	case PIR_SinglePass:
+		return &SinglePassClient{N: n, Q: Q, M: n / Q}, nil
+	case APIR_TAPIR:
 		return NewTAPIRClient(n, Q, recSize, vctype)
 	case APIR_DPF128:
-		if Q != -1 {
-			panic("DPF does not use Q")
-		}
-		panic("Unknown PIR type")
-		//return //&DPF128Client{N: n}
-	case APIR_MATRIX:
-		if Q != -1 {
-			panic("APIR_Matrix does not use Q")
-		}
+		return &DPF128Client{N: n}, nil
+	default: // APIR_MATRIX
 		return SetupAPIR_MatrixClient(n, recSize, vctype)
-	default:
-		panic("Unknown PIR type")
+	}
+}
+
+// SetWorkers sets the number of goroutines s uses to generate its digest or
+// to answer queries, if it does so in parallel. runtime.NumCPU() goroutines
+// are used if workers is not positive.
+func SetWorkers(s APIRServer, workers int) {
+	switch s := s.(type) {
+	case *TAPIRServer:
+		s.Workers = workers
+	case *APIR_MatrixServer:
+		s.Workers = workers
+	case *DPFServer:
+		s.Workers = workers
+	case *MatrixServer:
+		s.Workers = workers
+	case *DPF128Server:
+		s.Workers = workers
 	}
 }
 
 // Usage: Q is -1 if not needed
-func NewServer(t PirType, db *database.DB, role int, Q int, vctype vc.VcType) APIRServer {
+func NewServer(t PirType, db *database.DB, role int, Q int, vctype vc.VcType) (APIRServer, error) {
+	if err := checkParams(t, db.N, Q, db.RecSize, vctype); err != nil {
+		return nil, err
+	}
 	switch t {
 	case PIR_DPF:
-		if Q != -1 {
-			panic("DPF does not use Q")
-		}
-		return &DPFServer{Db: db}
+		return &DPFServer{Db: db}, nil
 	case PIR_MATRIX:
-		if Q != -1 {
-			panic("Matrix does not use Q")
-		}
-		return &MatrixServer{Db: db}
+		return &MatrixServer{Db: db}, nil
 	case PIR_SinglePass:
-		if db.N%Q != 0 {
-			panic("Q does not divide N")
-		}
-		return &SinglePassServer{Db: db, Q: Q, M: db.N / Q}
+		return &SinglePassServer{Db: db, Q: Q, M: db.N / Q}, nil
 	case APIR_TAPIR:
-		if db.N%Q != 0 {
-			panic("Q does not divide N")
-		}
 		return NewTAPIRServer(db, Q, role, vctype)
 	case APIR_DPF128:
-		if Q != -1 {
-			panic("DPF does not use Q")
-		}
-		panic("Unknown PIR type")
-		//return &DPF128Server{Db: db, Role: byte(role)}
-	case APIR_MATRIX:
-		if Q != -1 {
-			panic("APIR_Matrix does not use Q")
-		}
+		return &DPF128Server{Db: db, Role: byte(role)}, nil
+	default: // APIR_MATRIX
 		return SetupAPIR_MatrixServer(db, vctype)
-	default:
-		panic("Unknown PIR type")
 	}
 }
@@ -1,7 +1,9 @@
 package pir
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"math/bits"
 	"tapir/modules/database"
 	"tapir/modules/utils"
 	"tapir/modules/vc"
@@ -23,16 +25,34 @@ type DPFAnswer struct {
 	QueryRecord database.Record
 }
 
+// Batch query types, one DPF key and answer per cuckoo bucket (see
+// batch.go). The key of an empty bucket is nil.
+type DPFBatchQuery struct {
+	Keys []dpf.DPFkey
+}
+type DPFBatchAnswer struct {
+	Records []database.Record
+}
+
 type DPFServer struct {
 	Db *database.DB
+	// Workers is the number of goroutines Answer and BatchAnswer use,
+	// runtime.NumCPU() if not positive
+	Workers int
+
+	cuckoo cuckooCache
 }
 type DPFClient struct {
-	N          int
-	queriedIdx int
+	N int
+
+	cuckoo cuckooCache
 }
 
 func (s *DPFServer) Equals(other APIRServer) (bool, error) {
-	s2 := other.(*DPFServer)
+	s2, ok := other.(*DPFServer)
+	if !ok {
+		return false, errors.New("server types not equal")
+	}
 	if b, err := s.Db.Equals(s2.Db); !b {
 		return false, err
 	}
@@ -41,17 +61,16 @@ func (s *DPFServer) Equals(other APIRServer) (bool, error) {
 func (s *DPFServer) GetVCType() vc.VcType {
 	return vc.VcType(0)
 }
-func (s *DPFServer) SetVC(vc.VcType) {
-	return
+func (s *DPFServer) SetVC(vc.VcType) error {
+	return nil
 }
 
 ////////////////////////////////////////////////////////////
 // OFFLINE PHASE
 ////////////////////////////////////////////////////////////
 
-func (s *DPFServer) Update(_ []database.Update) (Nt, Qt int, dt Digest, opst []database.Update) {
-	log.Fatalf("not implemented")
-	return
+func (s *DPFServer) Update(_ []database.Update) (Nt, Qt int, dt Digest, opst []database.Update, err error) {
+	return -1, -1, nil, nil, fmt.Errorf("%w: updates of PIR_DPF", ErrUnsupported)
 }
 
 // There is no offline phase, so these functions do nothing
@@ -86,25 +105,267 @@ func (s *DPFServer) GetDB() *database.DB {
 // ONLINE PHASE
 ////////////////////////////////////////////////////////////
 
-func (c *DPFClient) Query(i int) (Query, Query, error) {
+func (c *DPFClient) Query(i int) (*QueryHandle, error) {
 	q0, q1 := dpf.Gen(uint64(i), utils.LogN(c.N))
-	return &DPFQuery{q0}, &DPFQuery{q1}, nil
+	return newHandle(c, &DPFQuery{q0}, &DPFQuery{q1}, i, nil), nil
 }
 
 func (s *DPFServer) Answer(query Query) (Answer, error) {
-	q := query.(*DPFQuery)
-	expandedKey := dpf.EvalFull(q.QueryKey, utils.LogN(s.Db.N))
-	return &DPFAnswer{s.Db.VectorProd(expandedKey)}, nil
+	q, ok := query.(*DPFQuery)
+	if !ok {
+		return nil, malformedQuery(query)
+	}
+	logN := utils.LogN(s.Db.N)
+	if err := checkDPFKey(q.QueryKey, logN); err != nil {
+		return nil, err
+	}
+	depth := subtreeDepth(numWorkers(s.Workers), logN)
+	if depth == 0 {
+		expandedKey := dpf.EvalFull(q.QueryKey, logN)
+		return &DPFAnswer{s.Db.VectorProd(expandedKey)}, nil
+	}
+
+	// Each worker expands the DPF subtrees covering its chunk of the
+	// database and multiplies them with the chunk, the answer is the XOR
+	// of the results.
+	size := 1 << (logN - depth)
+	rec := parallelXor(s.Workers, 1<<depth, func(first, last int) []byte {
+		out := make([]byte, s.Db.RecSize)
+		for j := first; j < last; j++ {
+			bits := dpf.EvalSubtree(q.QueryKey, logN, depth, uint64(j))
+			database.XorInto(out, s.Db.VectorProdRange(bits, j*size, min((j+1)*size, s.Db.N)))
+		}
+		return out
+	})
+	return &DPFAnswer{rec}, nil
 }
 
-func (c *DPFClient) Reconstruct(_ Digest, _ Hint, answer0 Answer, answer1 Answer) (database.Record, error) {
-	a0, a1 := answer0.(*DPFAnswer), answer1.(*DPFAnswer)
+// checkDPFKey checks that a key received from a client has the size of the
+// keys of a domain of 2^logN points, so that evaluating it cannot panic
+func checkDPFKey(key dpf.DPFkey, logN uint64) error {
+	if len(key) != dpf.KeySize(logN) {
+		return fmt.Errorf("%w: DPF key of %d bytes, expected %d", ErrMalformedQuery, len(key), dpf.KeySize(logN))
+	}
+	return nil
+}
+
+// subtreeDepth returns the depth of the DPF subtrees evaluated in parallel,
+// such that there are at least as many subtrees as workers. Subtrees are
+// no deeper than EvalFull expands, so they cover at least 128 records.
+func subtreeDepth(workers int, logN uint64) uint64 {
+	if workers <= 1 || logN < 7 {
+		return 0
+	}
+	return min(uint64(bits.Len(uint(workers-1))), logN-7)
+}
+
+// BatchQuery generates one DPF key per cuckoo bucket, the key of a bucket
+// holding a queried index selects its position in the bucket
+func (c *DPFClient) BatchQuery(indices []int) (*QueryHandle, error) {
+	distinct, slot, err := checkBatch(indices, c.N)
+	if err != nil {
+		return nil, err
+	}
+	numBuckets := batchNumBuckets(len(distinct))
+	assigned, err := cuckooAssign(distinct, numBuckets)
+	if err != nil {
+		return nil, err
+	}
+	l := c.cuckoo.layout(c.N, numBuckets)
+
+	q0 := &DPFBatchQuery{Keys: make([]dpf.DPFkey, numBuckets)}
+	q1 := &DPFBatchQuery{Keys: make([]dpf.DPFkey, numBuckets)}
+	for b, i := range assigned {
+		size := len(l.buckets[b])
+		if size == 0 {
+			continue
+		}
+		q0.Keys[b], q1.Keys[b] = dpf.Gen(uint64(bucketPosition(l, b, i)), utils.LogN(size))
+	}
+	return newHandle(c, q0, q1, newBatchState(distinct, slot, assigned), nil), nil
+}
+
+func (s *DPFServer) BatchAnswer(query Query) (Answer, error) {
+	q, ok := query.(*DPFBatchQuery)
+	if !ok {
+		return nil, malformedQuery(query)
+	}
+	if err := checkNumBuckets(len(q.Keys), s.Db.N); err != nil {
+		return nil, err
+	}
+	l := s.cuckoo.layout(s.Db.N, len(q.Keys))
+	for b, bucket := range l.buckets {
+		if len(bucket) == 0 {
+			continue
+		}
+		if err := checkDPFKey(q.Keys[b], utils.LogN(len(bucket))); err != nil {
+			return nil, err
+		}
+	}
+	recs := make([]database.Record, len(q.Keys))
+	parallelFor(s.Workers, len(q.Keys), func(b int) {
+		bucket := l.buckets[b]
+		if len(bucket) == 0 {
+			recs[b] = make(database.Record, s.Db.RecSize)
+			return
+		}
+		expandedKey := dpf.EvalFull(q.Keys[b], utils.LogN(len(bucket)))
+		recs[b] = s.Db.VectorProdIndices(expandedKey, bucket)
+	})
+	return &DPFBatchAnswer{Records: recs}, nil
+}
+
+func (c *DPFClient) BatchReconstruct(h *QueryHandle, _ Digest, _ Hint, answer0 Answer, answer1 Answer) ([]database.Record, error) {
+	batch, err := takeState[batchState](h, c)
+	if err != nil {
+		return nil, err
+	}
+	a0, ok := answer0.(*DPFBatchAnswer)
+	if !ok {
+		return nil, malformedType(answer0)
+	}
+	a1, ok := answer1.(*DPFBatchAnswer)
+	if !ok {
+		return nil, malformedType(answer1)
+	}
+	return batch.reconstruct(func(b int) (database.Record, error) {
+		if b >= len(a0.Records) || b >= len(a1.Records) || len(a0.Records[b]) != len(a1.Records[b]) {
+			return nil, fmt.Errorf("%w: batch answers do not match the query", ErrMalformedAnswer)
+		}
+		rec := append(database.Record(nil), a0.Records[b]...)
+		database.XorInto(rec, a1.Records[b])
+		return rec, nil
+	})
+}
+
+func (c *DPFClient) Reconstruct(h *QueryHandle, _ Digest, _ Hint, answer0 Answer, answer1 Answer) (database.Record, error) {
+	if _, err := takeState[int](h, c); err != nil {
+		return nil, err
+	}
+	a0, ok := answer0.(*DPFAnswer)
+	if !ok {
+		return nil, malformedType(answer0)
+	}
+	a1, ok := answer1.(*DPFAnswer)
+	if !ok {
+		return nil, malformedType(answer1)
+	}
+	if len(a0.QueryRecord) != len(a1.QueryRecord) {
+		return nil, fmt.Errorf("%w: answers of %d and %d bytes", ErrMalformedAnswer, len(a0.QueryRecord), len(a1.QueryRecord))
+	}
 	// XOR the two answers
 	database.XorInto(a0.QueryRecord, a1.QueryRecord)
 	// Return the result
 	return a0.QueryRecord, nil
 }
 func (c *DPFClient) UpdateHint(newN0, newN1, newQ0, newQ1 int, newDigest0, newDigest1 Digest, ops0, ops1 []database.Update) (N int, Q int, d Digest, hint Hint, err error) {
-	log.Fatal("not implemented yet")
-	return
+	return -1, -1, nil, nil, fmt.Errorf("%w: updates of PIR_DPF", ErrUnsupported)
+}
+
+////////////////////////////////////////////////////////////
+// ENCODING
+////////////////////////////////////////////////////////////
+
+func (*DPFDigest) MarshalBinary() ([]byte, error) {
+	return newWriter(PIR_DPF, kindDigest).Buf, nil
+}
+
+func (*DPFDigest) UnmarshalBinary(data []byte) error {
+	return newReader(data, PIR_DPF, kindDigest).Finish()
+}
+
+func (*DPFHintQuery) MarshalBinary() ([]byte, error) {
+	return newWriter(PIR_DPF, kindHintQuery).Buf, nil
+}
+
+func (*DPFHintQuery) UnmarshalBinary(data []byte) error {
+	return newReader(data, PIR_DPF, kindHintQuery).Finish()
+}
+
+func (*DPFHintResp) MarshalBinary() ([]byte, error) {
+	return newWriter(PIR_DPF, kindHintResp).Buf, nil
+}
+
+func (*DPFHintResp) UnmarshalBinary(data []byte) error {
+	return newReader(data, PIR_DPF, kindHintResp).Finish()
+}
+
+func (*DPFHint) MarshalBinary() ([]byte, error) {
+	return newWriter(PIR_DPF, kindHint).Buf, nil
+}
+
+func (*DPFHint) UnmarshalBinary(data []byte) error {
+	return newReader(data, PIR_DPF, kindHint).Finish()
+}
+
+func (q *DPFQuery) MarshalBinary() ([]byte, error) {
+	w := newWriter(PIR_DPF, kindQuery)
+	w.Bytes(q.QueryKey)
+	return w.Buf, nil
+}
+
+func (q *DPFQuery) UnmarshalBinary(data []byte) error {
+	r := newReader(data, PIR_DPF, kindQuery)
+	key := r.Bytes()
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	q.QueryKey = key
+	return nil
+}
+
+func (a *DPFAnswer) MarshalBinary() ([]byte, error) {
+	w := newWriter(PIR_DPF, kindAnswer)
+	w.Bytes(a.QueryRecord)
+	return w.Buf, nil
+}
+
+func (a *DPFAnswer) UnmarshalBinary(data []byte) error {
+	r := newReader(data, PIR_DPF, kindAnswer)
+	rec := r.Bytes()
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	a.QueryRecord = rec
+	return nil
+}
+
+func (q *DPFBatchQuery) MarshalBinary() ([]byte, error) {
+	w := newWriter(PIR_DPF, kindBatchQuery)
+	w.Uint32(uint32(len(q.Keys)))
+	for _, k := range q.Keys {
+		w.Bytes(k)
+	}
+	return w.Buf, nil
+}
+
+func (q *DPFBatchQuery) UnmarshalBinary(data []byte) error {
+	r := newReader(data, PIR_DPF, kindBatchQuery)
+	keys := make([]dpf.DPFkey, r.Len(4))
+	for i := range keys {
+		keys[i] = r.Bytes()
+	}
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	q.Keys = keys
+	return nil
+}
+
+func (a *DPFBatchAnswer) MarshalBinary() ([]byte, error) {
+	w := newWriter(PIR_DPF, kindBatchAnswer)
+	if err := writeRecords(w, a.Records); err != nil {
+		return nil, err
+	}
+	return w.Buf, nil
+}
+
+func (a *DPFBatchAnswer) UnmarshalBinary(data []byte) error {
+	r := newReader(data, PIR_DPF, kindBatchAnswer)
+	recs := readRecords(r)
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	a.Records = recs
+	return nil
 }
@@ -2,17 +2,14 @@ package pir
 
 import (
 	"errors"
-	"log"
+	"fmt"
 	"math"
 	"math/rand"
+	"sync"
 	"tapir/modules/database"
-	"tapir/modules/utils"
 	"tapir/modules/vc"
 )
 
-// TODO replace this or put it in testing util
-var masterKey utils.PRGKey = [16]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 'A', 'B', 'C', 'D', 'E', 'F'}
-
 // There is no offline phase in this protocol, define dummy types
 type MatrixDigest struct{}
 type MatrixHintQuery struct{}
@@ -30,6 +27,9 @@ type MatrixAnswer struct {
 type MatrixServer struct {
 	Db   *database.DB
 	Role byte
+	// Workers is the number of goroutines Answer uses, runtime.NumCPU() if
+	// not positive
+	Workers int
 }
 
 type MatrixClient struct {
@@ -39,13 +39,14 @@ type MatrixClient struct {
 	RecSize int
 
 	RandSource *rand.Rand
-
-	// State
-	queriedIdx int
+	randMu     sync.Mutex // guards RandSource
 }
 
 func (s *MatrixServer) Equals(other APIRServer) (bool, error) {
-	s2 := other.(*MatrixServer)
+	s2, ok := other.(*MatrixServer)
+	if !ok {
+		return false, errors.New("server types not equal")
+	}
 	if b, err := s.Db.Equals(s2.Db); !b {
 		return false, err
 	}
@@ -59,8 +60,8 @@ func (s *MatrixServer) Equals(other APIRServer) (bool, error) {
 func (s *MatrixServer) GetVCType() vc.VcType {
 	return vc.VcType(0)
 }
-func (s *MatrixServer) SetVC(vc.VcType) {
-	return
+func (s *MatrixServer) SetVC(vc.VcType) error {
+	return nil
 }
 
 func getHeightWidth(nRows int, rowLen int) (int, int) {
@@ -71,26 +72,27 @@ func getHeightWidth(nRows int, rowLen int) (int, int) {
 	return width, height
 }
 
-func matBoolVecProduct(db_data []byte, numRec, recSize int, bitVector []bool) []byte {
-	width, height := getHeightWidth(numRec, recSize)
-	out := make([]byte, width*recSize)
+func matBoolVecProduct(workers int, db_data []byte, numRec, recSize int, bitVector []bool) []byte {
+	width, _ := getHeightWidth(numRec, recSize)
+	return matRowsXor(workers, db_data, recSize*width, bitVector)
+}
 
-	//cnt := 0
-	tableWidth := recSize * width
-	//flatDb := db.Slice(0, db.N)
-	for j := 0; j < height; j++ {
-		if bitVector[j] {
-			start := tableWidth * j
-			length := tableWidth
-			if start+length >= len(db_data) {
-				length = len(db_data) - start
+// matRowsXor returns the XOR of the rows of length rowLen selected by
+// bitVector, the last row may be shorter. Up to workers goroutines XOR
+// disjoint ranges of rows.
+func matRowsXor(workers int, db_data []byte, rowLen int, bitVector []bool) []byte {
+	return parallelXor(workers, len(bitVector), func(first, last int) []byte {
+		out := make([]byte, rowLen)
+		for j := first; j < last; j++ {
+			start := rowLen * j
+			if !bitVector[j] || start >= len(db_data) {
+				continue
 			}
-			//psetggm.FastXorInto(out[0:length], db.Data[start:start+length], length)
+			length := min(rowLen, len(db_data)-start)
 			database.XorInto(out[0:length], db_data[start:start+length])
-			//cnt = cnt + tableWidth
 		}
-	}
-	return out
+		return out
+	})
 }
 
 ////////////////////////////////////////////////////////////
@@ -99,12 +101,24 @@ func matBoolVecProduct(db_data []byte, numRec, recSize int, bitVector []bool) []
 
 // There is no offline phase, so these functions do nothing
 
-func SetupMatrixClient(N, recSize int, vctype vc.VcType) *MatrixClient {
+func SetupMatrixClient(N, recSize int, vctype vc.VcType) (*MatrixClient, error) {
 	c := MatrixClient{N: N}
-	c.RandSource = rand.New(utils.NewBufPRG(utils.NewPRG(&masterKey)))
+	src, err := newQueryRand(nil)
+	if err != nil {
+		return nil, err
+	}
+	c.RandSource = src
 	c.RecSize = recSize
 	c.Width, c.Height = getHeightWidth(N, recSize)
-	return &c
+	return &c, nil
+}
+
+// SetTestSeed makes the query bit vectors deterministic, see SeedableClient.
+func (c *MatrixClient) SetTestSeed(seed [32]byte) {
+	src, _ := newQueryRand(&seed)
+	c.randMu.Lock()
+	defer c.randMu.Unlock()
+	c.RandSource = src
 }
 
 func (c *MatrixClient) RequestHint() (HintQuery, HintQuery, error) {
@@ -131,32 +145,45 @@ func (s *MatrixServer) GetDigest() Digest {
 func (s *MatrixServer) GetDB() *database.DB {
 	return s.Db
 }
-func (s *MatrixServer) Update(_ []database.Update) (Nt, Qt int, dt Digest, opst []database.Update) {
-	log.Fatalf("not implemented")
-	return
+func (s *MatrixServer) Update(_ []database.Update) (Nt, Qt int, dt Digest, opst []database.Update, err error) {
+	return -1, -1, nil, nil, fmt.Errorf("%w: updates of PIR_MATRIX", ErrUnsupported)
 }
 
-func (c *MatrixClient) Query(idx int) (Query, Query, error) {
-	c.queriedIdx = idx
+func (c *MatrixClient) Query(idx int) (*QueryHandle, error) {
 	if idx >= c.N || idx < 0 {
-		return nil, nil, errors.New("Query index out of bounds of database")
+		return nil, errors.New("Query index out of bounds of database")
 	}
 	rowNum := idx / c.Width
 	// colNum := idx % c.width
 	qL := make([]bool, c.Height)
 	qR := make([]bool, c.Height)
+	c.randMu.Lock()
 	for i := 0; i < c.Height; i++ {
 		qL[i] = (c.RandSource.Uint64()&1 == 0)
 		qR[i] = (qL[i] != (i == rowNum))
 	}
-	return &MatrixQuery{qL}, &MatrixQuery{qR}, nil
+	c.randMu.Unlock()
+	return newHandle(c, &MatrixQuery{qL}, &MatrixQuery{qR}, idx, nil), nil
 }
 
-func (c *MatrixClient) Reconstruct(digest Digest, hint Hint, answer0 Answer, answer1 Answer) (database.Record, error) {
+func (c *MatrixClient) Reconstruct(h *QueryHandle, digest Digest, hint Hint, answer0 Answer, answer1 Answer) (database.Record, error) {
+	idx, err := takeState[int](h, c)
+	if err != nil {
+		return nil, err
+	}
 
-	a0 := answer0.(*MatrixAnswer)
-	a1 := answer1.(*MatrixAnswer)
-	colNum := c.queriedIdx % c.Width
+	a0, ok := answer0.(*MatrixAnswer)
+	if !ok {
+		return nil, malformedType(answer0)
+	}
+	a1, ok := answer1.(*MatrixAnswer)
+	if !ok {
+		return nil, malformedType(answer1)
+	}
+	colNum := idx % c.Width
+	if len(a0.FlatRecords) != len(a1.FlatRecords) || len(a0.FlatRecords) < c.RecSize*(colNum+1) {
+		return nil, fmt.Errorf("%w: answers of %d and %d bytes", ErrMalformedAnswer, len(a0.FlatRecords), len(a1.FlatRecords))
+	}
 
 	database.XorInto(a0.FlatRecords, a1.FlatRecords)
 
@@ -164,9 +191,80 @@ func (c *MatrixClient) Reconstruct(digest Digest, hint Hint, answer0 Answer, ans
 }
 
 func (s *MatrixServer) Answer(q Query) (Answer, error) {
-	return &MatrixAnswer{matBoolVecProduct(*&s.Db.Data, s.Db.N, s.Db.RecSize, q.(*MatrixQuery).BitVector)}, nil
+	mq, ok := q.(*MatrixQuery)
+	if !ok {
+		return nil, malformedQuery(q)
+	}
+	return &MatrixAnswer{matBoolVecProduct(s.Workers, s.Db.Data, s.Db.N, s.Db.RecSize, mq.BitVector)}, nil
 }
 func (c *MatrixClient) UpdateHint(newN0, newN1, newQ0, newQ1 int, newDigest0, newDigest1 Digest, ops0, ops1 []database.Update) (N int, Q int, d Digest, hint Hint, err error) {
-	log.Fatal("not implemented yet")
-	return
+	return -1, -1, nil, nil, fmt.Errorf("%w: updates of PIR_MATRIX", ErrUnsupported)
+}
+
+////////////////////////////////////////////////////////////
+// ENCODING
+////////////////////////////////////////////////////////////
+
+func (*MatrixDigest) MarshalBinary() ([]byte, error) {
+	return newWriter(PIR_MATRIX, kindDigest).Buf, nil
+}
+
+func (*MatrixDigest) UnmarshalBinary(data []byte) error {
+	return newReader(data, PIR_MATRIX, kindDigest).Finish()
+}
+
+func (*MatrixHintQuery) MarshalBinary() ([]byte, error) {
+	return newWriter(PIR_MATRIX, kindHintQuery).Buf, nil
+}
+
+func (*MatrixHintQuery) UnmarshalBinary(data []byte) error {
+	return newReader(data, PIR_MATRIX, kindHintQuery).Finish()
+}
+
+func (*MatrixHintResp) MarshalBinary() ([]byte, error) {
+	return newWriter(PIR_MATRIX, kindHintResp).Buf, nil
+}
+
+func (*MatrixHintResp) UnmarshalBinary(data []byte) error {
+	return newReader(data, PIR_MATRIX, kindHintResp).Finish()
+}
+
+func (*MatrixHint) MarshalBinary() ([]byte, error) {
+	return newWriter(PIR_MATRIX, kindHint).Buf, nil
+}
+
+func (*MatrixHint) UnmarshalBinary(data []byte) error {
+	return newReader(data, PIR_MATRIX, kindHint).Finish()
+}
+
+func (q *MatrixQuery) MarshalBinary() ([]byte, error) {
+	w := newWriter(PIR_MATRIX, kindQuery)
+	writeBools(w, q.BitVector)
+	return w.Buf, nil
+}
+
+func (q *MatrixQuery) UnmarshalBinary(data []byte) error {
+	r := newReader(data, PIR_MATRIX, kindQuery)
+	v := readBools(r)
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	q.BitVector = v
+	return nil
+}
+
+func (a *MatrixAnswer) MarshalBinary() ([]byte, error) {
+	w := newWriter(PIR_MATRIX, kindAnswer)
+	w.Bytes(a.FlatRecords)
+	return w.Buf, nil
+}
+
+func (a *MatrixAnswer) UnmarshalBinary(data []byte) error {
+	r := newReader(data, PIR_MATRIX, kindAnswer)
+	flat := r.Bytes()
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	a.FlatRecords = flat
+	return nil
 }
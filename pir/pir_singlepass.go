@@ -2,7 +2,8 @@ package pir
 
 import (
 	"errors"
-	"log"
+	"fmt"
+	"io"
 	"math/rand/v2"
 
 	"tapir/modules/database"
@@ -11,14 +12,12 @@ import (
 	"tapir/modules/vc"
 )
 
-var SEED_SP = [32]byte{1}
-
 // Offline phase types
 
 type SinglePassDigest struct{} // There is no digest
 
 type SinglePassHintQuery struct {
-	RandSeed int
+	PermKey []byte
 }
 
 type SinglePassHintResp struct {
@@ -46,29 +45,42 @@ type SinglePassServer struct {
 	M  int
 }
 
+// singlePassQuery is the state of a query until its answers are
+// reconstructed
+type singlePassQuery struct {
+	idx        int    // queried index
+	pos        uint32 // hint set of idx
+	randSwaps  []uint32
+	setOffline []uint32 // query q_0 indices
+	setOnline  []uint32 // query q_1 indices
+}
+
 type SinglePassClient struct {
 	// database parameters
 	N int
 	Q int
 	M int
 
-	// query and refresh state
-	queriedIdx int
-	ind        int
-	randSwaps  []uint32
-	rInd       int
+	// guards the hint and the randomness, see hintLock
+	lock hintLock
+	// number of update rounds applied to the hint
+	epoch int
 
 	// Hint
 	Hint *SinglePassHint
 
 	// randomness
 	Prg *rand.ChaCha8
-	// seed for the permutations
-	PermSeed int
+	// key for the permutations, sent to server 0
+	PermKey  utils.PRGKey
+	testSeed *[32]byte
 }
 
 func (s *SinglePassServer) Equals(other APIRServer) (bool, error) {
-	s2 := other.(*SinglePassServer)
+	s2, ok := other.(*SinglePassServer)
+	if !ok {
+		return false, errors.New("server types not equal")
+	}
 	if b, err := s.Db.Equals(s2.Db); !b {
 		return false, err
 	}
@@ -81,8 +93,9 @@ func (s *SinglePassServer) Equals(other APIRServer) (bool, error) {
 func (s *SinglePassServer) GetVCType() vc.VcType {
 	return vc.VcType(0)
 }
-func (s *SinglePassServer) SetVC(vc.VcType) {
+func (s *SinglePassServer) SetVC(vc.VcType) error {
 	// Server has no VC
+	return nil
 }
 
 ////////////////////////////////////////////////////////////
@@ -95,17 +108,25 @@ func (s *SinglePassServer) GenDigest() (Digest, error) {
 	return &SinglePassDigest{}, nil
 }
 
-func (c *SinglePassClient) RequestHint() (HintQuery, HintQuery, error) {
-	seed := SEED_SP
-	c.Prg = rand.NewChaCha8(seed)
+// SetTestSeed makes the client randomness deterministic, see SeedableClient.
+func (c *SinglePassClient) SetTestSeed(seed [32]byte) {
+	c.lock.lock()
+	defer c.lock.unlock()
+	c.testSeed = &seed
+}
 
-	bigPermSeed := utils.RandomPRGKey(c.Prg)
-	c.PermSeed = 0
-	for i := 0; i < len(bigPermSeed); i++ {
-		c.PermSeed += int(bigPermSeed[i])
+func (c *SinglePassClient) RequestHint() (HintQuery, HintQuery, error) {
+	c.lock.lockExclusive()
+	defer c.lock.unlock()
+	c.lock.reset()
+	prg, err := newClientPrg(c.testSeed)
+	if err != nil {
+		return nil, nil, err
 	}
+	c.Prg = prg
+	c.PermKey = *utils.RandomPRGKey(c.Prg)
 
-	return &SinglePassHintQuery{RandSeed: c.PermSeed}, nil, nil
+	return &SinglePassHintQuery{PermKey: append([]byte(nil), c.PermKey[:]...)}, nil, nil
 }
 
 func (c *SinglePassClient) EqualDigests(_, _ Digest) bool {
@@ -120,15 +141,24 @@ func (s *SinglePassServer) GenHint(hintQuery HintQuery) (HintResp, error) {
 	if hintQuery == nil {
 		return nil, nil
 	}
-	hq := hintQuery.(*SinglePassHintQuery)
+	hq, ok := hintQuery.(*SinglePassHintQuery)
+	if !ok {
+		return nil, malformedQuery(hintQuery)
+	}
+	if len(hq.PermKey) != psetggm.PermKeySize {
+		return nil, errors.New("invalid permutation key size")
+	}
 
 	hints := make([]database.Record, s.M)
 	hintsBuf := make([]byte, s.M*s.Db.RecSize)
 
-	permutations := make([]uint32, s.Db.N)
-	inverse_permutations := make([]uint32, s.Db.N)
+	// the last partition may be partially filled after updates
+	permutations := make([]uint32, s.Q*s.M)
+	inverse_permutations := make([]uint32, s.Q*s.M)
 
-	psetggm.SinglePassAnswer(s.Db.Data, s.Db.N, s.Q, s.Db.RecSize, hintsBuf, hq.RandSeed, permutations, inverse_permutations)
+	if err := psetggm.SinglePassAnswer(s.Db.Data, s.Q*s.M, s.Q, s.Db.RecSize, hintsBuf, hq.PermKey, permutations, inverse_permutations); err != nil {
+		return nil, err
+	}
 
 	for i := 0; i < s.M; i++ {
 		hints[i] = database.Record(hintsBuf[s.Db.RecSize*i : s.Db.RecSize*(i+1)])
@@ -138,18 +168,34 @@ func (s *SinglePassServer) GenHint(hintQuery HintQuery) (HintResp, error) {
 }
 
 func (c *SinglePassClient) VerSetup(d0 Digest, d1 Digest, resp0 HintResp, resp1 HintResp) (Digest, Hint, error) {
+	c.lock.lockExclusive()
+	defer c.lock.unlock()
+
 	// make sure we only get one hint (resp0)
 	if resp1 != nil {
 		return nil, nil, errors.New("SinglePassClient only recieves one hint (from server 0)")
 	}
 
-	hintResp := resp0.(*SinglePassHintResp)
+	hintResp, ok := resp0.(*SinglePassHintResp)
+	if !ok {
+		return nil, nil, malformedType(resp0)
+	}
+	if len(hintResp.Parities) != c.M {
+		return nil, nil, fmt.Errorf("%w: hint of %d parities for M=%d", ErrMalformedAnswer, len(hintResp.Parities), c.M)
+	}
+	for _, p := range hintResp.Parities {
+		if len(p) != len(hintResp.Parities[0]) || len(p) == 0 || len(p)%16 != 0 {
+			return nil, nil, fmt.Errorf("%w: parities of unequal length or not a multiple of 16 bytes", ErrMalformedAnswer)
+		}
+	}
 
 	// generate permutations locally
 	permutations := make([]uint32, c.N)
 	inverse_permutations := make([]uint32, c.N)
 
-	psetggm.GeneratePerms(c.N, c.Q, c.PermSeed, permutations, inverse_permutations)
+	if err := psetggm.GeneratePerms(c.N, c.Q, c.PermKey[:], permutations, inverse_permutations); err != nil {
+		return nil, nil, err
+	}
 
 	if len(permutations) != c.N || len(inverse_permutations) != c.N {
 		return nil, nil, errors.New("permutations length does not match N")
@@ -185,9 +231,41 @@ func (s *SinglePassServer) GetDigest() Digest {
 func (s *SinglePassServer) GetDB() *database.DB {
 	return s.Db
 }
-func (s *SinglePassServer) Update(_ []database.Update) (Nt, Qt int, dt Digest, opst []database.Update) {
-	log.Fatalf("not implemented")
-	return
+
+// Update applies the updates to the database and returns the new N, Q and
+// the updates, whose values are replaced by the deltas val_old XOR val_new
+// that the client folds into its hint. ADDs go to free slots first, then to
+// the end of the database, which is extended by a partition of size M once
+// the last one is full.
+func (s *SinglePassServer) Update(ops []database.Update) (Nt, Qt int, dt Digest, opst []database.Update, err error) {
+	// reject invalid ops before changing anything
+	if _, err := s.Db.CheckUpdates(ops); err != nil {
+		return -1, -1, nil, nil, err
+	}
+	s.Db.AssignIndices(ops)
+
+	for i, op := range ops {
+		// add new partition
+		if op.Idx >= s.Q*s.M {
+			if err := s.Db.ExtendCapacity(s.M); err != nil {
+				return -1, -1, nil, nil, err
+			}
+			s.Q++
+		}
+		valOld, err := s.Db.Apply(op)
+		if err != nil {
+			return -1, -1, nil, nil, err
+		}
+
+		// Save delta of op: val_old XOR val_new
+		if err := psetggm.FastXorInto(ops[i].Val, valOld, s.Db.RecSize); err != nil {
+			return -1, -1, nil, nil, err
+		}
+	}
+	if err := s.Db.Sync(); err != nil {
+		return -1, -1, nil, nil, err
+	}
+	return s.Db.N, s.Q, &SinglePassDigest{}, ops, nil
 }
 
 ////////////////////////////////////////////////////////////
@@ -211,19 +289,45 @@ func (c *SinglePassClient) randomIdx(rangeMax int) uint32 {
 	return uint32(c.Prg.Uint64() % uint64(rangeMax)) // TODO this is sketchy
 }
 
-func (c *SinglePassClient) Query(i int) (Query, Query, error) {
-	if len(c.Hint.Parities) < 1 {
-		return nil, nil, errors.New("Hint is not set")
+// randomSwap samples a position of partition j not used by a pending query
+func (c *SinglePassClient) randomSwap(j int) uint32 {
+	for {
+		if x := c.randomIdx(c.M); c.lock.swappable(j, x) {
+			return x
+		}
+	}
+}
+
+// Query waits while the hint set of i is used by a pending query, burned
+// hint sets are handled as for TAPIRClient.Query
+func (c *SinglePassClient) Query(i int) (*QueryHandle, error) {
+	c.lock.lock()
+	defer c.lock.unlock()
+	if c.Hint == nil || len(c.Hint.Parities) < 1 {
+		return nil, errors.New("Hint is not set")
 	}
 	if i >= c.N || i < 0 {
-		return nil, nil, errors.New("Query index out of bounds of database")
+		return nil, errors.New("Query index out of bounds of database")
 	}
 
-	c.queriedIdx = i
-
 	// Paper's Query pseudocode line 1
 	// Where pos is "ind" in the paper
-	row, _, pos := c.findIndex(i)
+	var row, pos int
+	var burned any
+	c.lock.wait(func() bool {
+		row, _, pos = c.findIndex(i)
+		burned = c.lock.burned[uint32(pos)]
+		return burned != nil || c.lock.blocked(1, c.M, uint32(pos)) || c.lock.free(1, c.M, uint32(pos))
+	})
+	if burned != nil {
+		if q := burned.(singlePassQuery); q.idx == i {
+			return c.resend(q.pos), nil
+		}
+		return nil, fmt.Errorf("%w: hint set of index %d", ErrHintSetBurned, i)
+	}
+	if c.lock.blocked(1, c.M, uint32(pos)) {
+		return nil, fmt.Errorf("%w: no free hint set for index %d", ErrHintSetBurned, i)
+	}
 
 	setOnline := make([]uint32, c.Q)
 	setOffline := make([]uint32, c.Q)
@@ -233,42 +337,103 @@ func (c *SinglePassClient) Query(i int) (Query, Query, error) {
 		// Paper's Query pseudocode line 2
 		setOnline[j] = c.Hint.IdxToSetIdx[j][pos]
 		// Paper's Query pseudocode line 3
-		randSwaps[j] = c.randomIdx(c.M)
+		randSwaps[j] = c.randomSwap(j)
 		// Paper's Query pseudocode line 4
 		setOffline[j] = c.Hint.IdxToSetIdx[j][randSwaps[j]]
 	}
 	setOnline[row] = c.Hint.IdxToSetIdx[row][randSwaps[row]]
 
-	c.randSwaps = randSwaps
+	q := singlePassQuery{idx: i, pos: uint32(pos), randSwaps: randSwaps, setOffline: setOffline, setOnline: setOnline}
+	c.lock.reserve(q.pos, q.randSwaps)
+	return c.handle(q), nil
+}
 
-	return &SinglePassQuery{Indices: setOffline},
-		&SinglePassQuery{Indices: setOnline},
-		nil
+// RefreshQuery sends the queries of a burned hint set again, see
+// HintRefresher
+func (c *SinglePassClient) RefreshQuery() *QueryHandle {
+	c.lock.lock()
+	defer c.lock.unlock()
+	for pos := range c.lock.burned {
+		return c.resend(pos)
+	}
+	return nil
+}
+
+// resend reserves the burned query of hint set pos again, as for
+// TAPIRClient.resend
+func (c *SinglePassClient) resend(pos uint32) *QueryHandle {
+	q := c.lock.takeBurned(pos).(singlePassQuery)
+	for j := len(q.randSwaps); j < c.Q; j++ {
+		x := c.randomSwap(j)
+		q.randSwaps = append(q.randSwaps, x)
+		q.setOnline = append(q.setOnline, c.Hint.IdxToSetIdx[j][pos])
+		q.setOffline = append(q.setOffline, c.Hint.IdxToSetIdx[j][x])
+	}
+	c.lock.reserve(q.pos, q.randSwaps)
+	return c.handle(q)
+}
+
+// handle returns the handle of the reserved query q, which frees or burns
+// its hint sets when it is consumed
+func (c *SinglePassClient) handle(q singlePassQuery) *QueryHandle {
+	return newHandle(c, &SinglePassQuery{Indices: q.setOffline}, &SinglePassQuery{Indices: q.setOnline}, q, func(burn bool) {
+		c.lock.lock()
+		defer c.lock.unlock()
+		if burn {
+			c.lock.burn(q.pos, q)
+		} else {
+			c.lock.release(q.pos, q.randSwaps)
+		}
+	})
 }
 
 func (s *SinglePassServer) Answer(query Query) (Answer, error) {
 
-	q := query.(*SinglePassQuery)
+	q, ok := query.(*SinglePassQuery)
+	if !ok {
+		return nil, malformedQuery(query)
+	}
+	if len(q.Indices) != s.Q {
+		return nil, fmt.Errorf("%w: %d indices for %d partitions", ErrMalformedQuery, len(q.Indices), s.Q)
+	}
 
 	answer := SinglePassAnswer{FlatRecords: make([]byte, s.Q*s.Db.RecSize)}
 
-	currOffset := 0
 	for i := 0; i < s.Q; i++ {
-		psetggm.CopyIn(answer.FlatRecords[i*s.Db.RecSize:(i*s.Db.RecSize)+s.Db.RecSize], s.Db.Data, s.M*i+int(q.Indices[i]), s.Db.RecSize)
-		currOffset += s.M
+		if int(q.Indices[i]) >= s.M {
+			return nil, fmt.Errorf("%w: index %d out of bounds of partition", ErrMalformedQuery, q.Indices[i])
+		}
+		if err := psetggm.CopyIn(answer.FlatRecords[i*s.Db.RecSize:(i*s.Db.RecSize)+s.Db.RecSize], s.Db.Data, s.M*i+int(q.Indices[i]), s.Db.RecSize); err != nil {
+			return nil, err
+		}
 	}
 
 	return &answer, nil
 }
 
-func (c *SinglePassClient) Reconstruct(digest Digest, hint Hint, answer0 Answer, answer1 Answer) (database.Record, error) {
-
-	row, _, pos := c.findIndex(c.queriedIdx)
+func (c *SinglePassClient) Reconstruct(h *QueryHandle, digest Digest, hint Hint, answer0 Answer, answer1 Answer) (database.Record, error) {
+	q, err := takeState[singlePassQuery](h, c)
+	if err != nil {
+		return nil, err
+	}
+	defer h.finish()
 
-	a0 := answer0.(*SinglePassAnswer)
-	a1 := answer1.(*SinglePassAnswer)
+	a0, ok := answer0.(*SinglePassAnswer)
+	if !ok {
+		return nil, malformedType(answer0)
+	}
+	a1, ok := answer1.(*SinglePassAnswer)
+	if !ok {
+		return nil, malformedType(answer1)
+	}
 
+	c.lock.lock()
+	defer c.lock.unlock()
+	row, _, pos := c.findIndex(q.idx)
 	recSize := len(c.Hint.Parities[0])
+	if len(a0.FlatRecords) != c.Q*recSize || len(a1.FlatRecords) != c.Q*recSize {
+		return nil, fmt.Errorf("%w: answer not of expected length", ErrMalformedAnswer)
+	}
 
 	out := make(database.Record, recSize)
 
@@ -280,36 +445,288 @@ func (c *SinglePassClient) Reconstruct(digest Digest, hint Hint, answer0 Answer,
 
 	upos := uint32(pos)
 
-	psetggm.FastXorInto(out, xorResp1, recSize)
-	psetggm.FastXorInto(out, c.Hint.Parities[pos], recSize)
-	psetggm.FastXorInto(out, a1.FlatRecords[row*recSize:(row+1)*recSize], recSize)
+	// the sizes are checked by the first XOR, before the hint changes
+	if err := psetggm.FastXorInto(out, xorResp1, recSize); err != nil {
+		return nil, err
+	}
+	if err := psetggm.FastXorInto(out, c.Hint.Parities[pos], recSize); err != nil {
+		return nil, err
+	}
+	if err := psetggm.FastXorInto(out, a1.FlatRecords[row*recSize:(row+1)*recSize], recSize); err != nil {
+		return nil, err
+	}
 
 	c.Hint.Parities[pos] = xorResp0
 	for i := 0; i < c.Q; i++ {
 		//3)
-		psetggm.FastXorInto(c.Hint.Parities[c.randSwaps[i]], a0.FlatRecords[i*recSize:(i+1)*recSize], recSize)
-		psetggm.FastXorInto(c.Hint.Parities[c.randSwaps[i]], a1.FlatRecords[i*recSize:(i+1)*recSize], recSize)
+		if err := psetggm.FastXorInto(c.Hint.Parities[q.randSwaps[i]], a0.FlatRecords[i*recSize:(i+1)*recSize], recSize); err != nil {
+			return nil, err
+		}
+		if err := psetggm.FastXorInto(c.Hint.Parities[q.randSwaps[i]], a1.FlatRecords[i*recSize:(i+1)*recSize], recSize); err != nil {
+			return nil, err
+		}
 		//4)
 		temp1 := c.Hint.IdxToSetIdx[i][pos]
 		//can remove temp2 if not updatable
-		temp2 := c.Hint.IdxToSetIdx[i][c.randSwaps[i]]
+		temp2 := c.Hint.IdxToSetIdx[i][q.randSwaps[i]]
 		//5)
-		c.Hint.IdxToSetIdx[i][pos] = c.Hint.IdxToSetIdx[i][c.randSwaps[i]]
+		c.Hint.IdxToSetIdx[i][pos] = c.Hint.IdxToSetIdx[i][q.randSwaps[i]]
 		//6)
-		c.Hint.IdxToSetIdx[i][c.randSwaps[i]] = temp1
+		c.Hint.IdxToSetIdx[i][q.randSwaps[i]] = temp1
 		//7)
 		//for updatable: need to update new datastructure setIdxToIdx
-		c.Hint.SetIdxToIdx[i][temp1] = c.randSwaps[i]
+		c.Hint.SetIdxToIdx[i][temp1] = q.randSwaps[i]
 		c.Hint.SetIdxToIdx[i][temp2] = upos
 
 	}
 	//fix xoring once more than necessary
-	psetggm.FastXorInto(c.Hint.Parities[c.randSwaps[row]], a1.FlatRecords[row*recSize:(row+1)*recSize], recSize)
-	psetggm.FastXorInto(c.Hint.Parities[c.randSwaps[row]], out, recSize)
+	if err := psetggm.FastXorInto(c.Hint.Parities[q.randSwaps[row]], a1.FlatRecords[row*recSize:(row+1)*recSize], recSize); err != nil {
+		return nil, err
+	}
+	if err := psetggm.FastXorInto(c.Hint.Parities[q.randSwaps[row]], out, recSize); err != nil {
+		return nil, err
+	}
+	h.refreshed = true
 
 	return database.Record(out), nil
 }
+
+// UpdateHint folds the deltas of the updates into the parities of the hint.
+// The record at index i of partition q is part of parity SetIdxToIdx[q][i],
+// partitions added by the servers get their permutation from PermKey, just
+// like the initial ones.
 func (c *SinglePassClient) UpdateHint(newN0, newN1, newQ0, newQ1 int, newDigest0, newDigest1 Digest, ops0, ops1 []database.Update) (N int, Q int, d Digest, hint Hint, err error) {
-	log.Fatal("not implemented yet")
-	return
+	c.lock.lockExclusive()
+	defer c.lock.unlock()
+	if newN0 != newN1 || newQ0 != newQ1 || len(ops0) != len(ops1) {
+		return -1, -1, nil, nil, errors.New("update parameters from servers do not match")
+	}
+	if newQ0 < c.Q || newN0 > newQ0*c.M {
+		return -1, -1, nil, nil, errors.New("invalid database size after update")
+	}
+	recSize := len(c.Hint.Parities[0])
+	for i, op := range ops0 {
+		if !op.Equals(ops1[i]) {
+			return -1, -1, nil, nil, errors.New("update operations from servers do not match")
+		}
+		if op.Idx < 0 || op.Idx >= newN0 || len(op.Val) != recSize {
+			return -1, -1, nil, nil, fmt.Errorf("invalid update of index %d", op.Idx)
+		}
+		if op.Idx >= c.Q*c.M && op.Op != database.ADD {
+			return -1, -1, nil, nil, errors.New("only ADD ops in new partition possible")
+		}
+	}
+
+	// Generate the permutations of the new partitions
+	perms, invs, err := newPartitionPerms(c.M, c.PermKey[:], c.Q, newQ0)
+	if err != nil {
+		return -1, -1, nil, nil, err
+	}
+	c.Hint.IdxToSetIdx = append(c.Hint.IdxToSetIdx, perms...)
+	c.Hint.SetIdxToIdx = append(c.Hint.SetIdxToIdx, invs...)
+	c.N, c.Q = newN0, newQ0
+
+	for _, op := range ops0 {
+		_, _, pos := c.findIndex(op.Idx)
+		// update hint
+		if err := psetggm.FastXorInto(c.Hint.Parities[pos], op.Val, recSize); err != nil {
+			return -1, -1, nil, nil, err
+		}
+	}
+	c.epoch++
+
+	return c.N, c.Q, &SinglePassDigest{}, c.Hint, nil
+}
+
+// newPartitionPerms derives the permutations of partitions [from, to) and
+// their inverses from permKey, see psetggm.GenerateSinglePerm
+func newPartitionPerms(m int, permKey []byte, from, to int) ([][]uint32, [][]uint32, error) {
+	var perms, invs [][]uint32
+	for q := from; q < to; q++ {
+		perm, inv := make([]uint32, m), make([]uint32, m)
+		if err := psetggm.GenerateSinglePerm(m, permKey, q, perm, inv); err != nil {
+			return nil, nil, err
+		}
+		perms, invs = append(perms, perm), append(invs, inv)
+	}
+	return perms, invs, nil
+}
+
+// UpdateHintRange applies the updates of a range of epochs starting at the
+// epoch of the client
+func (c *SinglePassClient) UpdateHintRange(u0, u1 []EpochUpdate) (Digest, Hint, error) {
+	return updateHintRange(c, u0, u1)
+}
+
+func (c *SinglePassClient) Epoch() int {
+	c.lock.lock()
+	defer c.lock.unlock()
+	return c.epoch
+}
+
+func (c *SinglePassClient) SetEpoch(epoch int) {
+	c.lock.lock()
+	defer c.lock.unlock()
+	c.epoch = epoch
+}
+
+////////////////////////////////////////////////////////////
+// ENCODING
+////////////////////////////////////////////////////////////
+
+func (*SinglePassDigest) MarshalBinary() ([]byte, error) {
+	return newWriter(PIR_SinglePass, kindDigest).Buf, nil
+}
+
+func (*SinglePassDigest) UnmarshalBinary(data []byte) error {
+	return newReader(data, PIR_SinglePass, kindDigest).Finish()
+}
+
+func (h *SinglePassHintQuery) MarshalBinary() ([]byte, error) {
+	w := newWriter(PIR_SinglePass, kindHintQuery)
+	w.Bytes(h.PermKey)
+	return w.Buf, nil
+}
+
+func (h *SinglePassHintQuery) UnmarshalBinary(data []byte) error {
+	r := newReader(data, PIR_SinglePass, kindHintQuery)
+	key := r.Bytes()
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	if len(key) != psetggm.PermKeySize {
+		return fmt.Errorf("%w: permutation key of %d bytes", utils.ErrMalformed, len(key))
+	}
+	h.PermKey = key
+	return nil
+}
+
+func (h *SinglePassHintResp) MarshalBinary() ([]byte, error) {
+	w := newWriter(PIR_SinglePass, kindHintResp)
+	if err := writeRecords(w, h.Parities); err != nil {
+		return nil, err
+	}
+	return w.Buf, nil
+}
+
+func (h *SinglePassHintResp) UnmarshalBinary(data []byte) error {
+	r := newReader(data, PIR_SinglePass, kindHintResp)
+	parities := readRecords(r)
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	h.Parities = parities
+	return nil
+}
+
+func (h *SinglePassHint) MarshalBinary() ([]byte, error) {
+	w := newWriter(PIR_SinglePass, kindHint)
+	if err := writeRecords(w, h.Parities); err != nil {
+		return nil, err
+	}
+	writeUint32Matrix(w, h.IdxToSetIdx)
+	writeUint32Matrix(w, h.SetIdxToIdx)
+	return w.Buf, nil
+}
+
+func (h *SinglePassHint) UnmarshalBinary(data []byte) error {
+	r := newReader(data, PIR_SinglePass, kindHint)
+	parities := readRecords(r)
+	idxToSetIdx := readUint32Matrix(r)
+	setIdxToIdx := readUint32Matrix(r)
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	h.Parities, h.IdxToSetIdx, h.SetIdxToIdx = parities, idxToSetIdx, setIdxToIdx
+	return nil
+}
+
+func (q *SinglePassQuery) MarshalBinary() ([]byte, error) {
+	w := newWriter(PIR_SinglePass, kindQuery)
+	writeUint32s(w, q.Indices)
+	return w.Buf, nil
+}
+
+func (q *SinglePassQuery) UnmarshalBinary(data []byte) error {
+	r := newReader(data, PIR_SinglePass, kindQuery)
+	indices := readUint32s(r)
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	q.Indices = indices
+	return nil
+}
+
+func (a *SinglePassAnswer) MarshalBinary() ([]byte, error) {
+	w := newWriter(PIR_SinglePass, kindAnswer)
+	w.Bytes(a.FlatRecords)
+	return w.Buf, nil
+}
+
+func (a *SinglePassAnswer) UnmarshalBinary(data []byte) error {
+	r := newReader(data, PIR_SinglePass, kindAnswer)
+	flat := r.Bytes()
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	a.FlatRecords = flat
+	return nil
+}
+
+// SaveState writes the database parameters, hint and randomness of the
+// client to w
+func (c *SinglePassClient) SaveState(w io.Writer) error {
+	c.lock.lockExclusive()
+	defer c.lock.unlock()
+	if c.Hint == nil {
+		return errors.New("Hint is not set")
+	}
+	if len(c.lock.burned) > 0 {
+		return fmt.Errorf("%w: refresh the burned hint sets before saving the state", ErrHintSetBurned)
+	}
+	hint, err := c.Hint.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	sw := newStateWriter(PIR_SinglePass)
+	for _, v := range []int{c.N, c.Q, c.M, c.epoch} {
+		sw.Uint64(uint64(v))
+	}
+	sw.Raw(c.PermKey[:])
+	if err := writePrg(sw, c.Prg); err != nil {
+		return err
+	}
+	sw.Bytes(hint)
+	return writeState(w, sw)
+}
+
+// LoadState restores a state saved by SaveState, at most once as for
+// TAPIRClient.LoadState
+func (c *SinglePassClient) LoadState(r io.Reader) error {
+	c.lock.lockExclusive()
+	defer c.lock.unlock()
+	sr, err := readState(r, PIR_SinglePass)
+	if err != nil {
+		return err
+	}
+	n, q, m, epoch := readInt(sr), readInt(sr), readInt(sr), readInt(sr)
+	permKey := readPermKey(sr)
+	prg := readPrg(sr)
+	hintBytes := sr.Bytes()
+	if err := sr.Finish(); err != nil {
+		return err
+	}
+	var hint SinglePassHint
+	if err := hint.UnmarshalBinary(hintBytes); err != nil {
+		return err
+	}
+	if q < 1 || n > q*m || len(hint.Parities) != m || !checkPermutations(hint.IdxToSetIdx, hint.SetIdxToIdx, q, m) {
+		return errors.New("client state does not match its database parameters")
+	}
+
+	c.lock.reset()
+	c.N, c.Q, c.M, c.epoch = n, q, m, epoch
+	c.PermKey, c.Prg = permKey, prg
+	c.Hint = &hint
+	return nil
 }
@@ -0,0 +1,46 @@
+package pir
+
+import (
+	crand "crypto/rand"
+	mrand "math/rand"
+	"math/rand/v2"
+	"tapir/modules/utils"
+)
+
+// SeedableClient is implemented by clients that sample their hint
+// permutations and query randomness locally (APIR_TAPIR, PIR_SinglePass) and
+// by the matrix clients, which sample the bit vectors of their queries.
+//
+// By default these clients seed their randomness from crypto/rand on every
+// RequestHint, or on setup for the matrix clients. SetTestSeed fixes the
+// seed instead, which makes the hint permutations and queries reproducible,
+// and predictable to the servers. Only use it in tests and benchmarks.
+type SeedableClient interface {
+	SetTestSeed(seed [32]byte)
+}
+
+// newClientPrg returns a ChaCha8 PRG seeded from crypto/rand, or from
+// testSeed if a deterministic seed was explicitly set.
+func newClientPrg(testSeed *[32]byte) (*rand.ChaCha8, error) {
+	if testSeed != nil {
+		return rand.NewChaCha8(*testSeed), nil
+	}
+	var seed [32]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		return nil, err
+	}
+	return rand.NewChaCha8(seed), nil
+}
+
+// newQueryRand returns the source of the query bit vectors of the matrix
+// clients, an AES-based PRG keyed from crypto/rand, or with the first bytes
+// of testSeed if a deterministic seed was explicitly set.
+func newQueryRand(testSeed *[32]byte) (*mrand.Rand, error) {
+	var key utils.PRGKey
+	if testSeed != nil {
+		copy(key[:], testSeed[:])
+	} else if _, err := crand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	return mrand.New(utils.NewBufPRG(utils.NewPRG(&key))), nil
+}
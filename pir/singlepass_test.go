@@ -0,0 +1,151 @@
+package pir
+
+import (
+	"bytes"
+	rand2 "math/rand/v2"
+	"tapir/modules/database"
+	"tapir/modules/vc"
+	"testing"
+)
+
+func TestSinglePassRandomDB(t *testing.T) {
+	n := 256
+	recSize := 32
+	Q := 16
+	db := database.MakeRandomDB([32]byte{6}, n, recSize)
+
+	server0 := newServer(t, PIR_SinglePass, db, 0, Q, vc.None)
+	server1 := newServer(t, PIR_SinglePass, db, 1, Q, vc.None)
+	client := newClient(t, PIR_SinglePass, n, Q, recSize, vc.None)
+
+	// server 0 derives the permutations from the key in the hint query,
+	// the client derives them locally from the same key
+	hq0, hq1, err := client.RequestHint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hr0, err := server0.GenHint(hq0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hr1, err := server1.GenHint(hq1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hint, err := client.VerSetup(nil, nil, hr0, hr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range n {
+		h, err := client.Query(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q0, q1 := h.Queries[0], h.Queries[1]
+		a0, err := server0.Answer(q0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a1, err := server1.Answer(q1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := client.Reconstruct(h, nil, hint, a0, a1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rec, db.GetRecord(i)) {
+			t.Fatalf("record %d does not match", i)
+		}
+	}
+}
+
+func TestSinglePassUpdates(t *testing.T) {
+	n := 256
+	recSize := 32
+	Q := 16
+	M := n / Q
+
+	server0 := newServer(t, PIR_SinglePass, database.MakeRandomDB([32]byte{7}, n, recSize), 0, Q, vc.None).(*SinglePassServer)
+	server1 := newServer(t, PIR_SinglePass, database.MakeRandomDB([32]byte{7}, n, recSize), 1, Q, vc.None).(*SinglePassServer)
+	client := newClient(t, PIR_SinglePass, n, Q, recSize, vc.None).(*SinglePassClient)
+
+	hq0, hq1, err := client.RequestHint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hr0, err := server0.GenHint(hq0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hr1, err := server1.GenHint(hq1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.VerSetup(nil, nil, hr0, hr1); err != nil {
+		t.Fatal(err)
+	}
+
+	prg := rand2.NewChaCha8([32]byte{8})
+	deletes := []database.Update{{Op: database.DELETE, Idx: 5}, {Op: database.DELETE, Idx: 100}}
+	for _, ops := range [][]database.Update{
+		database.MakeRandomUpdates(prg, n, 10, recSize, []database.OpType{database.EDIT}),
+		// fills a new, partially filled partition
+		database.MakeRandomUpdates(prg, n, M/2, recSize, []database.OpType{database.ADD}),
+		// the first ADDs complete that partition, the others open another
+		database.MakeRandomUpdates(prg, n, M, recSize, []database.OpType{database.ADD}),
+		deletes,
+		// reuses the deleted slots
+		database.MakeRandomUpdates(prg, n, 3, recSize, []database.OpType{database.ADD}),
+	} {
+		ops1 := make([]database.Update, len(ops))
+		for i, op := range ops {
+			ops1[i] = database.Update{Op: op.Op, Idx: op.Idx, Val: append([]byte{}, op.Val...)}
+		}
+		N0, Q0, d0, delta0 := update(t, server0, ops)
+		N1, Q1, d1, delta1 := update(t, server1, ops1)
+		N, _, digest, hint, err := client.UpdateHint(N0, N1, Q0, Q1, d0, d1, delta0, delta1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := server0.Db.Equals(server1.Db); !b {
+			t.Fatal(err)
+		}
+
+		for i := range N {
+			h, err := client.Query(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q0, q1 := h.Queries[0], h.Queries[1]
+			a0, err := server0.Answer(q0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a1, err := server1.Answer(q1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec, err := client.Reconstruct(h, digest, hint, a0, a1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rec, server0.Db.GetRecord(i)) {
+				t.Fatalf("record %d does not match after update", i)
+			}
+		}
+	}
+	if server0.Db.N != n+M+M/2+1 || server0.Q != Q+2 || len(server0.Db.Free) != 0 {
+		t.Fatalf("unexpected N=%d, Q=%d, free slots %v", server0.Db.N, server0.Q, server0.Db.Free)
+	}
+
+	// mismatching updates from the servers are rejected
+	ops0 := database.MakeRandomUpdates(prg, n, 1, recSize, []database.OpType{database.EDIT})
+	ops1 := []database.Update{{Op: database.EDIT, Idx: ops0[0].Idx, Val: make([]byte, recSize)}}
+	N0, Q0, d0, delta0 := update(t, server0, ops0)
+	N1, Q1, d1, delta1 := update(t, server1, ops1)
+	if _, _, _, _, err := client.UpdateHint(N0, N1, Q0, Q1, d0, d1, delta0, delta1); err == nil {
+		t.Fatal("mismatching updates accepted")
+	}
+}
@@ -0,0 +1,152 @@
+package pir
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+
+	"tapir/modules/database"
+	"tapir/modules/utils"
+)
+
+////////////////////////////////////////////////////////////
+// PERSISTENT CLIENT STATE
+////////////////////////////////////////////////////////////
+
+// StatefulClient is implemented by clients whose hint can be saved and
+// restored, e.g., to resume after a restart without running the offline
+// phase again. The state is that between queries, SaveState waits until no
+// query is pending.
+type StatefulClient interface {
+	APIRClient
+	SaveState(w io.Writer) error
+	LoadState(r io.Reader) error
+	// Epoch returns the number of update rounds applied to the hint, it is
+	// saved with the state to fetch the updates missed since
+	Epoch() int
+	SetEpoch(epoch int)
+	// UpdateHintRange applies the updates of the epochs after Epoch()
+	UpdateHintRange(u0, u1 []EpochUpdate) (Digest, Hint, error)
+}
+
+// A saved state is encoded as
+//
+//	| header | state version (1 byte) | fields | SHA-256 of all preceding bytes |
+//
+// with the header of the binary encoding (see encoding.go).
+
+const StateVersion byte = 1
+
+var (
+	ErrStateVersion  = errors.New("unsupported client state version")
+	ErrStateChecksum = errors.New("client state checksum mismatch")
+)
+
+func newStateWriter(t PirType) *utils.BinWriter {
+	w := newWriter(t, kindClientState)
+	w.Byte(StateVersion)
+	return w
+}
+
+// writeState appends the checksum to the state in sw and writes it to w
+func writeState(w io.Writer, sw *utils.BinWriter) error {
+	sum := sha256.Sum256(sw.Buf)
+	sw.Raw(sum[:])
+	_, err := w.Write(sw.Buf)
+	return err
+}
+
+// readState reads a state of scheme t from r and checks its checksum and
+// header
+func readState(r io.Reader, t PirType) (*utils.BinReader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < sha256.Size {
+		return nil, fmt.Errorf("%w: state of %d bytes", utils.ErrMalformed, len(data))
+	}
+	body := data[:len(data)-sha256.Size]
+	sum := sha256.Sum256(body)
+	if !bytes.Equal(sum[:], data[len(body):]) {
+		return nil, ErrStateChecksum
+	}
+	sr := newReader(body, t, kindClientState)
+	if v := sr.Byte(); sr.Err() == nil && v != StateVersion {
+		return nil, fmt.Errorf("%w: %d", ErrStateVersion, v)
+	}
+	return sr, sr.Err()
+}
+
+func writePrg(w *utils.BinWriter, prg *rand.ChaCha8) error {
+	b, err := prg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	w.Bytes(b)
+	return nil
+}
+
+func readPrg(r *utils.BinReader) *rand.ChaCha8 {
+	b := r.Bytes()
+	if r.Err() != nil {
+		return nil
+	}
+	prg := &rand.ChaCha8{}
+	if err := prg.UnmarshalBinary(b); err != nil {
+		r.Fail(err)
+	}
+	return prg
+}
+
+func readPermKey(r *utils.BinReader) utils.PRGKey {
+	var key utils.PRGKey
+	copy(key[:], r.Raw(len(key)))
+	return key
+}
+
+// readInt reads a non-negative integer encoded as uint64
+func readInt(r *utils.BinReader) int {
+	v := r.Uint64()
+	if v > 1<<31 {
+		r.Fail(fmt.Errorf("%w: integer %d out of range", utils.ErrMalformed, v))
+		return 0
+	}
+	return int(v)
+}
+
+// checkPermutations checks that the q rows of idxToSetIdx are permutations
+// of [0, m) and the rows of setIdxToIdx their inverses
+func checkPermutations(idxToSetIdx, setIdxToIdx [][]uint32, q, m int) bool {
+	if len(idxToSetIdx) != q || len(setIdxToIdx) != q {
+		return false
+	}
+	for j := range q {
+		perm, inv := idxToSetIdx[j], setIdxToIdx[j]
+		if len(perm) != m || len(inv) != m {
+			return false
+		}
+		for k, v := range perm {
+			if int(v) >= m || int(inv[v]) != k {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkParities checks that there are m parities of recSize bytes
+func checkParities(parities []database.Record, m, recSize int) bool {
+	if len(parities) != m {
+		return false
+	}
+	for _, p := range parities {
+		if len(p) != recSize {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,174 @@
+package pir
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"testing"
+
+	"tapir/modules/database"
+	"tapir/modules/vc"
+)
+
+func retrieve(t *testing.T, client APIRClient, servers [2]APIRServer, i int) database.Record {
+	h, err := client.Query(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q0, q1 := h.Queries[0], h.Queries[1]
+	a0, err := servers[0].Answer(q0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1, err := servers[1].Answer(q1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := client.Reconstruct(h, nil, nil, a0, a1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestClientState(t *testing.T) {
+	n := 256
+	Q := 16
+	recSize := 32
+	for _, s := range []struct {
+		pirType PirType
+		vctype  vc.VcType
+	}{
+		{PIR_SinglePass, vc.None},
+		{APIR_TAPIR, vc.VC_MerkleTree},
+		{APIR_TAPIR, vc.VC_PointProof},
+	} {
+		log.Println("TestClientState with", s.pirType, "and VC type:", s.vctype)
+		dbs := [2]*database.DB{
+			database.MakeRandomDB([32]byte{18}, n, recSize),
+			database.MakeRandomDB([32]byte{18}, n, recSize),
+		}
+		servers := [2]APIRServer{
+			newServer(t, s.pirType, dbs[0], 0, Q, s.vctype),
+			newServer(t, s.pirType, dbs[1], 1, Q, s.vctype),
+		}
+		client := newClient(t, s.pirType, n, Q, recSize, s.vctype).(StatefulClient)
+		setupBatch(t, client, servers)
+		for i := range 20 {
+			retrieve(t, client, servers, i)
+		}
+
+		// the servers apply an update the client folds into its hint
+		ops := database.MakeRandomUpdates(rand.NewChaCha8([32]byte{19}), n, 4, recSize, []database.OpType{database.EDIT, database.ADD})
+		var res [2]struct {
+			n, q int
+			d    Digest
+			ops  []database.Update
+		}
+		for k := range servers {
+			res[k].n, res[k].q, res[k].d, res[k].ops = update(t, servers[k], copyUpdates(ops))
+		}
+		if _, _, _, _, err := client.UpdateHint(res[0].n, res[1].n, res[0].q, res[1].q, res[0].d, res[1].d, res[0].ops, res[1].ops); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := client.SaveState(&buf); err != nil {
+			t.Fatal(err)
+		}
+		saved := buf.Bytes()
+
+		// a new client continues where the saved one stopped
+		restored := newClient(t, s.pirType, n, Q, recSize, s.vctype).(StatefulClient)
+		if err := restored.LoadState(bytes.NewReader(saved)); err != nil {
+			t.Fatal(err)
+		}
+		if restored.Epoch() != 1 {
+			t.Fatal("restored epoch", restored.Epoch())
+		}
+		N := servers[0].GetDB().N
+		for i := range N {
+			if rec := retrieve(t, restored, servers, i); !bytes.Equal(rec, dbs[0].GetRecord(i)) {
+				t.Fatal("wrong record after restoring state", i)
+			}
+		}
+
+		// corrupted, truncated and foreign states are rejected
+		corrupted := bytes.Clone(saved)
+		corrupted[len(corrupted)/2] ^= 1
+		if err := restored.LoadState(bytes.NewReader(corrupted)); !errors.Is(err, ErrStateChecksum) {
+			t.Fatal("expected checksum error, got", err)
+		}
+		if err := restored.LoadState(bytes.NewReader(saved[:len(saved)-1])); err == nil {
+			t.Fatal("accepted truncated state")
+		}
+		other := PIR_SinglePass
+		if s.pirType == PIR_SinglePass {
+			other = APIR_TAPIR
+		}
+		otherClient := newClient(t, other, n, Q, recSize, vc.VC_MerkleTree).(StatefulClient)
+		if err := otherClient.LoadState(bytes.NewReader(saved)); !errors.Is(err, ErrSchemeMismatch) {
+			t.Fatal("expected scheme mismatch, got", err)
+		}
+
+		// states with a checksum but a hint that does not match the
+		// parameters are rejected
+		tampers := []func(c StatefulClient){
+			func(c StatefulClient) {
+				perm := hintPerms(c)
+				perm[0][0], perm[0][1] = perm[0][1], perm[0][0]
+			},
+			func(c StatefulClient) {
+				perm := hintPerms(c)
+				perm[1] = perm[1][:Q-1]
+			},
+		}
+		if s.pirType == APIR_TAPIR {
+			tampers = append(tampers,
+				func(c StatefulClient) {
+					h := c.(*TAPIRClient).Hint
+					for j := range h.Parities {
+						h.Parities[j] = h.Parities[j][1:]
+					}
+				},
+				func(c StatefulClient) {
+					d := c.(*TAPIRClient).Digest
+					d.ParamsDigest = append(bytes.Clone(d.ParamsDigest), 0)
+				})
+		}
+		for k, tamper := range tampers {
+			tampered := newClient(t, s.pirType, n, Q, recSize, s.vctype).(StatefulClient)
+			if err := tampered.LoadState(bytes.NewReader(saved)); err != nil {
+				t.Fatal(err)
+			}
+			tamper(tampered)
+			var buf bytes.Buffer
+			if err := tampered.SaveState(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if err := restored.LoadState(bytes.NewReader(buf.Bytes())); err == nil {
+				t.Fatal("accepted tampered state", k)
+			}
+		}
+	}
+}
+
+// hintPerms returns the permutations of the hint of c
+func hintPerms(c StatefulClient) [][]uint32 {
+	switch c := c.(type) {
+	case *TAPIRClient:
+		return c.Hint.IdxToSetIdx
+	case *SinglePassClient:
+		return c.Hint.IdxToSetIdx
+	}
+	panic("unexpected client")
+}
+
+func copyUpdates(ops []database.Update) []database.Update {
+	out := make([]database.Update, len(ops))
+	for i, op := range ops {
+		out[i] = database.Update{Op: op.Op, Idx: op.Idx, Val: bytes.Clone(op.Val)}
+	}
+	return out
+}
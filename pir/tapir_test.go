@@ -2,10 +2,14 @@ package pir
 
 import (
 	"bytes"
+	"errors"
 	"log"
 	"math/rand"
 	rand2 "math/rand/v2"
+	"slices"
 	"tapir/modules/database"
+	"tapir/modules/pp"
+	"tapir/modules/psetggm"
 	"tapir/modules/vc"
 	"testing"
 )
@@ -20,14 +24,14 @@ func TestTapirNonRandom(t *testing.T) {
 	db := database.MakeNumberDB(n, recSize)
 	db2 := database.MakeNumberDB(n, recSize)
 
-	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof} {
+	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof, vc.VC_KZG} {
 		// NOTE MAY FAIL ON RECORDS OF LESS THAN 128 BITS DUE TO SIMD INSTRUCTIONS
 		log.Println("TestTapirNonRandom with VC Type:", vctype)
 
-		server0 := NewServer(APIR_TAPIR, db, 0, Q, vctype).(*TAPIRServer)
-		server1 := NewServer(APIR_TAPIR, db2, 1, Q, vctype).(*TAPIRServer)
+		server0 := newServer(t, APIR_TAPIR, db, 0, Q, vctype).(*TAPIRServer)
+		server1 := newServer(t, APIR_TAPIR, db2, 1, Q, vctype).(*TAPIRServer)
 
-		client := NewClient(APIR_TAPIR, db.N, Q, recSize, vctype)
+		client := newClient(t, APIR_TAPIR, db.N, Q, recSize, vctype)
 
 		// Generate a digest for the database
 		d0, err := server0.GenDigest()
@@ -66,10 +70,11 @@ func TestTapirNonRandom(t *testing.T) {
 		// ONLINE
 		for i := range n {
 			// // Generate a query for record 1
-			query0, query1, err := client.Query(i)
+			h, err := client.Query(i)
 			if err != nil {
 				t.Fatal(err)
 			}
+			query0, query1 := h.Queries[0], h.Queries[1]
 
 			// // Answer the query
 			answer0, err := server0.Answer(query0)
@@ -83,7 +88,7 @@ func TestTapirNonRandom(t *testing.T) {
 			// Reconstruct the record
 			// The DPF PIR protocol does not have a digest or hint, so we pass in a
 			// dummy hint and digest values, this allows us to use the same TAPIR API
-			record, err := client.Reconstruct(digest, hint, answer0, answer1)
+			record, err := client.Reconstruct(h, digest, hint, answer0, answer1)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -116,10 +121,10 @@ func TestTapirRandomDB(t *testing.T) {
 		// NOTE MAY FAIL ON RECORDS OF LESS THAN 128 BITS DUE TO SIMD INSTRUCTIONS
 		log.Println("TestTapirRandomDB with VC Type:", vctype)
 
-		server0 := NewServer(APIR_TAPIR, db, 0, Q, vctype).(*TAPIRServer)
-		server1 := NewServer(APIR_TAPIR, db2, 1, Q, vctype).(*TAPIRServer)
+		server0 := newServer(t, APIR_TAPIR, db, 0, Q, vctype).(*TAPIRServer)
+		server1 := newServer(t, APIR_TAPIR, db2, 1, Q, vctype).(*TAPIRServer)
 
-		client := NewClient(APIR_TAPIR, db.N, Q, recSize, vctype)
+		client := newClient(t, APIR_TAPIR, db.N, Q, recSize, vctype)
 
 		// Generate a digest for the database
 		d0, err := server0.GenDigest()
@@ -156,10 +161,11 @@ func TestTapirRandomDB(t *testing.T) {
 		// ONLINE
 		for i := range n {
 			// // Generate a query for record 1
-			query0, query1, err := client.Query(i)
+			h, err := client.Query(i)
 			if err != nil {
 				t.Fatal(err)
 			}
+			query0, query1 := h.Queries[0], h.Queries[1]
 
 			// // Answer the query
 			answer0, err := server0.Answer(query0)
@@ -174,7 +180,7 @@ func TestTapirRandomDB(t *testing.T) {
 			// // Reconstruct the record
 			// // The DPF PIR protocol does not have a digest or hint, so we pass in a
 			// // dummy hint and digest values, this allows us to use the same TAPIR API
-			record, err := client.Reconstruct(digest, hint, answer0, answer1)
+			record, err := client.Reconstruct(h, digest, hint, answer0, answer1)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -193,7 +199,7 @@ func TestTapirRandomDB(t *testing.T) {
 
 func TestTapirSingleUpdates(t *testing.T) {
 
-	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof} {
+	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof, vc.VC_KZG} {
 		log.Println("TestTapirRandomUpdates with VC Type:", vctype)
 
 		n := 1024
@@ -212,13 +218,18 @@ func TestTapirSingleUpdates(t *testing.T) {
 		seed := [32]byte{42}
 		prg0 := rand2.NewChaCha8(seed)
 		prg1 := rand2.NewChaCha8(seed)
-		ops0 := database.MakeRandomUpdates(prg0, n, numUpdates, recSize, []database.OpType{database.ADD, database.EDIT})
-		ops1 := database.MakeRandomUpdates(prg1, n, numUpdates, recSize, []database.OpType{database.ADD, database.EDIT})
+		// a batch with more ADDs than DELETEs appends a partition
+		types := []database.OpType{database.ADD, database.EDIT, database.DELETE}
+		adds := []database.OpType{database.ADD}
+		ops0 := database.MakeRandomUpdates(prg0, n, numUpdates, recSize, types)
+		ops1 := database.MakeRandomUpdates(prg1, n, numUpdates, recSize, types)
+		ops0 = append(ops0, database.MakeRandomUpdates(prg0, n, numUpdates, recSize, adds)...)
+		ops1 = append(ops1, database.MakeRandomUpdates(prg1, n, numUpdates, recSize, adds)...)
 
-		server0 := NewServer(APIR_TAPIR, db0, 0, Q, vctype).(*TAPIRServer)
-		server1 := NewServer(APIR_TAPIR, db1, 1, Q, vctype).(*TAPIRServer)
+		server0 := newServer(t, APIR_TAPIR, db0, 0, Q, vctype).(*TAPIRServer)
+		server1 := newServer(t, APIR_TAPIR, db1, 1, Q, vctype).(*TAPIRServer)
 
-		client := NewClient(APIR_TAPIR, db0.N, Q, recSize, vctype)
+		client := newClient(t, APIR_TAPIR, db0.N, Q, recSize, vctype)
 
 		// Generate a digest for the database
 		d0, err := server0.GenDigest()
@@ -271,8 +282,8 @@ func TestTapirSingleUpdates(t *testing.T) {
 			}
 
 			// SERVER UPDATE
-			N0, Q0, d0, opsDelta0 := server0.Update([]database.Update{ops0[i]})
-			N1, Q1, d1, opsDelta1 := server1.Update([]database.Update{ops1[i]})
+			N0, Q0, d0, opsDelta0 := update(t, server0, []database.Update{ops0[i]})
+			N1, Q1, d1, opsDelta1 := update(t, server1, []database.Update{ops1[i]})
 
 			// Add checks for N values
 			if N0 != N1 {
@@ -315,10 +326,11 @@ func TestTapirSingleUpdates(t *testing.T) {
 			qryIdx := opsDelta0[idx].Idx
 
 			// // Generate a query for the updated object
-			query0, query1, err := client.Query(qryIdx)
+			h, err := client.Query(qryIdx)
 			if err != nil {
 				t.Fatal(err)
 			}
+			query0, query1 := h.Queries[0], h.Queries[1]
 
 			// // Answer the query
 			answer0, err := server0.Answer(query0)
@@ -330,7 +342,7 @@ func TestTapirSingleUpdates(t *testing.T) {
 				t.Fatal(err)
 			}
 			// Reconstruct the record
-			record, err := client.Reconstruct(digest, hint, answer0, answer1)
+			record, err := client.Reconstruct(h, digest, hint, answer0, answer1)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -370,10 +382,10 @@ func TestTapirBatchUpdates(t *testing.T) {
 		ops0 := database.MakeRandomUpdates(prg0, n, numUpdates, recSize, []database.OpType{database.ADD, database.EDIT})
 		ops1 := database.MakeRandomUpdates(prg1, n, numUpdates, recSize, []database.OpType{database.ADD, database.EDIT})
 
-		server0 := NewServer(APIR_TAPIR, db0, 0, Q, vctype).(*TAPIRServer)
-		server1 := NewServer(APIR_TAPIR, db1, 1, Q, vctype).(*TAPIRServer)
+		server0 := newServer(t, APIR_TAPIR, db0, 0, Q, vctype).(*TAPIRServer)
+		server1 := newServer(t, APIR_TAPIR, db1, 1, Q, vctype).(*TAPIRServer)
 
-		client := NewClient(APIR_TAPIR, db0.N, Q, recSize, vctype)
+		client := newClient(t, APIR_TAPIR, db0.N, Q, recSize, vctype)
 
 		// Generate a digest for the database
 		d0, err := server0.GenDigest()
@@ -410,16 +422,16 @@ func TestTapirBatchUpdates(t *testing.T) {
 		}
 
 		// SERVER UPDATE
-		N0, Q0, d0, opsDelta0 := server0.Update(ops0)
-		N1, Q1, d1, opsDelta1 := server1.Update(ops1)
+		N0, Q0, d0, opsDelta0 := update(t, server0, ops0)
+		N1, Q1, d1, opsDelta1 := update(t, server1, ops1)
 
 		// Add checks for N values
 		if N0 != N1 {
 			t.Fatal("updated DB sizes not equal")
 		}
 		// Add checks for Q values
-		if Q0 != Q1 {
-			t.Fatal("updated Q values not equal")
+		if Q0 != Q1 || Q0 != Q+1 {
+			t.Fatal("updated Q values not equal or no partition added")
 		}
 
 		// Check if digests are equal
@@ -437,6 +449,15 @@ func TestTapirBatchUpdates(t *testing.T) {
 			}
 		}
 
+		// a digest that differs only in the new partition is rejected
+		forged := appendedPartitionForged(d1.(*TAPIRDigest))
+		if _, _, _, _, err := client.(*TAPIRClient).UpdateHint(N0, N1, Q0, Q1, d0, forged, opsDelta0, opsDelta1); err == nil {
+			t.Fatal("accepted digest with a mismatching new partition")
+		}
+		if client.(*TAPIRClient).Q != Q || client.(*TAPIRClient).N != n {
+			t.Fatal("rejected update changed the client")
+		}
+
 		// CLIENT UPDATE
 		N, Q, digest, hint, err := client.(*TAPIRClient).UpdateHint(N0, N1, Q0, Q1, d0, d1, opsDelta0, opsDelta1)
 		if err != nil {
@@ -463,10 +484,11 @@ func TestTapirBatchUpdates(t *testing.T) {
 			qryIdx := opsDelta0[i].Idx
 
 			// // Generate a query for the updated object
-			query0, query1, err := client.Query(qryIdx)
+			h, err := client.Query(qryIdx)
 			if err != nil {
 				t.Fatal(err)
 			}
+			query0, query1 := h.Queries[0], h.Queries[1]
 
 			// // Answer the query
 			answer0, err := server0.Answer(query0)
@@ -478,7 +500,7 @@ func TestTapirBatchUpdates(t *testing.T) {
 				t.Fatal(err)
 			}
 			// Reconstruct the record
-			record, err := client.Reconstruct(digest, hint, answer0, answer1)
+			record, err := client.Reconstruct(h, digest, hint, answer0, answer1)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -493,3 +515,452 @@ func TestTapirBatchUpdates(t *testing.T) {
 		log.Println("Passed TAPIR small non-random test for VC type:", vctype, "now doing next type...")
 	}
 }
+
+func TestTapirClientRandomness(t *testing.T) {
+
+	// Tests that hint permutations are fresh per client unless a test seed is set
+	n := 1024
+	recSize := 16
+	Q := 8
+
+	newClient := func(seed *[32]byte) *TAPIRClient {
+		c := newClient(t, APIR_TAPIR, n, Q, recSize, vc.VC_MerkleTree).(*TAPIRClient)
+		if seed != nil {
+			c.SetTestSeed(*seed)
+		}
+		if _, _, err := c.RequestHint(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	samePerms := func(c0, c1 *TAPIRClient) bool {
+		for q := range Q {
+			for m := range c0.M {
+				if c0.Hint.IdxToSetIdx[q][m] != c1.Hint.IdxToSetIdx[q][m] {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	c0, c1 := newClient(nil), newClient(nil)
+	if c0.PermKey == c1.PermKey || samePerms(c0, c1) {
+		t.Fatal("clients without test seed share their permutations")
+	}
+
+	seed := [32]byte{42}
+	s0, s1 := newClient(&seed), newClient(&seed)
+	if s0.PermKey != s1.PermKey || !samePerms(s0, s1) {
+		t.Fatal("clients with the same test seed have different permutations")
+	}
+
+	// a single partition can be regenerated on its own, as done in UpdateHint
+	perm := make([]uint32, c0.M)
+	inv := make([]uint32, c0.M)
+	for q := range Q {
+		if err := psetggm.GenerateSinglePerm(c0.M, c0.PermKey[:], q, perm, inv); err != nil {
+			t.Fatal(err)
+		}
+		for m := range c0.M {
+			if perm[m] != c0.Hint.IdxToSetIdx[q][m] || inv[m] != c0.Hint.SetIdxToIdx[q][m] {
+				t.Fatalf("permutation of partition %d differs", q)
+			}
+		}
+	}
+}
+
+func TestTapirParamsMismatch(t *testing.T) {
+
+	// Tests that the client rejects servers using other PointProof parameters
+	n := 64
+	recSize := 16
+	Q := 8
+	db := database.MakeRandomDB([32]byte{3}, n, recSize)
+
+	server0 := newServer(t, APIR_TAPIR, db, 0, Q, vc.VC_PointProof)
+	server1 := newServer(t, APIR_TAPIR, db, 1, Q, vc.VC_PointProof)
+	client := newClient(t, APIR_TAPIR, n, Q, recSize, vc.VC_PointProof).(*TAPIRClient)
+
+	d0, err := server0.GenDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1, err := server1.GenDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client.EqualDigests(d0, d1) {
+		t.Fatal("digests of servers with the same parameters differ")
+	}
+
+	// a client with parameters from an independent setup
+	client.Vc = &vc.PPParams{PP: pp.NewPublicParams(client.M)}
+	if client.EqualDigests(d0, d1) {
+		t.Fatal("digests accepted for different parameters")
+	}
+}
+
+func TestTapirIncrementalUpdates(t *testing.T) {
+	n := 64
+	recSize := 16
+	Q := 8
+	M := n / Q
+
+	// all of them update the opening proofs incrementally
+	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof, vc.VC_KZG} {
+		log.Println("TestTapirIncrementalUpdates with VC Type:", vctype)
+
+		db := database.MakeRandomDB([32]byte{11}, n, recSize)
+		server := newServer(t, APIR_TAPIR, db, 0, Q, vctype).(*TAPIRServer)
+		if _, err := server.GenDigest(); err != nil {
+			t.Fatal(err)
+		}
+		// the vectors are rebuilt if missing, e.g., after decoding
+		server.vecs = nil
+
+		prg := rand2.NewChaCha8([32]byte{12})
+		// the first ADDs open a new, partially filled partition, the later
+		// ones, the EDITs and the DELETEs are applied to the existing
+		// partitions
+		for _, ops := range [][]database.Update{
+			database.MakeRandomUpdates(prg, server.Db.N, 3, recSize, []database.OpType{database.ADD}),
+			database.MakeRandomUpdates(prg, server.Db.N, 2, recSize, []database.OpType{database.ADD}),
+			database.MakeRandomUpdates(prg, server.Db.N, 4, recSize, []database.OpType{database.EDIT}),
+			database.MakeRandomUpdates(prg, server.Db.N, 2, recSize, []database.OpType{database.DELETE}),
+		} {
+			update(t, server, ops)
+		}
+		if server.Db.N != n+5 || server.Q != Q+1 {
+			t.Fatalf("unexpected N=%d, Q=%d after updates", server.Db.N, server.Q)
+		}
+
+		// the incrementally updated commitments and proofs match the ones
+		// of a server set up from the updated database
+		data := append([]byte{}, server.Db.Data...)
+		fresh := &TAPIRServer{
+			Db: &database.DB{N: (Q + 1) * M, RecSize: recSize, Capacity: (Q + 1) * M, Data: data},
+			Q:  Q + 1, M: M, VcType: vctype, Vc: server.Vc,
+		}
+		if _, err := fresh.GenDigest(); err != nil {
+			t.Fatal(err)
+		}
+		for q := range Q + 1 {
+			if !server.Vc.EqualCommitments(server.Digest.Coms[q], fresh.Digest.Coms[q]) {
+				t.Fatal("commitment of partition", q, "differs")
+			}
+		}
+		for i := range (Q + 1) * M {
+			if !server.Vc.EqualProofs(server.Proofs[i], fresh.Proofs[i]) {
+				t.Fatal("proof", i, "differs")
+			}
+		}
+	}
+}
+
+func TestTapirDeletes(t *testing.T) {
+	n := 64
+	recSize := 16
+	Q := 8
+
+	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_KZG} {
+		log.Println("TestTapirDeletes with VC Type:", vctype)
+
+		var seed [32]byte
+		if _, err := rand.Read(seed[:]); err != nil {
+			t.Fatal(err)
+		}
+		server0 := newServer(t, APIR_TAPIR, database.MakeRandomDB(seed, n, recSize), 0, Q, vctype).(*TAPIRServer)
+		server1 := newServer(t, APIR_TAPIR, database.MakeRandomDB(seed, n, recSize), 1, Q, vctype).(*TAPIRServer)
+		client := newClient(t, APIR_TAPIR, n, Q, recSize, vctype).(*TAPIRClient)
+
+		d0, err := server0.GenDigest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d1, err := server1.GenDigest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hq0, hq1, err := client.RequestHint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hint0, err := server0.GenHint(hq0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hint1, err := server1.GenHint(hq1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = client.VerSetup(d0, d1, hint0, hint1); err != nil {
+			t.Fatal(err)
+		}
+
+		// update both servers and the client, then check that all records
+		// are retrieved correctly
+		update := func(ops []database.Update) []database.Update {
+			ops0 := append([]database.Update{}, ops...)
+			ops1 := make([]database.Update, len(ops))
+			for i, op := range ops {
+				ops1[i] = database.Update{Op: op.Op, Idx: op.Idx, Val: append([]byte{}, op.Val...)}
+			}
+			N0, Q0, d0, delta0 := update(t, server0, ops0)
+			N1, Q1, d1, delta1 := update(t, server1, ops1)
+			N, _, digest, hint, err := client.UpdateHint(N0, N1, Q0, Q1, d0, d1, delta0, delta1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if N != server0.Db.N {
+				t.Fatal("db sizes not equal after update")
+			}
+			for i := range N {
+				h, err := client.Query(i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				query0, query1 := h.Queries[0], h.Queries[1]
+				answer0, err := server0.Answer(query0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				answer1, err := server1.Answer(query1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				record, err := client.Reconstruct(h, digest, hint, answer0, answer1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(record, server0.Db.GetRecord(i)) {
+					t.Fatal("retrieved record for", i, "is incorrect")
+				}
+			}
+			return delta0
+		}
+
+		deleted := []int{3, 17, 40}
+		var ops []database.Update
+		for _, idx := range deleted {
+			ops = append(ops, database.Update{Op: database.DELETE, Idx: idx})
+		}
+		update(ops)
+		for _, idx := range deleted {
+			if !server0.Db.IsFree(idx) || !bytes.Equal(server0.Db.GetRecord(idx), make([]byte, recSize)) {
+				t.Fatal("record", idx, "not deleted")
+			}
+		}
+
+		// ADDs fill the free slots, lowest first, before extending the
+		// database
+		prg := rand2.NewChaCha8([32]byte{13})
+		delta := update(database.MakeRandomUpdates(prg, n, 4, recSize, []database.OpType{database.ADD}))
+		for i, idx := range []int{3, 17, 40, n} {
+			if delta[i].Idx != idx {
+				t.Fatalf("ADD %d went to index %d, expected %d", i, delta[i].Idx, idx)
+			}
+		}
+		if len(server0.Db.Free) != 0 || server0.Db.N != n+1 {
+			t.Fatalf("unexpected N=%d and free slots %v", server0.Db.N, server0.Db.Free)
+		}
+		if b, err := server0.Db.Equals(server1.Db); !b {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTapirParallelGenDigest(t *testing.T) {
+	n := 64
+	recSize := 16
+	Q := 4
+
+	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof, vc.VC_KZG} {
+		log.Println("TestTapirParallelGenDigest with VC Type:", vctype)
+
+		serial := newServer(t, APIR_TAPIR, database.MakeRandomDB([32]byte{13}, n, recSize), 0, Q, vctype).(*TAPIRServer)
+		serial.Workers = 1
+		if _, err := serial.GenDigest(); err != nil {
+			t.Fatal(err)
+		}
+		// more workers than partitions, and a number not dividing N
+		for _, workers := range []int{3, 2 * Q, 0} {
+			par := newServer(t, APIR_TAPIR, database.MakeRandomDB([32]byte{13}, n, recSize), 0, Q, vctype).(*TAPIRServer)
+			SetWorkers(par, workers)
+			if _, err := par.GenDigest(); err != nil {
+				t.Fatal(err)
+			}
+			for q := range Q {
+				if !serial.Vc.EqualCommitments(serial.Digest.Coms[q], par.Digest.Coms[q]) {
+					t.Fatal("commitment of partition", q, "differs with", workers, "workers")
+				}
+			}
+			for i := range n {
+				if !bytes.Equal(serial.Vc.ProofToBytes(serial.Proofs[i]), par.Vc.ProofToBytes(par.Proofs[i])) {
+					t.Fatal("proof", i, "differs with", workers, "workers")
+				}
+			}
+		}
+	}
+}
+
+func TestTapirUpdateLog(t *testing.T) {
+	n := 256
+	Q := 16
+	recSize := 32
+	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof} {
+		log.Println("TestTapirUpdateLog with VC Type:", vctype)
+		dbs := [2]*database.DB{
+			database.MakeRandomDB([32]byte{19}, n, recSize),
+			database.MakeRandomDB([32]byte{19}, n, recSize),
+		}
+		servers := [2]APIRServer{
+			newServer(t, APIR_TAPIR, dbs[0], 0, Q, vctype),
+			newServer(t, APIR_TAPIR, dbs[1], 1, Q, vctype),
+		}
+		client := newClient(t, APIR_TAPIR, n, Q, recSize, vctype).(*TAPIRClient)
+		setupBatch(t, client, servers)
+
+		// freshClient returns a client set up for the initial database
+		freshClient := func() *TAPIRClient {
+			c := newClient(t, APIR_TAPIR, n, Q, recSize, vctype).(*TAPIRClient)
+			setupBatch(t, c, [2]APIRServer{
+				newServer(t, APIR_TAPIR, database.MakeRandomDB([32]byte{19}, n, recSize), 0, Q, vctype),
+				newServer(t, APIR_TAPIR, database.MakeRandomDB([32]byte{19}, n, recSize), 1, Q, vctype),
+			})
+			return c
+		}
+
+		// the client misses three update rounds
+		prg := rand2.NewChaCha8([32]byte{20})
+		for range 3 {
+			ops := database.MakeRandomUpdates(prg, n, 4, recSize, []database.OpType{database.EDIT, database.ADD})
+			update(t, servers[0], copyUpdates(ops))
+			update(t, servers[1], ops)
+		}
+		var updates [2][]EpochUpdate
+		for k, s := range servers {
+			if e := s.(UpdateLogger).Epoch(); e != 3 {
+				t.Fatal("server at epoch", e)
+			}
+			var err error
+			if updates[k], err = s.(UpdateLogger).UpdatesSince(client.Epoch()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(updates[0]) != 3 {
+			t.Fatal("got", len(updates[0]), "updates")
+		}
+		// the log keeps the digest of every epoch, not the current one
+		if client.EqualDigests(updates[0][0].Digest, updates[0][2].Digest) {
+			t.Fatal("logged digests of different epochs are equal")
+		}
+		if _, err := servers[0].(UpdateLogger).UpdatesSince(4); err == nil {
+			t.Fatal("accepted future epoch")
+		}
+		// the log returns copies of its entries
+		updates[0][0].Ops[0].Val[0] ^= 1
+		again, err := servers[0].(UpdateLogger).UpdatesSince(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again[0].Ops[0].Equals(updates[0][0].Ops[0]) {
+			t.Fatal("modified the logged update")
+		}
+		updates[0][0].Ops[0].Val[0] ^= 1
+
+		// mismatching ops of any epoch are rejected before the hint changes
+		parities := make([]database.Record, len(client.Hint.Parities))
+		for j, p := range client.Hint.Parities {
+			parities[j] = bytes.Clone(p)
+		}
+		forgedOps := slices.Clone(updates[1])
+		forgedOps[2].Ops = copyUpdates(forgedOps[2].Ops)
+		forgedOps[2].Ops[0].Val[0] ^= 1
+		if _, _, err := client.UpdateHintRange(updates[0], forgedOps); err == nil {
+			t.Fatal("accepted mismatching ops of epoch 3")
+		}
+		if client.Epoch() != 0 || !slices.EqualFunc(parities, client.Hint.Parities, database.Record.Equals) {
+			t.Fatal("hint changed by rejected updates")
+		}
+		// as are ops out of range
+		badOps := copyUpdates(updates[0][0].Ops)
+		badOps[0].Idx = -1
+		u := updates[0][0]
+		if _, _, _, _, err := client.UpdateHint(u.N, u.N, u.Q, u.Q, u.Digest, u.Digest, badOps, copyUpdates(badOps)); err == nil {
+			t.Fatal("accepted update of index -1")
+		}
+		if client.Epoch() != 0 || !slices.EqualFunc(parities, client.Hint.Parities, database.Record.Equals) {
+			t.Fatal("hint changed by rejected updates")
+		}
+
+		// a mismatching intermediate digest is rejected
+		forged := slices.Clone(updates[1])
+		forged[1].Digest = forged[2].Digest
+		if _, _, err := client.UpdateHintRange(updates[0], forged); err == nil {
+			t.Fatal("accepted mismatching digest of epoch 2")
+		}
+		// as is an intermediate digest that differs only in the commitment
+		// of a partition added by the update
+		grown := slices.IndexFunc(updates[0], func(u EpochUpdate) bool { return u.Q > Q })
+		if grown < 0 {
+			t.Fatal("no update added a partition")
+		}
+		forged = slices.Clone(updates[1])
+		forged[grown].Digest = appendedPartitionForged(forged[grown].Digest.(*TAPIRDigest))
+		client = freshClient()
+		if _, _, err := client.UpdateHintRange(updates[0], forged); err == nil {
+			t.Fatal("accepted digest with a mismatching new partition")
+		}
+		if client.Epoch() != grown {
+			t.Fatal("rejected the updates at epoch", client.Epoch()+1, "instead of", grown+1)
+		}
+
+		client = freshClient()
+		if _, _, err := client.UpdateHintRange(updates[0], updates[1]); err != nil {
+			t.Fatal(err)
+		}
+		if client.Epoch() != 3 {
+			t.Fatal("client at epoch", client.Epoch())
+		}
+		for i := range dbs[0].N {
+			if rec := retrieve(t, client, servers, i); !bytes.Equal(rec, dbs[0].GetRecord(i)) {
+				t.Fatal("wrong record after catching up", i)
+			}
+		}
+		// applying the same epochs again is rejected
+		if _, _, err := client.UpdateHintRange(updates[0], updates[1]); err == nil {
+			t.Fatal("applied epochs twice")
+		}
+	}
+}
+
+// appendedPartitionForged returns a copy of d whose last commitment is the
+// one of the first partition
+func appendedPartitionForged(d *TAPIRDigest) *TAPIRDigest {
+	coms := slices.Clone(d.Coms)
+	coms[len(coms)-1] = coms[0]
+	return &TAPIRDigest{Coms: coms, ParamsDigest: d.ParamsDigest}
+}
+
+func TestUpdateLogDropsEpochs(t *testing.T) {
+	var l UpdateLog
+	for range MaxLoggedEpochs + 2 {
+		if _, err := l.Append(1, 1, &TAPIRDigest{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l.Epoch() != MaxLoggedEpochs+2 {
+		t.Fatal("log at epoch", l.Epoch())
+	}
+	if _, err := l.UpdatesSince(1); !errors.Is(err, ErrEpochDropped) {
+		t.Fatal("expected dropped epoch, got", err)
+	}
+	updates, err := l.UpdatesSince(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != MaxLoggedEpochs || updates[0].Epoch != 3 {
+		t.Fatal("got", len(updates), "updates from epoch", updates[0].Epoch)
+	}
+}
@@ -0,0 +1,148 @@
+package pir
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"tapir/modules/database"
+)
+
+////////////////////////////////////////////////////////////
+// UPDATE LOG
+////////////////////////////////////////////////////////////
+
+// EpochUpdate is the result of the update that moved a server from epoch
+// Epoch-1 to Epoch, i.e., the input of APIRClient.UpdateHint for this server
+type EpochUpdate struct {
+	Epoch  int
+	N      int
+	Q      int
+	Digest Digest // digest after the update
+	Ops    []database.Update
+}
+
+// UpdateLogger is implemented by servers that log their updates, so that
+// clients that missed updates can catch up. A server starts at epoch 0, each
+// call of Update starts a new epoch.
+type UpdateLogger interface {
+	Epoch() int
+	UpdatesSince(epoch int) ([]EpochUpdate, error)
+}
+
+// MaxLoggedEpochs is the number of epochs an UpdateLog keeps, clients
+// whose hint is older must run the offline phase again.
+const MaxLoggedEpochs = 1024
+
+// ErrEpochDropped is returned by UpdatesSince for an epoch whose updates
+// are no longer logged
+var ErrEpochDropped = errors.New("updates of the epoch are no longer logged")
+
+// UpdateLog is a log of the updates of the last MaxLoggedEpochs epochs, it
+// implements UpdateLogger. The zero value is an empty log at epoch 0.
+type UpdateLog struct {
+	// epoch before the first entry
+	first   int
+	entries []EpochUpdate
+}
+
+func (l *UpdateLog) Epoch() int {
+	return l.first + len(l.entries)
+}
+
+// Append logs an update and returns the new epoch. Digests are updated in
+// place by the servers, so the log keeps a copy of d, and of the ops.
+func (l *UpdateLog) Append(n, q int, d Digest, ops []database.Update) (int, error) {
+	dc, err := cloneDigest(d)
+	if err != nil {
+		return 0, fmt.Errorf("error logging update: %w", err)
+	}
+	opsc := cloneOps(ops)
+	if len(l.entries) == MaxLoggedEpochs {
+		l.entries[0] = EpochUpdate{}
+		l.entries = l.entries[1:]
+		l.first++
+	}
+	l.entries = append(l.entries, EpochUpdate{Epoch: l.Epoch() + 1, N: n, Q: q, Digest: dc, Ops: opsc})
+	return l.Epoch(), nil
+}
+
+// UpdatesSince returns copies of the updates after epoch in order
+func (l *UpdateLog) UpdatesSince(epoch int) ([]EpochUpdate, error) {
+	if epoch < 0 || epoch > l.Epoch() {
+		return nil, fmt.Errorf("epoch %d is not in [0, %d]", epoch, l.Epoch())
+	}
+	if epoch < l.first {
+		return nil, fmt.Errorf("%w: epoch %d, the log starts at epoch %d", ErrEpochDropped, epoch, l.first)
+	}
+	out := make([]EpochUpdate, 0, l.Epoch()-epoch)
+	for _, e := range l.entries[epoch-l.first:] {
+		d, err := cloneDigest(e.Digest)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, EpochUpdate{Epoch: e.Epoch, N: e.N, Q: e.Q, Digest: d, Ops: cloneOps(e.Ops)})
+	}
+	return out, nil
+}
+
+func cloneOps(ops []database.Update) []database.Update {
+	out := make([]database.Update, len(ops))
+	for i, op := range ops {
+		out[i] = database.Update{Op: op.Op, Idx: op.Idx, Val: append([]byte(nil), op.Val...)}
+	}
+	return out
+}
+
+// cloneDigest copies a digest through its binary encoding
+func cloneDigest(d Digest) (Digest, error) {
+	m, ok := d.(encoding.BinaryMarshaler)
+	if !ok || reflect.TypeOf(d).Kind() != reflect.Pointer {
+		return nil, fmt.Errorf("cannot copy digest of type %T", d)
+	}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	dc := reflect.New(reflect.TypeOf(d).Elem()).Interface()
+	if err := dc.(encoding.BinaryUnmarshaler).UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// updateHintRange applies the updates of both servers epoch by epoch, each
+// digest of one server must match that of the other server. It returns the
+// digest and hint after the last update, nil if there are no updates.
+func updateHintRange(c StatefulClient, u0, u1 []EpochUpdate) (Digest, Hint, error) {
+	if len(u0) != len(u1) {
+		return nil, nil, fmt.Errorf("servers returned %d and %d updates", len(u0), len(u1))
+	}
+	// check that the servers agree on all epochs before the hint is
+	// changed, UpdateHint checks each epoch against the client
+	epoch := c.Epoch()
+	for k := range u0 {
+		if u0[k].Epoch != epoch+k+1 || u1[k].Epoch != epoch+k+1 {
+			return nil, nil, fmt.Errorf("updates of epochs %d and %d do not follow epoch %d", u0[k].Epoch, u1[k].Epoch, epoch+k)
+		}
+		if u0[k].N != u1[k].N || u0[k].Q != u1[k].Q || len(u0[k].Ops) != len(u1[k].Ops) {
+			return nil, nil, fmt.Errorf("epoch %d: update parameters from servers do not match", u0[k].Epoch)
+		}
+		for i, op := range u0[k].Ops {
+			if !op.Equals(u1[k].Ops[i]) {
+				return nil, nil, fmt.Errorf("epoch %d: update operations from servers do not match", u0[k].Epoch)
+			}
+		}
+	}
+	var digest Digest
+	var hint Hint
+	for k := range u0 {
+		var err error
+		_, _, digest, hint, err = c.UpdateHint(u0[k].N, u1[k].N, u0[k].Q, u1[k].Q, u0[k].Digest, u1[k].Digest, u0[k].Ops, u1[k].Ops)
+		if err != nil {
+			return nil, nil, fmt.Errorf("epoch %d: %w", u0[k].Epoch, err)
+		}
+	}
+	return digest, hint, nil
+}
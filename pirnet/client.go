@@ -0,0 +1,490 @@
+package pirnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"tapir/modules/database"
+	"tapir/pir"
+)
+
+// Remote is a connection to a single server. It offers the network-facing
+// part of pir.APIRServer. Requests on one Remote are sent one at a time,
+// concurrent requests wait for their turn until their context is done.
+type Remote struct {
+	// sem holds the connection while a request is in flight
+	sem  chan struct{}
+	conn net.Conn
+	// err is set once a request was interrupted mid-frame, the connection
+	// is out of sync with the server and all later requests fail with err
+	err error
+}
+
+// ErrBroken is returned for requests on a connection that was interrupted
+// by a canceled request or a network error, the server has to be dialed
+// again.
+var ErrBroken = errors.New("connection broken by an interrupted request")
+
+// Dial connects to the server listening on the TCP address addr.
+func Dial(ctx context.Context, addr string) (*Remote, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewRemote(conn), nil
+}
+
+// NewRemote uses an established connection to a server.
+func NewRemote(conn net.Conn) *Remote {
+	return &Remote{sem: make(chan struct{}, 1), conn: conn}
+}
+
+func (r *Remote) Close() error {
+	return r.conn.Close()
+}
+
+// roundTrip sends the request req of type t and decodes the response into
+// resp. A nil req is sent as an empty payload. If ctx is done before the
+// response arrived, the request is aborted and the connection is broken.
+func (r *Remote) roundTrip(ctx context.Context, t MsgType, req interface{}, resp interface{}) error {
+	var payload []byte
+	if req != nil {
+		var err error
+		if payload, err = encode(req); err != nil {
+			return fmt.Errorf("error encoding %s request: %w", t, err)
+		}
+	}
+
+	select {
+	case r.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-r.sem }()
+	if r.err != nil {
+		return r.err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	rt, payload, err := r.exchange(ctx, t, payload)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		r.err = fmt.Errorf("%w: %s: %w", ErrBroken, t, err)
+		return err
+	}
+	switch rt {
+	case t:
+		if err := decode(payload, resp); err != nil {
+			return fmt.Errorf("malformed %s response: %w", t, err)
+		}
+		return nil
+	case MsgError:
+		var e errorResp
+		if err := decode(payload, &e); err != nil {
+			return fmt.Errorf("malformed error response: %w", err)
+		}
+		return &RemoteError{Op: t, Msg: e.Msg}
+	default:
+		return fmt.Errorf("unexpected response type %s to %s request", rt, t)
+	}
+}
+
+// exchange writes a frame and reads the response frame, the I/O is
+// interrupted by setting a past deadline once ctx is done
+func (r *Remote) exchange(ctx context.Context, t MsgType, payload []byte) (MsgType, []byte, error) {
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		r.conn.SetDeadline(time.Unix(1, 0))
+		close(interrupted)
+	})
+	err := WriteFrame(r.conn, t, payload)
+	var rt MsgType
+	if err == nil {
+		rt, payload, err = ReadFrame(r.conn)
+	}
+	if !stop() {
+		// the deadline may have been set after the response arrived
+		<-interrupted
+		if err == nil {
+			err = r.conn.SetDeadline(time.Time{})
+		}
+	}
+	return rt, payload, err
+}
+
+// GenDigest returns the current digest of the server.
+func (r *Remote) GenDigest(ctx context.Context) (pir.Digest, error) {
+	resp, err := r.digest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Digest, nil
+}
+
+// digest returns the current digest and epoch of the server
+func (r *Remote) digest(ctx context.Context) (*digestResp, error) {
+	var resp digestResp
+	if err := r.roundTrip(ctx, MsgGenDigest, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *Remote) GenHint(ctx context.Context, hq pir.HintQuery) (pir.HintResp, error) {
+	var resp hintResp
+	if err := r.roundTrip(ctx, MsgGenHint, &hintReq{HintQuery: hq}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.HintResp, nil
+}
+
+func (r *Remote) Answer(ctx context.Context, q pir.Query) (pir.Answer, error) {
+	var resp answerResp
+	if err := r.roundTrip(ctx, MsgAnswer, &answerReq{Query: q}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Answer, nil
+}
+
+// BatchAnswer answers a query of pir.BatchClient.BatchQuery.
+func (r *Remote) BatchAnswer(ctx context.Context, q pir.Query) (pir.Answer, error) {
+	var resp answerResp
+	if err := r.roundTrip(ctx, MsgBatchAnswer, &answerReq{Query: q}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Answer, nil
+}
+
+// Update applies ops to the database of the server. Servers only accept
+// updates on connections to their admin listener (Server.ServeAdmin).
+func (r *Remote) Update(ctx context.Context, ops []database.Update) (*UpdateResult, error) {
+	var resp UpdateResult
+	if err := r.roundTrip(ctx, MsgUpdate, &updateReq{Ops: ops}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// UpdatesSince returns the results of the updates the server applied after
+// epoch, each with the digest of its epoch.
+func (r *Remote) UpdatesSince(ctx context.Context, epoch int) ([]pir.EpochUpdate, error) {
+	var resp updatesSinceResp
+	if err := r.roundTrip(ctx, MsgUpdatesSince, &updatesSinceReq{Epoch: epoch}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Updates, nil
+}
+
+// Client drives a pir.APIRClient against two remote servers. Retrieve and
+// RetrieveBatch may be called from several goroutines, Setup, Update,
+// UpdateHint, LoadState and FastForward wait for running retrievals and
+// block new ones until they are done.
+type Client struct {
+	C       pir.APIRClient
+	Servers [2]*Remote
+
+	// mu guards Digest and Hint
+	mu     sync.RWMutex
+	Digest pir.Digest
+	Hint   pir.Hint
+}
+
+// NewClient connects to the servers at addr0 and addr1.
+func NewClient(ctx context.Context, c pir.APIRClient, addr0, addr1 string) (*Client, error) {
+	r0, err := Dial(ctx, addr0)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to server 0: %w", err)
+	}
+	r1, err := Dial(ctx, addr1)
+	if err != nil {
+		r0.Close()
+		return nil, fmt.Errorf("error connecting to server 1: %w", err)
+	}
+	return &Client{C: c, Servers: [2]*Remote{r0, r1}}, nil
+}
+
+func (c *Client) Close() error {
+	return errors.Join(c.Servers[0].Close(), c.Servers[1].Close())
+}
+
+// both runs f for both servers in parallel and returns the first error.
+func both(f func(i int) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range 2 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := f(i); err != nil {
+				errs[i] = fmt.Errorf("server %d: %w", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Setup runs the offline phase: it fetches both digests, requests the hint
+// and verifies the setup.
+func (c *Client) Setup(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	digests := make([]*digestResp, 2)
+	err := both(func(i int) (err error) {
+		digests[i], err = c.Servers[i].digest(ctx)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	if digests[0].Epoch != digests[1].Epoch {
+		return fmt.Errorf("servers are at epochs %d and %d", digests[0].Epoch, digests[1].Epoch)
+	}
+
+	hq0, hq1, err := c.C.RequestHint()
+	if err != nil {
+		return err
+	}
+	hqs := []pir.HintQuery{hq0, hq1}
+	resps := make([]pir.HintResp, 2)
+	err = both(func(i int) (err error) {
+		resps[i], err = c.Servers[i].GenHint(ctx, hqs[i])
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Digest, c.Hint, err = c.C.VerSetup(digests[0].Digest, digests[1].Digest, resps[0], resps[1])
+	if err != nil {
+		return err
+	}
+	if sc, ok := c.C.(pir.StatefulClient); ok {
+		sc.SetEpoch(digests[0].Epoch)
+	}
+	return nil
+}
+
+// Retrieve privately retrieves record i. If a server does not answer, e.g.,
+// because ctx is done, the query is released.
+func (c *Client) Retrieve(ctx context.Context, i int) (database.Record, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	h, err := c.query(ctx, func() (*pir.QueryHandle, error) {
+		return c.C.Query(i)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.retrieve(ctx, h)
+}
+
+// retrieve sends the queries of h to the servers and reconstructs the
+// record, h is released if a server does not answer
+func (c *Client) retrieve(ctx context.Context, h *pir.QueryHandle) (database.Record, error) {
+	answers := make([]pir.Answer, 2)
+	err := both(func(i int) (err error) {
+		answers[i], err = c.Servers[i].Answer(ctx, h.Queries[i])
+		return
+	})
+	if err != nil {
+		h.Release()
+		return nil, err
+	}
+	return c.C.Reconstruct(h, c.Digest, c.Hint, answers[0], answers[1])
+}
+
+// query builds a query with newQuery. If it needs burned hint sets, see
+// pir.HintRefresher, they are refreshed and the query is built again.
+func (c *Client) query(ctx context.Context, newQuery func() (*pir.QueryHandle, error)) (*pir.QueryHandle, error) {
+	h, err := newQuery()
+	if !errors.Is(err, pir.ErrHintSetBurned) {
+		return h, err
+	}
+	if err := c.refreshBurned(ctx); err != nil {
+		return nil, err
+	}
+	return newQuery()
+}
+
+// refreshBurned sends the queries of the burned hint sets again
+func (c *Client) refreshBurned(ctx context.Context) error {
+	hr, ok := c.C.(pir.HintRefresher)
+	if !ok {
+		return nil
+	}
+	for h := hr.RefreshQuery(); h != nil; h = hr.RefreshQuery() {
+		if _, err := c.retrieve(ctx, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetrieveBatch privately retrieves the records of the indices in a single
+// round trip, the scheme must implement pir.BatchClient.
+func (c *Client) RetrieveBatch(ctx context.Context, indices []int) ([]database.Record, error) {
+	bc, ok := c.C.(pir.BatchClient)
+	if !ok {
+		return nil, errors.New("batch queries are not supported by the scheme")
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	h, err := c.query(ctx, func() (*pir.QueryHandle, error) {
+		return bc.BatchQuery(indices)
+	})
+	if err != nil {
+		return nil, err
+	}
+	answers := make([]pir.Answer, 2)
+	err = both(func(i int) (err error) {
+		answers[i], err = c.Servers[i].BatchAnswer(ctx, h.Queries[i])
+		return
+	})
+	if err != nil {
+		h.Release()
+		return nil, err
+	}
+	return bc.BatchReconstruct(h, c.Digest, c.Hint, answers[0], answers[1])
+}
+
+// RetrieveValue privately retrieves value i of a database encoded with
+// database.EncodeValues: its head record and then its continuation records.
+// Values longer than maxLen are rejected. The number of retrieved records
+// reveals the number of records of the value to the servers.
+func (c *Client) RetrieveValue(ctx context.Context, i, maxLen int) ([]byte, error) {
+	head, err := c.Retrieve(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	indices, err := database.ContinuationIndices(head, maxLen)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding value %d: %w", i, err)
+	}
+	rest := make([]database.Record, len(indices))
+	errs := make([]error, len(indices))
+	var wg sync.WaitGroup
+	for j, idx := range indices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rest[j], errs[j] = c.Retrieve(ctx, idx)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return database.DecodeValue(head, rest)
+}
+
+// Update sends ops to both servers and updates the hint with their results.
+// The client needs to be connected to the admin listeners of the servers.
+// The servers modify the ops, hence each server gets its own copy.
+func (c *Client) Update(ctx context.Context, ops []database.Update) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	results := make([]*UpdateResult, 2)
+	err := both(func(i int) (err error) {
+		results[i], err = c.Servers[i].Update(ctx, copyOps(ops))
+		return
+	})
+	if err != nil {
+		return err
+	}
+	return c.updateHint(results[0], results[1])
+}
+
+// UpdateHint updates the hint with the results of an update on both servers.
+func (c *Client) UpdateHint(r0, r1 *UpdateResult) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.updateHint(r0, r1)
+}
+
+func (c *Client) updateHint(r0, r1 *UpdateResult) error {
+	_, _, d, h, err := c.C.UpdateHint(r0.N, r1.N, r0.Q, r1.Q, r0.Digest, r1.Digest, r0.Ops, r1.Ops)
+	if err != nil {
+		return err
+	}
+	c.Digest, c.Hint = d, h
+	return nil
+}
+
+// SaveState saves the state of the client, which must implement
+// pir.StatefulClient.
+func (c *Client) SaveState(w io.Writer) error {
+	sc, ok := c.C.(pir.StatefulClient)
+	if !ok {
+		return errors.New("saving the state is not supported by the scheme")
+	}
+	return sc.SaveState(w)
+}
+
+// LoadState restores a state saved by SaveState instead of running Setup and
+// fast-forwards it over the updates the servers applied since.
+func (c *Client) LoadState(ctx context.Context, r io.Reader) error {
+	sc, ok := c.C.(pir.StatefulClient)
+	if !ok {
+		return errors.New("loading the state is not supported by the scheme")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := sc.LoadState(r); err != nil {
+		return err
+	}
+	return c.fastForward(ctx, sc)
+}
+
+// FastForward applies the updates the servers applied since the epoch of
+// the hint.
+func (c *Client) FastForward(ctx context.Context) error {
+	sc, ok := c.C.(pir.StatefulClient)
+	if !ok {
+		return errors.New("the scheme does not track epochs")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fastForward(ctx, sc)
+}
+
+func (c *Client) fastForward(ctx context.Context, sc pir.StatefulClient) error {
+	updates := make([][]pir.EpochUpdate, 2)
+	err := both(func(i int) (err error) {
+		updates[i], err = c.Servers[i].UpdatesSince(ctx, sc.Epoch())
+		return
+	})
+	if err != nil {
+		return err
+	}
+	d, h, err := sc.UpdateHintRange(updates[0], updates[1])
+	if err != nil {
+		return err
+	}
+	if d != nil {
+		c.Digest, c.Hint = d, h
+	}
+	return nil
+}
+
+func copyOps(ops []database.Update) []database.Update {
+	out := make([]database.Update, len(ops))
+	for i, op := range ops {
+		out[i] = database.Update{Op: op.Op, Idx: op.Idx, Val: append([]byte(nil), op.Val...)}
+	}
+	return out
+}
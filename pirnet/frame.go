@@ -0,0 +1,107 @@
+package pirnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Wire format of a single frame:
+//
+//	| length (4 bytes, big endian) | type (1 byte) | payload (length-1 bytes) |
+//
+// The length covers the type byte and the payload.
+
+// MaxFrameSize bounds the size of a single frame. Payloads are read into a
+// buffer that grows with the bytes received, so a malformed length prefix
+// does not allocate more memory than the peer sends.
+const MaxFrameSize = 1 << 30
+
+// MaxRequestSize bounds the payload of a query or hint request a server
+// reads, e.g., the indices of a TAPIR batch query. Requests for the digest
+// or for updates are bounded by maxSmallRequestSize and only admin
+// connections accept updates of up to MaxFrameSize.
+const (
+	MaxRequestSize      = 1 << 26
+	maxSmallRequestSize = 1 << 10
+)
+
+type MsgType byte
+
+const (
+	MsgGenDigest MsgType = iota + 1
+	MsgGenHint
+	MsgAnswer
+	MsgUpdate
+	MsgError
+	MsgBatchAnswer
+	MsgUpdatesSince
+)
+
+func (t MsgType) String() string {
+	switch t {
+	case MsgGenDigest:
+		return "GenDigest"
+	case MsgGenHint:
+		return "GenHint"
+	case MsgAnswer:
+		return "Answer"
+	case MsgUpdate:
+		return "Update"
+	case MsgError:
+		return "Error"
+	case MsgBatchAnswer:
+		return "BatchAnswer"
+	case MsgUpdatesSince:
+		return "UpdatesSince"
+	default:
+		return fmt.Sprintf("MsgType(%d)", byte(t))
+	}
+}
+
+var ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+// WriteFrame writes one length-prefixed frame to w.
+func WriteFrame(w io.Writer, t MsgType, payload []byte) error {
+	if len(payload)+1 > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	buf := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)+1))
+	buf[4] = byte(t)
+	copy(buf[5:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads one length-prefixed frame of at most MaxFrameSize bytes
+// from r.
+func ReadFrame(r io.Reader) (MsgType, []byte, error) {
+	return readFrame(r, func(MsgType) int { return MaxFrameSize - 1 })
+}
+
+// readFrame reads one length-prefixed frame from r whose payload does not
+// exceed limit(t) bytes for its type t
+func readFrame(r io.Reader, limit func(MsgType) int) (MsgType, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n == 0 {
+		return 0, nil, errors.New("frame without message type")
+	}
+	t := MsgType(hdr[4])
+	if n > MaxFrameSize || int(n-1) > limit(t) {
+		return 0, nil, fmt.Errorf("%w: %s frame of %d bytes", ErrFrameTooLarge, t, n)
+	}
+	payload, err := io.ReadAll(io.LimitReader(r, int64(n-1)))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) < int(n-1) {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return t, payload, nil
+}
@@ -0,0 +1,83 @@
+package pirnet
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+
+	"tapir/modules/database"
+	"tapir/pir"
+)
+
+// Payloads carried in the frames. The PIR types are interface values, their
+// concrete types are registered with gob in the pir and vc packages.
+
+type digestResp struct {
+	Digest pir.Digest
+	// number of updates applied by the server
+	Epoch int
+}
+
+type hintReq struct {
+	HintQuery pir.HintQuery
+}
+
+type hintResp struct {
+	HintResp pir.HintResp
+}
+
+type answerReq struct {
+	Query pir.Query
+}
+
+type answerResp struct {
+	Answer pir.Answer
+}
+
+type updateReq struct {
+	Ops []database.Update
+}
+
+// UpdateResult holds the values a server returns after applying updates,
+// i.e., the input of APIRClient.UpdateHint for this server.
+type UpdateResult struct {
+	N      int
+	Q      int
+	Digest pir.Digest
+	Ops    []database.Update
+}
+
+type updatesSinceReq struct {
+	Epoch int
+}
+
+type updatesSinceResp struct {
+	Updates []pir.EpochUpdate
+}
+
+type errorResp struct {
+	Msg string
+}
+
+// RemoteError is returned by the client if the server answered a request
+// with an error frame.
+type RemoteError struct {
+	Op  MsgType
+	Msg string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote %s failed: %s", e.Op, e.Msg)
+}
+
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decode(payload []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+}
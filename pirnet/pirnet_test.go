@@ -0,0 +1,493 @@
+package pirnet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"tapir/modules/database"
+	"tapir/modules/vc"
+	"tapir/pir"
+	"testing"
+	"time"
+)
+
+// Parties of the tests run in the same process and share the parameters of
+// a process-local trusted setup
+func TestMain(m *testing.M) {
+	vc.AllowLocalSetup(true)
+	os.Exit(m.Run())
+}
+
+func newPirServer(t *testing.T, pirType pir.PirType, db *database.DB, role, q int, vctype vc.VcType) pir.APIRServer {
+	s, err := pir.NewServer(pirType, db, role, q, vctype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newPirClient(t *testing.T, pirType pir.PirType, n, q, recSize int, vctype vc.VcType) pir.APIRClient {
+	c, err := pir.NewClient(pirType, n, q, recSize, vctype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// startServers starts two servers on local ports and returns their addresses
+func startServers(t *testing.T, pirType pir.PirType, seed [32]byte, n, q, recSize int, vctype vc.VcType) []string {
+	return serve(t, pirType, func() *database.DB { return database.MakeRandomDB(seed, n, recSize) }, q, vctype)
+}
+
+// serve starts two servers with the databases returned by makeDB on local
+// ports and returns their addresses. The servers accept updates.
+func serve(t *testing.T, pirType pir.PirType, makeDB func() *database.DB, q int, vctype vc.VcType) []string {
+	addrs := make([]string, 2)
+	for i := range 2 {
+		s, err := NewServer(newPirServer(t, pirType, makeDB(), i, q, vctype))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.ServeAdmin(l)
+		t.Cleanup(func() { s.Close() })
+		addrs[i] = l.Addr().String()
+	}
+	return addrs
+}
+
+func TestRemoteTapir(t *testing.T) {
+	n := 64
+	q := 8
+	recSize := 32
+	seed := [32]byte{7}
+
+	for _, vctype := range []vc.VcType{vc.VC_MerkleTree, vc.VC_PointProof, vc.VC_KZG} {
+		addrs := startServers(t, pir.APIR_TAPIR, seed, n, q, recSize, vctype)
+		db := database.MakeRandomDB(seed, n, recSize)
+
+		client, err := NewClient(context.Background(), newPirClient(t, pir.APIR_TAPIR, n, q, recSize, vctype), addrs[0], addrs[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if err := client.Setup(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for i := range n {
+			rec, err := client.Retrieve(context.Background(), i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rec, db.GetRecord(i)) {
+				t.Fatalf("record %d does not match", i)
+			}
+		}
+
+		// Apply edits on both servers and retrieve the updated records
+		prg := rand.NewChaCha8([32]byte{8})
+		ops := database.MakeRandomUpdates(prg, n, 4, recSize, []database.OpType{database.EDIT})
+		db.Update(ops)
+		if err := client.Update(context.Background(), ops); err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range ops {
+			rec, err := client.Retrieve(context.Background(), op.Idx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rec, db.GetRecord(op.Idx)) {
+				t.Fatalf("updated record %d does not match", op.Idx)
+			}
+		}
+	}
+}
+
+func TestRemoteError(t *testing.T) {
+	addrs := startServers(t, pir.APIR_TAPIR, [32]byte{}, 16, 4, 16, vc.VC_MerkleTree)
+	r, err := Dial(context.Background(), addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// a query of the wrong type must result in an error, not a crash
+	_, err = r.Answer(context.Background(), &pir.DPFQuery{})
+	if _, ok := err.(*RemoteError); !ok {
+		t.Fatalf("expected remote error, got %v", err)
+	}
+	// the connection is still usable afterwards
+	if _, err := r.GenDigest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteAdmin(t *testing.T) {
+	n := 16
+	recSize := 16
+	s, err := NewServer(newPirServer(t, pir.APIR_TAPIR, database.MakeRandomDB([32]byte{}, n, recSize), 0, 4, vc.VC_MerkleTree))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	var addrs [2]string
+	for i, serve := range []func(net.Listener) error{s.Serve, s.ServeAdmin} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serve(l)
+		addrs[i] = l.Addr().String()
+	}
+
+	ops := database.MakeRandomUpdates(rand.NewChaCha8([32]byte{1}), n, 2, recSize, []database.OpType{database.EDIT})
+	r, err := Dial(context.Background(), addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Update(context.Background(), ops); !errors.As(err, new(*RemoteError)) {
+		t.Fatal("expected update on the public listener to be rejected, got", err)
+	}
+	updates, err := r.UpdatesSince(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 0 {
+		t.Fatal("rejected update was applied")
+	}
+
+	admin, err := Dial(context.Background(), addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if _, err := admin.Update(context.Background(), ops); err != nil {
+		t.Fatal(err)
+	}
+	if updates, err = r.UpdatesSince(context.Background(), 0); err != nil || len(updates) != 1 {
+		t.Fatal("expected one update, got", len(updates), err)
+	}
+}
+
+func TestFrameLimit(t *testing.T) {
+	// a length prefix of a large frame without the payload allocates no
+	// more than the bytes received
+	var hdr bytes.Buffer
+	if err := WriteFrame(&hdr, MsgAnswer, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	b := hdr.Bytes()
+	b[0], b[1] = 0x3f, 0xff
+	if _, _, err := ReadFrame(bytes.NewReader(b)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal("expected unexpected EOF, got", err)
+	}
+
+	// servers bound requests by their type
+	limit := func(t MsgType) int { return requestLimit(t, false) }
+	for _, c := range []struct {
+		t    MsgType
+		size int
+		ok   bool
+	}{
+		{MsgGenDigest, 0, true},
+		{MsgGenDigest, maxSmallRequestSize + 1, false},
+		{MsgAnswer, 1 << 20, true},
+		{MsgAnswer, MaxRequestSize + 1, false},
+		{MsgUpdate, MaxRequestSize + 1, false},
+	} {
+		var buf bytes.Buffer
+		if err := WriteFrame(&buf, c.t, make([]byte, c.size)); err != nil {
+			t.Fatal(err)
+		}
+		_, payload, err := readFrame(&buf, limit)
+		if c.ok && (err != nil || len(payload) != c.size) {
+			t.Fatalf("%s frame of %d bytes: %v", c.t, c.size, err)
+		}
+		if !c.ok && !errors.Is(err, ErrFrameTooLarge) {
+			t.Fatalf("%s frame of %d bytes: expected error, got %v", c.t, c.size, err)
+		}
+	}
+}
+
+func TestRemoteBatch(t *testing.T) {
+	n := 64
+	q := 8
+	recSize := 32
+	seed := [32]byte{9}
+
+	addrs := startServers(t, pir.APIR_TAPIR, seed, n, q, recSize, vc.VC_MerkleTree)
+	db := database.MakeRandomDB(seed, n, recSize)
+
+	client, err := NewClient(context.Background(), newPirClient(t, pir.APIR_TAPIR, n, q, recSize, vc.VC_MerkleTree), addrs[0], addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	indices := []int{5, 0, 63, 5}
+	recs, err := client.RetrieveBatch(context.Background(), indices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j, i := range indices {
+		if !bytes.Equal(recs[j], db.GetRecord(i)) {
+			t.Fatalf("record %d does not match", i)
+		}
+	}
+
+	// schemes without batch support answer with an error
+	addrs = startServers(t, pir.PIR_MATRIX, seed, n, -1, recSize, vc.None)
+	r, err := Dial(context.Background(), addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.BatchAnswer(context.Background(), &pir.MatrixQuery{}); err == nil {
+		t.Fatal("expected error for scheme without batch queries")
+	}
+}
+
+func TestRemoteSaveState(t *testing.T) {
+	n := 64
+	q := 8
+	recSize := 32
+	seed := [32]byte{10}
+
+	addrs := startServers(t, pir.APIR_TAPIR, seed, n, q, recSize, vc.VC_MerkleTree)
+	db := database.MakeRandomDB(seed, n, recSize)
+
+	client, err := NewClient(context.Background(), newPirClient(t, pir.APIR_TAPIR, n, q, recSize, vc.VC_MerkleTree), addrs[0], addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var state bytes.Buffer
+	if err := client.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	// the servers are updated while the saved client is offline
+	prg := rand.NewChaCha8([32]byte{11})
+	var edited []int
+	for range 2 {
+		ops := database.MakeRandomUpdates(prg, n, 3, recSize, []database.OpType{database.EDIT})
+		db.Update(ops)
+		if err := client.Update(context.Background(), ops); err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range ops {
+			edited = append(edited, op.Idx)
+		}
+	}
+
+	// a restarted client resumes from the saved state and catches up
+	resumed, err := NewClient(context.Background(), newPirClient(t, pir.APIR_TAPIR, n, q, recSize, vc.VC_MerkleTree), addrs[0], addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if err := resumed.LoadState(context.Background(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if e := resumed.C.(pir.StatefulClient).Epoch(); e != 2 {
+		t.Fatalf("resumed client at epoch %d", e)
+	}
+	for _, i := range edited {
+		rec, err := resumed.Retrieve(context.Background(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rec, db.GetRecord(i)) {
+			t.Fatalf("updated record %d does not match", i)
+		}
+	}
+
+	// a client set up after the updates starts at the current epoch
+	late, err := NewClient(context.Background(), newPirClient(t, pir.APIR_TAPIR, n, q, recSize, vc.VC_MerkleTree), addrs[0], addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	if err := late.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if e := late.C.(pir.StatefulClient).Epoch(); e != 2 {
+		t.Fatalf("client set up at epoch %d", e)
+	}
+}
+
+func TestRemoteConcurrent(t *testing.T) {
+	n := 256
+	q := 16
+	recSize := 32
+	seed := [32]byte{12}
+
+	addrs := startServers(t, pir.APIR_TAPIR, seed, n, q, recSize, vc.VC_MerkleTree)
+	db := database.MakeRandomDB(seed, n, recSize)
+
+	client, err := NewClient(context.Background(), newPirClient(t, pir.APIR_TAPIR, n, q, recSize, vc.VC_MerkleTree), addrs[0], addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records retrieved while an update runs match the database before
+	// or after the update
+	prg := rand.NewChaCha8([32]byte{13})
+	ops := database.MakeRandomUpdates(prg, n, 4, recSize, []database.OpType{database.EDIT})
+	before := database.MakeRandomDB(seed, n, recSize)
+	db.Update(ops)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 9)
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range 16 {
+				i := (g*16 + k) % n
+				rec, err := client.Retrieve(context.Background(), i)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(rec, before.GetRecord(i)) && !bytes.Equal(rec, db.GetRecord(i)) {
+					errs <- errors.New("record does not match")
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := client.Update(context.Background(), ops); err != nil {
+			errs <- err
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		rec, err := client.Retrieve(context.Background(), op.Idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rec, db.GetRecord(op.Idx)) {
+			t.Fatalf("updated record %d does not match", op.Idx)
+		}
+	}
+}
+
+func TestRemoteCancel(t *testing.T) {
+	// a server that never reads its requests
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	r := NewRemote(conn)
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.GenDigest(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected deadline exceeded, got", err)
+	}
+	// the request was interrupted mid-frame, later requests fail fast
+	if _, err := r.GenDigest(context.Background()); !errors.Is(err, ErrBroken) {
+		t.Fatal("expected broken connection, got", err)
+	}
+
+	// a canceled retrieval burns the hint set of its query, which is
+	// refreshed when other records of the set are retrieved
+	n := 64
+	q := 8
+	recSize := 32
+	seed := [32]byte{14}
+	addrs := startServers(t, pir.APIR_TAPIR, seed, n, q, recSize, vc.VC_MerkleTree)
+	db := database.MakeRandomDB(seed, n, recSize)
+	client, err := NewClient(context.Background(), newPirClient(t, pir.APIR_TAPIR, n, q, recSize, vc.VC_MerkleTree), addrs[0], addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Retrieve(ctx, 3); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected canceled retrieval, got", err)
+	}
+	for i := range n {
+		rec, err := client.Retrieve(context.Background(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rec, db.GetRecord(i)) {
+			t.Fatalf("record %d does not match", i)
+		}
+	}
+}
+
+func TestRemoteValues(t *testing.T) {
+	q := 8
+	recSize := 32
+	prg := rand.New(rand.NewPCG(15, 0))
+	values := make([][]byte, 24)
+	for i := range values {
+		values[i] = make([]byte, 20+prg.IntN(300))
+		for j := range values[i] {
+			values[i][j] = byte(prg.Uint32())
+		}
+	}
+	recs, err := database.EncodeValues(values, recSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// TAPIR needs a multiple of Q records
+	for len(recs)%q != 0 {
+		recs = append(recs, make(database.Record, recSize))
+	}
+	addrs := serve(t, pir.APIR_TAPIR, func() *database.DB { return database.DBFromRecords(recs) }, q, vc.VC_MerkleTree)
+
+	client, err := NewClient(context.Background(), newPirClient(t, pir.APIR_TAPIR, len(recs), q, recSize, vc.VC_MerkleTree), addrs[0], addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range values {
+		got, err := client.RetrieveValue(context.Background(), i, 320)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, v) {
+			t.Fatalf("value %d does not match", i)
+		}
+	}
+	if _, err := client.RetrieveValue(context.Background(), 0, 10); !errors.Is(err, database.ErrMalformedValue) {
+		t.Fatal("expected value exceeding the maximum length, got", err)
+	}
+}
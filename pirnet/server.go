@@ -0,0 +1,295 @@
+package pirnet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"tapir/pir"
+)
+
+// Server exposes a pir.APIRServer over TCP. Requests on different
+// connections are handled concurrently, Update is exclusive. Updates are
+// only accepted on listeners served with ServeAdmin, which are meant to be
+// reachable by the operator only.
+type Server struct {
+	srv    pir.APIRServer
+	digest pir.Digest
+
+	// log of the updates for servers that do not log them themselves
+	log pir.UpdateLog
+
+	mu sync.RWMutex // guards srv, digest and log
+
+	lmu       sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// NewServer computes the digest of s and returns a Server ready to serve it.
+func NewServer(s pir.APIRServer) (*Server, error) {
+	d, err := s.GenDigest()
+	if err != nil {
+		return nil, fmt.Errorf("error generating digest: %w", err)
+	}
+	return &Server{
+		srv:       s,
+		digest:    d,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// ListenAndServe listens on the TCP address addr and serves requests.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ListenAndServeAdmin listens on the TCP address addr and serves requests
+// including updates.
+func (s *Server) ListenAndServeAdmin(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeAdmin(l)
+}
+
+// Serve accepts connections on l until l is closed or Close is called.
+// Update requests are rejected.
+func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, false)
+}
+
+// ServeAdmin is like Serve but also accepts Update requests.
+func (s *Server) ServeAdmin(l net.Listener) error {
+	return s.serve(l, true)
+}
+
+func (s *Server) serve(l net.Listener, admin bool) error {
+	if !s.track(l) {
+		l.Close()
+		return net.ErrClosed
+	}
+	defer s.untrack(l)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return net.ErrClosed
+			}
+			return err
+		}
+		go s.serveConn(conn, admin)
+	}
+}
+
+// Close stops all listeners and closes open connections.
+func (s *Server) Close() error {
+	s.lmu.Lock()
+	defer s.lmu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (s *Server) track(l net.Listener) bool {
+	s.lmu.Lock()
+	defer s.lmu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(l net.Listener) {
+	s.lmu.Lock()
+	defer s.lmu.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *Server) isClosed() bool {
+	s.lmu.Lock()
+	defer s.lmu.Unlock()
+	return s.closed
+}
+
+func (s *Server) serveConn(conn net.Conn, admin bool) {
+	s.lmu.Lock()
+	if s.closed {
+		s.lmu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.lmu.Unlock()
+
+	defer func() {
+		s.lmu.Lock()
+		delete(s.conns, conn)
+		s.lmu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		t, payload, err := readFrame(conn, func(t MsgType) int { return requestLimit(t, admin) })
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !s.isClosed() {
+				log.Println("pirnet: error reading request from", conn.RemoteAddr(), ":", err)
+			}
+			return
+		}
+		resp, err := s.handle(t, payload, admin)
+		if err != nil {
+			t = MsgError
+			resp, err = encode(&errorResp{Msg: err.Error()})
+			if err != nil {
+				log.Println("pirnet: error encoding error response:", err)
+				return
+			}
+		}
+		if err := WriteFrame(conn, t, resp); err != nil {
+			log.Println("pirnet: error writing response to", conn.RemoteAddr(), ":", err)
+			return
+		}
+	}
+}
+
+// handle processes a single request and returns the encoded response. The
+// response is encoded while holding the lock since digests are updated in place.
+func (s *Server) handle(t MsgType, payload []byte, admin bool) (resp []byte, err error) {
+	// A malformed request must not take down the server, e.g., a query of
+	// the wrong type for the scheme.
+	defer func() {
+		if r := recover(); r != nil {
+			resp, err = nil, fmt.Errorf("error handling %s request: %v", t, r)
+		}
+	}()
+
+	switch t {
+	case MsgGenDigest:
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return encode(&digestResp{Digest: s.digest, Epoch: s.updateLog().Epoch()})
+
+	case MsgGenHint:
+		var req hintReq
+		if err := decode(payload, &req); err != nil {
+			return nil, fmt.Errorf("malformed hint request: %w", err)
+		}
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		h, err := s.srv.GenHint(req.HintQuery)
+		if err != nil {
+			return nil, err
+		}
+		return encode(&hintResp{HintResp: h})
+
+	case MsgAnswer:
+		var req answerReq
+		if err := decode(payload, &req); err != nil {
+			return nil, fmt.Errorf("malformed query: %w", err)
+		}
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		a, err := s.srv.Answer(req.Query)
+		if err != nil {
+			return nil, err
+		}
+		return encode(&answerResp{Answer: a})
+
+	case MsgBatchAnswer:
+		bs, ok := s.srv.(pir.BatchServer)
+		if !ok {
+			return nil, errors.New("batch queries are not supported by the scheme")
+		}
+		var req answerReq
+		if err := decode(payload, &req); err != nil {
+			return nil, fmt.Errorf("malformed batch query: %w", err)
+		}
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		a, err := bs.BatchAnswer(req.Query)
+		if err != nil {
+			return nil, err
+		}
+		return encode(&answerResp{Answer: a})
+
+	case MsgUpdate:
+		if !admin {
+			return nil, errors.New("updates are only accepted on the admin listener")
+		}
+		var req updateReq
+		if err := decode(payload, &req); err != nil {
+			return nil, fmt.Errorf("malformed update request: %w", err)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		n, q, d, ops, err := s.srv.Update(req.Ops)
+		if err != nil {
+			return nil, err
+		}
+		s.digest = d
+		if _, ok := s.srv.(pir.UpdateLogger); !ok {
+			if _, err := s.log.Append(n, q, d, ops); err != nil {
+				return nil, err
+			}
+		}
+		return encode(&UpdateResult{N: n, Q: q, Digest: d, Ops: ops})
+
+	case MsgUpdatesSince:
+		var req updatesSinceReq
+		if err := decode(payload, &req); err != nil {
+			return nil, fmt.Errorf("malformed updates request: %w", err)
+		}
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		updates, err := s.updateLog().UpdatesSince(req.Epoch)
+		if err != nil {
+			return nil, err
+		}
+		return encode(&updatesSinceResp{Updates: updates})
+
+	default:
+		return nil, fmt.Errorf("unknown message type %s", t)
+	}
+}
+
+// requestLimit returns the maximum payload size of a request of type t
+func requestLimit(t MsgType, admin bool) int {
+	switch t {
+	case MsgGenHint, MsgAnswer, MsgBatchAnswer:
+		return MaxRequestSize
+	case MsgUpdate:
+		if admin {
+			return MaxFrameSize - 1
+		}
+		// read the request to reject it with an error
+		return MaxRequestSize
+	default:
+		return maxSmallRequestSize
+	}
+}
+
+// updateLog returns the log of the updates applied by the server
+func (s *Server) updateLog() pir.UpdateLogger {
+	if l, ok := s.srv.(pir.UpdateLogger); ok {
+		return l
+	}
+	return &s.log
+}